@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	// alignCutoffHz low-passes both sensors for --check-alignment, so hand shake and linear
+	// acceleration don't swamp the gravity change caused by turning.
+	alignCutoffHz = 5.0
+	// alignWindow is the interval over which the gravity change is compared with the gyro.
+	alignWindow = 40 * time.Millisecond
+	// alignMinTurnDeg is how much tilting (rotation not about gravity) --check-alignment wants
+	// to see before it decides.
+	alignMinTurnDeg = 540.0
+	// alignMargin: the best candidate must fit this many times better than the current
+	// matrices (or the runner-up) to be reported.
+	alignMargin = 2.0
+)
+
+// axisPermutations returns the 48 matrices of 0 and ±1 that map axes onto axes (rotations and
+// mirrorings), the identity first. These are the mistakes a hand-written matrix can make.
+func axisPermutations() []MountMatrix {
+	perms := [][3]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	var out []MountMatrix
+	for _, p := range perms {
+		for signs := 0; signs < 8; signs++ {
+			row := func(i int) Vec3 {
+				v := [3]float64{}
+				v[p[i]] = 1
+				if signs&(1<<i) != 0 {
+					v[p[i]] = -1
+				}
+				return Vec3{v[0], v[1], v[2]}
+			}
+			out = append(out, MountMatrix{X: row(0), Y: row(1), Z: row(2)})
+		}
+	}
+	return out
+}
+
+// mulMatrix returns a×b.
+func mulMatrix(a, b MountMatrix) MountMatrix {
+	col := func(v Vec3) Vec3 { return a.Apply(v).Add(Vec3{}) } // -0 + 0 = 0, no -0 in the config
+	cx, cy, cz := col(Vec3{b.X.X, b.Y.X, b.Z.X}), col(Vec3{b.X.Y, b.Y.Y, b.Z.Y}), col(Vec3{b.X.Z, b.Y.Z, b.Z.Z})
+	return MountMatrix{
+		X: Vec3{cx.X, cy.X, cz.X},
+		Y: Vec3{cx.Y, cy.Y, cz.Y},
+		Z: Vec3{cx.Z, cy.Z, cz.Z},
+	}
+}
+
+// alignmentCheck compares the gyro with the accel in the DSU frame (--check-alignment). While
+// the device is turned, gravity as seen by the accel changes by dg = -(ω × g)·dt; with the
+// gyro in another frame than the accel that no longer holds. The check predicts dg from the
+// gyro passed through each of axisPermutations and keeps the squared error of each, so the
+// one that fits best tells how the gyro has to be turned to match the accel.
+type alignmentCheck struct {
+	gyroLP, accelLP *vecLowPass
+	candidates      []MountMatrix
+	errs            []float64
+
+	startTS     uint64 // window start
+	startG      Vec3
+	gyroSum     Vec3
+	n           int
+	turned      float64 // radians of tilting seen so far
+	lastTS      uint64
+	haveStart   bool
+	haveSamples bool
+}
+
+func newAlignmentCheck() *alignmentCheck {
+	c := axisPermutations()
+	return &alignmentCheck{
+		gyroLP:     newVecLowPass(alignCutoffHz),
+		accelLP:    newVecLowPass(alignCutoffHz),
+		candidates: c,
+		errs:       make([]float64, len(c)),
+	}
+}
+
+// Update feeds one DSU-frame sample. The gyro goes through the same low-pass as the accel so
+// both lag alike.
+func (a *alignmentCheck) Update(s IMUSample) {
+	gyro := a.gyroLP.Update(s.Gyro, s.TSus)
+	g := a.accelLP.Update(s.Accel, s.TSus)
+	if !a.haveStart {
+		a.startTS, a.startG, a.lastTS, a.haveStart = s.TSus, g, s.TSus, true
+		return
+	}
+	if s.TSus <= a.lastTS {
+		return
+	}
+	a.lastTS = s.TSus
+	a.gyroSum = a.gyroSum.Add(gyro)
+	a.n++
+	dt := float64(s.TSus-a.startTS) / 1e6
+	if dt < alignWindow.Seconds() {
+		return
+	}
+	w := a.gyroSum.Scale(1 / float64(a.n))
+	mid := a.startG.Add(g).Scale(0.5)
+	dg := g.Sub(a.startG)
+	for i, r := range a.candidates {
+		e := dg.Add(r.Apply(w).Cross(mid).Scale(dt))
+		a.errs[i] += e.Dot(e)
+	}
+	if n := mid.Norm(); n > 0 {
+		up := mid.Scale(1 / n)
+		a.turned += w.Sub(up.Scale(w.Dot(up))).Norm() * dt
+	}
+	a.startTS, a.startG, a.gyroSum, a.n = s.TSus, g, Vec3{}, 0
+	a.haveSamples = true
+}
+
+// TurnedDeg is how much tilting the check has seen, in degrees.
+func (a *alignmentCheck) TurnedDeg() float64 { return a.turned * 180 / math.Pi }
+
+// Result returns the candidate that fits best, and whether it fits clearly better than both
+// the identity and the runner-up. best is the identity when the frames agree.
+func (a *alignmentCheck) Result() (best MountMatrix, decided bool) {
+	if !a.haveSamples {
+		return MountMatrix{}, false
+	}
+	bi, second := 0, math.Inf(1)
+	for i, e := range a.errs {
+		if e < a.errs[bi] {
+			bi = i
+		}
+	}
+	for i, e := range a.errs {
+		if i != bi && e < second {
+			second = e
+		}
+	}
+	return a.candidates[bi], second > alignMargin*a.errs[bi] // a tie at zero decides nothing
+}
+
+// runCheckAlignment has the user tilt the device and reports whether the gyro agrees with
+// the accel after the configured matrices, with a corrected gyro_matrix if it doesn't. read
+// returns sensor-frame samples.
+func runCheckAlignment(read func() (IMUSample, error), ls *liveSettings, rate float64) error {
+	fmt.Printf("Alignment check: slowly tilt the device forward, back, left and right, and roll it, for a few seconds (up to %v)...\n", calibrateTimeout)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	deadline := time.Now().Add(calibrateTimeout)
+	check := newAlignmentCheck()
+	for check.TurnedDeg() < alignMinTurnDeg {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not enough motion (%.0f of %.0f degrees of tilting); tilt the device in several directions", check.TurnedDeg(), alignMinTurnDeg)
+		}
+		<-ticker.C
+		s, err := read()
+		if err != nil {
+			continue
+		}
+		check.Update(ls.applyMatrices(s))
+	}
+
+	best, decided := check.Result()
+	if !decided {
+		return errors.New("inconclusive: the motion fits several gyro orientations; tilt about all three axes and retry")
+	}
+	if best == axisPermutations()[0] {
+		fmt.Printf("Alignment check: gyro and accel frames agree\n")
+		return nil
+	}
+	fixed := mulMatrix(best, ls.GyroMatrix)
+	fmt.Fprintf(os.Stderr, "WARNING: gyro and accel frames disagree: the gyro matches the accel only after turning it by %s\n", formatMatrix(best))
+	fmt.Fprintf(os.Stderr, "WARNING: suggested gyro_matrix: %s (or fix accel_matrix if the accel is the wrong one)\n", formatMatrix(fixed))
+	row := func(v Vec3) string { return fmt.Sprintf("[%g, %g, %g]", v.X, v.Y, v.Z) }
+	fmt.Printf("gyro_matrix:\n  x: %s\n  y: %s\n  z: %s\n", row(fixed.X), row(fixed.Y), row(fixed.Z))
+	return errors.New("gyro and accel frames disagree")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// tiltSamples simulates the device being tilted about all three axes for secs at 200 Hz:
+// gravity in the device frame turns by dg = -(ω × g)·dt while the gyro reports gyroFrame·ω.
+func tiltSamples(gyroFrame MountMatrix, secs float64) []IMUSample {
+	const rate, sub = 200.0, 10
+	g := Vec3{0, 0, 9.81}
+	var out []IMUSample
+	for i := 0; i < int(secs*rate); i++ {
+		t := float64(i) / rate
+		w := Vec3{
+			2 * math.Sin(2*math.Pi*0.5*t),
+			2 * math.Sin(2*math.Pi*0.7*t+1),
+			1.5 * math.Sin(2*math.Pi*0.3*t+2),
+		}
+		out = append(out, IMUSample{Gyro: gyroFrame.Apply(w), Accel: g, TSus: uint64(t * 1e6)})
+		for k := 0; k < sub; k++ {
+			g = g.Sub(w.Cross(g).Scale(1 / (rate * sub)))
+		}
+		g = g.Scale(9.81 / g.Norm())
+	}
+	return out
+}
+
+func TestAxisPermutations(t *testing.T) {
+	perms := axisPermutations()
+	if len(perms) != 48 {
+		t.Fatalf("%d permutations, want 48", len(perms))
+	}
+	if id := (MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, 1, 0}, Z: Vec3{0, 0, 1}}); perms[0] != id {
+		t.Errorf("first permutation %s, want the identity", formatMatrix(perms[0]))
+	}
+	seen := map[MountMatrix]bool{}
+	for _, m := range perms {
+		if seen[m] {
+			t.Errorf("%s listed twice", formatMatrix(m))
+		}
+		seen[m] = true
+		// orthogonal: m×mᵀ is the identity
+		tr := MountMatrix{X: Vec3{m.X.X, m.Y.X, m.Z.X}, Y: Vec3{m.X.Y, m.Y.Y, m.Z.Y}, Z: Vec3{m.X.Z, m.Y.Z, m.Z.Z}}
+		if got := mulMatrix(m, tr); got != perms[0] {
+			t.Errorf("%s times its transpose is %s", formatMatrix(m), formatMatrix(got))
+		}
+	}
+}
+
+func TestAlignmentCheck(t *testing.T) {
+	id := axisPermutations()[0]
+	for _, tc := range []struct {
+		name string
+		gyro MountMatrix // frame the gyro reports in, relative to the accel
+	}{
+		{"consistent", id},
+		{"x and y swapped", MountMatrix{X: Vec3{0, 1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, 1}}},
+		{"z flipped", MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, 1, 0}, Z: Vec3{0, 0, -1}}},
+		{"rotated about z", MountMatrix{X: Vec3{0, -1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, 1}}},
+		{"cycled and mirrored", MountMatrix{X: Vec3{0, 0, -1}, Y: Vec3{-1, 0, 0}, Z: Vec3{0, 1, 0}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			check := newAlignmentCheck()
+			if _, decided := check.Result(); decided {
+				t.Fatal("decided before any samples")
+			}
+			for _, s := range tiltSamples(tc.gyro, 8) {
+				check.Update(s)
+			}
+			if check.TurnedDeg() < alignMinTurnDeg {
+				t.Fatalf("only %.0f degrees of tilting, the fixture should give at least %v", check.TurnedDeg(), alignMinTurnDeg)
+			}
+			best, decided := check.Result()
+			if !decided {
+				t.Fatalf("undecided (best %s)", formatMatrix(best))
+			}
+			// best turns the gyro into the accel frame: best×gyro is the identity, which is
+			// the gyro_matrix correction runCheckAlignment suggests
+			if got := mulMatrix(best, tc.gyro); got != id {
+				t.Errorf("best %s, corrected gyro frame %s, want the identity", formatMatrix(best), formatMatrix(got))
+			}
+			if tc.gyro == id && best != id {
+				t.Errorf("consistent frames reported as %s", formatMatrix(best))
+			}
+		})
+	}
+}
+
+func TestAlignmentCheckNoTilt(t *testing.T) {
+	// turning about gravity alone doesn't change the accel, so nothing can be decided
+	check := newAlignmentCheck()
+	for i := 0; i < 1600; i++ {
+		check.Update(IMUSample{Gyro: Vec3{0, 0, 2}, Accel: Vec3{0, 0, 9.81}, TSus: uint64(i) * 5000})
+	}
+	if d := check.TurnedDeg(); d > 1 {
+		t.Errorf("%.1f degrees of tilting from a turn about gravity", d)
+	}
+	if best, decided := check.Result(); decided {
+		t.Errorf("decided %s from a turn about gravity", formatMatrix(best))
+	}
+}
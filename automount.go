@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// autoMountSamples is how many resting samples --auto-mount averages.
+	autoMountSamples = 200
+	// autoMountSnapDeg: gravity within this angle of a sensor axis is taken to lie on it, so a
+	// slightly tilted table still gives a clean matrix of 0 and ±1.
+	autoMountSnapDeg = 15.0
+)
+
+// gravityToMount derives a mount matrix from the accel measured with the device lying screen
+// up: the shortest rotation taking it onto restGravity. Gravity says nothing about rotation
+// around the vertical, so yaw (which way is forward) is left as the rotation makes it.
+func gravityToMount(g Vec3) (MountMatrix, error) {
+	if g.Norm() == 0 {
+		return MountMatrix{}, errors.New("accel reads zero")
+	}
+	g = snapToAxis(g.Scale(1/g.Norm()), autoMountSnapDeg)
+	q := quatBetween(g, restGravity)
+	// the matrix columns are the rotated basis vectors
+	cx, cy, cz := q.Rotate(Vec3{X: 1}), q.Rotate(Vec3{Y: 1}), q.Rotate(Vec3{Z: 1})
+	clean := func(v float64) float64 {
+		v = math.Round(v*1e6) / 1e6
+		if v == 0 {
+			return 0 // no -0 in the config file
+		}
+		return v
+	}
+	row := func(a, b, c float64) Vec3 { return Vec3{clean(a), clean(b), clean(c)} }
+	return MountMatrix{
+		X: row(cx.X, cy.X, cz.X),
+		Y: row(cx.Y, cy.Y, cz.Y),
+		Z: row(cx.Z, cy.Z, cz.Z),
+	}, nil
+}
+
+// snapToAxis returns the signed unit axis nearest to the unit vector v when it is within
+// maxDeg of it, and v otherwise.
+func snapToAxis(v Vec3, maxDeg float64) Vec3 {
+	for _, ax := range []Vec3{{X: 1}, {Y: 1}, {Z: 1}, {X: -1}, {Y: -1}, {Z: -1}} {
+		if math.Acos(math.Min(1, v.Dot(ax)))*180/math.Pi <= maxDeg {
+			return ax
+		}
+	}
+	return v
+}
+
+// runAutoMount waits for the device to rest, averages the sensor-frame accel and returns the
+// mount matrix derived from it. read returns sensor-frame samples.
+func runAutoMount(read func() (IMUSample, error), rest *restDetector, rate float64) (MountMatrix, error) {
+	fmt.Printf("Auto mount: lay the device flat, screen up, and don't touch it (up to %v)...\n", calibrateTimeout)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	deadline := time.Now().Add(calibrateTimeout)
+	var sum Vec3
+	n := 0
+	for n < autoMountSamples {
+		if time.Now().After(deadline) {
+			return MountMatrix{}, fmt.Errorf("device did not stay still long enough (%d of %d samples)", n, autoMountSamples)
+		}
+		<-ticker.C
+		s, err := read()
+		if err != nil {
+			continue
+		}
+		if !rest.Update(s.Gyro, s.Accel, s.TSus) {
+			sum, n = Vec3{}, 0
+			continue
+		}
+		sum = sum.Add(s.Accel)
+		n++
+	}
+	mean := sum.Scale(1 / float64(n))
+	fmt.Printf("Auto mount: gravity in the sensor frame (%.3f, %.3f, %.3f) m/s^2\n", mean.X, mean.Y, mean.Z)
+	return gravityToMount(mean)
+}
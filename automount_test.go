@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGravityToMount(t *testing.T) {
+	g := standardGravity
+	s30, c30 := math.Sin(math.Pi/6), math.Cos(math.Pi/6)
+	for _, tc := range []struct {
+		name    string
+		gravity Vec3 // sensor-frame accel, lying screen up
+		want    *MountMatrix
+	}{
+		{"already z down", Vec3{Z: -g}, &identityMatrix},
+		{"slightly tilted snaps to identity", Vec3{X: 0.1 * g, Z: -g}, &identityMatrix},
+		{"sensor x down", Vec3{X: -g}, nil},
+		{"sensor y up", Vec3{Y: g}, nil},
+		{"upside down", Vec3{Z: g}, nil},
+		{"tilted 30 degrees, not snapped", Vec3{X: s30 * g, Z: -c30 * g}, nil},
+	} {
+		m, err := gravityToMount(tc.gravity)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if tc.want != nil && m != *tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, m, *tc.want)
+		}
+		// measured gravity ends up pointing down, whatever the yaw; a snapped tilt stays tilted
+		maxDeg := 0.1 // the matrix is rounded to 6 decimals
+		if tc.want != nil {
+			maxDeg = autoMountSnapDeg
+		}
+		got := m.Apply(tc.gravity.Scale(1 / tc.gravity.Norm()))
+		if deg := math.Acos(math.Min(1, -got.Z)) * 180 / math.Pi; deg > maxDeg {
+			t.Errorf("%s: gravity maps to %+v, %.3g° from straight down", tc.name, got, deg)
+		}
+		// and the matrix is a rotation: orthonormal rows, determinant +1
+		rows := []Vec3{m.X, m.Y, m.Z}
+		for i := range rows {
+			for j := range rows {
+				want := 0.0
+				if i == j {
+					want = 1
+				}
+				if d := rows[i].Dot(rows[j]); math.Abs(d-want) > 1e-5 {
+					t.Errorf("%s: row %d . row %d = %g", tc.name, i, j, d)
+				}
+			}
+		}
+		if det := m.X.Dot(m.Y.Cross(m.Z)); math.Abs(det-1) > 1e-5 {
+			t.Errorf("%s: determinant %g, want 1 (a mirror, not a rotation)", tc.name, det)
+		}
+		// axis-aligned gravity gives a clean matrix of 0 and ±1
+		if tc.want == nil && tc.gravity.X*tc.gravity.Z == 0 {
+			for _, v := range []float64{m.X.X, m.X.Y, m.X.Z, m.Y.X, m.Y.Y, m.Y.Z, m.Z.X, m.Z.Y, m.Z.Z} {
+				if v != 0 && v != 1 && v != -1 {
+					t.Errorf("%s: entry %g in %+v", tc.name, v, m)
+					break
+				}
+			}
+		}
+	}
+	if _, err := gravityToMount(Vec3{}); err == nil {
+		t.Error("zero accel accepted")
+	}
+}
+
+func TestSnapToAxis(t *testing.T) {
+	tilt := func(deg float64) Vec3 {
+		r := deg * math.Pi / 180
+		return Vec3{X: math.Sin(r), Z: -math.Cos(r)}
+	}
+	for _, tc := range []struct {
+		in   Vec3
+		want Vec3
+	}{
+		{Vec3{Y: 1}, Vec3{Y: 1}},
+		{tilt(10), Vec3{Z: -1}},
+		{tilt(15), Vec3{Z: -1}},
+		{tilt(20), tilt(20)},
+		{tilt(80), Vec3{X: 1}},
+	} {
+		if got := snapToAxis(tc.in, autoMountSnapDeg); !near(got, tc.want, 1e-12) {
+			t.Errorf("snapToAxis(%+v) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// axisAngleYAML is a rotation written as an axis and a right-handed angle in degrees, an
+// alternative to spelling out the matrix block (mount_axisangle, accel_axisangle,
+// gyro_axisangle).
+type axisAngleYAML struct {
+	Axis  []float64 `yaml:"axis,flow"`
+	Angle float64   `yaml:"angle"`
+}
+
+// axisAngleMatrix returns the rotation matrix of a by Rodrigues' formula. The axis need not
+// be normalized but must not be zero.
+func axisAngleMatrix(a axisAngleYAML) (MountMatrix, error) {
+	if len(a.Axis) != 3 {
+		return MountMatrix{}, fmt.Errorf("axis has %d values, want 3 (x, y, z)", len(a.Axis))
+	}
+	axis := Vec3{a.Axis[0], a.Axis[1], a.Axis[2]}
+	if axis.Norm() < 1e-9 {
+		return MountMatrix{}, errors.New("axis has zero length")
+	}
+	rad := a.Angle * math.Pi / 180
+	// the matrix columns are the rotated basis vectors
+	cx, cy, cz := rotateVec(Vec3{X: 1}, axis, rad), rotateVec(Vec3{Y: 1}, axis, rad), rotateVec(Vec3{Z: 1}, axis, rad)
+	clean := func(v float64) float64 {
+		v = math.Round(v*1e12) / 1e12 // exact 0 and ±1 for quarter turns
+		if v == 0 {
+			return 0 // no -0 in the config file
+		}
+		return v
+	}
+	row := func(a, b, c float64) Vec3 { return Vec3{clean(a), clean(b), clean(c)} }
+	return MountMatrix{
+		X: row(cx.X, cy.X, cz.X),
+		Y: row(cx.Y, cy.Y, cz.Y),
+		Z: row(cx.Z, cy.Z, cz.Z),
+	}, nil
+}
+
+// axisAngleToBlock converts the axis-angle form name into the rows of matrix block
+// matrixName. Setting both forms of one block is an error.
+func axisAngleToBlock(name, matrixName string, a axisAngleYAML, x, y, z *[]float64) error {
+	if *x != nil || *y != nil || *z != nil {
+		return fmt.Errorf("set either %s or %s, not both", matrixName, name)
+	}
+	m, err := axisAngleMatrix(a)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	mm := toMatrixYAML(m)
+	*x, *y, *z = mm.X, mm.Y, mm.Z
+	return nil
+}
+
+// applyAxisAngles turns the axis-angle forms of the config into their matrix blocks, so the
+// rest of the bridge only sees matrices.
+func (c *Config) applyAxisAngles() error {
+	for _, b := range []struct {
+		name, matrixName string
+		a                **axisAngleYAML
+		x, y, z          *[]float64
+	}{
+		{"mount_axisangle", "mount_matrix", &c.MountAxisAngle, &c.MountMatrix.X, &c.MountMatrix.Y, &c.MountMatrix.Z},
+		{"accel_axisangle", "accel_matrix", &c.AccelAxisAngle, &c.AccelMatrix.X, &c.AccelMatrix.Y, &c.AccelMatrix.Z},
+		{"gyro_axisangle", "gyro_matrix", &c.GyroAxisAngle, &c.GyroMatrix.X, &c.GyroMatrix.Y, &c.GyroMatrix.Z},
+	} {
+		if *b.a == nil {
+			continue
+		}
+		if err := axisAngleToBlock(b.name, b.matrixName, **b.a, b.x, b.y, b.z); err != nil {
+			return err
+		}
+		*b.a = nil
+	}
+	return nil
+}
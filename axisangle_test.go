@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestAxisAngleMatrix(t *testing.T) {
+	s := math.Sqrt(0.5)
+	for _, tc := range []struct {
+		name  string
+		a     axisAngleYAML
+		want  MountMatrix
+		isErr string // substring of the error, "" for none
+	}{
+		{"no turn", axisAngleYAML{Axis: []float64{0, 0, 1}, Angle: 0}, identityMatrix, ""},
+		{"full turn", axisAngleYAML{Axis: []float64{1, 2, 3}, Angle: 360}, identityMatrix, ""},
+		{"90 about z", axisAngleYAML{Axis: []float64{0, 0, 1}, Angle: 90},
+			MountMatrix{X: Vec3{0, -1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, 1}}, ""},
+		{"axis need not be normalized", axisAngleYAML{Axis: []float64{0, 0, 2}, Angle: 90},
+			MountMatrix{X: Vec3{0, -1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, 1}}, ""},
+		{"-90 about z", axisAngleYAML{Axis: []float64{0, 0, 1}, Angle: -90},
+			MountMatrix{X: Vec3{0, 1, 0}, Y: Vec3{-1, 0, 0}, Z: Vec3{0, 0, 1}}, ""},
+		{"90 about x", axisAngleYAML{Axis: []float64{1, 0, 0}, Angle: 90},
+			MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, 0, -1}, Z: Vec3{0, 1, 0}}, ""},
+		{"90 about y", axisAngleYAML{Axis: []float64{0, 1, 0}, Angle: 90},
+			MountMatrix{X: Vec3{0, 0, 1}, Y: Vec3{0, 1, 0}, Z: Vec3{-1, 0, 0}}, ""},
+		{"180 about x, upside down", axisAngleYAML{Axis: []float64{1, 0, 0}, Angle: 180},
+			MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, -1, 0}, Z: Vec3{0, 0, -1}}, ""},
+		{"180 about the x=y diagonal swaps x and y", axisAngleYAML{Axis: []float64{1, 1, 0}, Angle: 180},
+			MountMatrix{X: Vec3{0, 1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, -1}}, ""},
+		{"120 about the body diagonal cycles the axes", axisAngleYAML{Axis: []float64{1, 1, 1}, Angle: 120},
+			MountMatrix{X: Vec3{0, 0, 1}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 1, 0}}, ""},
+		{"45 about z", axisAngleYAML{Axis: []float64{0, 0, 1}, Angle: 45},
+			MountMatrix{X: Vec3{s, -s, 0}, Y: Vec3{s, s, 0}, Z: Vec3{0, 0, 1}}, ""},
+		{"zero axis", axisAngleYAML{Axis: []float64{0, 0, 0}, Angle: 90}, MountMatrix{}, "zero length"},
+		{"short axis", axisAngleYAML{Axis: []float64{0, 1}, Angle: 90}, MountMatrix{}, "2 values"},
+		{"no axis", axisAngleYAML{Angle: 90}, MountMatrix{}, "0 values"},
+	} {
+		got, err := axisAngleMatrix(tc.a)
+		if tc.isErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.isErr) {
+				t.Errorf("%s: %v, want an error with %q", tc.name, err, tc.isErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		// quarter turns come out exact, other angles within rounding
+		if !near(got.X, tc.want.X, 1e-12) || !near(got.Y, tc.want.Y, 1e-12) || !near(got.Z, tc.want.Z, 1e-12) {
+			t.Errorf("%s: %s, want %s", tc.name, formatMatrix(got), formatMatrix(tc.want))
+		}
+	}
+}
+
+func TestAxisAngleMatrixMatchesQuaternion(t *testing.T) {
+	for _, a := range []axisAngleYAML{
+		{Axis: []float64{0.3, -0.5, 0.8}, Angle: 37},
+		{Axis: []float64{-2, 1, 0.5}, Angle: -115},
+		{Axis: []float64{0, 1, 1}, Angle: 200},
+	} {
+		m, err := axisAngleMatrix(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		axis := Vec3{a.Axis[0], a.Axis[1], a.Axis[2]}
+		q := quatFromAxisAngle(axis.Scale(1/axis.Norm()), a.Angle*math.Pi/180)
+		for _, v := range []Vec3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}, {0.2, -3, 1.5}} {
+			if got, want := m.Apply(v), q.Rotate(v); !near(got, want, 1e-9) {
+				t.Errorf("axis %v angle %g: %+v turns into %+v, the quaternion into %+v", a.Axis, a.Angle, v, got, want)
+			}
+		}
+		// the axis stays put
+		if got := m.Apply(axis); !near(got, axis, 1e-9) {
+			t.Errorf("axis %v angle %g: the axis turns into %+v", a.Axis, a.Angle, got)
+		}
+	}
+}
+
+func TestConfigAxisAngle(t *testing.T) {
+	load := func(body string) (*Config, error) {
+		var c Config
+		if err := c.mergeYAML([]byte(body), "test.yaml"); err != nil {
+			return nil, err
+		}
+		return &c, c.applyAxisAngles()
+	}
+	c, err := load("mount_axisangle: {axis: [0, 0, 1], angle: 90}\ngyro_axisangle: {axis: [1, 0, 0], angle: 180}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mount, ok := parseMatrix(c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z)
+	gyro, gok := parseMatrix(c.GyroMatrix.X, c.GyroMatrix.Y, c.GyroMatrix.Z)
+	if !ok || !gok || mount != (MountMatrix{X: Vec3{0, -1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, 1}}) ||
+		gyro != (MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, -1, 0}, Z: Vec3{0, 0, -1}}) {
+		t.Errorf("mount %+v, gyro %+v", c.MountMatrix, c.GyroMatrix)
+	}
+	// converted once: the rest of the bridge sees only the matrix blocks
+	if c.MountAxisAngle != nil || c.GyroAxisAngle != nil || c.AccelMatrix.X != nil {
+		t.Errorf("after conversion: %+v %+v accel %+v", c.MountAxisAngle, c.GyroAxisAngle, c.AccelMatrix)
+	}
+
+	for _, tc := range []struct{ body, want string }{
+		{"mount_matrix: {x: [1, 0, 0], y: [0, 1, 0], z: [0, 0, 1]}\nmount_axisangle: {axis: [0, 0, 1], angle: 90}\n", "not both"},
+		{"accel_axisangle: {axis: [0, 0, 0], angle: 90}\n", "accel_axisangle: axis has zero length"},
+	} {
+		if _, err := load(tc.body); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: %v, want an error with %q", tc.body, err, tc.want)
+		}
+	}
+}
+
+func TestProfileAxisAngle(t *testing.T) {
+	var cfg Config
+	if err := cfg.mergeYAML([]byte(`mount_matrix: {x: [1, 0, 0], y: [0, 1, 0], z: [0, 0, 1]}
+profiles:
+  flipped:
+    mount_axisangle: {axis: [1, 0, 0], angle: 180}
+  broken:
+    gyro_axisangle: {axis: [0, 0, 0], angle: 90}
+`), "test.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyProfile(&cfg, "flipped"); err != nil {
+		t.Fatal(err)
+	}
+	// the profile's axis-angle replaces the top-level matrix like a profile matrix would
+	m, ok := parseMatrix(cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z)
+	if !ok || m != (MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, -1, 0}, Z: Vec3{0, 0, -1}}) {
+		t.Errorf("mount after the profile: %+v", cfg.MountMatrix)
+	}
+	if err := applyProfile(&cfg, "broken"); err == nil || !strings.Contains(err.Error(), "profile broken") {
+		t.Errorf("broken profile: %v", err)
+	}
+}
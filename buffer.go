@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// iioDevDir holds the iio:deviceN character devices the buffer is read from.
+var iioDevDir = "/dev"
+
+// bufferDevPath returns the character device to read dev's buffer from: node when set
+// (buffer_dev), else the iio:deviceN node named like the sysfs directory. It fails when the
+// path is not a character device.
+func bufferDevPath(dev *IIODevice, node string) (string, error) {
+	if node == "" {
+		node = filepath.Join(iioDevDir, filepath.Base(dev.Base))
+	}
+	fi, err := os.Stat(node)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("%s is not a character device", node)
+	}
+	return node, nil
+}
+
+// bufferLength is the kernel buffer size requested, in scans.
+const bufferLength = 128
+
+// bufferDrains are the values of buffer_drain / --buffer-drain: what readSample returns when
+// several scans arrived since the last tick.
+var bufferDrains = []string{"latest", "average"}
+
+// scanChannels returns the scan elements the buffered reader enables: gyro X/Y/Z, accel X/Y/Z
+// and the timestamp, with the channel names the driver uses.
+func scanChannels(dev *IIODevice) []string {
+	g, a := dev.AngVelChans, dev.AccelChans
+	return []string{g[0], g[1], g[2], a[0], a[1], a[2], "in_timestamp"}
+}
+
+// scanElement is one channel of a buffer scan, as described by scan_elements/<ch>_type and
+// _index. Offset is its byte position in the scan.
+type scanElement struct {
+	Name        string
+	Index       int
+	BigEndian   bool
+	Signed      bool
+	RealBits    uint
+	StorageBits uint
+	Shift       uint
+	Offset      int
+}
+
+// parseScanType parses a scan element type such as "le:s16/16>>0" or "be:u12/16>>4".
+func parseScanType(s string) (scanElement, error) {
+	var e scanElement
+	bad := fmt.Errorf("bad scan type %q", s)
+	endian, rest, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || (endian != "le" && endian != "be") || len(rest) < 2 {
+		return e, bad
+	}
+	e.BigEndian = endian == "be"
+	switch rest[0] {
+	case 's':
+		e.Signed = true
+	case 'u':
+	default:
+		return e, bad
+	}
+	bits, shift, _ := strings.Cut(rest[1:], ">>")
+	real, storage, ok := strings.Cut(bits, "/")
+	if !ok {
+		return e, bad
+	}
+	storage, _, _ = strings.Cut(storage, "X") // repeat count; the IMU channels have none
+	r, err1 := strconv.ParseUint(real, 10, 8)
+	st, err2 := strconv.ParseUint(storage, 10, 8)
+	var sh uint64
+	var err3 error
+	if shift != "" {
+		sh, err3 = strconv.ParseUint(shift, 10, 8)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || st%8 != 0 || st == 0 || st > 64 || r == 0 || r > st {
+		return e, bad
+	}
+	e.RealBits, e.StorageBits, e.Shift = uint(r), uint(st), uint(sh)
+	return e, nil
+}
+
+// layoutScan orders the elements by index and assigns their byte offsets: each element is
+// aligned to its own storage size, and the scan is padded to the largest one. It returns the
+// scan size in bytes.
+func layoutScan(els []scanElement) int {
+	sort.Slice(els, func(i, j int) bool { return els[i].Index < els[j].Index })
+	off, maxSize := 0, 1
+	for i := range els {
+		size := int(els[i].StorageBits / 8)
+		off = (off + size - 1) / size * size
+		els[i].Offset = off
+		off += size
+		maxSize = max(maxSize, size)
+	}
+	return (off + maxSize - 1) / maxSize * maxSize
+}
+
+// decode extracts the element's value from a scan.
+func (e scanElement) decode(scan []byte) int64 {
+	b := scan[e.Offset : e.Offset+int(e.StorageBits/8)]
+	var order binary.ByteOrder = binary.LittleEndian
+	if e.BigEndian {
+		order = binary.BigEndian
+	}
+	var v uint64
+	switch len(b) {
+	case 1:
+		v = uint64(b[0])
+	case 2:
+		v = uint64(order.Uint16(b))
+	case 4:
+		v = uint64(order.Uint32(b))
+	case 8:
+		v = order.Uint64(b)
+	}
+	v >>= e.Shift
+	if e.RealBits < 64 {
+		v &= 1<<e.RealBits - 1
+		if e.Signed && v&(1<<(e.RealBits-1)) != 0 {
+			v |= ^uint64(0) << e.RealBits
+		}
+	}
+	return int64(v)
+}
+
+// IIOBufferDevice reads gyro, accel and timestamp of a combined IMU from one buffer scan, so
+// both vectors of a sample come from the same instant. Like EvdevDevice, a goroutine reads
+// scans as they come, so the kernel buffer never fills, and readSample returns the latest one
+// or, with average, the mean of all scans since the previous call.
+type IIOBufferDevice struct {
+	dev      *IIODevice
+	elements map[string]scanElement
+	chans    []string // enabled channels, see scanChannels
+	scanSize int
+	average  bool
+	ts       iioTimestamp // clock of in_timestamp
+	f        *os.File
+
+	mu     sync.Mutex
+	latest []byte // last scan read
+	fresh  int    // scans read since the last readSample
+	sum    IMUSample
+	err    error // set when the reader stops
+}
+
+// openIIOBuffer enables the six motion channels and the timestamp on dev's buffer and starts
+// reading it from node (see bufferDevPath). dev must have both sensors. drain is one of
+// bufferDrains.
+func openIIOBuffer(dev *IIODevice, drain, node string) (*IIOBufferDevice, error) {
+	if !dev.HaveGyro || !dev.HaveAccel {
+		return nil, fmt.Errorf("%s: the buffered source needs a combined accel+gyro device", dev.Base)
+	}
+	node, err := bufferDevPath(dev, node)
+	if err != nil {
+		return nil, err
+	}
+	scanDir := filepath.Join(dev.Base, "scan_elements")
+	if !fileExists(scanDir) {
+		return nil, fmt.Errorf("%s: no scan_elements (driver has no buffer support)", dev.Base)
+	}
+	// the buffer must be off while it is set up
+	_ = writeInt(filepath.Join(dev.Base, "buffer", "enable"), 0)
+	if err := setBufferTrigger(dev.Base); err != nil {
+		return nil, err
+	}
+
+	b := &IIOBufferDevice{dev: dev, elements: make(map[string]scanElement), chans: scanChannels(dev), average: drain == "average", ts: newIIOTimestamp(dev.Base)}
+	var els []scanElement
+	for _, ch := range b.chans {
+		if err := writeInt(filepath.Join(scanDir, ch+"_en"), 1); err != nil {
+			return nil, fmt.Errorf("enable %s: %w", ch, err)
+		}
+		typ, err := os.ReadFile(filepath.Join(scanDir, ch+"_type"))
+		if err != nil {
+			return nil, err
+		}
+		e, err := parseScanType(string(typ))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ch, err)
+		}
+		idx, err := readInt(filepath.Join(scanDir, ch+"_index"))
+		if err != nil {
+			return nil, err
+		}
+		e.Name, e.Index = ch, int(idx)
+		els = append(els, e)
+	}
+	// channels not read here would still take space in the scan; turn them off
+	others, _ := filepath.Glob(filepath.Join(scanDir, "*_en"))
+	for _, p := range others {
+		if !slices.Contains(b.chans, strings.TrimSuffix(filepath.Base(p), "_en")) {
+			_ = writeInt(p, 0)
+		}
+	}
+	b.scanSize = layoutScan(els)
+	for _, e := range els {
+		b.elements[e.Name] = e
+	}
+
+	if err := writeInt(filepath.Join(dev.Base, "buffer", "length"), bufferLength); err != nil {
+		return nil, fmt.Errorf("buffer length: %w", err)
+	}
+	if err := writeInt(filepath.Join(dev.Base, "buffer", "enable"), 1); err != nil {
+		return nil, fmt.Errorf("buffer enable: %w", err)
+	}
+	f, err := os.Open(node)
+	if err != nil {
+		_ = writeInt(filepath.Join(dev.Base, "buffer", "enable"), 0)
+		return nil, err
+	}
+	b.f = f
+	go b.run(f)
+	return b, nil
+}
+
+// setBufferTrigger points the device at its own data-ready trigger ("<name>-devN") when it
+// has none set. Devices without a trigger attribute push scans by themselves.
+func setBufferTrigger(base string) error {
+	cur := filepath.Join(base, "trigger", "current_trigger")
+	if !fileExists(cur) {
+		return nil
+	}
+	if b, err := os.ReadFile(cur); err == nil && strings.TrimSpace(string(b)) != "" {
+		return nil
+	}
+	name, _ := os.ReadFile(filepath.Join(base, "name"))
+	n := strings.TrimPrefix(filepath.Base(base), "iio:device")
+	want := strings.TrimSpace(string(name)) + "-dev" + n
+	if err := os.WriteFile(cur, []byte(want), 0644); err != nil {
+		return fmt.Errorf("set trigger %s: %w", want, err)
+	}
+	return nil
+}
+
+// run reads scans from r until it fails.
+func (b *IIOBufferDevice) run(r io.Reader) {
+	buf := make([]byte, b.scanSize*16)
+	for {
+		n, err := io.ReadAtLeast(r, buf, b.scanSize)
+		if whole := n / b.scanSize * b.scanSize; whole > 0 {
+			b.mu.Lock()
+			if b.average {
+				for off := 0; off < whole; off += b.scanSize {
+					s := b.decodeScan(buf[off : off+b.scanSize])
+					b.sum.Gyro, b.sum.Accel = b.sum.Gyro.Add(s.Gyro), b.sum.Accel.Add(s.Accel)
+				}
+			}
+			b.latest = append(b.latest[:0], buf[whole-b.scanSize:whole]...)
+			b.fresh += whole / b.scanSize
+			b.mu.Unlock()
+		}
+		if err != nil {
+			b.mu.Lock()
+			b.err = err
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// readSample returns the newest scan, or io.EOF when none arrived since the last call. With
+// average the gyro and accel are the mean of those scans; the timestamp and raw counts are
+// the newest scan's.
+func (b *IIOBufferDevice) readSample() (IMUSample, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return IMUSample{}, fmt.Errorf("%s: buffer read: %w", b.dev.Base, b.err)
+	}
+	if b.fresh == 0 {
+		return IMUSample{}, io.EOF
+	}
+	s := b.decodeScan(b.latest)
+	if b.average {
+		k := 1 / float64(b.fresh)
+		s.Gyro, s.Accel = b.sum.Gyro.Scale(k), b.sum.Accel.Scale(k)
+		b.sum = IMUSample{}
+	}
+	b.fresh = 0
+	return s, nil
+}
+
+// decodeScan converts one scan to SI units with the device offsets and scales.
+func (b *IIOBufferDevice) decodeScan(scan []byte) IMUSample {
+	var raw [6]int64
+	for i := range raw {
+		raw[i] = b.elements[b.chans[i]].decode(scan)
+	}
+	v := func(i int) float64 { return float64(raw[i]) }
+	d := b.dev
+	return IMUSample{
+		TSus:     b.ts.Micros(b.elements["in_timestamp"].decode(scan)),
+		RawGyro:  [3]int64{raw[0], raw[1], raw[2]},
+		RawAccel: [3]int64{raw[3], raw[4], raw[5]},
+		Gyro: Vec3{
+			X: (v(0) + d.GyroOffset.X) * d.GyroScale.X,
+			Y: (v(1) + d.GyroOffset.Y) * d.GyroScale.Y,
+			Z: (v(2) + d.GyroOffset.Z) * d.GyroScale.Z,
+		},
+		Accel: Vec3{
+			X: (v(3) + d.AccelOffset.X) * d.AccelScale.X,
+			Y: (v(4) + d.AccelOffset.Y) * d.AccelScale.Y,
+			Z: (v(5) + d.AccelOffset.Z) * d.AccelScale.Z,
+		},
+	}
+}
+
+// Close stops the buffer.
+func (b *IIOBufferDevice) Close() error {
+	err := b.f.Close()
+	return errors.Join(err, writeInt(filepath.Join(b.dev.Base, "buffer", "enable"), 0))
+}
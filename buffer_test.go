@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBufferDevPath(t *testing.T) {
+	// /dev/null stands in for the iio:deviceN character devices
+	devDir := t.TempDir()
+	if err := os.Symlink("/dev/null", filepath.Join(devDir, "iio:device2")); err != nil {
+		t.Fatal(err)
+	}
+	regular := filepath.Join(devDir, "iio:device3")
+	if err := os.WriteFile(regular, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := iioDevDir
+	iioDevDir = devDir
+	t.Cleanup(func() { iioDevDir = old })
+
+	for _, tc := range []struct {
+		base, node string
+		want       string
+		wantErr    bool
+	}{
+		// derived from the sysfs directory name
+		{"/sys/bus/iio/devices/iio:device2", "", filepath.Join(devDir, "iio:device2"), false},
+		{"/sys/bus/iio/devices/iio:device7", "", "", true}, // no such node
+		{"/sys/bus/iio/devices/iio:device3", "", "", true}, // not a character device
+		// buffer_dev wins over the derived name
+		{"/sys/bus/iio/devices/iio:device7", "/dev/null", "/dev/null", false},
+		{"/sys/bus/iio/devices/iio:device2", regular, "", true},
+		{"/sys/bus/iio/devices/iio:device2", devDir, "", true}, // a directory
+	} {
+		got, err := bufferDevPath(&IIODevice{Base: tc.base}, tc.node)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("bufferDevPath(%s, %q) = %q, %v; want %q, error %v", tc.base, tc.node, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseScanType(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    scanElement
+		wantErr bool
+	}{
+		{"le:s16/16>>0", scanElement{Signed: true, RealBits: 16, StorageBits: 16}, false},
+		{"be:u12/16>>4\n", scanElement{BigEndian: true, RealBits: 12, StorageBits: 16, Shift: 4}, false},
+		{"le:s64/64>>0", scanElement{Signed: true, RealBits: 64, StorageBits: 64}, false},
+		{"le:s20/32", scanElement{Signed: true, RealBits: 20, StorageBits: 32}, false},
+		{"le:s16/16X2>>0", scanElement{Signed: true, RealBits: 16, StorageBits: 16}, false},
+		{"", scanElement{}, true},
+		{"me:s16/16>>0", scanElement{}, true},
+		{"le:f16/16>>0", scanElement{}, true},
+		{"le:s16>>0", scanElement{}, true},
+		{"le:s16/12>>0", scanElement{}, true},  // storage not whole bytes
+		{"le:s24/16>>0", scanElement{}, true},  // more real bits than storage
+		{"le:s0/16>>0", scanElement{}, true},   // no bits
+		{"le:s16/128>>0", scanElement{}, true}, // wider than a uint64
+		{"le:s16/16>>x", scanElement{}, true},
+	} {
+		got, err := parseScanType(tc.in)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("parseScanType(%q) = %+v, %v; want %+v, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestLayoutScan(t *testing.T) {
+	s16 := scanElement{Signed: true, RealBits: 16, StorageBits: 16}
+	ts := scanElement{Name: "in_timestamp", Index: 6, Signed: true, RealBits: 64, StorageBits: 64}
+	// a combined IMU's six 16-bit channels, listed out of index order, then the timestamp
+	var els []scanElement
+	for _, i := range []int{3, 0, 5, 1, 4, 2} {
+		e := s16
+		e.Index = i
+		els = append(els, e)
+	}
+	els = append(els, ts)
+	if size := layoutScan(els); size != 24 {
+		t.Errorf("scan size %d, want 24 (12 bytes of axes, 4 of padding, 8 of timestamp)", size)
+	}
+	for i, e := range els {
+		want := 2 * i
+		if i == 6 {
+			want = 16
+		}
+		if e.Index != i || e.Offset != want {
+			t.Errorf("element %d: index %d offset %d, want offset %d", i, e.Index, e.Offset, want)
+		}
+	}
+
+	// an odd byte before a wider element is padded to its size, and the scan to the widest
+	els = []scanElement{
+		{Index: 0, RealBits: 8, StorageBits: 8},
+		{Index: 1, RealBits: 32, StorageBits: 32},
+		{Index: 2, RealBits: 8, StorageBits: 8},
+	}
+	if size := layoutScan(els); size != 12 || els[1].Offset != 4 || els[2].Offset != 8 {
+		t.Errorf("size %d, offsets %d %d; want 12, 4 and 8", size, els[1].Offset, els[2].Offset)
+	}
+}
+
+func TestScanElementDecode(t *testing.T) {
+	for _, tc := range []struct {
+		typ  string
+		scan []byte
+		want int64
+	}{
+		{"le:s16/16>>0", []byte{0x34, 0x12}, 0x1234},
+		{"le:s16/16>>0", []byte{0xff, 0xff}, -1},
+		{"le:u16/16>>0", []byte{0xff, 0xff}, 65535},
+		{"be:s16/16>>0", []byte{0x80, 0x00}, -32768},
+		// 12 bits in the top of 16: shifted down, then sign-extended
+		{"be:s12/16>>4", []byte{0xff, 0xf0}, -1},
+		{"be:s12/16>>4", []byte{0x7f, 0xf5}, 2047},
+		{"le:u12/16>>4", []byte{0xf0, 0xff}, 4095},
+		// bits above real_bits are masked off
+		{"le:s20/32>>0", []byte{0x00, 0x00, 0xf8, 0xaa}, -524288},
+		{"le:s8/8>>0", []byte{0x80}, -128},
+		{"le:s64/64>>0", []byte{0x00, 0x10, 0xa5, 0xd4, 0xe8, 0x00, 0x00, 0x00}, 1_000_000_000_000},
+	} {
+		e, err := parseScanType(tc.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.decode(tc.scan); got != tc.want {
+			t.Errorf("%s of % x = %d, want %d", tc.typ, tc.scan, got, tc.want)
+		}
+	}
+}
+
+// bufferFixture is a combined IMU whose scan is six le:s16 axes (gyro, then accel) and a
+// le:s64 realtime timestamp, with 0.001 rad/s and 0.01 m/s^2 per count.
+func bufferFixture(average bool) *IIOBufferDevice {
+	dev := &IIODevice{
+		Base: "/sys/bus/iio/devices/iio:device0", HaveGyro: true, HaveAccel: true,
+		AngVelChans: [3]string{"in_anglvel_x", "in_anglvel_y", "in_anglvel_z"},
+		AccelChans:  [3]string{"in_accel_x", "in_accel_y", "in_accel_z"},
+		GyroScale:   Vec3{0.001, 0.001, 0.001}, AccelScale: Vec3{0.01, 0.01, 0.01},
+		AccelOffset: Vec3{Z: 10},
+	}
+	b := &IIOBufferDevice{dev: dev, elements: make(map[string]scanElement), chans: scanChannels(dev), average: average,
+		ts: iioTimestamp{clock: "realtime", id: iioClocks["realtime"]}}
+	var els []scanElement
+	for i, ch := range b.chans {
+		typ := "le:s16/16>>0"
+		if ch == "in_timestamp" {
+			typ = "le:s64/64>>0"
+		}
+		e, _ := parseScanType(typ)
+		e.Name, e.Index = ch, i
+		els = append(els, e)
+	}
+	b.scanSize = layoutScan(els)
+	for _, e := range els {
+		b.elements[e.Name] = e
+	}
+	return b
+}
+
+// craftScan packs gyro and accel counts and a timestamp (ns) in bufferFixture's layout.
+func craftScan(gyro, accel [3]int16, tsNs int64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, gyro)
+	binary.Write(&buf, binary.LittleEndian, accel)
+	buf.Write(make([]byte, 4))
+	binary.Write(&buf, binary.LittleEndian, tsNs)
+	return buf.Bytes()
+}
+
+func TestBufferDecodeScan(t *testing.T) {
+	b := bufferFixture(false)
+	if b.scanSize != 24 {
+		t.Fatalf("scan size %d, want 24", b.scanSize)
+	}
+	s := b.decodeScan(craftScan([3]int16{100, -200, 300}, [3]int16{0, 1, -991}, 1_700_000_000_123_456_789))
+	if !near(s.Gyro, Vec3{0.1, -0.2, 0.3}, 1e-12) || !near(s.Accel, Vec3{0, 0.01, -9.81}, 1e-12) {
+		t.Errorf("gyro %+v accel %+v", s.Gyro, s.Accel)
+	}
+	if s.RawGyro != [3]int64{100, -200, 300} || s.RawAccel != [3]int64{0, 1, -991} {
+		t.Errorf("raw gyro %v accel %v", s.RawGyro, s.RawAccel)
+	}
+	if s.TSus != 1_700_000_000_123_456 {
+		t.Errorf("timestamp %d µs", s.TSus)
+	}
+}
+
+func TestBufferDrain(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(craftScan([3]int16{100, 0, 0}, [3]int16{}, 1_000_000_000))
+	stream.Write(craftScan([3]int16{200, 0, 0}, [3]int16{}, 1_004_000_000))
+	stream.Write(craftScan([3]int16{600, 0, 0}, [3]int16{}, 1_008_000_000))
+	scans := stream.Bytes()
+
+	// latest: the newest scan only
+	b := bufferFixture(false)
+	b.run(bytes.NewReader(scans))
+	b.err = nil // the reader stopped at the end of the fixture
+	s, err := b.readSample()
+	if err != nil || !near(s.Gyro, Vec3{X: 0.6}, 1e-12) || s.TSus != 1_008_000 {
+		t.Errorf("latest: %+v, %v", s, err)
+	}
+	if _, err := b.readSample(); err != io.EOF {
+		t.Errorf("second read without a new scan: %v, want EOF", err)
+	}
+
+	// average: the mean of the three, stamped with the newest
+	b = bufferFixture(true)
+	b.run(bytes.NewReader(scans))
+	b.err = nil
+	if s, err := b.readSample(); err != nil || !near(s.Gyro, Vec3{X: 0.3}, 1e-12) || s.TSus != 1_008_000 || s.RawGyro[0] != 600 {
+		t.Errorf("average: %+v, %v", s, err)
+	}
+
+	// a partial scan at the end is not taken
+	b = bufferFixture(false)
+	b.run(bytes.NewReader(scans[:len(scans)-5]))
+	b.err = nil
+	if s, _ := b.readSample(); s.TSus != 1_004_000 {
+		t.Errorf("after a cut scan got the sample at %d µs, want the one before", s.TSus)
+	}
+
+	// once the reader stops, readSample reports why
+	b.run(bytes.NewReader(nil))
+	if _, err := b.readSample(); err == nil || err.Error() != "/sys/bus/iio/devices/iio:device0: buffer read: EOF" {
+		t.Errorf("after the reader stopped: %v", err)
+	}
+}
+
+func TestBufferDrainManyScansPerTick(t *testing.T) {
+	// more scans than one read takes, in two ticks; each tick drains all of its own
+	tick := func(from, n int) io.Reader {
+		var stream bytes.Buffer
+		for i := from; i < from+n; i++ {
+			stream.Write(craftScan([3]int16{int16(i), 0, 0}, [3]int16{2: int16(-i)}, int64(i)*1_000_000))
+		}
+		return &stream
+	}
+	for _, tc := range []struct {
+		average      bool
+		first, again float64 // gyro X of the two ticks, rad/s
+	}{
+		{false, 0.039, 0.049},
+		{true, 0.0195, 0.0445}, // mean of 0..39, then of 40..49
+	} {
+		b := bufferFixture(tc.average)
+		b.run(tick(0, 40))
+		b.err = nil
+		s, err := b.readSample()
+		if err != nil || !near(s.Gyro, Vec3{X: tc.first}, 1e-12) || !near(s.Accel, Vec3{Z: (10 - tc.first*1000) * 0.01}, 1e-12) || s.TSus != 39_000 {
+			t.Errorf("average %v, first tick: %+v, %v", tc.average, s, err)
+		}
+		b.run(tick(40, 10))
+		b.err = nil
+		if s, err := b.readSample(); err != nil || !near(s.Gyro, Vec3{X: tc.again}, 1e-12) || s.TSus != 49_000 || s.RawGyro[0] != 49 {
+			t.Errorf("average %v, second tick: %+v, %v", tc.average, s, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// busErrorLimit is how many reads in a row may fail with a bus error before the IIO device is
+// reset (about 0.1 s at 250 Hz). It doubles with each reset that doesn't bring the reads back.
+const busErrorLimit = 25
+
+// isBusError reports whether a read failed because the I2C/SPI transfer to the sensor failed
+// (EIO) or the chip stopped answering (ENXIO), as opposed to a missing file or a parse error.
+func isBusError(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENXIO)
+}
+
+// busErrorWatch decides when repeated bus errors call for a device reset: after busErrorLimit
+// failed reads in a row, doubling after each reset that didn't bring the reads back.
+type busErrorWatch struct {
+	errs, resets int
+}
+
+// Fail records a failed read and returns the length of the run of bus errors when the device
+// is due for a reset, 0 otherwise. Errors that are not bus errors are not counted.
+func (w *busErrorWatch) Fail(err error) int {
+	if !isBusError(err) {
+		return 0
+	}
+	// a bus that stays down is retried less and less often
+	if w.errs++; w.errs < busErrorLimit<<min(w.resets, 6) {
+		return 0
+	}
+	n := w.errs
+	w.errs = 0
+	w.resets++
+	return n
+}
+
+// OK records a good read and returns how many resets it took to recover, 0 when there were
+// none since the last good read.
+func (w *busErrorWatch) OK() int {
+	n := w.resets
+	w.errs, w.resets = 0, 0
+	return n
+}
+
+// resetIIODevice reopens the IIO device at base and configures it again, which rewrites the
+// scales and rates the chip may have lost after a bus glitch. enables are the gyro and accel
+// enable settings, as at startup.
+func resetIIODevice(base string, rates sensorRates, setScales, setRate bool, scalePolicy string, enableGyro, enableAccel bool) (*IIODevice, error) {
+	dev, err := openIIODevice(base)
+	if err != nil {
+		return nil, err
+	}
+	applySensorEnables(dev, enableGyro, enableAccel)
+	configureDevice(dev, rates, setScales, setRate, scalePolicy)
+	return dev, nil
+}
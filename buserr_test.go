@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestIsBusError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&fs.PathError{Op: "read", Path: "in_anglvel_x_raw", Err: syscall.EIO}, true},
+		{&fs.PathError{Op: "read", Path: "in_anglvel_x_raw", Err: syscall.ENXIO}, true},
+		{&fs.PathError{Op: "open", Path: "in_anglvel_x_raw", Err: syscall.ENOENT}, false},
+		{&strconv.NumError{Func: "ParseInt", Num: "garbage", Err: strconv.ErrSyntax}, false},
+		{errors.New("EIO"), false},
+	} {
+		if got := isBusError(tc.err); got != tc.want {
+			t.Errorf("isBusError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestBusErrorWatchTriggersReset(t *testing.T) {
+	eio := &fs.PathError{Op: "read", Path: "in_accel_z_raw", Err: syscall.EIO}
+	var w busErrorWatch
+	// the reset comes after busErrorLimit errors in a row, then after twice as many
+	failUntilReset := func(err error) int {
+		for i := 1; i <= 1000; i++ {
+			if n := w.Fail(err); n > 0 {
+				if n != i {
+					t.Errorf("reset after %d errors reported a run of %d", i, n)
+				}
+				return i
+			}
+		}
+		return 0
+	}
+	if n := failUntilReset(eio); n != busErrorLimit {
+		t.Errorf("first reset after %d errors, want %d", n, busErrorLimit)
+	}
+	if n := failUntilReset(&fs.PathError{Op: "read", Err: syscall.ENXIO}); n != 2*busErrorLimit {
+		t.Errorf("second reset after %d errors, want %d", n, 2*busErrorLimit)
+	}
+	if w.resets != 2 {
+		t.Errorf("%d resets, want 2", w.resets)
+	}
+
+	// other errors neither count nor break the run
+	for range busErrorLimit * 10 {
+		if n := w.Fail(syscall.ENOENT); n > 0 {
+			t.Fatal("a missing file triggered a reset")
+		}
+	}
+
+	// a good read reports the recovery and starts over
+	if n := w.OK(); n != 2 {
+		t.Errorf("OK after two resets = %d", n)
+	}
+	if n := w.OK(); n != 0 {
+		t.Errorf("OK again = %d, want 0", n)
+	}
+	for range busErrorLimit - 1 {
+		w.Fail(eio)
+	}
+	w.OK() // a good read in between restarts the count
+	if n := failUntilReset(eio); n != busErrorLimit {
+		t.Errorf("after recovering, reset after %d errors, want %d", n, busErrorLimit)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// restWindow is how many recent gyro samples the resting detector computes variance over.
+	restWindow = 32
+
+	defaultRestAccelTolerance = 0.5  // m/s^2
+	defaultRestGyroVariance   = 0.25 // (deg/s)^2, i.e. 0.5 deg/s standard deviation
+	defaultRestMinMs          = 500
+	defaultRestAxes           = "xyz"
+)
+
+// restDetector decides whether the device is lying still: the accel magnitude stays within
+// accelTol of 1 g and the gyro variance on the selected axes stays below gyroVar, both for at
+// least minUS. Inputs are in the DSU frame (after the mount matrices).
+type restDetector struct {
+	accelTol float64 // m/s^2
+	gyroVar  float64 // (deg/s)^2
+	minUS    uint64  // minimum stable duration
+	axes     [3]bool // gyro axes taken into account (x, y, z)
+	buf      [restWindow]Vec3
+	n, next  int    // samples in buf, next slot to write
+	since    uint64 // timestamp the current still stretch began, 0 when moving
+	last     restVerdict
+}
+
+// restVerdict is the detector state after the last sample, for --debug-calib.
+type restVerdict struct {
+	Still    bool
+	StillFor float64 // seconds the device has been still (counting before minUS)
+	AccelErr float64 // | |accel| - 1 g |, m/s^2
+	GyroVar  float64 // largest variance of the selected axes, (deg/s)^2
+}
+
+// parseRestAxes turns "xyz", "xy", ... into the axes mask.
+func parseRestAxes(s string) ([3]bool, error) {
+	var axes [3]bool
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return axes, fmt.Errorf("rest_axes is empty")
+	}
+	for _, c := range s {
+		i := strings.IndexRune("xyz", c)
+		if i < 0 {
+			return axes, fmt.Errorf("rest_axes %q: want a combination of x, y and z", s)
+		}
+		axes[i] = true
+	}
+	return axes, nil
+}
+
+// newRestDetector builds a detector from the rest_* config keys, filling in defaults.
+func newRestDetector(cfg *Config) (*restDetector, error) {
+	d := &restDetector{
+		accelTol: defaultRestAccelTolerance,
+		gyroVar:  defaultRestGyroVariance,
+		minUS:    defaultRestMinMs * 1000,
+	}
+	if cfg.RestAccelTolerance < 0 || cfg.RestGyroVariance < 0 || cfg.RestMinMs < 0 {
+		return nil, fmt.Errorf("rest_accel_tolerance, rest_gyro_variance and rest_min_ms must not be negative")
+	}
+	if cfg.RestAccelTolerance > 0 {
+		d.accelTol = cfg.RestAccelTolerance
+	}
+	if cfg.RestGyroVariance > 0 {
+		d.gyroVar = cfg.RestGyroVariance
+	}
+	if cfg.RestMinMs > 0 {
+		d.minUS = uint64(cfg.RestMinMs) * 1000
+	}
+	axes := cfg.RestAxes
+	if axes == "" {
+		axes = defaultRestAxes
+	}
+	var err error
+	if d.axes, err = parseRestAxes(axes); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Update feeds one sample (gyro in rad/s, accel in m/s^2) and reports whether the device has
+// been still for at least the minimum duration.
+func (d *restDetector) Update(gyro, accel Vec3, tsUS uint64) bool {
+	d.buf[d.next] = gyro.Scale(180 / math.Pi)
+	d.next = (d.next + 1) % restWindow
+	if d.n < restWindow {
+		d.n++
+	}
+
+	v := restVerdict{AccelErr: math.Abs(accel.Norm() - standardGravity)}
+	var mean, sq Vec3
+	for i := 0; i < d.n; i++ {
+		mean = mean.Add(d.buf[i])
+		sq = sq.Add(Vec3{d.buf[i].X * d.buf[i].X, d.buf[i].Y * d.buf[i].Y, d.buf[i].Z * d.buf[i].Z})
+	}
+	mean, sq = mean.Scale(1/float64(d.n)), sq.Scale(1/float64(d.n))
+	vars := [3]float64{sq.X - mean.X*mean.X, sq.Y - mean.Y*mean.Y, sq.Z - mean.Z*mean.Z}
+	for i, on := range d.axes {
+		if on && vars[i] > v.GyroVar {
+			v.GyroVar = vars[i]
+		}
+	}
+
+	// a half-full window says little about variance
+	calm := d.n == restWindow && v.AccelErr <= d.accelTol && v.GyroVar <= d.gyroVar
+	switch {
+	case !calm:
+		d.since = 0
+	case d.since == 0:
+		d.since = tsUS
+	}
+	if d.since != 0 && tsUS >= d.since {
+		v.StillFor = float64(tsUS-d.since) / 1e6
+		v.Still = tsUS-d.since >= d.minUS
+	}
+	d.last = v
+	return v.Still
+}
+
+// Verdict returns the state after the last Update.
+func (d *restDetector) Verdict() restVerdict { return d.last }
+
+// gyroBiasEstimator tracks the gyro offset while the device rests, for gyro_bias_rate. The
+// estimate follows the resting gyro reading with a leaky integrator, so one bumped sample
+// barely moves it, and it is frozen whenever the device is not still.
+type gyroBiasEstimator struct {
+	rate   float64 // adaptation rate, 1/s (time constant is 1/rate)
+	bias   Vec3    // rad/s, DSU frame
+	lastTS uint64
+}
+
+func newGyroBiasEstimator(rate float64) *gyroBiasEstimator {
+	return &gyroBiasEstimator{rate: rate}
+}
+
+// Update learns from gyro when still is true and returns the current bias estimate.
+func (b *gyroBiasEstimator) Update(gyro Vec3, still bool, tsUS uint64) Vec3 {
+	if still && b.lastTS != 0 && tsUS > b.lastTS {
+		dt := float64(tsUS-b.lastTS) / 1e6
+		k := math.Min(1, b.rate*dt)
+		b.bias = b.bias.Add(gyro.Sub(b.bias).Scale(k))
+	}
+	b.lastTS = tsUS
+	return b.bias
+}
+
+// describeRestingGravity reports the direction of the resting accel (DSU frame) and whether it
+// looks inverted. The shipped configs put gravity on -Z with the device flat and screen up,
+// so a reading dominated by +Z means the Z row of the accel matrix has the wrong sign, unless
+// the device really lies screen down. Other orientations (in a stand, on its side) give no
+// verdict.
+func describeRestingGravity(a Vec3) (desc string, inverted bool) {
+	n := a.Norm()
+	if n == 0 {
+		return "accel reads zero", false
+	}
+	g := a.Scale(1 / n)
+	desc = fmt.Sprintf("gravity direction (%.2f, %.2f, %.2f)", g.X, g.Y, g.Z)
+	if math.Abs(g.Z) < math.Cos(30*math.Pi/180) {
+		return desc + ", device not lying flat", false
+	}
+	if g.Z > 0 {
+		return desc + ", pointing +Z", true
+	}
+	return desc + ", pointing -Z as expected for a device lying screen up", false
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRestAxes(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    [3]bool
+		wantErr bool
+	}{
+		{"xyz", [3]bool{true, true, true}, false},
+		{"XY", [3]bool{true, true, false}, false},
+		{" z ", [3]bool{false, false, true}, false},
+		{"zx", [3]bool{true, false, true}, false},
+		{"", [3]bool{}, true},
+		{"xw", [3]bool{}, true},
+	} {
+		got, err := parseRestAxes(tc.in)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("parseRestAxes(%q) = %v, %v; want %v, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestNewRestDetectorConfig(t *testing.T) {
+	d, err := newRestDetector(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.accelTol != defaultRestAccelTolerance || d.gyroVar != defaultRestGyroVariance || d.minUS != defaultRestMinMs*1000 || d.axes != [3]bool{true, true, true} {
+		t.Errorf("defaults: %+v", d)
+	}
+	d, err = newRestDetector(&Config{RestAccelTolerance: 2, RestGyroVariance: 1, RestMinMs: 100, RestAxes: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.accelTol != 2 || d.gyroVar != 1 || d.minUS != 100_000 || d.axes != [3]bool{true, false, false} {
+		t.Errorf("configured: %+v", d)
+	}
+	for _, cfg := range []Config{{RestAccelTolerance: -1}, {RestGyroVariance: -1}, {RestMinMs: -1}, {RestAxes: "q"}} {
+		if _, err := newRestDetector(&cfg); err == nil {
+			t.Errorf("newRestDetector(%+v) accepted it", cfg)
+		}
+	}
+}
+
+// restFeed feeds d samples at 100 Hz from tsUS on, with gyro noise of sd deg/s per axis, and
+// returns the verdict after each.
+func restFeed(d *restDetector, rng *rand.Rand, tsUS uint64, n int, sd Vec3, accel Vec3) []bool {
+	var out []bool
+	for i := 0; i < n; i++ {
+		g := Vec3{rng.NormFloat64() * sd.X, rng.NormFloat64() * sd.Y, rng.NormFloat64() * sd.Z}
+		out = append(out, d.Update(g.Scale(math.Pi/180), accel, tsUS+uint64(i)*10_000))
+	}
+	return out
+}
+
+func TestRestDetectorStillVsMoving(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	flat := Vec3{Z: -standardGravity}
+	quiet := Vec3{0.1, 0.1, 0.1}
+
+	d, _ := newRestDetector(&Config{})
+	still := restFeed(d, rng, 1_000_000, 100, quiet, flat)
+	// the window fills after restWindow samples, then rest_min_ms (500 ms = 50 samples) runs
+	first := -1
+	for i, s := range still {
+		if s {
+			first = i
+			break
+		}
+	}
+	if want := restWindow - 1 + 50; first != want {
+		t.Errorf("still from sample %d, want %d", first, want)
+	}
+	if v := d.Verdict(); !v.Still || v.StillFor < 0.5 || v.GyroVar > defaultRestGyroVariance || v.AccelErr != 0 {
+		t.Errorf("verdict after rest: %+v", v)
+	}
+
+	// handling the device (gyro swinging by several deg/s) ends the rest at once
+	moving := restFeed(d, rng, 2_000_000, 5, Vec3{20, 20, 20}, flat)
+	if moving[len(moving)-1] {
+		t.Error("still while moving")
+	}
+	if v := d.Verdict(); v.StillFor != 0 {
+		t.Errorf("still stretch not reset by motion: %+v", v)
+	}
+
+	// a quiet gyro but an accel far from 1 g (being carried, or a bad scale) is not rest
+	d, _ = newRestDetector(&Config{})
+	if got := restFeed(d, rng, 1_000_000, 100, quiet, Vec3{Z: -12}); got[len(got)-1] {
+		t.Error("still with |accel| 2 m/s^2 off 1 g")
+	}
+	// unless the tolerance allows it
+	d, _ = newRestDetector(&Config{RestAccelTolerance: 3})
+	if got := restFeed(d, rng, 1_000_000, 100, quiet, Vec3{Z: -12}); !got[len(got)-1] {
+		t.Error("not still within rest_accel_tolerance 3")
+	}
+}
+
+func TestRestDetectorAxes(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	flat := Vec3{Z: -standardGravity}
+	noisyZ := Vec3{0.1, 0.1, 3}
+
+	d, _ := newRestDetector(&Config{})
+	if got := restFeed(d, rng, 1_000_000, 100, noisyZ, flat); got[len(got)-1] {
+		t.Error("still with a noisy z axis counted")
+	}
+	d, _ = newRestDetector(&Config{RestAxes: "xy"})
+	if got := restFeed(d, rng, 1_000_000, 100, noisyZ, flat); !got[len(got)-1] {
+		t.Errorf("not still with the noisy z axis dropped: %+v", d.Verdict())
+	}
+	// raising the variance threshold works too
+	d, _ = newRestDetector(&Config{RestGyroVariance: 20})
+	if got := restFeed(d, rng, 1_000_000, 100, noisyZ, flat); !got[len(got)-1] {
+		t.Errorf("not still with rest_gyro_variance 20: %+v", d.Verdict())
+	}
+}
+
+func TestGyroBiasEstimator(t *testing.T) {
+	offset := Vec3{0.01, -0.02, 0.005} // rad/s
+	b := newGyroBiasEstimator(0.2)
+	// 30 s at rest, 100 Hz: six time constants
+	var got Vec3
+	for i := 0; i <= 3000; i++ {
+		got = b.Update(offset, true, 1_000_000+uint64(i)*10_000)
+	}
+	if !near(got, offset, offset.Norm()*0.01) {
+		t.Errorf("after 30 s at rest bias = %+v, want about %+v", got, offset)
+	}
+
+	// turning: the real motion must not leak into the estimate
+	for i := 1; i <= 500; i++ {
+		if m := b.Update(Vec3{Z: 3}, false, 31_000_000+uint64(i)*10_000); m != got {
+			t.Fatalf("bias moved to %+v while moving", m)
+		}
+	}
+	// back at rest after motion, learning continues from the frozen value, not from the
+	// timestamp of the last still sample
+	if next := b.Update(offset, true, 36_010_000); !near(next, got, 1e-3) {
+		t.Errorf("first sample after motion jumped the bias to %+v", next)
+	}
+}
+
+func TestGyroBiasEstimatorRates(t *testing.T) {
+	// rate 0 never learns: a fixed bias only a recalibration sets
+	b := newGyroBiasEstimator(0)
+	b.bias = Vec3{X: 0.1}
+	for i := 0; i < 100; i++ {
+		b.Update(Vec3{Y: 1}, true, uint64(i+1)*10_000)
+	}
+	if b.bias != (Vec3{X: 0.1}) {
+		t.Errorf("rate 0 learned: %+v", b.bias)
+	}
+	// a long gap never overshoots the reading
+	b = newGyroBiasEstimator(5)
+	b.Update(Vec3{X: 1}, true, 1_000_000)
+	if got := b.Update(Vec3{X: 1}, true, 11_000_000); got != (Vec3{X: 1}) {
+		t.Errorf("after a 10 s step bias = %+v, want the reading", got)
+	}
+}
+
+func TestDescribeRestingGravity(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		a        Vec3
+		want     string
+		inverted bool
+	}{
+		{"flat screen up", Vec3{Z: -standardGravity}, "gravity direction (0.00, 0.00, -1.00), pointing -Z as expected for a device lying screen up", false},
+		{"inverted Z row", Vec3{Z: standardGravity}, "gravity direction (0.00, 0.00, 1.00), pointing +Z", true},
+		// a slight tilt is still lying flat
+		{"tilted 20 deg", Vec3{X: 0.342, Z: 0.940}.Scale(standardGravity), "gravity direction (0.34, 0.00, 0.94), pointing +Z", true},
+		{"in a stand", Vec3{Y: -7, Z: -7}, "gravity direction (0.00, -0.71, -0.71), device not lying flat", false},
+		{"on its side", Vec3{X: standardGravity}, "gravity direction (1.00, 0.00, 0.00), device not lying flat", false},
+		{"no accel", Vec3{}, "accel reads zero", false},
+	} {
+		desc, inverted := describeRestingGravity(tc.a)
+		if desc != tc.want || inverted != tc.inverted {
+			t.Errorf("%s: got %q, inverted %v; want %q, %v", tc.name, desc, inverted, tc.want, tc.inverted)
+		}
+	}
+}
+
+func TestCalibWindowQuality(t *testing.T) {
+	rest, _ := newRestDetector(&Config{})
+	deg := math.Pi / 180
+	for _, tc := range []struct {
+		name      string
+		gyroSwing float64 // deg/s, alternating sign
+		magSwing  float64 // m/s^2 on |accel|, alternating sign
+		score     float64
+	}{
+		{"perfectly still", 0, 0, 100},
+		{"gyro at a quarter of the variance limit", 0.25, 0, 75},
+		{"gyro at the variance limit", 0.5, 0, 0},
+		{"gyro beyond it", 2, 0, 0},
+		{"accel spread at half the tolerance", 0, 0.25, 50},
+		// the worse of the two sets the score
+		{"both", 0.25, 0.25, 50},
+	} {
+		var w calibWindow
+		for i := 0; i < 100; i++ {
+			sign := float64(1 - 2*(i%2))
+			w.Add(Vec3{Y: sign * tc.gyroSwing * deg}, Vec3{Z: -(standardGravity + sign*tc.magSwing)})
+		}
+		if q := w.Quality(rest); math.Abs(q.Score-tc.score) > 1e-6 {
+			t.Errorf("%s: score %.2f (gyro var %g, accel spread %g), want %g", tc.name, q.Score, q.GyroVar, q.AccelSpread, tc.score)
+		}
+	}
+	var empty calibWindow
+	if q := empty.Quality(rest); q.Score != 0 {
+		t.Errorf("empty window scores %g", q.Score)
+	}
+}
+
+// calibReader returns resting samples 10 ms apart, flat with |accel| = mag, and the gyro
+// swinging by ±swing deg/s about y.
+func calibReader(swing, mag float64) func() (IMUSample, error) {
+	i := 0
+	return func() (IMUSample, error) {
+		i++
+		sign := float64(1 - 2*(i%2))
+		return IMUSample{Gyro: Vec3{Y: sign * swing * math.Pi / 180}, Accel: Vec3{Z: -mag}, TSus: 1_000_000 + uint64(i)*10_000}, nil
+	}
+}
+
+func TestRunCalibrateFull(t *testing.T) {
+	ls := &liveSettings{AccelMatrix: identityMatrix, GyroMatrix: identityMatrix}
+	path := filepath.Join(t.TempDir(), "calibration.yaml")
+
+	// a quiet window is accepted and gives the uniform accel scale
+	rest, _ := newRestDetector(&Config{})
+	if err := runCalibrateFull(calibReader(0.05, 9.7), ls, rest, 4000, path, defaultCalibrationMinQuality); err != nil {
+		t.Fatal(err)
+	}
+	cal, err := loadCalibration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accel, gyro := cal.corrections()
+	if k := standardGravity / 9.7; math.Abs(accel.X.X-k) > 1e-9 || accel.Y.Y != accel.X.X || accel.Z.Z != accel.X.X || gyro != identityMatrix {
+		t.Errorf("saved accel correction %+v, gyro %+v; want %g on the diagonal", accel, gyro, k)
+	}
+}
+
+func TestRunCalibrateFullRefusesNoisyWindow(t *testing.T) {
+	ls := &liveSettings{AccelMatrix: identityMatrix, GyroMatrix: identityMatrix}
+	path := filepath.Join(t.TempDir(), "calibration.yaml")
+
+	// still enough for the rest detector (variance 0.16 of 0.25), but scoring 36
+	rest, _ := newRestDetector(&Config{})
+	err := runCalibrateFull(calibReader(0.4, 9.7), ls, rest, 4000, path, defaultCalibrationMinQuality)
+	if err == nil || !strings.Contains(err.Error(), "quality 36 is below the minimum of 50") {
+		t.Errorf("noisy window: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("a refused calibration was written: %v", err)
+	}
+
+	// a lower threshold takes it
+	rest, _ = newRestDetector(&Config{})
+	if err := runCalibrateFull(calibReader(0.4, 9.7), ls, rest, 4000, path, 30); err != nil {
+		t.Errorf("with calibration_min_quality 30: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// calibrationFileName is the calibration file looked up next to the config file.
+const calibrationFileName = "iio-dsu-bridge.calib.yaml"
+
+// identityMatrix leaves vectors unchanged; it is the correction when none is calibrated.
+var identityMatrix = MountMatrix{X: Vec3{X: 1}, Y: Vec3{Y: 1}, Z: Vec3{Z: 1}}
+
+// Calibration is the per-unit sensor calibration, kept apart from the config (which describes
+// the device model) because it differs between two units of the same handheld.
+//
+// The correction matrices compensate scale and cross-axis sensitivity in the sensor frame.
+// They are applied before the mount matrix, which only reorients: out = mount * (corr * raw).
+type Calibration struct {
+	AccelCorrection *matrixYAML `yaml:"accel_correction,omitempty"`
+	GyroCorrection  *matrixYAML `yaml:"gyro_correction,omitempty"`
+}
+
+// calibrationPath returns calibration_file, or the calibration file next to cfgPath.
+func calibrationPath(cfg *Config, cfgPath string) string {
+	if cfg.CalibrationFile != "" {
+		return cfg.CalibrationFile
+	}
+	if cfgPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cfgPath), calibrationFileName)
+}
+
+// loadCalibration reads the calibration file at path. A missing file is an empty calibration.
+func loadCalibration(path string) (*Calibration, error) {
+	cal := &Calibration{}
+	if path == "" {
+		return cal, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, cal); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, m := range []struct {
+		name string
+		m    *matrixYAML
+	}{{"accel_correction", cal.AccelCorrection}, {"gyro_correction", cal.GyroCorrection}} {
+		if m.m == nil {
+			continue
+		}
+		if err := checkMatrixBlock(m.name, m.m.X, m.m.Y, m.m.Z); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return cal, nil
+}
+
+// corrections returns the accel and gyro correction matrices, identity where not calibrated.
+func (c *Calibration) corrections() (accel, gyro MountMatrix) {
+	accel, gyro = identityMatrix, identityMatrix
+	if c == nil {
+		return accel, gyro
+	}
+	if c.AccelCorrection != nil {
+		if m, ok := parseMatrix(c.AccelCorrection.X, c.AccelCorrection.Y, c.AccelCorrection.Z); ok {
+			accel = m
+		}
+	}
+	if c.GyroCorrection != nil {
+		if m, ok := parseMatrix(c.GyroCorrection.X, c.GyroCorrection.Y, c.GyroCorrection.Z); ok {
+			gyro = m
+		}
+	}
+	return accel, gyro
+}
+
+// saveCalibration writes cal to path (via a temporary file, so a crash never leaves half a
+// calibration behind).
+func saveCalibration(path string, cal *Calibration) error {
+	b, err := yaml.Marshal(cal)
+	if err != nil {
+		return err
+	}
+	b = append([]byte("# iio-dsu-bridge sensor calibration (written by --calibrate-full)\n"), b...)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const (
+	// calibrateRestSamples is how many resting samples --calibrate-full averages.
+	calibrateRestSamples = 500
+	// calibrateTimeout bounds how long --calibrate-full waits for the device to rest.
+	calibrateTimeout = 60 * time.Second
+	// defaultCalibrationMinQuality is the lowest quality score --calibrate-full saves.
+	defaultCalibrationMinQuality = 50
+)
+
+// calibWindow accumulates the samples a calibration is computed from, to judge how still the
+// device really was: the gyro variance and the spread of the accel magnitude.
+type calibWindow struct {
+	n           int
+	gyro, gyro2 Vec3    // sums of deg/s and its square, per axis
+	mag, mag2   float64 // sums of |accel| and its square
+}
+
+func (w *calibWindow) Add(gyro, accel Vec3) {
+	g := gyro.Scale(180 / math.Pi)
+	w.n++
+	w.gyro = w.gyro.Add(g)
+	w.gyro2 = w.gyro2.Add(Vec3{g.X * g.X, g.Y * g.Y, g.Z * g.Z})
+	m := accel.Norm()
+	w.mag += m
+	w.mag2 += m * m
+}
+
+// calibQuality rates a calibration window from 0 (unusable) to 100 (perfectly still). Each of
+// the gyro variance and the accel magnitude spread is compared with the resting detector's
+// threshold for it; the worse one sets the score.
+type calibQuality struct {
+	GyroVar     float64 // largest per-axis variance, (deg/s)^2
+	AccelSpread float64 // standard deviation of |accel|, m/s^2
+	Score       float64
+}
+
+func (w *calibWindow) Quality(rest *restDetector) calibQuality {
+	if w.n == 0 {
+		return calibQuality{}
+	}
+	n := float64(w.n)
+	mean, sq := w.gyro.Scale(1/n), w.gyro2.Scale(1/n)
+	q := calibQuality{
+		GyroVar:     max(sq.X-mean.X*mean.X, sq.Y-mean.Y*mean.Y, sq.Z-mean.Z*mean.Z, 0),
+		AccelSpread: math.Sqrt(max(w.mag2/n-(w.mag/n)*(w.mag/n), 0)),
+	}
+	worst := max(q.GyroVar/rest.gyroVar, q.AccelSpread/rest.accelTol)
+	q.Score = 100 * min(max(1-worst, 0), 1)
+	return q
+}
+
+// runCalibrateFull measures the calibration and writes it to path. So far it needs a single
+// resting pose: the averaged accel magnitude gives a uniform accel scale correction, and the
+// gyro correction is kept (identity unless calibrated otherwise). A multi-pose routine for the
+// cross-axis terms can fill in the same matrices later. read returns sensor-frame samples;
+// rest gets them through the mount matrices like the main loop does.
+//
+// A window scoring below minQuality (see calibQuality) is refused and nothing is written.
+func runCalibrateFull(read func() (IMUSample, error), ls *liveSettings, rest *restDetector, rate float64, path string, minQuality float64) error {
+	if path == "" {
+		return errors.New("no calibration file path (set calibration_file or use --config)")
+	}
+	cal, err := loadCalibration(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Calibrating: put the device down flat and don't touch it (up to %v)...\n", calibrateTimeout)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	deadline := time.Now().Add(calibrateTimeout)
+	var sum Vec3
+	var win calibWindow
+	n := 0
+	for n < calibrateRestSamples {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device did not stay still long enough (%d of %d samples)", n, calibrateRestSamples)
+		}
+		<-ticker.C
+		s, err := read()
+		if err != nil {
+			continue
+		}
+		if !rest.Update(ls.GyroMatrix.Apply(s.Gyro), ls.AccelMatrix.Apply(s.Accel), s.TSus) {
+			// movement restarts the average
+			sum, n, win = Vec3{}, 0, calibWindow{}
+			continue
+		}
+		sum = sum.Add(s.Accel)
+		win.Add(s.Gyro, s.Accel)
+		n++
+	}
+
+	q := win.Quality(rest)
+	fmt.Printf("Calibration quality: %.0f/100 (gyro variance %.4f (deg/s)^2, accel magnitude spread %.4f m/s^2)\n",
+		q.Score, q.GyroVar, q.AccelSpread)
+	if q.Score < minQuality {
+		return fmt.Errorf("quality %.0f is below the minimum of %.0f; nothing was saved. Put the device on a firm, still surface and retry", q.Score, minQuality)
+	}
+
+	mean := sum.Scale(1 / float64(n))
+	if mean.Norm() == 0 {
+		return errors.New("accel reads zero at rest; nothing to calibrate")
+	}
+	k := standardGravity / mean.Norm()
+	accel := toMatrixYAML(MountMatrix{X: Vec3{X: k}, Y: Vec3{Y: k}, Z: Vec3{Z: k}})
+	cal.AccelCorrection = &accel
+	if cal.GyroCorrection == nil {
+		gyro := toMatrixYAML(identityMatrix)
+		cal.GyroCorrection = &gyro
+	}
+	fmt.Printf("Accel at rest: %.4f m/s^2 -> scale correction %.5f\n", mean.Norm(), k)
+	if err := saveCalibration(path, cal); err != nil {
+		return err
+	}
+	fmt.Printf("Calibration written to %s\n", path)
+	return nil
+}
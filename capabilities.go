@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"slices"
+)
+
+// configSchemaVersion is bumped when config keys change meaning or are removed, so installers
+// can tell whether a config they write is understood.
+const configSchemaVersion = 1
+
+// outputBackends are the protocols samples can be sent with.
+var outputBackends = []string{"dsu"}
+
+// orientationFilters are the fusion filters --debug-orientation can use.
+var orientationFilters = []string{"complementary"}
+
+// devicePresets are the built-in device configs. None are compiled in yet; the example
+// configs ship as files.
+var devicePresets = map[string]*Config{}
+
+// capabilities describes what this binary supports (--capabilities, GET /capabilities).
+type capabilities struct {
+	ConfigSchema  int      `json:"config_schema"`
+	Outputs       []string `json:"outputs"`
+	Sources       []string `json:"sources"`
+	ScalePolicies []string `json:"scale_policies"`
+	Presets       []string `json:"presets"`
+	Filters       []string `json:"filters"`
+
+	// SendDrops counts, per DSU client, the motion packets dropped because their send failed
+	// or timed out. Only GET /capabilities of a running bridge has it.
+	SendDrops map[string]uint64 `json:"send_drops,omitempty"`
+}
+
+func currentCapabilities() capabilities {
+	return capabilities{
+		ConfigSchema:  configSchemaVersion,
+		Outputs:       outputBackends,
+		Sources:       sampleSources,
+		ScalePolicies: slices.Sorted(maps.Keys(scalePolicies)),
+		Presets:       append([]string{}, slices.Sorted(maps.Keys(devicePresets))...), // [] rather than null
+		Filters:       orientationFilters,
+	}
+}
+
+// printCapabilities writes the capabilities as indented JSON to stdout.
+func printCapabilities() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(currentCapabilities())
+}
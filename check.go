@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// runCheck validates the resolved config and device without starting the DSU server.
+// The scales and rates configureDevice would write are only reported, unless apply is set.
+// It prints a summary and a PASS/FAIL verdict with the problems found, and returns the
+// process exit code. The report goes to w.
+func runCheck(w io.Writer, cfg *Config, cfgErr error, rate float64, setScales, setRate, apply bool) int {
+	var problems, warnings []string
+	if cfgErr != nil {
+		problems = append(problems, fmt.Sprintf("config: %v", cfgErr))
+	}
+
+	var dev, gyroDev, accelDev *IIODevice
+	var evdev *EvdevDevice
+	var evErr error
+	if cfg.Source == "evdev" {
+		if evdev, evErr = openEvdevSource(cfg); evErr != nil {
+			problems = append(problems, fmt.Sprintf("evdev: %v", evErr))
+		}
+	} else if base, err := selectIIOBase(w, cfg); err != nil {
+		// auto falls back to evdev like the bridge does
+		if cfg.Source == "auto" {
+			evdev, evErr = openEvdevSource(cfg)
+		}
+		if evdev == nil {
+			problems = append(problems, fmt.Sprintf("device: %v (try --list-iio)", err))
+		}
+		if evErr != nil {
+			problems = append(problems, fmt.Sprintf("evdev: %v", evErr))
+		}
+	} else if dev, err = openIIODevice(base); err != nil {
+		problems = append(problems, fmt.Sprintf("device %s: %v", base, err))
+	} else {
+		applySensorEnables(dev, *cfg.EnableGyro, *cfg.EnableAccel)
+		gyroDev, accelDev = openComplementary(w, dev, *cfg.EnableGyro, *cfg.EnableAccel)
+	}
+	if evdev != nil {
+		defer evdev.Close()
+	}
+
+	// Scales and rates: apply them, or work on copies so the summary shows the planned values
+	devs := []*IIODevice{dev, gyroDev, accelDev}
+	for i, d := range devs {
+		if d == nil {
+			continue
+		}
+		if apply {
+			configureDevice(d, sensorRatesFor(cfg, rate), setScales, setRate, cfg.ScalePolicy)
+			continue
+		}
+		planned := *d
+		for _, line := range planDevice(&planned, sensorRatesFor(cfg, rate), setScales, setRate, cfg.ScalePolicy) {
+			fmt.Fprintf(w, "Would set %s %s\n", d.Base, line)
+		}
+		devs[i] = &planned
+	}
+	dev, gyroDev, accelDev = devs[0], devs[1], devs[2]
+	if rate == 0 {
+		// no rate configured: the bridge follows the device
+		if rate = deviceOutputRate(dev, gyroDev, accelDev); rate == 0 {
+			rate = defaultRate
+		}
+	}
+
+	if evdev != nil {
+		if *cfg.EnableGyro && !evdev.HaveGyro {
+			problems = append(problems, "no gyroscope axes on "+evdev.Path)
+		}
+		if *cfg.EnableAccel && !evdev.HaveAccel {
+			problems = append(problems, "no accelerometer axes on "+evdev.Path)
+		}
+	}
+	if dev != nil {
+		gyro, accel := dev, dev
+		if gyroDev != nil {
+			gyro = gyroDev
+		}
+		if accelDev != nil {
+			accel = accelDev
+		}
+		if !*cfg.EnableGyro {
+			// disabled on purpose
+		} else if !gyro.HaveGyro {
+			problems = append(problems, "no gyroscope channels found")
+		} else if gyro.GyroScale.X == 0 {
+			problems = append(problems, fmt.Sprintf("gyro scale is 0 on %s and nothing to set it from", gyro.Base))
+		}
+		if !*cfg.EnableAccel {
+			// disabled on purpose
+		} else if !accel.HaveAccel {
+			problems = append(problems, "no accelerometer channels found")
+		} else if accel.AccelScale.X == 0 {
+			problems = append(problems, fmt.Sprintf("accel scale is 0 on %s and nothing to set it from", accel.Base))
+		}
+	}
+
+	if _, err := newRestDetector(cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("config: %v", err))
+	}
+
+	accelMount, gyroMount, accelSrc, gyroSrc := resolveMatrices(cfg)
+	switch {
+	case accelSrc == "" && gyroSrc == "":
+		problems = append(problems, "no mount matrix configured (mount_matrix, accel_matrix or gyro_matrix)")
+	case accelSrc == "":
+		warnings = append(warnings, "no matrix applies to the accelerometer; accel will be sent as zero")
+	case gyroSrc == "":
+		warnings = append(warnings, "no matrix applies to the gyroscope; gyro will be sent as zero")
+	}
+	if accelSrc != "" && !isOrthonormal(accelMount) {
+		warnings = append(warnings, fmt.Sprintf("%s for accel is not orthonormal (rows should be unit length and perpendicular)", accelSrc))
+	}
+	if gyroSrc != "" && !isOrthonormal(gyroMount) {
+		warnings = append(warnings, fmt.Sprintf("%s for gyro is not orthonormal (rows should be unit length and perpendicular)", gyroSrc))
+	}
+
+	warnings = append(warnings, lintConfig(cfg, rate, setRate, dev, gyroDev, accelDev)...)
+
+	printSummary(w, dev, gyroDev, accelDev, evdev, accelMount, gyroMount, accelSrc, gyroSrc, rate)
+
+	for _, warn := range warnings {
+		fmt.Fprintf(w, "WARN: %s\n", warn)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(w, "FAIL: %s\n", p)
+		}
+		fmt.Fprintf(w, "FAIL (%d problem(s))\n", len(problems))
+		return 1
+	}
+	fmt.Fprintln(w, "PASS")
+	return 0
+}
+
+// planDevice mirrors configureDevice without writing to sysfs: it updates dev with the scales
+// that would be picked and describes each write. auto-noise needs to write while probing, so
+// it is only announced.
+func planDevice(dev *IIODevice, rates sensorRates, setScales, setRate bool, scalePolicy string) []string {
+	var out []string
+	if setScales {
+		if dev.HaveGyro && ((dev.GyroScale.X == 0 && dev.GyroScale.Y == 0 && dev.GyroScale.Z == 0) || scalePolicy == "auto-noise") {
+			if avail, _, err := availableScales(dev, "anglvel"); err == nil {
+				if scalePolicy == "auto-noise" {
+					out = append(out, "in_anglvel_scale by probing each of "+fmt.Sprint(avail)+" (auto-noise)")
+				} else {
+					pick := pickMiddleScale(dev, "anglvel", avail)
+					out = append(out, fmt.Sprintf("in_anglvel_scale=%g", pick))
+					dev.GyroScale = Vec3{X: pick, Y: pick, Z: pick}
+				}
+			}
+		}
+		if dev.HaveAccel && dev.AccelScale.X == 0 && dev.AccelScale.Y == 0 && dev.AccelScale.Z == 0 {
+			if avail, _, err := availableScales(dev, "accel"); err == nil {
+				pick := pickMiddleScale(dev, "accel", avail)
+				out = append(out, fmt.Sprintf("in_accel_scale=%g", pick))
+				dev.AccelScale = Vec3{X: pick, Y: pick, Z: pick}
+			}
+		}
+	}
+	if setRate {
+		if dev.HaveGyro && rates.Gyro > 0 {
+			if attr := firstRateAttr(dev.Base, "anglvel"); attr != "" {
+				pick, hz := planChannelRate(dev.Base, "anglvel", rates.Gyro, rates.Band)
+				out = append(out, fmt.Sprintf("%s=%g", attr, pick))
+				dev.AngVelRateHz = hz
+			}
+		}
+		if dev.HaveAccel && rates.Accel > 0 {
+			if attr := firstRateAttr(dev.Base, "accel"); attr != "" {
+				pick, hz := planChannelRate(dev.Base, "accel", rates.Accel, rates.Band)
+				out = append(out, fmt.Sprintf("%s=%g", attr, pick))
+				dev.AccelRateHz = hz
+			}
+		}
+	}
+	return out
+}
+
+// printSummary prints the resolved devices, scales, rates and matrices to w in one block.
+func printSummary(w io.Writer, dev, gyroDev, accelDev *IIODevice, evdev *EvdevDevice, accelMount, gyroMount MountMatrix, accelSrc, gyroSrc string, rate float64) {
+	fmt.Fprintln(w, "---- summary ----")
+	if evdev != nil {
+		if evdev.HaveGyro {
+			fmt.Fprintf(w, "Gyro:        %s (evdev) scale=%g\n", evdev.Path, evdev.GyroScale.X)
+		} else {
+			fmt.Fprintln(w, "Gyro:        (none)")
+		}
+		if evdev.HaveAccel {
+			fmt.Fprintf(w, "Accel:       %s (evdev) scale=%g\n", evdev.Path, evdev.AccelScale.X)
+		} else {
+			fmt.Fprintln(w, "Accel:       (none)")
+		}
+	} else if dev == nil {
+		fmt.Fprintln(w, "Device:      (none)")
+	} else {
+		gyro, accel := dev, dev
+		if gyroDev != nil {
+			gyro = gyroDev
+		}
+		if accelDev != nil {
+			accel = accelDev
+		}
+		if gyro.HaveGyro {
+			fmt.Fprintf(w, "Gyro:        %s scale=%g rate=%g Hz\n", gyro.Base, gyro.GyroScale.X, gyro.AngVelRateHz)
+		} else {
+			fmt.Fprintln(w, "Gyro:        (none)")
+		}
+		if accel.HaveAccel {
+			fmt.Fprintf(w, "Accel:       %s scale=%g rate=%g Hz\n", accel.Base, accel.AccelScale.X, accel.AccelRateHz)
+		} else {
+			fmt.Fprintln(w, "Accel:       (none)")
+		}
+	}
+	fmt.Fprintf(w, "Output rate: %g Hz\n", rate)
+	if accelSrc != "" {
+		fmt.Fprintf(w, "Accel matrix (%s): %s\n", accelSrc, formatMatrix(accelMount))
+	}
+	if gyroSrc != "" {
+		fmt.Fprintf(w, "Gyro matrix (%s):  %s\n", gyroSrc, formatMatrix(gyroMount))
+	}
+	fmt.Fprintln(w, "-----------------")
+}
+
+// isOrthonormal reports whether the rows of m are unit length and mutually perpendicular,
+// i.e. m only reorients axes (rotation, optionally with a mirror).
+func isOrthonormal(m MountMatrix) bool {
+	const eps = 1e-3
+	dot := func(a, b Vec3) float64 { return a.X*b.X + a.Y*b.Y + a.Z*b.Z }
+	rows := []Vec3{m.X, m.Y, m.Z}
+	for i := range rows {
+		if math.Abs(dot(rows[i], rows[i])-1) > eps {
+			return false
+		}
+		for j := i + 1; j < len(rows); j++ {
+			if math.Abs(dot(rows[i], rows[j])) > eps {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const checkIdentity = `
+mount_matrix:
+  x: [1, 0, 0]
+  y: [0, 1, 0]
+  z: [0, 0, 1]
+`
+
+func TestRunCheck(t *testing.T) {
+	scaled := func() map[string]string {
+		return axes(axes(map[string]string{
+			"name":             "bmi323-imu",
+			"in_anglvel_scale": "0.001065",
+			"in_accel_scale":   "0.002394",
+		}, "anglvel", [3]int{}), "accel", [3]int{})
+	}
+	unscaled := axes(axes(map[string]string{"name": "bmi323-imu"}, "anglvel", [3]int{}), "accel", [3]int{})
+
+	tests := []struct {
+		name   string
+		attrs  map[string]string // iio:device0; nil = no device
+		config string
+		cfgErr error
+		want   int
+		lines  []string
+	}{
+		{"good", scaled(), checkIdentity, nil, 0, []string{"PASS"}},
+		{"no matrix", scaled(), "", nil, 1, []string{"FAIL: no mount matrix configured"}},
+		{"no device", nil, checkIdentity, nil, 1, []string{"FAIL: device:"}},
+		{"zero scale", unscaled, checkIdentity, nil, 1, []string{
+			"FAIL: gyro scale is 0 on", "FAIL: accel scale is 0 on", "FAIL (2 problem(s))"}},
+		{"broken resting detector", scaled(), checkIdentity + "rest_min_ms: -5\n", nil, 1, []string{"FAIL: config: rest_accel_tolerance"}},
+		{"config error", scaled(), checkIdentity, errors.New("yaml: line 3: bad indent"), 1, []string{"FAIL: config: yaml: line 3"}},
+		{"skewed matrix only warns", scaled(), `
+mount_matrix:
+  x: [1, 0.5, 0]
+  y: [0, 1, 0]
+  z: [0, 0, 1]
+`, nil, 0, []string{"WARN: mount_matrix for accel is not orthonormal", "PASS"}},
+		{"disabled gyro is fine without one", axes(map[string]string{"name": "accel_3d", "in_accel_scale": "0.01"}, "accel", [3]int{}),
+			checkIdentity + "enable_gyro: false\n", nil, 0, []string{"Gyro:        (none)", "PASS"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			base := useSysfs(t)
+			if tc.attrs != nil {
+				writeAttrs(t, filepath.Join(base, "iio:device0"), tc.attrs)
+			}
+			cfg := runConfig(t, tc.config+"source: iio\n")
+			var out bytes.Buffer
+			if got := runCheck(&out, &cfg, tc.cfgErr, 100, false, false, false); got != tc.want {
+				t.Errorf("runCheck = %d, want %d\n%s", got, tc.want, out.String())
+			}
+			for _, l := range tc.lines {
+				if !strings.Contains(out.String(), "\n"+l) && !strings.HasPrefix(out.String(), l) {
+					t.Errorf("report lacks %q:\n%s", l, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunCheckOnlyPlansWithoutApply(t *testing.T) {
+	base := useSysfs(t)
+	dev := filepath.Join(base, "iio:device0")
+	writeAttrs(t, dev, axes(axes(map[string]string{
+		"name":                          "bmi323-imu",
+		"in_anglvel_scales_available":   "0.000266 0.000532 0.001065",
+		"in_accel_scales_available":     "0.000598 0.001197 0.002394",
+		"in_anglvel_sampling_frequency": "100",
+		"sampling_frequency_available":  "25 50 100 200 400",
+	}, "anglvel", [3]int{}), "accel", [3]int{}))
+	cfg := runConfig(t, checkIdentity+"source: iio\n")
+
+	var out bytes.Buffer
+	if got := runCheck(&out, &cfg, nil, 200, true, true, false); got != 0 {
+		t.Fatalf("runCheck = %d\n%s", got, out.String())
+	}
+	for _, l := range []string{"in_anglvel_scale=0.000532", "in_accel_scale=0.001197", "in_anglvel_sampling_frequency=200"} {
+		if !strings.Contains(out.String(), "Would set "+dev+" "+l) {
+			t.Errorf("report lacks the planned %s:\n%s", l, out.String())
+		}
+	}
+	if fileExists(filepath.Join(dev, "in_anglvel_scale")) {
+		t.Error("runCheck without apply wrote in_anglvel_scale")
+	}
+	if b, _ := readFloat(filepath.Join(dev, "in_anglvel_sampling_frequency")); b != 100 {
+		t.Errorf("runCheck without apply changed the sampling frequency to %g", b)
+	}
+}
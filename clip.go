@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// clipWarnEvery rate-limits the clipping warnings, per sensor.
+const clipWarnEvery = 10 * time.Second
+
+// clipSensor watches one sensor's raw counts for the channel limit.
+type clipSensor struct {
+	name, hint string
+	full       [3]int64 // largest count per axis; 0 = axis not watched
+	hits       int      // clipped samples since the last warning
+	warned     time.Time
+}
+
+// clipDetector flags samples whose raw counts sit at the largest count the channel can
+// report (channelFullCount): the motion went past the full-scale range the scale implies and
+// the sensor clipped. Only IIO sources are watched.
+type clipDetector struct {
+	gyro, accel clipSensor
+}
+
+func newClipDetector() *clipDetector {
+	return &clipDetector{
+		gyro:  clipSensor{name: "gyro", hint: "a larger in_anglvel_scale (scale_policy: auto-noise picks one that covers fast turns)"},
+		accel: clipSensor{name: "accel", hint: "a larger in_accel_scale"},
+	}
+}
+
+// watch sets the limits of the axes of dev marked in gyro and accel from the channels' bit
+// depth.
+func (c *clipDetector) watch(dev *IIODevice, gyro, accel [3]bool) {
+	for i := range 3 {
+		if gyro[i] && dev.HaveGyro {
+			c.gyro.full[i] = int64(channelFullCount(dev.Base, dev.AngVelChans[i]))
+		}
+		if accel[i] && dev.HaveAccel {
+			c.accel.full[i] = int64(channelFullCount(dev.Base, dev.AccelChans[i]))
+		}
+	}
+}
+
+// Check looks at the raw counts of s, read at now, and warns when a sensor clipped.
+func (c *clipDetector) Check(s IMUSample, now time.Time) {
+	c.gyro.check(s.RawGyro, now)
+	c.accel.check(s.RawAccel, now)
+}
+
+func (c *clipSensor) check(raw [3]int64, now time.Time) {
+	axis := -1
+	for i, v := range raw {
+		// a signed channel bottoms out one count further than it tops out
+		if c.full[i] > 0 && (v >= c.full[i] || v <= -c.full[i]) {
+			axis = i
+		}
+	}
+	if axis < 0 {
+		return
+	}
+	c.hits++
+	if !c.warned.IsZero() && now.Sub(c.warned) < clipWarnEvery {
+		return
+	}
+	count := ""
+	if c.hits > 1 {
+		count = fmt.Sprintf(", %d samples since the last warning", c.hits)
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %s clipping: %c axis at %d, the channel limit%s; consider %s\n",
+		c.name, "xyz"[axis], raw[axis], count, c.hint)
+	c.hits, c.warned = 0, now
+}
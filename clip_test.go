@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClipSensorCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		full [3]int64
+		raw  [3]int64
+		want string // substring of the warning, "" for none
+	}{
+		{"in range", [3]int64{32767, 32767, 32767}, [3]int64{32766, -32766, 0}, ""},
+		{"at the top", [3]int64{32767, 32767, 32767}, [3]int64{0, 32767, 0}, "y axis at 32767"},
+		{"at the negated top", [3]int64{32767, 32767, 32767}, [3]int64{0, 0, -32767}, "z axis at -32767"},
+		{"at the bottom", [3]int64{32767, 32767, 32767}, [3]int64{-32768, 0, 0}, "x axis at -32768"},
+		{"12-bit channel", [3]int64{2047, 2047, 2047}, [3]int64{-2048, 0, 0}, "x axis at -2048"},
+		{"12-bit in range", [3]int64{2047, 2047, 2047}, [3]int64{2046, -2047 + 1, 100}, ""},
+		{"unwatched axis", [3]int64{32767, 0, 32767}, [3]int64{0, 32767, 0}, ""},
+		{"nothing watched", [3]int64{}, [3]int64{32767, -32768, 32767}, ""},
+	} {
+		c := clipSensor{name: "gyro", hint: "a larger scale", full: tc.full}
+		out := captureStderr(t, func() { c.check(tc.raw, time.Unix(1000, 0)) })
+		if (tc.want == "") != (out == "") || !strings.Contains(out, tc.want) {
+			t.Errorf("%s: %q, want %q", tc.name, out, tc.want)
+		}
+		if tc.want != "" && !strings.Contains(out, "gyro clipping") {
+			t.Errorf("%s: %q does not name the sensor", tc.name, out)
+		}
+	}
+}
+
+func TestClipWarningRateLimit(t *testing.T) {
+	c := clipSensor{name: "accel", hint: "a larger in_accel_scale", full: [3]int64{32767, 32767, 32767}}
+	start := time.Unix(1000, 0)
+	clipped := [3]int64{32767, 0, 0}
+	var warnings []string
+	for i := range 25 {
+		now := start.Add(time.Duration(i) * time.Second)
+		raw := clipped
+		if i%2 == 1 {
+			raw = [3]int64{} // only every other second clips
+		}
+		if out := captureStderr(t, func() { c.check(raw, now) }); out != "" {
+			warnings = append(warnings, out)
+		}
+	}
+	// at 0 s, then once 10 s have passed at the next clip: 10 s and 20 s
+	if len(warnings) != 3 {
+		t.Fatalf("%d warnings in 25 s, want 3:\n%s", len(warnings), strings.Join(warnings, ""))
+	}
+	if strings.Contains(warnings[0], "since the last warning") || !strings.Contains(warnings[1], "5 samples since the last warning") {
+		t.Errorf("warnings:\n%s", strings.Join(warnings, ""))
+	}
+}
+
+func TestClipDetectorWatch(t *testing.T) {
+	base := useSysfs(t)
+	// a 12-bit gyro described by its scan elements, and an accel without them (16-bit)
+	attrs := axes(axes(map[string]string{"name": "imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001"},
+		"anglvel", [3]int{2047, -100, 0}), "accel", [3]int{0, 0, -32768})
+	for i, a := range []string{"x", "y", "z"} {
+		attrs[fmt.Sprintf("scan_elements/in_anglvel_%s_type", a)] = "le:s12/16>>0"
+		attrs[fmt.Sprintf("scan_elements/in_anglvel_%s_index", a)] = fmt.Sprint(i)
+	}
+	writeAttrs(t, filepath.Join(base, "iio:device0"), attrs)
+	dev, err := openIIODevice(filepath.Join(base, "iio:device0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClipDetector()
+	c.watch(dev, [3]bool{true, true, true}, [3]bool{true, true, true})
+	if c.gyro.full != [3]int64{2047, 2047, 2047} || c.accel.full != [3]int64{32767, 32767, 32767} {
+		t.Fatalf("limits: gyro %v accel %v", c.gyro.full, c.accel.full)
+	}
+	s, err := dev.readSample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureStderr(t, func() { c.Check(s, time.Unix(1000, 0)) })
+	if !strings.Contains(out, "gyro clipping: x axis at 2047") || !strings.Contains(out, "accel clipping: z axis at -32768") {
+		t.Errorf("warnings:\n%s", out)
+	}
+
+	// only the axes a device provides are watched on it
+	c = newClipDetector()
+	c.watch(dev, [3]bool{true, false, false}, [3]bool{})
+	if c.gyro.full != [3]int64{2047, 0, 0} || c.accel.full != [3]int64{} {
+		t.Errorf("partial watch: gyro %v accel %v", c.gyro.full, c.accel.full)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// controlServer is the optional HTTP API (--control-addr) for live tuning:
+//
+//	GET   /settings            current matrices, sensitivity, deadzone and low-pass cutoffs
+//	PATCH /settings[?persist=1] change any of them; persist also writes them to the config file
+//	GET   /capabilities        same JSON as --capabilities
+//	GET   /pause               {"paused": bool}
+//	PUT   /pause               {"paused": bool} freezes or resumes motion output
+//	GET   /profile             {"profile": name} ("" for the top-level settings)
+//	PUT   /profile             {"profile": name} switches profile
+//	GET   /rotation            {"rotation": degrees}
+//	PUT   /rotation            {"rotation": 0|90|180|270} follows the screen rotation
+//	GET   /history             the last samples sent, oldest first (history_size)
+//	POST  /recenter            turns the fused heading to straight ahead (recenter_ramp_ms)
+//	POST  /recalibrate         re-measures the gyro bias once the device rests (like the button)
+type controlServer struct {
+	mu       sync.Mutex // serializes PATCHes (read-modify-write of the settings)
+	settings *settingsStore
+	cfgPath  string
+	pause    *pauseSwitch
+	profiles *profileSwitcher
+	rotation *screenRotation
+	history  *sampleHistory   // nil when history_size is 0
+	recenter *headingRecenter // nil without a fused orientation
+	servers  []*DSUServer     // the DSU outputs, for the send drops in GET /capabilities
+
+	// recalibrate asks the main loop for a gyro recalibration
+	recalibrate chan<- struct{}
+}
+
+// rotationJSON is the body of GET and PUT /rotation.
+type rotationJSON struct {
+	Rotation *int `json:"rotation"`
+}
+
+// profileJSON is the body of GET and PUT /profile.
+type profileJSON struct {
+	Profile *string `json:"profile"`
+}
+
+// pauseJSON is the body of GET and PUT /pause.
+type pauseJSON struct {
+	Paused *bool `json:"paused"`
+}
+
+// settingsJSON is the wire form of liveSettings. In a PATCH every field is optional.
+type settingsJSON struct {
+	AccelMatrix     *matrixYAML `json:"accel_matrix,omitempty"`
+	GyroMatrix      *matrixYAML `json:"gyro_matrix,omitempty"`
+	GyroSensitivity *float64    `json:"gyro_sensitivity,omitempty"`
+	GyroDeadzone    *float64    `json:"gyro_deadzone,omitempty"`
+	AccelCutoffHz   *float64    `json:"accel_cutoff_hz,omitempty"`
+	GravityCutoffHz *float64    `json:"gravity_cutoff_hz,omitempty"`
+}
+
+func (c *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /settings", c.getSettings)
+	mux.HandleFunc("PATCH /settings", c.patchSettings)
+	mux.HandleFunc("GET /capabilities", c.getCapabilities)
+	mux.HandleFunc("GET /pause", c.getPause)
+	mux.HandleFunc("PUT /pause", c.putPause)
+	mux.HandleFunc("GET /profile", c.getProfile)
+	mux.HandleFunc("PUT /profile", c.putProfile)
+	mux.HandleFunc("GET /rotation", c.getRotation)
+	mux.HandleFunc("PUT /rotation", c.putRotation)
+	mux.HandleFunc("GET /history", c.getHistory)
+	mux.HandleFunc("POST /recenter", c.postRecenter)
+	mux.HandleFunc("POST /recalibrate", c.postRecalibrate)
+	return mux
+}
+
+func (c *controlServer) getProfile(w http.ResponseWriter, r *http.Request) {
+	name := c.profiles.Active()
+	writeJSON(w, http.StatusOK, profileJSON{Profile: &name})
+}
+
+func (c *controlServer) putProfile(w http.ResponseWriter, r *http.Request) {
+	var req profileJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Profile == nil {
+		http.Error(w, `bad request: want {"profile": "name"}`, http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.profiles.Select(*req.Profile, "control API"); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	c.getProfile(w, r)
+}
+
+func (c *controlServer) getPause(w http.ResponseWriter, r *http.Request) {
+	paused := c.pause.Paused()
+	writeJSON(w, http.StatusOK, pauseJSON{Paused: &paused})
+}
+
+func (c *controlServer) putPause(w http.ResponseWriter, r *http.Request) {
+	var req pauseJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Paused == nil {
+		http.Error(w, `bad request: want {"paused": true|false}`, http.StatusBadRequest)
+		return
+	}
+	c.pause.Set(*req.Paused, "control API")
+	c.getPause(w, r)
+}
+
+func (c *controlServer) getRotation(w http.ResponseWriter, r *http.Request) {
+	deg := c.rotation.Degrees()
+	writeJSON(w, http.StatusOK, rotationJSON{Rotation: &deg})
+}
+
+func (c *controlServer) getHistory(w http.ResponseWriter, r *http.Request) {
+	if c.history == nil {
+		http.Error(w, "history is off (history_size: 0)", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.history.Snapshot())
+}
+
+func (c *controlServer) postRecenter(w http.ResponseWriter, r *http.Request) {
+	if c.recenter == nil {
+		http.Error(w, "no fused orientation to recenter (needs --orientation-udp or --debug-orientation)", http.StatusConflict)
+		return
+	}
+	c.recenter.Request("control API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *controlServer) postRecalibrate(w http.ResponseWriter, r *http.Request) {
+	select {
+	case c.recalibrate <- struct{}{}:
+	default: // one is already pending
+	}
+	fmt.Printf("control: gyro recalibration requested\n")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *controlServer) putRotation(w http.ResponseWriter, r *http.Request) {
+	var req rotationJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Rotation == nil {
+		http.Error(w, `bad request: want {"rotation": 0|90|180|270}`, http.StatusBadRequest)
+		return
+	}
+	if err := c.rotation.Set(*req.Rotation, "control API"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.getRotation(w, r)
+}
+
+func (c *controlServer) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	caps := currentCapabilities()
+	if len(c.servers) > 0 {
+		caps.SendDrops = sendDrops(c.servers)
+	}
+	writeJSON(w, http.StatusOK, caps)
+}
+
+func (c *controlServer) getSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, settingsToJSON(c.settings.Load()))
+}
+
+func (c *controlServer) patchSettings(w http.ResponseWriter, r *http.Request) {
+	var req settingsJSON
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := *c.settings.Load()
+	persist := map[string]any{}
+	if req.AccelMatrix != nil {
+		m, ok := parseMatrix(req.AccelMatrix.X, req.AccelMatrix.Y, req.AccelMatrix.Z)
+		if !ok {
+			http.Error(w, "accel_matrix needs x, y and z with 3 values each", http.StatusBadRequest)
+			return
+		}
+		next.AccelMatrix = m
+		persist["accel_matrix"] = *req.AccelMatrix
+	}
+	if req.GyroMatrix != nil {
+		m, ok := parseMatrix(req.GyroMatrix.X, req.GyroMatrix.Y, req.GyroMatrix.Z)
+		if !ok {
+			http.Error(w, "gyro_matrix needs x, y and z with 3 values each", http.StatusBadRequest)
+			return
+		}
+		next.GyroMatrix = m
+		persist["gyro_matrix"] = *req.GyroMatrix
+	}
+	if req.GyroSensitivity != nil {
+		if *req.GyroSensitivity <= 0 {
+			http.Error(w, "gyro_sensitivity must be > 0", http.StatusBadRequest)
+			return
+		}
+		next.GyroSensitivity = *req.GyroSensitivity
+		persist["gyro_sensitivity"] = *req.GyroSensitivity
+	}
+	if req.GyroDeadzone != nil {
+		if *req.GyroDeadzone < 0 {
+			http.Error(w, "gyro_deadzone must be >= 0", http.StatusBadRequest)
+			return
+		}
+		next.GyroDeadzone = *req.GyroDeadzone
+		persist["gyro_deadzone"] = *req.GyroDeadzone
+	}
+	if req.AccelCutoffHz != nil {
+		if *req.AccelCutoffHz < 0 {
+			http.Error(w, "accel_cutoff_hz must be >= 0", http.StatusBadRequest)
+			return
+		}
+		next.AccelCutoffHz = *req.AccelCutoffHz
+		persist["accel_cutoff_hz"] = *req.AccelCutoffHz
+	}
+	if req.GravityCutoffHz != nil {
+		if *req.GravityCutoffHz < 0 {
+			http.Error(w, "gravity_cutoff_hz must be >= 0", http.StatusBadRequest)
+			return
+		}
+		next.GravityCutoffHz = *req.GravityCutoffHz
+		persist["gravity_cutoff_hz"] = *req.GravityCutoffHz
+	}
+
+	if p := r.URL.Query().Get("persist"); p == "1" || p == "true" {
+		if c.cfgPath == "" {
+			http.Error(w, "no config file to persist to", http.StatusConflict)
+			return
+		}
+		if err := updateConfigFile(c.cfgPath, persist); err != nil {
+			http.Error(w, "persist: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	c.settings.Store(&next)
+	fmt.Printf("control: settings updated (%d field(s))\n", len(persist))
+	writeJSON(w, http.StatusOK, settingsToJSON(&next))
+}
+
+func settingsToJSON(ls *liveSettings) settingsJSON {
+	am, gm := toMatrixYAML(ls.AccelMatrix), toMatrixYAML(ls.GyroMatrix)
+	sens, dz := ls.GyroSensitivity, ls.GyroDeadzone
+	accelHz, gravityHz := ls.AccelCutoffHz, ls.GravityCutoffHz
+	return settingsJSON{AccelMatrix: &am, GyroMatrix: &gm, GyroSensitivity: &sens, GyroDeadzone: &dz,
+		AccelCutoffHz: &accelHz, GravityCutoffHz: &gravityHz}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// startControlServer serves the control API on addr in the background.
+func startControlServer(addr string, c *controlServer) (string, error) {
+	listen, public, err := listenAddr(addr, "")
+	if err != nil {
+		return "", err
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return "", err
+	}
+	if public {
+		fmt.Fprintf(os.Stderr, "WARNING: control API on %s is reachable from the network and has no authentication\n", listen)
+	}
+	go func() {
+		if err := http.Serve(ln, c.handler()); err != nil && !errors.Is(err, net.ErrClosed) {
+			fmt.Fprintf(os.Stderr, "control: %v\n", err)
+		}
+	}()
+	return ln.Addr().String(), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestControl returns a control API over identity settings and the channel its
+// recalibration requests go to.
+func newTestControl(t *testing.T) (*controlServer, http.Handler, chan struct{}) {
+	t.Helper()
+	store := &settingsStore{}
+	store.Store(&liveSettings{
+		AccelMatrix: identityMatrix, GyroMatrix: identityMatrix,
+		AccelCorrection: identityMatrix, GyroCorrection: identityMatrix,
+		GyroSensitivity: 1, GyroAxisScale: Vec3{1, 1, 1}, AccelAxisScale: Vec3{1, 1, 1},
+		GravityCutoffHz: defaultGravityCutoffHz,
+	})
+	recal := make(chan struct{}, 1)
+	c := &controlServer{settings: store, recalibrate: recal}
+	return c, c.handler(), recal
+}
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestControlPatchSettings(t *testing.T) {
+	c, h, _ := newTestControl(t)
+	rec := serve(h, "PATCH", "/settings", `{"gyro_sensitivity": 1.5, "gyro_deadzone": 0.2, "accel_cutoff_hz": 20, "gravity_cutoff_hz": 0,
+		"gyro_matrix": {"x": [0, 1, 0], "y": [1, 0, 0], "z": [0, 0, -1]}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /settings: %d %s", rec.Code, rec.Body)
+	}
+	ls := c.settings.Load()
+	if ls.GyroSensitivity != 1.5 || ls.GyroDeadzone != 0.2 || ls.AccelCutoffHz != 20 || ls.GravityCutoffHz != 0 {
+		t.Errorf("settings not applied: %+v", ls)
+	}
+	if want := (MountMatrix{X: Vec3{Y: 1}, Y: Vec3{X: 1}, Z: Vec3{Z: -1}}); ls.GyroMatrix != want {
+		t.Errorf("gyro matrix = %+v, want %+v", ls.GyroMatrix, want)
+	}
+	if ls.AccelMatrix != identityMatrix {
+		t.Errorf("accel matrix changed to %+v by a PATCH that did not name it", ls.AccelMatrix)
+	}
+
+	// GET returns what the PATCH stored
+	var got settingsJSON
+	rec = serve(h, "GET", "/settings", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if *got.GyroSensitivity != 1.5 || *got.AccelCutoffHz != 20 || *got.GravityCutoffHz != 0 {
+		t.Errorf("GET /settings = %s", rec.Body)
+	}
+}
+
+func TestControlPatchSettingsRejects(t *testing.T) {
+	for _, body := range []string{
+		`{"gyro_sensitivity": 0}`,
+		`{"gyro_deadzone": -1}`,
+		`{"accel_cutoff_hz": -5}`,
+		`{"gravity_cutoff_hz": -0.1}`,
+		`{"accel_matrix": {"x": [1, 0], "y": [0, 1, 0], "z": [0, 0, 1]}}`,
+		`{"gyro_sensitivty": 2}`,
+		`not json`,
+		// a bad field rejects the whole PATCH, including the good ones before it
+		`{"gyro_sensitivity": 2, "accel_cutoff_hz": -1}`,
+	} {
+		c, h, _ := newTestControl(t)
+		before := *c.settings.Load()
+		if rec := serve(h, "PATCH", "/settings", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: got %d, want 400", body, rec.Code)
+		}
+		if after := *c.settings.Load(); after != before {
+			t.Errorf("PATCH %s changed the settings to %+v", body, after)
+		}
+	}
+}
+
+func TestControlPatchSettingsPersist(t *testing.T) {
+	c, h, _ := newTestControl(t)
+	if rec := serve(h, "PATCH", "/settings?persist=1", `{"gyro_deadzone": 0.5}`); rec.Code != http.StatusConflict {
+		t.Errorf("persist without a config file: got %d, want 409", rec.Code)
+	}
+
+	c.cfgPath = filepath.Join(t.TempDir(), configFileName)
+	writeAttrs(t, filepath.Dir(c.cfgPath), map[string]string{configFileName: "# tuned by hand\nname: bmi323\n"})
+	if rec := serve(h, "PATCH", "/settings?persist=1", `{"gravity_cutoff_hz": 1.5}`); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH with persist: %d %s", rec.Code, rec.Body)
+	}
+	b, err := os.ReadFile(c.cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	if err := cfg.mergeYAML(b, c.cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GravityCutoffHz == nil || *cfg.GravityCutoffHz != 1.5 || cfg.Name != "bmi323" {
+		t.Errorf("persisted config:\n%s", b)
+	}
+	if !strings.Contains(string(b), "# tuned by hand") {
+		t.Errorf("persisting dropped the comments:\n%s", b)
+	}
+}
+
+func TestControlRecalibrate(t *testing.T) {
+	_, h, recal := newTestControl(t)
+	if rec := serve(h, "POST", "/recalibrate", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /recalibrate: got %d, want 202", rec.Code)
+	}
+	// a second request while one is pending does not block
+	if rec := serve(h, "POST", "/recalibrate", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("second POST /recalibrate: got %d, want 202", rec.Code)
+	}
+	select {
+	case <-recal:
+	default:
+		t.Fatal("no recalibration requested")
+	}
+	if rec := serve(h, "GET", "/recalibrate", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /recalibrate: got %d, want 405", rec.Code)
+	}
+}
+
+func TestControlOptionalFeatures(t *testing.T) {
+	_, h, _ := newTestControl(t)
+	if rec := serve(h, "POST", "/recenter", ""); rec.Code != http.StatusConflict {
+		t.Errorf("POST /recenter without fusion: got %d, want 409", rec.Code)
+	}
+	if rec := serve(h, "GET", "/history", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /history with history off: got %d, want 404", rec.Code)
+	}
+}
+
+func TestVecLowPassSetCutoff(t *testing.T) {
+	f := newVecLowPass(1)
+	f.Update(Vec3{}, 1_000_000)
+	if v := f.Update(Vec3{X: 1}, 1_010_000); v.X <= 0 || v.X >= 0.5 {
+		t.Fatalf("1 Hz low-pass after 10 ms = %v", v.X)
+	}
+	// turning the filter off passes samples through from the next one on
+	f.SetCutoff(0)
+	if v := f.Update(Vec3{X: 2}, 1_020_000); v.X != 2 {
+		t.Errorf("unfiltered = %v, want 2", v.X)
+	}
+	// turning it back on continues from the last value instead of jumping
+	f.SetCutoff(1)
+	if v := f.Update(Vec3{X: 3}, 1_030_000); v.X <= 2 || v.X >= 2.5 {
+		t.Errorf("refiltered = %v, want just above 2", v.X)
+	}
+}
+
+func TestCapabilitiesMatchRegistries(t *testing.T) {
+	old := devicePresets
+	devicePresets = map[string]*Config{"steamdeck": {}, "legion-go": {}}
+	defer func() { devicePresets = old }()
+
+	_, h, _ := newTestControl(t)
+	rec := serve(h, "GET", "/capabilities", "")
+	var got capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /capabilities: %v\n%s", err, rec.Body)
+	}
+	if got.ConfigSchema != configSchemaVersion {
+		t.Errorf("config_schema = %d, want %d", got.ConfigSchema, configSchemaVersion)
+	}
+	if !slices.Equal(got.Presets, []string{"legion-go", "steamdeck"}) {
+		t.Errorf("presets = %v, want the registered ones, sorted", got.Presets)
+	}
+	if !slices.Equal(got.Outputs, outputBackends) || !slices.Equal(got.Sources, sampleSources) || !slices.Equal(got.Filters, orientationFilters) {
+		t.Errorf("outputs %v, sources %v, filters %v do not match the registries", got.Outputs, got.Sources, got.Filters)
+	}
+	if len(got.ScalePolicies) != len(scalePolicies) {
+		t.Errorf("scale_policies = %v, want %d", got.ScalePolicies, len(scalePolicies))
+	}
+	for _, p := range got.ScalePolicies {
+		if _, ok := scalePolicies[p]; !ok {
+			t.Errorf("scale policy %q is listed but not registered", p)
+		}
+	}
+
+	// no presets is an empty list, not null
+	devicePresets = map[string]*Config{}
+	rec = serve(h, "GET", "/capabilities", "")
+	if !strings.Contains(rec.Body.String(), `"presets":[]`) {
+		t.Errorf("without presets: %s", rec.Body)
+	}
+}
+
+func TestCapabilitiesSendDrops(t *testing.T) {
+	c, h, _ := newTestControl(t)
+	if rec := serve(h, "GET", "/capabilities", ""); strings.Contains(rec.Body.String(), "send_drops") {
+		t.Errorf("send_drops without DSU outputs: %s", rec.Body)
+	}
+	// two outputs, with a client that lost packets on both
+	var servers []*DSUServer
+	for _, n := range []uint64{2, 5} {
+		srv, err := NewDSUServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.mu.Lock()
+		srv.sendDrops["192.168.1.20:51000"] = n
+		srv.mu.Unlock()
+		servers = append(servers, srv)
+	}
+	servers[1].mu.Lock()
+	servers[1].sendDrops["192.168.1.21:40000"] = 0
+	servers[1].mu.Unlock()
+	c.servers = servers
+
+	var got capabilities
+	rec := serve(h, "GET", "/capabilities", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /capabilities: %v\n%s", err, rec.Body)
+	}
+	if len(got.SendDrops) != 2 || got.SendDrops["192.168.1.20:51000"] != 7 || got.SendDrops["192.168.1.21:40000"] != 0 {
+		t.Errorf("send_drops = %v, want 7 and 0", got.SendDrops)
+	}
+	// --capabilities describes the binary, not a running bridge
+	if currentCapabilities().SendDrops != nil {
+		t.Error("--capabilities has send_drops")
+	}
+}
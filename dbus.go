@@ -0,0 +1,833 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// D-Bus service (--dbus): the same live settings as the HTTP control API, for desktop tools
+// that talk D-Bus. Only the parts of the protocol a session-bus service needs are implemented:
+// EXTERNAL auth, and marshalling of the basic types, arrays, dicts and variants.
+const (
+	dbusName  = "io.github.Sebalvarez97.IioDsuBridge"
+	dbusPath  = "/io/github/Sebalvarez97/IioDsuBridge"
+	dbusIface = dbusName
+)
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+ <interface name="` + dbusIface + `">
+  <method name="ReloadConfig"/>
+  <method name="Recalibrate"/>
+  <method name="Recenter"/>
+  <method name="SetSensitivity"><arg name="sensitivity" type="d" direction="in"/></method>
+  <method name="SetDeadzone"><arg name="deadzone" type="d" direction="in"/></method>
+  <method name="SelectProfile"><arg name="name" type="s" direction="in"/></method>
+  <property name="Device" type="s" access="read"/>
+  <property name="DeviceLabel" type="s" access="read"/>
+  <property name="Rate" type="i" access="read"/>
+  <property name="AccelMatrix" type="ad" access="read"/>
+  <property name="GyroMatrix" type="ad" access="read"/>
+  <property name="GyroSensitivity" type="d" access="read"/>
+  <property name="GyroDeadzone" type="d" access="read"/>
+  <property name="Profile" type="s" access="read"/>
+ </interface>
+ <interface name="org.freedesktop.DBus.Properties">
+  <method name="Get"><arg type="s" direction="in"/><arg type="s" direction="in"/><arg type="v" direction="out"/></method>
+  <method name="GetAll"><arg type="s" direction="in"/><arg type="a{sv}" direction="out"/></method>
+ </interface>
+ <interface name="org.freedesktop.DBus.Introspectable">
+  <method name="Introspect"><arg type="s" direction="out"/></method>
+ </interface>
+</node>
+`
+
+// dbusService answers method calls on dbusPath.
+type dbusService struct {
+	mu       sync.Mutex // serializes setting changes, like controlServer.mu
+	settings *settingsStore
+	cfgPath  string
+	profiles *profileSwitcher
+	device   string
+	label    string // deviceLabel of the IIO device, or the evdev name
+	rate     int
+
+	// the same hooks as POST /recenter and POST /recalibrate
+	recenter    *headingRecenter // nil without a fused orientation
+	recalibrate chan<- struct{}
+}
+
+// dbusError is returned to the caller as a D-Bus error reply.
+type dbusError struct{ Name, Msg string }
+
+func (e *dbusError) Error() string { return e.Name + ": " + e.Msg }
+
+func dbusErr(name, format string, a ...any) *dbusError {
+	return &dbusError{Name: name, Msg: fmt.Sprintf(format, a...)}
+}
+
+// dbusVariant is a value of D-Bus type v.
+type dbusVariant struct {
+	Sig   string
+	Value any
+}
+
+// properties returns the exported properties as variants.
+func (d *dbusService) properties() map[string]dbusVariant {
+	ls := d.settings.Load()
+	flat := func(m MountMatrix) []float64 {
+		return []float64{m.X.X, m.X.Y, m.X.Z, m.Y.X, m.Y.Y, m.Y.Z, m.Z.X, m.Z.Y, m.Z.Z}
+	}
+	return map[string]dbusVariant{
+		"Device":          {"s", d.device},
+		"DeviceLabel":     {"s", d.label},
+		"Rate":            {"i", int32(d.rate)},
+		"AccelMatrix":     {"ad", flat(ls.AccelMatrix)},
+		"GyroMatrix":      {"ad", flat(ls.GyroMatrix)},
+		"GyroSensitivity": {"d", ls.GyroSensitivity},
+		"GyroDeadzone":    {"d", ls.GyroDeadzone},
+		"Profile":         {"s", d.profiles.Active()},
+	}
+}
+
+// dispatch runs one method call and returns the reply's signature and arguments.
+func (d *dbusService) dispatch(iface, member string, args []any) (string, []any, error) {
+	switch iface + "." + member {
+	case "org.freedesktop.DBus.Peer.Ping":
+		return "", nil, nil
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		return "s", []any{dbusIntrospection}, nil
+	case "org.freedesktop.DBus.Properties.Get":
+		if len(args) != 2 {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.InvalidArgs", "Get takes (ss)")
+		}
+		name, _ := args[1].(string)
+		v, ok := d.properties()[name]
+		if args[0] != dbusIface || !ok {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.UnknownProperty", "no property %v.%s", args[0], name)
+		}
+		return "v", []any{v}, nil
+	case "org.freedesktop.DBus.Properties.GetAll":
+		if len(args) != 1 {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.InvalidArgs", "GetAll takes (s)")
+		}
+		if args[0] != dbusIface {
+			return "a{sv}", []any{map[string]dbusVariant{}}, nil
+		}
+		return "a{sv}", []any{d.properties()}, nil
+	case "org.freedesktop.DBus.Properties.Set":
+		return "", nil, dbusErr("org.freedesktop.DBus.Error.PropertyReadOnly", "properties are read-only; use the Set* methods")
+	case dbusIface + ".ReloadConfig":
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := d.profiles.Reload(); err != nil {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.Failed", "%v", err)
+		}
+		fmt.Printf("dbus: reloaded settings from %s\n", d.cfgPath)
+		return "", nil, nil
+	case dbusIface + ".Recalibrate":
+		select {
+		case d.recalibrate <- struct{}{}:
+		default: // one is already pending
+		}
+		fmt.Printf("dbus: gyro recalibration requested\n")
+		return "", nil, nil
+	case dbusIface + ".Recenter":
+		if d.recenter == nil {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.Failed", "no fused orientation to recenter (needs --orientation-udp or --debug-orientation)")
+		}
+		d.recenter.Request("dbus")
+		return "", nil, nil
+	case dbusIface + ".SelectProfile":
+		name, ok := "", len(args) == 1
+		if ok {
+			name, ok = args[0].(string)
+		}
+		if !ok {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.InvalidArgs", "SelectProfile takes (s)")
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := d.profiles.Select(name, "dbus"); err != nil {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.Failed", "%v", err)
+		}
+		return "", nil, nil
+	case dbusIface + ".SetSensitivity", dbusIface + ".SetDeadzone":
+		v, ok := dbusSingleDouble(args)
+		if !ok {
+			return "", nil, dbusErr("org.freedesktop.DBus.Error.InvalidArgs", "%s takes (d)", member)
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		next := *d.settings.Load()
+		if member == "SetSensitivity" {
+			if v <= 0 {
+				return "", nil, dbusErr("org.freedesktop.DBus.Error.InvalidArgs", "gyro_sensitivity must be > 0")
+			}
+			next.GyroSensitivity = v
+		} else {
+			if v < 0 {
+				return "", nil, dbusErr("org.freedesktop.DBus.Error.InvalidArgs", "gyro_deadzone must be >= 0")
+			}
+			next.GyroDeadzone = v
+		}
+		d.settings.Store(&next)
+		fmt.Printf("dbus: %s(%g)\n", member, v)
+		return "", nil, nil
+	}
+	return "", nil, dbusErr("org.freedesktop.DBus.Error.UnknownMethod", "no method %s.%s", iface, member)
+}
+
+func dbusSingleDouble(args []any) (float64, bool) {
+	if len(args) != 1 {
+		return 0, false
+	}
+	v, ok := args[0].(float64)
+	return v, ok
+}
+
+// ---------- bus connection ----------
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusErrorMsg     = 3
+
+	dbusNoReplyExpected = 0x1
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSender      = 7
+	dbusFieldSignature   = 8
+)
+
+// dbusMessage is a decoded message; Fields maps header field codes to their values.
+type dbusMessage struct {
+	Type   byte
+	Flags  byte
+	Serial uint32
+	Fields map[byte]any
+	Body   []any
+}
+
+func (m *dbusMessage) str(code byte) string {
+	s, _ := m.Fields[code].(string)
+	return s
+}
+
+type dbusConn struct {
+	c      net.Conn
+	r      *bufio.Reader
+	serial uint32
+}
+
+// sessionBusAddress returns the unix socket of the session bus.
+func sessionBusAddress() (network, addr string, err error) {
+	env := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if env == "" {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			return "unix", filepath.Join(dir, "bus"), nil
+		}
+		return "", "", errors.New("DBUS_SESSION_BUS_ADDRESS is not set")
+	}
+	for _, a := range strings.Split(env, ";") {
+		rest, ok := strings.CutPrefix(a, "unix:")
+		if !ok {
+			continue
+		}
+		for _, kv := range strings.Split(rest, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			switch k {
+			case "path":
+				return "unix", v, nil
+			case "abstract":
+				return "unix", "@" + v, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no unix transport in %q", env)
+}
+
+// dialSessionBus connects and authenticates to the session bus and says Hello.
+func dialSessionBus() (*dbusConn, error) {
+	network, addr, err := sessionBusAddress()
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &dbusConn{c: c, r: bufio.NewReader(c)}
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(c, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	line, err := conn.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "OK ") {
+		c.Close()
+		return nil, fmt.Errorf("auth rejected: %q", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(c, "BEGIN\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := conn.call("Hello", ""); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// call invokes a bus daemon method and waits for its reply, dropping anything else.
+func (c *dbusConn) call(member, sig string, args ...any) (*dbusMessage, error) {
+	serial, err := c.send(dbusMethodCall, 0, map[byte]any{
+		dbusFieldPath:        dbusObjectPath("/org/freedesktop/DBus"),
+		dbusFieldInterface:   "org.freedesktop.DBus",
+		dbusFieldMember:      member,
+		dbusFieldDestination: "org.freedesktop.DBus",
+	}, sig, args)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if rs, _ := m.Fields[dbusFieldReplySerial].(uint32); rs != serial {
+			continue
+		}
+		if m.Type == dbusErrorMsg {
+			return nil, fmt.Errorf("%s: %s %v", member, m.str(dbusFieldErrorName), m.Body)
+		}
+		return m, nil
+	}
+}
+
+// dbusObjectPath and dbusSignature mark strings of type o and g.
+type (
+	dbusObjectPath string
+	dbusSignature  string
+)
+
+func (c *dbusConn) send(typ, flags byte, fields map[byte]any, sig string, body []any) (uint32, error) {
+	var b dbusEncoder
+	types, err := dbusSplitSig(sig)
+	if err != nil {
+		return 0, err
+	}
+	if len(types) != len(body) {
+		return 0, fmt.Errorf("dbus: %d values for signature %q", len(body), sig)
+	}
+	for i, t := range types {
+		if err := b.value(t, body[i]); err != nil {
+			return 0, err
+		}
+	}
+	if sig != "" {
+		fields[dbusFieldSignature] = dbusSignature(sig)
+	}
+	c.serial++
+	var h dbusEncoder
+	h.b = append(h.b, 'l', typ, flags, 1)
+	h.u32(uint32(len(b.b)))
+	h.u32(c.serial)
+	codes := make([]int, 0, len(fields))
+	for k := range fields {
+		codes = append(codes, int(k))
+	}
+	sort.Ints(codes)
+	hf := make([]any, 0, len(codes))
+	for _, k := range codes {
+		v := fields[byte(k)]
+		hf = append(hf, []any{byte(k), dbusVariant{dbusSigOf(v), v}})
+	}
+	if err := h.value("a(yv)", hf); err != nil {
+		return 0, err
+	}
+	h.align(8)
+	_, err = c.c.Write(append(h.b, b.b...))
+	return c.serial, err
+}
+
+func (c *dbusConn) read() (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if fixed[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	hdrLen := (16 + int(fieldsLen) + 7) &^ 7
+	if fieldsLen > 1<<26 || bodyLen > 1<<27 {
+		return nil, errors.New("dbus: message too large")
+	}
+	msg := make([]byte, hdrLen+int(bodyLen))
+	copy(msg, fixed)
+	if _, err := io.ReadFull(c.r, msg[16:]); err != nil {
+		return nil, err
+	}
+	m := &dbusMessage{Type: fixed[1], Flags: fixed[2], Serial: order.Uint32(fixed[8:]), Fields: map[byte]any{}}
+	d := &dbusDecoder{b: msg, pos: 12, order: order}
+	hf, err := d.value("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range hf.([]any) {
+		st := f.([]any)
+		m.Fields[st[0].(byte)] = st[1].(dbusVariant).Value
+	}
+	d.pos = hdrLen
+	sig, _ := m.Fields[dbusFieldSignature].(string)
+	types, err := dbusSplitSig(sig)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		v, err := d.value(t)
+		if err != nil {
+			return nil, err
+		}
+		m.Body = append(m.Body, v)
+	}
+	return m, nil
+}
+
+// startDBusService claims dbusName on the session bus and serves d in the background.
+func startDBusService(d *dbusService) error {
+	c, err := dialSessionBus()
+	if err != nil {
+		return err
+	}
+	reply, err := c.call("RequestName", "su", dbusName, uint32(4)) // DBUS_NAME_FLAG_DO_NOT_QUEUE
+	if err != nil {
+		c.c.Close()
+		return err
+	}
+	if len(reply.Body) != 1 || reply.Body[0] != uint32(1) { // PRIMARY_OWNER
+		c.c.Close()
+		return fmt.Errorf("%s is already taken (another bridge running?)", dbusName)
+	}
+	go func() {
+		for {
+			m, err := c.read()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "dbus: %v\n", err)
+				return
+			}
+			if m.Type != dbusMethodCall || m.Flags&dbusNoReplyExpected != 0 {
+				continue
+			}
+			reply := map[byte]any{dbusFieldReplySerial: m.Serial}
+			if s := m.str(dbusFieldSender); s != "" {
+				reply[dbusFieldDestination] = s
+			}
+			sig, out, err := "", []any(nil), error(nil)
+			if m.str(dbusFieldPath) != dbusPath {
+				err = dbusErr("org.freedesktop.DBus.Error.UnknownObject", "no object %s", m.str(dbusFieldPath))
+			} else {
+				sig, out, err = d.dispatch(m.str(dbusFieldInterface), m.str(dbusFieldMember), m.Body)
+			}
+			typ := byte(dbusMethodReturn)
+			if err != nil {
+				var de *dbusError
+				if !errors.As(err, &de) {
+					de = dbusErr("org.freedesktop.DBus.Error.Failed", "%v", err)
+				}
+				typ, sig, out = dbusErrorMsg, "s", []any{de.Msg}
+				reply[dbusFieldErrorName] = de.Name
+			}
+			if _, err := c.send(typ, 0, reply, sig, out); err != nil {
+				fmt.Fprintf(os.Stderr, "dbus: %v\n", err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// ---------- marshalling ----------
+
+// dbusSigOf returns the D-Bus signature for the Go values the service sends.
+func dbusSigOf(v any) string {
+	switch v.(type) {
+	case byte:
+		return "y"
+	case bool:
+		return "b"
+	case int32:
+		return "i"
+	case uint32:
+		return "u"
+	case float64:
+		return "d"
+	case string:
+		return "s"
+	case dbusObjectPath:
+		return "o"
+	case dbusSignature:
+		return "g"
+	case dbusVariant:
+		return "v"
+	}
+	return ""
+}
+
+// dbusSplitSig splits a signature into its complete types.
+func dbusSplitSig(sig string) ([]string, error) {
+	var out []string
+	for sig != "" {
+		n, err := dbusTypeLen(sig)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sig[:n])
+		sig = sig[n:]
+	}
+	return out, nil
+}
+
+// dbusTypeLen returns the length of the first complete type in sig. An array without an
+// element type, an empty or unclosed struct, and a stray closing bracket are errors.
+func dbusTypeLen(sig string) (int, error) {
+	if sig == "" {
+		return 0, errors.New("dbus: missing type in signature")
+	}
+	switch sig[0] {
+	case 'a':
+		n, err := dbusTypeLen(sig[1:])
+		if err != nil {
+			return 0, fmt.Errorf("dbus: bad array signature %q", sig)
+		}
+		return 1 + n, nil
+	case '(', '{':
+		depth := 0
+		for i := 0; i < len(sig); i++ {
+			switch sig[i] {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+				if depth == 0 {
+					if i == 1 {
+						return 0, fmt.Errorf("dbus: empty struct in signature %q", sig)
+					}
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("dbus: unclosed %q in signature %q", sig[0], sig)
+	case ')', '}':
+		return 0, fmt.Errorf("dbus: unexpected %q in signature %q", sig[0], sig)
+	}
+	return 1, nil
+}
+
+// dbusCompleteType checks that t is exactly one complete type.
+func dbusCompleteType(t string) error {
+	n, err := dbusTypeLen(t)
+	if err != nil {
+		return err
+	}
+	if n != len(t) {
+		return fmt.Errorf("dbus: %q is not a single complete type", t)
+	}
+	return nil
+}
+
+func dbusAlign(t byte) int {
+	switch t {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 4
+}
+
+type dbusEncoder struct{ b []byte }
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *dbusEncoder) u32(v uint32) {
+	e.align(4)
+	e.b = binary.LittleEndian.AppendUint32(e.b, v)
+}
+
+// value encodes v as the single complete type t.
+func (e *dbusEncoder) value(t string, v any) error {
+	if err := dbusCompleteType(t); err != nil {
+		return err
+	}
+	bad := fmt.Errorf("dbus: cannot encode %T as %s", v, t)
+	e.align(dbusAlign(t[0]))
+	switch t[0] {
+	case 'y':
+		x, ok := v.(byte)
+		if !ok {
+			return bad
+		}
+		e.b = append(e.b, x)
+	case 'b':
+		x, ok := v.(bool)
+		if !ok {
+			return bad
+		}
+		if x {
+			e.u32(1)
+		} else {
+			e.u32(0)
+		}
+	case 'i':
+		x, ok := v.(int32)
+		if !ok {
+			return bad
+		}
+		e.u32(uint32(x))
+	case 'u':
+		x, ok := v.(uint32)
+		if !ok {
+			return bad
+		}
+		e.u32(x)
+	case 'd':
+		x, ok := v.(float64)
+		if !ok {
+			return bad
+		}
+		e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(x))
+	case 's', 'o':
+		s := fmt.Sprint(v)
+		e.u32(uint32(len(s)))
+		e.b = append(append(e.b, s...), 0)
+	case 'g':
+		s := fmt.Sprint(v)
+		e.b = append(append(e.b, byte(len(s))), s...)
+		e.b = append(e.b, 0)
+	case 'v':
+		x, ok := v.(dbusVariant)
+		if !ok {
+			return bad
+		}
+		if err := e.value("g", x.Sig); err != nil {
+			return err
+		}
+		return e.value(x.Sig, x.Value)
+	case '(':
+		x, ok := v.([]any)
+		fields, err := dbusSplitSig(t[1 : len(t)-1])
+		if err != nil {
+			return err
+		}
+		if !ok || len(x) != len(fields) {
+			return bad
+		}
+		for i, ft := range fields {
+			if err := e.value(ft, x[i]); err != nil {
+				return err
+			}
+		}
+	case 'a':
+		e.u32(0)
+		lenAt := len(e.b) - 4
+		elem := t[1:]
+		e.align(dbusAlign(elem[0]))
+		start := len(e.b)
+		switch x := v.(type) {
+		case []float64:
+			for _, f := range x {
+				if err := e.value(elem, f); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for _, it := range x {
+				if err := e.value(elem, it); err != nil {
+					return err
+				}
+			}
+		case map[string]dbusVariant:
+			if elem != "{sv}" {
+				return bad
+			}
+			for _, k := range slices.Sorted(maps.Keys(x)) {
+				e.align(8)
+				e.value("s", k)
+				if err := e.value("v", x[k]); err != nil {
+					return err
+				}
+			}
+		default:
+			return bad
+		}
+		binary.LittleEndian.PutUint32(e.b[lenAt:], uint32(len(e.b)-start))
+	default:
+		return bad
+	}
+	return nil
+}
+
+type dbusDecoder struct {
+	b     []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *dbusDecoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.b) {
+		return nil, errors.New("dbus: short message")
+	}
+	p := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return p, nil
+}
+
+// value decodes one complete type t. Structs and dict entries come back as []any, arrays as
+// []any, variants as dbusVariant, and o/g as plain strings.
+func (d *dbusDecoder) value(t string) (any, error) {
+	if err := dbusCompleteType(t); err != nil {
+		return nil, err
+	}
+	a := dbusAlign(t[0])
+	d.pos = (d.pos + a - 1) / a * a
+	switch t[0] {
+	case 'y':
+		p, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return p[0], nil
+	case 'n', 'q':
+		p, err := d.take(2)
+		if err != nil {
+			return nil, err
+		}
+		if t[0] == 'n' {
+			return int16(d.order.Uint16(p)), nil
+		}
+		return d.order.Uint16(p), nil
+	case 'b', 'i', 'u', 'h':
+		p, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint32(p)
+		switch t[0] {
+		case 'b':
+			return v != 0, nil
+		case 'i':
+			return int32(v), nil
+		}
+		return v, nil
+	case 'x', 't', 'd':
+		p, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(p)
+		switch t[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 's', 'o':
+		p, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(d.order.Uint32(p)) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'g':
+		p, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(p[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'v':
+		sig, err := d.value("g")
+		if err != nil {
+			return nil, err
+		}
+		s := sig.(string)
+		if err := dbusCompleteType(s); err != nil {
+			return nil, fmt.Errorf("dbus: bad variant signature %q", s)
+		}
+		v, err := d.value(s)
+		return dbusVariant{s, v}, err
+	case '(', '{':
+		fields, err := dbusSplitSig(t[1 : len(t)-1])
+		if err != nil {
+			return nil, err
+		}
+		var out []any
+		for _, ft := range fields {
+			v, err := d.value(ft)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case 'a':
+		p, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		n := int(d.order.Uint32(p))
+		ea := dbusAlign(t[1])
+		d.pos = (d.pos + ea - 1) / ea * ea
+		end := d.pos + n
+		if end > len(d.b) {
+			return nil, errors.New("dbus: short message")
+		}
+		out := []any{}
+		for d.pos < end {
+			v, err := d.value(t[1:])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("dbus: unsupported type %q", t)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestDBus returns a service over identity settings, with a recenter hook and the channel
+// its recalibration requests go to.
+func newTestDBus(t *testing.T) (*dbusService, chan struct{}) {
+	t.Helper()
+	c, _, recal := newTestControl(t)
+	d := &dbusService{
+		settings: c.settings, profiles: &profileSwitcher{settings: c.settings},
+		device: "/sys/bus/iio/devices/iio:device0", label: "accel-display", rate: 250,
+		recenter: newHeadingRecenter(0), recalibrate: recal,
+	}
+	return d, recal
+}
+
+func TestDBusDispatch(t *testing.T) {
+	for _, tc := range []struct {
+		iface, member string
+		args          []any
+		wantSig       string
+		wantErr       string // D-Bus error name, "" for success
+	}{
+		{"org.freedesktop.DBus.Peer", "Ping", nil, "", ""},
+		{"org.freedesktop.DBus.Introspectable", "Introspect", nil, "s", ""},
+		{"org.freedesktop.DBus.Properties", "Get", []any{dbusIface, "Rate"}, "v", ""},
+		{"org.freedesktop.DBus.Properties", "Get", []any{dbusIface, "Nope"}, "", "org.freedesktop.DBus.Error.UnknownProperty"},
+		{"org.freedesktop.DBus.Properties", "Get", []any{"org.example.Other", "Rate"}, "", "org.freedesktop.DBus.Error.UnknownProperty"},
+		{"org.freedesktop.DBus.Properties", "Get", []any{dbusIface}, "", "org.freedesktop.DBus.Error.InvalidArgs"},
+		{"org.freedesktop.DBus.Properties", "GetAll", []any{dbusIface}, "a{sv}", ""},
+		{"org.freedesktop.DBus.Properties", "Set", []any{dbusIface, "Rate", dbusVariant{"i", int32(1)}}, "", "org.freedesktop.DBus.Error.PropertyReadOnly"},
+		{dbusIface, "SetSensitivity", []any{1.5}, "", ""},
+		{dbusIface, "SetSensitivity", []any{0.0}, "", "org.freedesktop.DBus.Error.InvalidArgs"},
+		{dbusIface, "SetSensitivity", []any{"1.5"}, "", "org.freedesktop.DBus.Error.InvalidArgs"},
+		{dbusIface, "SetDeadzone", []any{-1.0}, "", "org.freedesktop.DBus.Error.InvalidArgs"},
+		{dbusIface, "SetDeadzone", nil, "", "org.freedesktop.DBus.Error.InvalidArgs"},
+		{dbusIface, "SelectProfile", []any{int32(1)}, "", "org.freedesktop.DBus.Error.InvalidArgs"},
+		{dbusIface, "ReloadConfig", nil, "", "org.freedesktop.DBus.Error.Failed"}, // no config file
+		{dbusIface, "Recalibrate", nil, "", ""},
+		{dbusIface, "Recenter", nil, "", ""},
+		{dbusIface, "Shutdown", nil, "", "org.freedesktop.DBus.Error.UnknownMethod"},
+	} {
+		d, _ := newTestDBus(t)
+		sig, out, err := d.dispatch(tc.iface, tc.member, tc.args)
+		name := ""
+		if err != nil {
+			var de *dbusError
+			if !errors.As(err, &de) {
+				t.Errorf("%s.%s: error %v is not a D-Bus error", tc.iface, tc.member, err)
+				continue
+			}
+			name = de.Name
+		}
+		if name != tc.wantErr || sig != tc.wantSig {
+			t.Errorf("%s.%s%v = %q, %v; want signature %q, error %q", tc.iface, tc.member, tc.args, sig, err, tc.wantSig, tc.wantErr)
+		}
+		if types, _ := dbusSplitSig(sig); err == nil && len(types) != len(out) {
+			t.Errorf("%s.%s: %d values for signature %q", tc.iface, tc.member, len(out), sig)
+		}
+	}
+}
+
+func TestDBusDispatchEffects(t *testing.T) {
+	d, recal := newTestDBus(t)
+	if _, _, err := d.dispatch(dbusIface, "SetDeadzone", []any{0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if dz := d.settings.Load().GyroDeadzone; dz != 0.5 {
+		t.Errorf("deadzone = %g after SetDeadzone(0.5)", dz)
+	}
+	_, out, _ := d.dispatch("org.freedesktop.DBus.Properties", "Get", []any{dbusIface, "GyroDeadzone"})
+	if v := out[0].(dbusVariant); v.Sig != "d" || v.Value != 0.5 {
+		t.Errorf("Get GyroDeadzone = %+v", v)
+	}
+	_, out, _ = d.dispatch("org.freedesktop.DBus.Properties", "GetAll", []any{dbusIface})
+	props := out[0].(map[string]dbusVariant)
+	if props["Device"].Value != "/sys/bus/iio/devices/iio:device0" || props["Rate"].Value != int32(250) || len(props["GyroMatrix"].Value.([]float64)) != 9 {
+		t.Errorf("GetAll = %+v", props)
+	}
+
+	// Recalibrate queues one request like POST /recalibrate, and does not block on a second
+	d.dispatch(dbusIface, "Recalibrate", nil)
+	d.dispatch(dbusIface, "Recalibrate", nil)
+	select {
+	case <-recal:
+	default:
+		t.Error("no recalibration requested")
+	}
+	// Recenter marks the heading recenter pending like POST /recenter
+	d.dispatch(dbusIface, "Recenter", nil)
+	if !d.recenter.pending.Load() {
+		t.Error("no recenter requested")
+	}
+	d.recenter = nil
+	if _, _, err := d.dispatch(dbusIface, "Recenter", nil); err == nil || !strings.Contains(err.Error(), "no fused orientation") {
+		t.Errorf("Recenter without fusion: %v", err)
+	}
+}
+
+func TestDBusIntrospectionListsMethods(t *testing.T) {
+	d, _ := newTestDBus(t)
+	for _, m := range []string{"ReloadConfig", "Recalibrate", "Recenter", "SetSensitivity", "SetDeadzone", "SelectProfile"} {
+		if !strings.Contains(dbusIntrospection, `<method name="`+m+`"`) {
+			t.Errorf("introspection does not list %s", m)
+		}
+		if _, _, err := d.dispatch(dbusIface, m, nil); err != nil && strings.Contains(err.Error(), "UnknownMethod") {
+			t.Errorf("introspection lists %s but dispatch does not know it", m)
+		}
+	}
+	for name := range d.properties() {
+		if !strings.Contains(dbusIntrospection, `<property name="`+name+`"`) {
+			t.Errorf("introspection does not list property %s", name)
+		}
+	}
+}
+
+func TestDBusSplitSig(t *testing.T) {
+	for _, tc := range []struct {
+		sig     string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"su", []string{"s", "u"}, false},
+		{"a{sv}as", []string{"a{sv}", "as"}, false},
+		{"a(yv)", []string{"a(yv)"}, false},
+		{"(i(sd))ad", []string{"(i(sd))", "ad"}, false},
+		{"aad", []string{"aad"}, false},
+		{"a", nil, true},
+		{"sa", nil, true},
+		{"aa", nil, true},
+		{"(", nil, true},
+		{"(ii", nil, true},
+		{"()", nil, true},
+		{"a{", nil, true},
+		{")", nil, true},
+		{"s}", nil, true},
+	} {
+		got, err := dbusSplitSig(tc.sig)
+		if (err != nil) != tc.wantErr || !slices.Equal(got, tc.want) {
+			t.Errorf("dbusSplitSig(%q) = %q, %v; want %q, error %v", tc.sig, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestDBusValueBadSignature(t *testing.T) {
+	for _, sig := range []string{"", "a", "(", "()", "(i", "ii", "}"} {
+		var e dbusEncoder
+		if err := e.value(sig, int32(1)); err == nil {
+			t.Errorf("encode as %q accepted", sig)
+		}
+		d := &dbusDecoder{b: make([]byte, 16), order: nil}
+		if _, err := d.value(sig); err == nil {
+			t.Errorf("decode as %q accepted", sig)
+		}
+	}
+}
+
+// pipeConns returns two ends of an in-memory D-Bus connection.
+func pipeConns() (*dbusConn, *dbusConn) {
+	a, b := net.Pipe()
+	return &dbusConn{c: a, r: bufio.NewReader(a)}, &dbusConn{c: b, r: bufio.NewReader(b)}
+}
+
+// fakeSessionBus stands in for the session bus for one client: it takes the auth, answers
+// Hello and RequestName, and then hands over the connection to call the service on.
+func fakeSessionBus(t *testing.T) <-chan *dbusConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bus")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+path)
+	conns := make(chan *dbusConn, 1)
+	t.Cleanup(func() {
+		l.Close()
+		select {
+		case c := <-conns:
+			c.c.Close()
+		default:
+		}
+	})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := &dbusConn{c: c, r: bufio.NewReader(c)}
+		if _, err := conn.r.ReadString('\n'); err != nil { // AUTH EXTERNAL
+			return
+		}
+		io.WriteString(c, "OK 0123456789abcdef0123456789abcdef\r\n")
+		if _, err := conn.r.ReadString('\n'); err != nil { // BEGIN
+			return
+		}
+		for _, reply := range []dbusVariant{{"s", ":1.1"}, {"u", uint32(1)}} { // Hello, RequestName
+			m, err := conn.read()
+			if err != nil {
+				return
+			}
+			conn.send(dbusMethodReturn, 0, map[byte]any{dbusFieldReplySerial: m.Serial}, reply.Sig, []any{reply.Value})
+		}
+		conns <- conn
+	}()
+	return conns
+}
+
+// callService calls member of the service's interface over the bus and returns the reply.
+func callService(t *testing.T, bus *dbusConn, member string) *dbusMessage {
+	t.Helper()
+	serial, err := bus.send(dbusMethodCall, 0, map[byte]any{
+		dbusFieldPath:        dbusObjectPath(dbusPath),
+		dbusFieldInterface:   dbusIface,
+		dbusFieldMember:      member,
+		dbusFieldDestination: dbusName,
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := bus.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Fields[dbusFieldReplySerial] == serial {
+			return m
+		}
+	}
+}
+
+func TestDBusMessageRoundTrip(t *testing.T) {
+	tx, rx := pipeConns()
+	defer tx.c.Close()
+	defer rx.c.Close()
+	body := []any{"hello", uint32(7), []float64{1, 2.5}, map[string]dbusVariant{"Rate": {"i", int32(250)}, "Name": {"s", "bmi323"}}, dbusVariant{"ad", []float64{-1}}}
+	sent := make(chan error, 1)
+	go func() {
+		_, err := tx.send(dbusMethodReturn, 0, map[byte]any{dbusFieldReplySerial: uint32(3), dbusFieldDestination: ":1.42"}, "suada{sv}v", body)
+		if err != nil {
+			tx.c.Close() // unblock the read
+		}
+		sent <- err
+	}()
+	m, readErr := rx.read()
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if m.Type != dbusMethodReturn || m.Fields[dbusFieldReplySerial] != uint32(3) || m.str(dbusFieldDestination) != ":1.42" || m.str(dbusFieldSignature) != "suada{sv}v" {
+		t.Errorf("header: %+v", m)
+	}
+	if len(m.Body) != 5 || m.Body[0] != "hello" || m.Body[1] != uint32(7) {
+		t.Fatalf("body: %#v", m.Body)
+	}
+	if a := m.Body[2].([]any); len(a) != 2 || a[1] != 2.5 {
+		t.Errorf("array: %#v", a)
+	}
+	// dict entries come back sorted by key
+	if a := m.Body[3].([]any); len(a) != 2 || a[0].([]any)[0] != "Name" || a[1].([]any)[1].(dbusVariant).Value != int32(250) {
+		t.Errorf("dict: %#v", a)
+	}
+	if v := m.Body[4].(dbusVariant); v.Sig != "ad" {
+		t.Errorf("variant: %#v", v)
+	}
+}
+
+func TestDBusSendRejectsBadSignature(t *testing.T) {
+	tx, _ := pipeConns()
+	defer tx.c.Close()
+	for _, tc := range []struct {
+		sig  string
+		body []any
+	}{{"a", []any{[]float64{1}}}, {"(s", []any{[]any{"x"}}}, {"ss", []any{"only one"}}} {
+		if _, err := tx.send(dbusMethodReturn, 0, map[byte]any{}, tc.sig, tc.body); err == nil {
+			t.Errorf("send with signature %q accepted", tc.sig)
+		}
+	}
+}
+
+func TestDBusReadMalformed(t *testing.T) {
+	// a message whose body signature is a bare "a" must fail, not panic
+	tx, rx := pipeConns()
+	go func() {
+		tx.send(dbusMethodCall, 0, map[byte]any{dbusFieldPath: dbusObjectPath(dbusPath), dbusFieldMember: "Ping"}, "s", []any{"x"})
+		tx.c.Close()
+	}()
+	raw := new(bytes.Buffer)
+	buf := make([]byte, 512)
+	for {
+		n, err := rx.c.Read(buf)
+		raw.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	// header field 8 (signature), a variant of type g holding "s"
+	msg := bytes.Replace(raw.Bytes(), []byte{8, 1, 'g', 0, 1, 's', 0}, []byte{8, 1, 'g', 0, 1, 'a', 0}, 1)
+	if bytes.Equal(msg, raw.Bytes()) {
+		t.Fatal("signature field not found in the message")
+	}
+	c := &dbusConn{r: bufio.NewReader(bytes.NewReader(msg))}
+	if _, err := c.read(); err == nil {
+		t.Error("message with body signature \"a\" accepted")
+	}
+}
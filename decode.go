@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// readHexPackets extracts packets from a hex dump: --dump-packets output, `hexdump -C` or
+// `xxd` output, or plain hex (one packet per line, spaces optional). A leading offset column
+// is skipped and each line's bytes end at the first word that is not hex (the field names and
+// ASCII columns). Lines with an offset are joined; a line without hex bytes, or an offset of
+// 0, starts a new packet.
+func readHexPackets(r io.Reader) ([][]byte, error) {
+	var pkts [][]byte
+	var cur []byte
+	flush := func() {
+		if len(cur) > 0 {
+			pkts = append(pkts, cur)
+			cur = nil
+		}
+	}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		words := strings.Fields(sc.Text())
+		// an offset is a hex word followed by bytes: "0000", "00000000:" or "00000010"
+		offset := len(words) > 1 && len(words[0]) >= 4 && isHexWord(strings.TrimSuffix(words[0], ":")) &&
+			(strings.HasSuffix(words[0], ":") || len(words[1]) == 2)
+		switch {
+		case offset:
+			if off := strings.Trim(strings.TrimSuffix(words[0], ":"), "0"); off == "" {
+				flush()
+			}
+			words = words[1:]
+		case len(cur) > 0 && len(words) == 1 && len(words[0]) == 8:
+			// hexdump ends a dump with a line holding only the total length, as 8 digits
+			flush()
+			continue
+		}
+		var line []byte
+		for _, w := range words {
+			if !isHexWord(w) || len(w)%2 != 0 {
+				break
+			}
+			b, _ := hex.DecodeString(w)
+			line = append(line, b...)
+		}
+		switch {
+		case len(line) == 0:
+			flush()
+		case !offset:
+			flush()
+			pkts = append(pkts, line)
+		default:
+			cur = append(cur, line...)
+		}
+	}
+	flush()
+	return pkts, sc.Err()
+}
+
+func isHexWord(w string) bool {
+	if w == "" {
+		return false
+	}
+	for _, c := range w {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeDSUDump reads a hex dump from r (see readHexPackets) and prints every packet decoded
+// field by field, with the same validation the server applies to what it receives. It
+// returns the number of packets that failed validation.
+func decodeDSUDump(r io.Reader, w io.Writer) (bad int, err error) {
+	pkts, err := readHexPackets(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(pkts) == 0 {
+		return 0, fmt.Errorf("no hex bytes found")
+	}
+	for i, pkt := range pkts {
+		magic := dsuMagicServer
+		if len(pkt) >= 4 && string(pkt[:4]) == dsuMagicClient {
+			magic = dsuMagicClient
+		}
+		verdict := "valid"
+		if _, _, err := parseDSUPacket(pkt, magic); err != nil {
+			verdict = "INVALID: " + err.Error()
+			bad++
+		}
+		fmt.Fprintf(w, "packet %d (%s): %s", i+1, verdict, formatDSUPacket(pkt))
+	}
+	return bad, nil
+}
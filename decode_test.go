@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadHexPackets(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want [][]byte
+	}{
+		{"plain hex, one packet per line", "01 02 03\naabb\n", [][]byte{{1, 2, 3}, {0xaa, 0xbb}}},
+		{"dump-packets lines", "Version, 6 bytes\n  0000  44 53                 magic = \"DS\"\n  0002  e9 03                 version = 1001\n",
+			[][]byte{{0x44, 0x53, 0xe9, 0x03}}},
+		{"xxd", "00000000: 4453 5553 e903  DSUS..\n00000006: 0600                ..\n", [][]byte{{0x44, 0x53, 0x55, 0x53, 0xe9, 0x03, 0x06, 0x00}}},
+		{"hexdump -C", "00000000  44 53 55 53 e9 03  |DSUS..|\n00000006  06 00              |..|\n00000008\n",
+			[][]byte{{0x44, 0x53, 0x55, 0x53, 0xe9, 0x03, 0x06, 0x00}}},
+		{"offset 0 starts a new packet", "0000  01 02\n0002  03\n0000  04\n", [][]byte{{1, 2, 3}, {4}}},
+		{"blank line separates", "01 02\n\n03\n", [][]byte{{1, 2}, {3}}},
+		{"odd-length word ends the bytes", "01 02 abc 03\n", [][]byte{{1, 2}}},
+		{"offset lines, then plain hex", "0000  01 02\n0203\n", [][]byte{{1, 2}, {2, 3}}},
+		{"no hex at all", "hello world\n", nil},
+	} {
+		got, err := readHexPackets(strings.NewReader(tc.in))
+		if err != nil || !slices.EqualFunc(got, tc.want, bytes.Equal) {
+			t.Errorf("%s: %x, %v; want %x", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestDecodeDSUDump(t *testing.T) {
+	s := &DSUServer{serverID: 0xdeadbeef}
+	version := s.buildPacket(dsuMsgVersion, []byte{0xe9, 0x03})
+	data := s.buildControllerData(0, true, 7, 123456, 0, 0, -1, 1.5, 0, -90)
+	badCRC := slices.Clone(version)
+	badCRC[8] ^= 0xff
+
+	// known good: --dump-packets output of a server reply, a data packet and a client request
+	var in bytes.Buffer
+	for i, pkt := range [][]byte{version, data, subscribeRequest()} {
+		fmt.Fprintf(&in, "DSU-> #%d %s", i+1, formatDSUPacket(pkt))
+	}
+	var out bytes.Buffer
+	bad, err := decodeDSUDump(&in, &out)
+	if err != nil || bad != 0 {
+		t.Fatalf("good dump: %d bad, %v\n%s", bad, err, &out)
+	}
+	for _, want := range []string{
+		"packet 1 (valid): Version, 22 bytes\n",
+		"packet 2 (valid): ControllerData, 100 bytes\n",
+		"  0020  07 00 00 00                          packet number = 7\n",
+		"packet 3 (valid): ",
+		`magic = "DSUC"`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("good dump output lacks %q:\n%s", want, &out)
+		}
+	}
+
+	// malformed: a bad CRC and a cut packet are reported, a later good packet still decodes
+	in.Reset()
+	out.Reset()
+	fmt.Fprintf(&in, "%x\n%x\n%x\n", badCRC, data[:30], version)
+	bad, err = decodeDSUDump(&in, &out)
+	if err != nil || bad != 2 {
+		t.Errorf("malformed dump: %d bad, %v; want 2", bad, err)
+	}
+	for _, want := range []string{"packet 1 (INVALID: ", "packet 2 (INVALID: ", "packet 3 (valid): Version"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("malformed dump output lacks %q:\n%s", want, &out)
+		}
+	}
+
+	if _, err := decodeDSUDump(strings.NewReader("nothing to see\n"), &out); err == nil {
+		t.Error("a dump without hex bytes decoded")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dropWindow is the span the drop rate is measured over for --max-drop-rate.
+const dropWindow = 10 * time.Second
+
+// dropCounter counts output ticks the main loop missed. A ticker whose receiver is busy
+// discards ticks, so a tick arriving more than 1.5 periods after the previous one stands for
+// the ticks that were dropped in between.
+type dropCounter struct {
+	period time.Duration
+	last   time.Time
+	Total  uint64 // ticks dropped since start
+
+	winStart          time.Time
+	winTicks, winDrop uint64
+}
+
+func newDropCounter(period time.Duration) *dropCounter {
+	return &dropCounter{period: period}
+}
+
+// Tick records a tick handled at now and returns how many were dropped before it.
+func (d *dropCounter) Tick(now time.Time) int {
+	if d.last.IsZero() {
+		d.last, d.winStart = now, now
+		return 0
+	}
+	dropped := 0
+	if gap := now.Sub(d.last); gap > d.period*3/2 {
+		dropped = int((gap+d.period/2)/d.period) - 1
+	}
+	d.last = now
+	d.Total += uint64(dropped)
+	d.winTicks += uint64(1 + dropped)
+	d.winDrop += uint64(dropped)
+	return dropped
+}
+
+// Window returns the percentage of ticks dropped over the last dropWindow once it has
+// elapsed, and starts a new one; ok is false while the window is still open.
+func (d *dropCounter) Window(now time.Time) (pct float64, ok bool) {
+	if d.winStart.IsZero() || now.Sub(d.winStart) < dropWindow || d.winTicks == 0 {
+		return 0, false
+	}
+	pct = 100 * float64(d.winDrop) / float64(d.winTicks)
+	d.winStart, d.winTicks, d.winDrop = now, 0, 0
+	return pct, true
+}
+
+// sendDrops sums the per-client send drops of servers; a client of several outputs is counted
+// once, with the total.
+func sendDrops(servers []*DSUServer) map[string]uint64 {
+	out := make(map[string]uint64)
+	for _, srv := range servers {
+		for addr, n := range srv.SendDrops() {
+			out[addr] += n
+		}
+	}
+	return out
+}
+
+// sendDropReport lists the clients that lost packets between the prev and cur counts, e.g.
+// "192.168.1.20:51000 (12), 192.168.1.21:40000 (3)", sorted by address; "" when none did.
+func sendDropReport(prev, cur map[string]uint64) string {
+	var parts []string
+	for _, addr := range slices.Sorted(maps.Keys(cur)) {
+		if n := cur[addr] - prev[addr]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s (%d)", addr, n))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDropCounterTick(t *testing.T) {
+	d := newDropCounter(10 * time.Millisecond)
+	t0 := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 0},
+		{10 * time.Millisecond, 0},
+		// jitter up to 1.5 periods is not a drop
+		{24 * time.Millisecond, 0},
+		{50 * time.Millisecond, 2},
+		{60 * time.Millisecond, 0},
+		{100 * time.Millisecond, 3},
+	} {
+		if got := d.Tick(t0.Add(tc.at)); got != tc.want {
+			t.Errorf("tick at %v: %d dropped, want %d", tc.at, got, tc.want)
+		}
+	}
+	if d.Total != 5 {
+		t.Errorf("Total = %d, want 5", d.Total)
+	}
+}
+
+func TestDropCounterWindow(t *testing.T) {
+	d := newDropCounter(100 * time.Millisecond)
+	t0 := time.Unix(1000, 0)
+	d.Tick(t0)
+	// 9 s on time, then one second in which every other tick is missed
+	at := t0
+	for range 90 {
+		at = at.Add(100 * time.Millisecond)
+		d.Tick(at)
+	}
+	if _, ok := d.Window(at); ok {
+		t.Fatal("window closed before dropWindow elapsed")
+	}
+	for range 5 {
+		at = at.Add(200 * time.Millisecond)
+		d.Tick(at)
+	}
+	pct, ok := d.Window(at)
+	if !ok || pct != 5 {
+		t.Errorf("Window = %v%%, %v; want 5%% (5 of 100 ticks)", pct, ok)
+	}
+	// the next window starts empty
+	if _, ok := d.Window(at.Add(time.Second)); ok {
+		t.Error("a new window closed at once")
+	}
+}
+
+// slowReader takes delay per readSample, like a sensor on a slow bus.
+type slowReader struct{ delay time.Duration }
+
+func (r slowReader) readSample() (IMUSample, error) {
+	time.Sleep(r.delay)
+	return IMUSample{TSus: uint64(time.Now().UnixMicro())}, nil
+}
+
+func TestDropCounterSlowReader(t *testing.T) {
+	// the main loop's shape: a read on every tick, with reads that take 2.5 periods
+	const period = 4 * time.Millisecond
+	var src SampleReader = slowReader{delay: period * 5 / 2}
+	d := newDropCounter(period)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range 20 {
+		now := <-ticker.C
+		d.Tick(now)
+		src.readSample()
+	}
+	// each read misses at least one tick; a loaded test machine misses more
+	if d.Total < 15 {
+		t.Errorf("Total = %d after 20 slow reads, want at least 15", d.Total)
+	}
+}
+
+func TestSendDropReport(t *testing.T) {
+	for _, tc := range []struct {
+		prev, cur map[string]uint64
+		want      string
+	}{
+		{nil, nil, ""},
+		{nil, map[string]uint64{"10.0.0.2:5000": 0}, ""},
+		{map[string]uint64{"10.0.0.2:5000": 4}, map[string]uint64{"10.0.0.2:5000": 4}, ""},
+		{nil, map[string]uint64{"10.0.0.3:5000": 3, "10.0.0.2:5000": 12}, "10.0.0.2:5000 (12), 10.0.0.3:5000 (3)"},
+		// only what was dropped in the window is reported
+		{map[string]uint64{"10.0.0.2:5000": 10, "10.0.0.3:5000": 3}, map[string]uint64{"10.0.0.2:5000": 15, "10.0.0.3:5000": 3}, "10.0.0.2:5000 (5)"},
+	} {
+		if got := sendDropReport(tc.prev, tc.cur); got != tc.want {
+			t.Errorf("sendDropReport(%v, %v) = %q, want %q", tc.prev, tc.cur, got, tc.want)
+		}
+	}
+}
@@ -8,11 +8,15 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"os"
+	"maps"
 	"strings"
 	"fmt"
 	"encoding/hex"
+	"crypto/sha256"
 )
 
 const (
@@ -26,18 +30,47 @@ const (
 	dsuMagicClient = "DSUC" // client → server
 )
 
+// Device model and connection type reported in the shared beginning of info/data packets.
+const (
+	dsuModelNone    uint8 = 0 // not applicable
+	dsuModelPartial uint8 = 1 // no or partial gyro
+	dsuModelFull    uint8 = 2 // full gyro
+	dsuConnNone     uint8 = 0 // not applicable
+	dsuConnUSB      uint8 = 1
+	dsuConnBT       uint8 = 2
+)
+
+// dsuAccelUnits and dsuGyroUnits are the values of output_accel_units and output_gyro_units:
+// what 1 m/s^2 and 1 rad/s are in the packet. DSU defines g and deg/s; some forks take the
+// SI units as they are.
+var (
+	dsuAccelUnits = map[string]float64{"g": 1 / standardGravity, "m_s2": 1}
+	dsuGyroUnits  = map[string]float64{"deg_s": 180 / math.Pi, "rad_s": 1}
+)
+
+// dsuMAC is the controller MAC when no device identity is known (see SetMAC).
 var dsuMAC = [6]byte{0x02, 0x20, 0x6A, 0x7E, 0x51, 0x01}
 
-func init() {
-    if s := os.Getenv("DSU_MAC"); s != "" {
-        // admite "02:20:6A:7E:51:01" o "02-20-6A-7E-51-01"
-        clean := strings.NewReplacer(":", "", "-", "").Replace(s)
-        if len(clean) == 12 {
-            if b, err := hex.DecodeString(clean); err == nil {
-                copy(dsuMAC[:], b[:6])
-            }
-        }
-    }
+// parseMAC accepts "02:20:6A:7E:51:01", "02-20-6A-7E-51-01" or "02206A7E5101".
+func parseMAC(s string) ([6]byte, error) {
+	var mac [6]byte
+	clean := strings.NewReplacer(":", "", "-", "").Replace(s)
+	b, err := hex.DecodeString(clean)
+	if err != nil || len(b) != 6 {
+		return mac, fmt.Errorf("bad MAC %q (want six hex bytes like 02:20:6A:7E:51:01)", s)
+	}
+	copy(mac[:], b)
+	return mac, nil
+}
+
+// deriveMAC turns a device identity into a stable controller MAC: the first bytes of its
+// SHA-256, marked locally administered and unicast.
+func deriveMAC(identity string) [6]byte {
+	var mac [6]byte
+	sum := sha256.Sum256([]byte(identity))
+	copy(mac[:], sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
 }
 
 // A single-slot server (slot 0). Enough for our case.
@@ -49,33 +82,123 @@ type DSUServer struct {
 	// active clients subscribed to slot 0 (key = addr.String())
 	subs map[string]*net.UDPAddr
 
-	// packet counter per client
-	pkt uint32
+	// motion packets sent in total, and the packet number last sent to each client
+	pkt   uint32
+	pktNo map[string]uint32
 
 	// flag to debug req resp and packet sizes
 	debug bool
 	lastInfo time.Time
+
+	// device model / connection type / MAC advertised to clients (see SetIdentity, SetMAC)
+	model    uint8
+	connType uint8
+	mac      [6]byte
+
+	// last motion timestamp sent, and backward steps seen since the last warning
+	lastTS      uint64
+	tsBackSteps int
+	tsWarned    time.Time
+
+	// dump annotates outgoing packets (--dump-packets); nil when disabled
+	dump atomic.Pointer[packetDumper]
+
+	// factors from m/s^2 and rad/s to the packet's accel and gyro units (SetUnits)
+	accelUnit, gyroUnit float64
+
+	// writeTimeout bounds each socket write (SetWriteTimeout); motion packets that miss it are
+	// dropped and counted per client in sendDrops. Send errors go to errLog.
+	writeTimeout atomic.Int64 // time.Duration
+	sendDrops    map[string]uint64
+	errLog       *dedupLogger
+
+	// strictCRC drops requests whose CRC does not match (SetStrictCRC); by default they are
+	// served, as some clients send a zero or wrong CRC
+	strictCRC atomic.Bool
 }
 
 func NewDSUServer(bind string) (*DSUServer, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", bind)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("resolve DSU address %s: %w", bind, err)
 	}
 	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bind DSU socket %s: %w", bind, err)
 	}
 	s := &DSUServer{
-		serverID: randUint32(),
-		conn:     conn,
-		subs:     make(map[string]*net.UDPAddr),
-		debug:    os.Getenv("DSU_DEBUG") == "1", 
+		serverID:  randUint32(),
+		conn:      conn,
+		subs:      make(map[string]*net.UDPAddr),
+		pktNo:     make(map[string]uint32),
+		sendDrops: make(map[string]uint64),
+		debug:     os.Getenv("DSU_DEBUG") == "1", 
+		model:     dsuModelFull,
+		connType:  dsuConnUSB,
+		mac:       dsuMAC,
+		accelUnit: dsuAccelUnits["g"],
+		gyroUnit:  dsuGyroUnits["deg_s"],
+		errLog:    newDedupLogger(os.Stderr, repeatSummaryEvery),
 	}
+	s.writeTimeout.Store(int64(dsuWriteTimeout))
 	go s.readLoop()
 	return s, nil
 }
 
+// bindErrorKind is the cause of a NewDSUServer failure, as far as main needs to know it.
+type bindErrorKind int
+
+const (
+	bindErrOther      bindErrorKind = iota
+	bindErrInUse                    // another socket holds the port
+	bindErrPermission               // not allowed to bind (privileged port, sandbox, SELinux)
+	bindErrAddress                  // the address is malformed or not local to this machine
+)
+
+// classifyBindError maps an error from NewDSUServer to its cause.
+func classifyBindError(err error) bindErrorKind {
+	var addrErr *net.AddrError
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return bindErrOther
+	case errors.Is(err, syscall.EADDRINUSE):
+		return bindErrInUse
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return bindErrPermission
+	case errors.Is(err, syscall.EADDRNOTAVAIL), errors.As(err, &addrErr), errors.As(err, &dnsErr):
+		return bindErrAddress
+	default:
+		return bindErrOther
+	}
+}
+
+// probeDSUServer sends a version request to addr and reports whether a DSU server answered.
+// Used to tell the user what is holding the port when our bind fails.
+func probeDSUServer(addr string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	req := make([]byte, 20)
+	copy(req[0:4], []byte(dsuMagicClient))
+	binary.LittleEndian.PutUint16(req[4:6], dsuProtoVersion)
+	binary.LittleEndian.PutUint16(req[6:8], 4)
+	binary.LittleEndian.PutUint32(req[12:16], randUint32())
+	binary.LittleEndian.PutUint32(req[16:20], dsuMsgVersion)
+	binary.LittleEndian.PutUint32(req[8:12], crc32.ChecksumIEEE(req))
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(req); err != nil {
+		return false
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	return err == nil && n >= 4 && string(buf[0:4]) == dsuMagicServer
+}
+
 func dumpPacket(prefix string, b []byte) {
     if !strings.HasPrefix(prefix, "DSU") { fmt.Println(prefix) } // opcional
     if len(b) < 20 { fmt.Printf("%s <len=%d>\n", prefix, len(b)); return }
@@ -94,6 +217,107 @@ func randUint32() uint32 {
 	return rand.Uint32()
 }
 
+// SetIdentity sets the device model and connection type reported for slot 0.
+func (s *DSUServer) SetIdentity(model, connType uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.model = model
+	s.connType = connType
+}
+
+// SetMAC sets the controller MAC sent in info and data packets. Clients may key saved
+// settings on it, so it should stay the same for a device (see deriveMAC).
+func (s *DSUServer) SetMAC(mac [6]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mac = mac
+}
+
+// SetUnits selects the units motion is sent in, keys of dsuAccelUnits and dsuGyroUnits.
+func (s *DSUServer) SetUnits(accel, gyro string) error {
+	a, ok := dsuAccelUnits[accel]
+	if !ok {
+		return fmt.Errorf("unknown accel output unit %q (want g or m_s2)", accel)
+	}
+	g, ok := dsuGyroUnits[gyro]
+	if !ok {
+		return fmt.Errorf("unknown gyro output unit %q (want deg_s or rad_s)", gyro)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accelUnit, s.gyroUnit = a, g
+	return nil
+}
+
+// SetPacketDump turns the annotated hex dump of outgoing packets on or off.
+func (s *DSUServer) SetPacketDump(on bool) {
+	if on {
+		s.dump.Store(newPacketDumper())
+	} else {
+		s.dump.Store(nil)
+	}
+}
+
+// dsuWriteTimeout is the default bound on a socket write. UDP sends normally complete at
+// once; a full socket buffer must not stall the output loop.
+const dsuWriteTimeout = 2 * time.Millisecond
+
+// SetWriteTimeout sets how long a packet may wait for socket buffer space before it is
+// dropped; 0 lets writes block.
+func (s *DSUServer) SetWriteTimeout(d time.Duration) {
+	s.writeTimeout.Store(int64(d))
+}
+
+// SetStrictCRC makes the server drop client requests with a wrong CRC instead of serving them.
+func (s *DSUServer) SetStrictCRC(on bool) {
+	s.strictCRC.Store(on)
+}
+
+// send writes pkt to addr, dumping it first when --dump-packets is on. Failures are logged
+// (collapsed when they repeat) and returned.
+func (s *DSUServer) send(pkt []byte, addr *net.UDPAddr) error {
+	if d := s.dump.Load(); d != nil {
+		d.Dump("TX", pkt)
+	}
+	if d := time.Duration(s.writeTimeout.Load()); d > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(d))
+	} else {
+		s.conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := s.conn.WriteToUDP(pkt, addr)
+	if err != nil {
+		s.errLog.Printf("WARNING: DSU send to %s failed, packet dropped: %v", addr, err)
+	}
+	return err
+}
+
+// SetQoS marks outgoing packets with a DSCP class (IP_TOS) and an IP TTL, for streaming to a
+// remote client over the LAN. A zero value leaves that option at the OS default.
+func (s *DSUServer) SetQoS(dscp, ttl int) error {
+	raw, err := s.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if dscp > 0 {
+			if e := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2); e != nil {
+				serr = fmt.Errorf("IP_TOS: %w", e)
+				return
+			}
+		}
+		if ttl > 0 {
+			if e := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl); e != nil {
+				serr = fmt.Errorf("IP_TTL: %w", e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
 func (s *DSUServer) Close() error {
 	return s.conn.Close()
 }
@@ -105,54 +329,60 @@ func (s *DSUServer) readLoop() {
 		if err != nil {
 			return
 		}
-		if n < 20 {
-			continue
-		}
-		// parse header
-		magic := string(buf[0:4])
-		if magic != dsuMagicClient {
-			continue
-		}
-		ver := binary.LittleEndian.Uint16(buf[4:6])
-		if ver != dsuProtoVersion {
-			// ignore unknown versions
-			continue
-		}
-		// fast debug output
-		if n >= 24 {
-			mt := binary.LittleEndian.Uint32(buf[16:20])
-			println("DSU<-", magic, "v", ver, "len", binary.LittleEndian.Uint16(buf[6:8]), "msgType", mt)
+		if err := s.handleRequest(buf[:n], addr); err != nil && s.debug {
+			fmt.Printf("RX from %s dropped: %v\n", addr, err)
 		}
+	}
+}
+
+// handleRequest validates one client packet and answers it. b is untrusted network input;
+// invalid packets are rejected with the parseDSUPacket error and never answered. A wrong CRC
+// only rejects the packet with SetStrictCRC.
+func (s *DSUServer) handleRequest(b []byte, addr *net.UDPAddr) error {
+	// parse and validate header (magic, version, length, CRC)
+	hdr, payload, err := parseDSUPacket(b, dsuMagicClient)
+	if errors.Is(err, errDSUCRC) && !s.strictCRC.Load() {
 		if s.debug {
-			dumpPacket("RX", buf[:n])
-		}
-		// length := binary.LittleEndian.Uint16(buf[6:8]) // not needed here
-		// crc := binary.LittleEndian.Uint32(buf[8:12])   // could verify if you want
-		// clientID := binary.LittleEndian.Uint32(buf[12:16])
-		msgType := binary.LittleEndian.Uint32(buf[16:20])
-
-		switch msgType {
-		case dsuMsgVersion:
-			s.replyVersion(addr)
-		case dsuMsgInfo:
-			s.replyVersion(addr)  
-			s.replyInfoRequest(buf[:n], addr)
-		case dsuMsgData:
-			s.replyVersion(addr) 
-			s.handleDataSubscribe(buf[:n], addr)
-			// spec: no immediate response; start/continue streaming after this
-		default:
-			// ignore others
+			fmt.Printf("RX from %s: %v, served anyway\n", addr, err)
 		}
+		err = nil
 	}
+	if err != nil {
+		return err
+	}
+	b = b[:20+len(payload)] // trailing bytes past the declared length are not part of it
+	// fast debug output
+	if len(b) >= 24 {
+		println("DSU<-", hdr.Magic, "v", hdr.Version, "len", hdr.Length, "msgType", hdr.MsgType)
+	}
+	if s.debug {
+		dumpPacket("RX", b)
+	}
+
+	switch hdr.MsgType {
+	case dsuMsgVersion:
+		s.replyVersion(addr)
+	case dsuMsgInfo:
+		s.replyVersion(addr)  
+		s.replyInfoRequest(b, addr)
+	case dsuMsgData:
+		s.replyVersion(addr) 
+		s.handleDataSubscribe(b, addr)
+		// spec: no immediate response; start/continue streaming after this
+	default:
+		// ignore others
+	}
+	return nil
 }
 
 func (s *DSUServer) replyVersion(addr *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
     payload := make([]byte, 2)
     binary.LittleEndian.PutUint16(payload[0:2], dsuProtoVersion)
     pkt := s.buildPacket(dsuMsgVersion, payload)
 	if s.debug { dumpPacket("TX", pkt) }
-    s.conn.WriteToUDP(pkt, addr)
+    s.send(pkt, addr)
 }
 
 func (s *DSUServer) replyInfoRequest(req []byte, addr *net.UDPAddr) {
@@ -162,6 +392,8 @@ func (s *DSUServer) replyInfoRequest(req []byte, addr *net.UDPAddr) {
 	}
 	count := int(int32(binary.LittleEndian.Uint32(req[20:24])))
 	offset := 24
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i := 0; i < count; i++ {
 		if offset >= len(req) {
 			break
@@ -173,13 +405,13 @@ func (s *DSUServer) replyInfoRequest(req []byte, addr *net.UDPAddr) {
 		if slot != 0 {
 			pkt := s.buildControllerInfo(slot, 0)
 			if s.debug { dumpPacket("TX", pkt) }
-			s.conn.WriteToUDP(pkt, addr)
+			s.send(pkt, addr)
 			continue
 		}
 		// connected=2 in shared beginning, but the "Info" response requires an extra trailing 0 byte
 		pkt := s.buildControllerInfo(0, 2)
 		if s.debug { dumpPacket("TX", pkt) }
-		s.conn.WriteToUDP(pkt, addr)
+		s.send(pkt, addr)
 	}
 }
 
@@ -202,19 +434,43 @@ func (s *DSUServer) handleDataSubscribe(req []byte, addr *net.UDPAddr) {
 		if s.debug { fmt.Println("info: sending immediate ControllerInfo after subscribe") }
 		pkt := s.buildControllerInfo(0, 2)
 		if s.debug { dumpPacket("TX", pkt) }
-		s.conn.WriteToUDP(pkt, addr)
+		s.send(pkt, addr)
 	case (flags&0x01) != 0 && slot == 0:
 		s.subs[addr.String()] = addr
 
 		if s.debug { fmt.Println("info: sending immediate ControllerInfo after subscribe") }
 		pkt := s.buildControllerInfo(0, 2)
 		if s.debug { dumpPacket("TX", pkt) }
-		s.conn.WriteToUDP(pkt, addr)
+		s.send(pkt, addr)
 	default:
 		// not our slot → ignore
 	}
 }
 
+const (
+	// dsuMinTSStep is how far (µs) a backward motion timestamp is moved past the previous one.
+	dsuMinTSStep = 1
+	// dsuTSWarnEvery rate-limits the backward timestamp warning.
+	dsuTSWarnEvery = 10 * time.Second
+)
+
+// monotonicTS keeps the motion timestamp from going backward (wall clock steps, skew between
+// split devices), which clients integrating over dt turn into a spike. A backward value is
+// replaced by the previous one plus dsuMinTSStep. Callers hold s.mu.
+func (s *DSUServer) monotonicTS(ts uint64) uint64 {
+	if ts < s.lastTS {
+		s.tsBackSteps++
+		if now := time.Now(); now.Sub(s.tsWarned) >= dsuTSWarnEvery {
+			fmt.Fprintf(os.Stderr, "WARNING: motion timestamp went backward by %d us (%d time(s) since last warning); holding it monotonic\n",
+				s.lastTS-ts, s.tsBackSteps)
+			s.tsWarned, s.tsBackSteps = now, 0
+		}
+		ts = s.lastTS + dsuMinTSStep
+	}
+	s.lastTS = ts
+	return ts
+}
+
 // sanitizeFloat32 returns 0 if the value is NaN or Infinity to prevent crashes in DSU clients.
 func sanitizeFloat32(v float32) float32 {
 	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
@@ -223,37 +479,61 @@ func sanitizeFloat32(v float32) float32 {
 	return v
 }
 
+// Stats returns the number of subscribed clients and the motion packets sent so far.
+func (s *DSUServer) Stats() (clients int, packets uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs), s.pkt
+}
+
+// SendDrops returns, per client address, the motion packets dropped because their send failed
+// or timed out.
+func (s *DSUServer) SendDrops() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.sendDrops)
+}
+
 // Broadcast one IMU sample (already mount-adjusted & scaled to SI units).
 func (s *DSUServer) Broadcast(sample IMUSample) {
-	// convert units for DSU and sanitize to prevent NaN/Infinity crashes
-	ax := sanitizeFloat32(float32(sample.Accel.X / 9.80665)) // m/s^2 → g
-	ay := sanitizeFloat32(float32(sample.Accel.Y / 9.80665))
-	az := sanitizeFloat32(float32(sample.Accel.Z / 9.80665))
-	const rad2deg = 180.0 / math.Pi
-	gx := sanitizeFloat32(float32(sample.Gyro.X * rad2deg)) // rad/s → deg/s
-	gy := sanitizeFloat32(float32(sample.Gyro.Y * rad2deg))
-	gz := sanitizeFloat32(float32(sample.Gyro.Z * rad2deg))
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, a := range s.subs {
+	// convert units for DSU (g and deg/s unless SetUnits) and sanitize to prevent NaN/Infinity crashes
+	ax := sanitizeFloat32(float32(sample.Accel.X * s.accelUnit))
+	ay := sanitizeFloat32(float32(sample.Accel.Y * s.accelUnit))
+	az := sanitizeFloat32(float32(sample.Accel.Z * s.accelUnit))
+	gx := sanitizeFloat32(float32(sample.Gyro.X * s.gyroUnit))
+	gy := sanitizeFloat32(float32(sample.Gyro.Y * s.gyroUnit))
+	gz := sanitizeFloat32(float32(sample.Gyro.Z * s.gyroUnit))
+	ts := s.monotonicTS(sample.TSus)
+	// the packet is the same for every client but for its packet number: build it once and
+	// patch number and CRC per client
+	var pkt []byte
+	for key, a := range s.subs {
+		if pkt == nil {
+			pkt = s.buildControllerData(0, true, 0, ts, ax, ay, az, gx, gy, gz)
+		}
+		s.pktNo[key]++
 		s.pkt++
-		pkt := s.buildControllerData(0, true, s.pkt, sample.TSus, ax, ay, az, gx, gy, gz)
+		setDataPacketNo(pkt, s.pktNo[key])
 		if s.debug && (s.pkt%100 == 1) { dumpPacket("TX", pkt) } 
-		s.conn.WriteToUDP(pkt, a)
+		if err := s.send(pkt, a); err != nil {
+			s.sendDrops[key]++
+		}
 	}
 	now := time.Now()
 	if now.Sub(s.lastInfo) >= 500*time.Millisecond {
 		pktInfo := s.buildControllerInfo(0, 2)
 		for _, a := range s.subs {
 			if s.debug { dumpPacket("TX", pktInfo) }
-			s.conn.WriteToUDP(pktInfo, a)
+			s.send(pktInfo, a)
 		}
 		s.lastInfo = now
 	}
 }
 
 // ---------- packet builders ----------
+// They read the identity and version set by the Set methods: callers hold s.mu.
 
 func (s *DSUServer) buildPacket(msgType uint32, payload []byte) []byte {
     // Citron/Yuzu expects payload_length = sizeof(Type) + sizeof(Data)
@@ -282,15 +562,23 @@ func (s *DSUServer) buildPacket(msgType uint32, payload []byte) []byte {
 	return out
 }
 
+// setDataPacketNo stores a client's packet number in a built ControllerData packet and
+// updates its CRC.
+func setDataPacketNo(pkt []byte, n uint32) {
+	binary.LittleEndian.PutUint32(pkt[20+12:20+16], n)
+	binary.LittleEndian.PutUint32(pkt[8:12], 0)
+	binary.LittleEndian.PutUint32(pkt[8:12], crc32.ChecksumIEEE(pkt))
+}
+
 // Shared beginning (11 bytes): slot, state, model, connection, MAC(6), battery
-func sharedBeginning(slot uint8, state uint8) []byte {
+func (s *DSUServer) sharedBeginning(slot uint8, state uint8) []byte {
 	b := make([]byte, 11)
 	b[0] = slot
 	b[1] = state         // 0=not connected, 1=reserved?, 2=connected
-	b[2] = 2             // device model: full gyro
-	b[3] = 1             // connection: 1=USB, 2=BT, 0=NA
+	b[2] = s.model       // device model: 0=NA, 1=no/partial gyro, 2=full gyro
+	b[3] = s.connType    // connection: 1=USB, 2=BT, 0=NA
 	// MAC 6 bytes
-	copy(b[4:10], dsuMAC[:])
+	copy(b[4:10], s.mac[:])
 	b[10] = 0x05         // battery: "Full (or almost)" (cosmético)
 	return b
 }
@@ -300,7 +588,7 @@ func sharedBeginning(slot uint8, state uint8) []byte {
 func (s *DSUServer) buildControllerInfo(slot uint8, state uint8) []byte {
 	p := make([]byte, 12)
 	// info bytes
-	copy(p[0:11], sharedBeginning(slot, state))
+	copy(p[0:11], s.sharedBeginning(slot, state))
 	// byte 11: is_pad_active
     if state == 2 {
         p[11] = 1 // active
@@ -321,7 +609,7 @@ func (s *DSUServer) buildControllerData(slot uint8, connected bool, pktNo uint32
 	if connected {
 		state = 2
 	}
-	copy(p[0:11], sharedBeginning(slot, state))
+	copy(p[0:11], s.sharedBeginning(slot, state))
 
 	// 11: isConnected (2/0)
 	if connected { p[11] = 1 } else { p[11] = 0 }
@@ -360,5 +648,62 @@ func (s *DSUServer) buildControllerData(slot uint8, connected bool, pktNo uint32
 	return s.buildPacket(dsuMsgData, p)
 }
 
+// ---------- packet parsing ----------
+
+// dsuHeader is the fixed 20-byte start of every DSU packet.
+type dsuHeader struct {
+	Magic   string
+	Version uint16
+	Length  uint16 // message type + payload, in bytes
+	CRC     uint32
+	ID      uint32
+	MsgType uint32
+}
+
+var (
+	errDSUShort   = errors.New("dsu: packet shorter than header")
+	errDSUMagic   = errors.New("dsu: wrong magic")
+	errDSUVersion = errors.New("dsu: unsupported protocol version")
+	errDSULength  = errors.New("dsu: length field exceeds packet")
+	errDSUCRC     = errors.New("dsu: CRC mismatch")
+)
+
+// parseDSUPacket validates a packet from the network and splits it into header and payload.
+// It never trusts the input: the length field is checked against the buffer before use, the
+// CRC is verified over exactly the declared length, and trailing bytes are ignored. magic is
+// dsuMagicClient for requests and dsuMagicServer for our own packets. The CRC is checked
+// last, so with errDSUCRC the header and payload are otherwise sound and still returned.
+func parseDSUPacket(b []byte, magic string) (dsuHeader, []byte, error) {
+	var h dsuHeader
+	if len(b) < 20 {
+		return h, nil, errDSUShort
+	}
+	h = dsuHeader{
+		Magic:   string(b[0:4]),
+		Version: binary.LittleEndian.Uint16(b[4:6]),
+		Length:  binary.LittleEndian.Uint16(b[6:8]),
+		CRC:     binary.LittleEndian.Uint32(b[8:12]),
+		ID:      binary.LittleEndian.Uint32(b[12:16]),
+		MsgType: binary.LittleEndian.Uint32(b[16:20]),
+	}
+	if h.Magic != magic {
+		return h, nil, errDSUMagic
+	}
+	if h.Version != dsuProtoVersion {
+		return h, nil, errDSUVersion
+	}
+	end := 16 + int(h.Length)
+	if h.Length < 4 || end > len(b) {
+		return h, nil, errDSULength
+	}
+	pkt := make([]byte, end)
+	copy(pkt, b[:end])
+	pkt[8], pkt[9], pkt[10], pkt[11] = 0, 0, 0, 0
+	if crc32.ChecksumIEEE(pkt) != h.CRC {
+		return h, b[20:end], errDSUCRC
+	}
+	return h, b[20:end], nil
+}
+
 // ----- helpers for tests -----
 var _ = errors.Is
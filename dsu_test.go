@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockoptInt reads an IPPROTO_IP option of the server's socket.
+func sockoptInt(t *testing.T, s *DSUServer, opt int) int {
+	t.Helper()
+	raw, err := s.conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var gerr error
+	raw.Control(func(fd uintptr) {
+		v, gerr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, opt)
+	})
+	if gerr != nil {
+		t.Skipf("getsockopt not supported here: %v", gerr)
+	}
+	return v
+}
+
+func TestSetQoS(t *testing.T) {
+	s, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defTTL := sockoptInt(t, s, syscall.IP_TTL)
+
+	if err := s.SetQoS(46, 0); err != nil { // EF
+		t.Fatal(err)
+	}
+	if got := sockoptInt(t, s, syscall.IP_TOS); got != 46<<2 {
+		t.Errorf("IP_TOS = %#x, want %#x", got, 46<<2)
+	}
+	if got := sockoptInt(t, s, syscall.IP_TTL); got != defTTL {
+		t.Errorf("ttl 0 changed IP_TTL from %d to %d", defTTL, got)
+	}
+
+	if err := s.SetQoS(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := sockoptInt(t, s, syscall.IP_TTL); got != 2 {
+		t.Errorf("IP_TTL = %d, want 2", got)
+	}
+	if got := sockoptInt(t, s, syscall.IP_TOS); got != 46<<2 {
+		t.Errorf("dscp 0 changed IP_TOS to %#x", got)
+	}
+
+	if err := s.SetQoS(0, 256); err == nil {
+		t.Error("SetQoS accepted a TTL of 256")
+	}
+}
+
+func TestClassifyBindError(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return fmt.Errorf("bind DSU socket: %w", &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", errno)})
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bindErrorKind
+	}{
+		{"nil", nil, bindErrOther},
+		{"in use", opErr(syscall.EADDRINUSE), bindErrInUse},
+		{"permission", opErr(syscall.EACCES), bindErrPermission},
+		{"not permitted", opErr(syscall.EPERM), bindErrPermission},
+		{"address not local", opErr(syscall.EADDRNOTAVAIL), bindErrAddress},
+		{"bad address", &net.AddrError{Err: "missing port in address", Addr: "127.0.0.1"}, bindErrAddress},
+		{"unknown host", &net.DNSError{Err: "no such host", Name: "dsu.invalid", IsNotFound: true}, bindErrAddress},
+		{"other errno", opErr(syscall.ENOBUFS), bindErrOther},
+		{"plain error", errors.New("boom"), bindErrOther},
+	}
+	for _, tc := range tests {
+		if got := classifyBindError(tc.err); got != tc.want {
+			t.Errorf("%s: classifyBindError(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestNewDSUServerBindErrors(t *testing.T) {
+	for _, tc := range []struct {
+		bind string
+		want bindErrorKind
+	}{
+		{"127.0.0.1", bindErrAddress},         // no port
+		{"127.0.0.1:70000", bindErrAddress},   // port out of range
+		{"192.0.2.1:26760", bindErrAddress},   // TEST-NET-1, never a local address
+		{"dsu.invalid:26760", bindErrAddress}, // reserved TLD, never resolves
+	} {
+		s, err := NewDSUServer(tc.bind)
+		if err == nil {
+			s.Close()
+			t.Errorf("NewDSUServer(%s) succeeded", tc.bind)
+			continue
+		}
+		if got := classifyBindError(err); got != tc.want {
+			t.Errorf("NewDSUServer(%s): %v classified as %v, want %v", tc.bind, err, got, tc.want)
+		}
+	}
+}
+
+func TestFormatDSUPacket(t *testing.T) {
+	s := &DSUServer{serverID: 0xdeadbeef}
+	got := formatDSUPacket(s.buildPacket(dsuMsgVersion, []byte{0xe9, 0x03}))
+	want := `Version, 22 bytes
+  0000  44 53 55 53                          magic = "DSUS"
+  0004  e9 03                                version = 1001
+  0006  06 00                                length = 6
+  0008  14 db 8a 82                          crc32 = 0x828adb14
+  000c  ef be ad de                          server id = 0xdeadbeef
+  0010  00 00 10 00                          message type = 0x00100000
+  0014  e9 03                                protocol version = 1001
+`
+	if got != want {
+		t.Errorf("version packet:\n%s\nwant:\n%s", got, want)
+	}
+
+	s.mac, s.model, s.connType = [6]byte{0x02, 0x20, 0x6a, 0x7e, 0x51, 0x01}, dsuModelFull, dsuConnUSB
+	got = formatDSUPacket(s.buildControllerData(0, true, 7, 123456, 0, 0, -1, 1.5, 0, -90))
+	for _, line := range []string{
+		"ControllerData, 100 bytes\n",
+		"  0018  02 20 6a 7e 51 01                    mac = 02206a7e5101\n",
+		"  0020  07 00 00 00                          packet number = 7\n",
+		"  0044  40 e2 01 00 00 00 00 00              motion timestamp (us) = 123456\n",
+		"  0054  00 00 80 bf                          accel z (g) = -1\n",
+		"  0058  00 00 c0 3f                          gyro pitch (deg/s) = 1.5\n",
+		"  0060  00 00 b4 c2                          gyro roll (deg/s) = -90\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("data packet dump lacks %q:\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, "unannotated") {
+		t.Errorf("data packet has unannotated bytes:\n%s", got)
+	}
+}
+
+func TestFormatDSUPacketMalformed(t *testing.T) {
+	if got := formatDSUPacket([]byte("DSUS")); got != "short packet, 4 bytes: 44 53 55 53\n" {
+		t.Errorf("short packet: %q", got)
+	}
+	s := &DSUServer{}
+	info := s.buildControllerInfo(0, 2)
+	if got := formatDSUPacket(info[:26]); !strings.Contains(got, "mac: truncated") {
+		t.Errorf("cut info packet:\n%s", got)
+	}
+	if got := formatDSUPacket(append(info, 0xaa, 0xbb)); !strings.Contains(got, "  0020  aa bb (unannotated)\n") {
+		t.Errorf("info packet with trailing bytes:\n%s", got)
+	}
+	got := formatDSUPacket(s.buildPacket(0x00100099, nil))
+	if !strings.HasPrefix(got, "message 0x00100099, 20 bytes\n") {
+		t.Errorf("unknown message type:\n%s", got)
+	}
+}
+
+func TestMonotonicTS(t *testing.T) {
+	s := &DSUServer{}
+	in := []uint64{1000, 2000, 2000, 1500, 1400, 3000, 100, 2999}
+	want := []uint64{1000, 2000, 2000, 2001, 2002, 3000, 3001, 3002}
+	for i, ts := range in {
+		if got := s.monotonicTS(ts); got != want[i] {
+			t.Errorf("step %d: monotonicTS(%d) = %d, want %d", i, ts, got, want[i])
+		}
+	}
+	// the first backward step warned; the three after it within dsuTSWarnEvery are counted
+	if s.tsWarned.IsZero() || s.tsBackSteps != 3 {
+		t.Errorf("warned at %v with %d steps pending, want a warning and 3", s.tsWarned, s.tsBackSteps)
+	}
+}
+
+// fuzzServer is a server answering to a local sink, for feeding it requests directly.
+func fuzzServer(f *testing.F) (*DSUServer, *net.UDPAddr) {
+	s, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { s.Close() })
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { sink.Close() })
+	go func() { // drain, so replies never back up
+		buf := make([]byte, 2048)
+		for {
+			if _, err := sink.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return s, sink.LocalAddr().(*net.UDPAddr)
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add(clientPacket(dsuMsgVersion, nil))
+	f.Add(clientPacket(dsuMsgInfo, []byte{1, 0, 0, 0, 0}))
+	f.Add(clientPacket(dsuMsgInfo, []byte{0xff, 0xff, 0xff, 0x7f, 0, 1, 2, 3})) // count far past the slots sent
+	f.Add(clientPacket(dsuMsgInfo, []byte{0xff, 0xff, 0xff, 0xff}))             // negative count
+	f.Add(subscribeRequest())
+	f.Add(clientPacket(dsuMsgData, []byte{0, 0, 0, 0, 0, 0, 0, 0}))
+	f.Add(clientPacket(dsuMsgData, []byte{1, 3}))
+	f.Add(append(clientPacket(dsuMsgVersion, nil), 0xde, 0xad)) // trailing bytes
+	f.Add([]byte("DSUC"))
+	s, addr := fuzzServer(f)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, payload, err := parseDSUPacket(b, dsuMagicClient)
+		switch {
+		case err == nil:
+			if int(h.Length) != 4+len(payload) || 20+len(payload) > len(b) {
+				t.Fatalf("accepted length %d with a %d-byte payload from %d bytes", h.Length, len(payload), len(b))
+			}
+		case errors.Is(err, errDSUShort), errors.Is(err, errDSUMagic), errors.Is(err, errDSUVersion),
+			errors.Is(err, errDSULength), errors.Is(err, errDSUCRC):
+		default:
+			t.Fatalf("unclassified error %v", err)
+		}
+		// a wrong CRC alone is served unless the server is strict
+		if herr := s.handleRequest(b, addr); (herr == nil) != (err == nil || errors.Is(err, errDSUCRC)) {
+			t.Fatalf("handleRequest = %v, but parseDSUPacket = %v", herr, err)
+		}
+	})
+}
+
+func FuzzPacketRoundTrip(f *testing.F) {
+	f.Add(uint32(0xdeadbeef), uint32(dsuMsgVersion), []byte{0xe9, 0x03})
+	f.Add(uint32(1), uint32(dsuMsgInfo), make([]byte, 12))
+	f.Add(uint32(0), uint32(dsuMsgData), make([]byte, 80))
+	f.Add(uint32(42), uint32(0x00100099), []byte{})
+
+	f.Fuzz(func(t *testing.T, id, msgType uint32, payload []byte) {
+		if 20+len(payload) > 65507 {
+			return // does not fit in a UDP datagram, so never built
+		}
+		s := &DSUServer{serverID: id}
+		pkt := s.buildPacket(msgType, payload)
+		h, got, err := parseDSUPacket(pkt, dsuMagicServer)
+		if err != nil {
+			t.Fatalf("parseDSUPacket rejected a built packet: %v\n% x", err, pkt)
+		}
+		if h.ID != id || h.MsgType != msgType || h.Version != dsuProtoVersion || !bytes.Equal(got, payload) {
+			t.Fatalf("round trip: %+v, payload % x", h, got)
+		}
+		// a built packet is not mistaken for a request
+		if _, _, err := parseDSUPacket(pkt, dsuMagicClient); !errors.Is(err, errDSUMagic) {
+			t.Fatalf("server packet parsed as a request: %v", err)
+		}
+	})
+}
+
+func TestBroadcastPerClientPacketNumbers(t *testing.T) {
+	srv, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	subscribe := func() *net.UDPConn {
+		conn, err := net.DialUDP("udp", nil, srv.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		before, _ := srv.Stats()
+		conn.Write(subscribeRequest())
+		deadline := time.Now().Add(2 * time.Second)
+		for clients, _ := srv.Stats(); clients == before; clients, _ = srv.Stats() {
+			if time.Now().After(deadline) {
+				t.Fatal("subscription never registered")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return conn
+	}
+	a, b := subscribe(), subscribe()
+
+	// every client gets one packet per tick, numbered from 1 without gaps, with a valid CRC
+	for i := range 3 {
+		srv.Broadcast(IMUSample{TSus: uint64(i+1) * 1000})
+		for name, conn := range map[string]*net.UDPConn{"a": a, "b": b} {
+			if m := nextMotion(t, conn); m.PktNo != uint32(i+1) {
+				t.Errorf("tick %d: client %s got packet %d", i+1, name, m.PktNo)
+			}
+		}
+	}
+	if _, pkts := srv.Stats(); pkts != 6 {
+		t.Errorf("%d packets sent, want 6", pkts)
+	}
+
+	// a client that joins later starts its own sequence
+	c := subscribe()
+	srv.Broadcast(IMUSample{TSus: 4000})
+	for _, tc := range []struct {
+		conn *net.UDPConn
+		want uint32
+	}{{a, 4}, {b, 4}, {c, 1}} {
+		if m := nextMotion(t, tc.conn); m.PktNo != tc.want {
+			t.Errorf("after a third client joined: packet %d, want %d", m.PktNo, tc.want)
+		}
+	}
+}
+
+func TestBroadcastSendFailureDropsAndContinues(t *testing.T) {
+	out, conn := subscribedOutput(t, outputConfig{})
+	srv := out.DSUServer
+	// an IPv6 client of an IPv4 socket: every send fails at once, like a write that misses its
+	// deadline
+	bad := &net.UDPAddr{IP: net.IPv6loopback, Port: 9}
+	srv.mu.Lock()
+	srv.subs[bad.String()] = bad
+	var log bytes.Buffer
+	srv.errLog = newDedupLogger(&log, repeatSummaryEvery)
+	srv.mu.Unlock()
+
+	for i := range 3 {
+		srv.Broadcast(IMUSample{TSus: uint64(i+1) * 1000})
+	}
+	// the healthy client still gets every packet, in sequence
+	for want := uint32(1); want <= 3; want++ {
+		if m := nextMotion(t, conn); m.PktNo != want {
+			t.Errorf("healthy client got packet %d, want %d", m.PktNo, want)
+		}
+	}
+	drops := srv.SendDrops()
+	if drops[bad.String()] != 3 || drops[conn.LocalAddr().String()] != 0 {
+		t.Errorf("send drops %v, want 3 for %s only", drops, bad)
+	}
+	if !strings.Contains(log.String(), "DSU send to "+bad.String()+" failed, packet dropped") {
+		t.Errorf("no warning for the failed sends: %q", log.String())
+	}
+	// the count is a copy
+	drops[bad.String()] = 0
+	if srv.SendDrops()[bad.String()] != 3 {
+		t.Error("SendDrops returned the server's own map")
+	}
+}
+
+func TestRequestCRC(t *testing.T) {
+	srv, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.DialUDP("udp", nil, srv.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	noCRC := clientPacket(dsuMsgVersion, nil)
+	binary.LittleEndian.PutUint32(noCRC[8:12], 0)
+	if _, payload, err := parseDSUPacket(noCRC, dsuMagicClient); !errors.Is(err, errDSUCRC) || payload == nil {
+		t.Fatalf("zero CRC: payload %v, %v; want the payload with errDSUCRC", payload, err)
+	}
+	answered := func(pkt []byte) bool {
+		conn.Write(pkt)
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		buf := make([]byte, 256)
+		_, err := conn.Read(buf)
+		return err == nil
+	}
+	for _, tc := range []struct {
+		strict       bool
+		good, zeroed bool // answered
+	}{{false, true, true}, {true, true, false}} {
+		srv.SetStrictCRC(tc.strict)
+		if got := answered(clientPacket(dsuMsgVersion, nil)); got != tc.good {
+			t.Errorf("strict %v: request with a good CRC answered %v", tc.strict, got)
+		}
+		if got := answered(noCRC); got != tc.zeroed {
+			t.Errorf("strict %v: request with a zero CRC answered %v", tc.strict, got)
+		}
+	}
+}
+
+func TestPacketVersion(t *testing.T) {
+	srv, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pkt := srv.buildControllerInfo(0, 2)
+	if h, _, err := parseDSUPacket(pkt, dsuMagicServer); err != nil || h.Version != dsuProtoVersion {
+		t.Fatalf("info packet: %+v, %v", h, err)
+	}
+	// other revisions are refused
+	for _, v := range []uint16{0, 1000, 1002} {
+		binary.LittleEndian.PutUint16(pkt[4:6], v)
+		binary.LittleEndian.PutUint32(pkt[8:12], 0)
+		binary.LittleEndian.PutUint32(pkt[8:12], crc32.ChecksumIEEE(pkt))
+		if _, _, err := parseDSUPacket(pkt, dsuMagicServer); !errors.Is(err, errDSUVersion) {
+			t.Errorf("version %d packet: %v, want errDSUVersion", v, err)
+		}
+	}
+}
+
+func TestVersionReply(t *testing.T) {
+	_, conn := subscribedOutput(t, outputConfig{})
+	buf := make([]byte, 256)
+	conn.Write(clientPacket(dsuMsgVersion, nil))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, payload, err := parseDSUPacket(buf[:n], dsuMagicServer)
+		if err != nil || h.MsgType != dsuMsgVersion {
+			continue // the info packet sent on subscribe
+		}
+		if h.Version != dsuProtoVersion || binary.LittleEndian.Uint16(payload) != dsuProtoVersion {
+			t.Errorf("version reply with header %d, payload % x", h.Version, payload)
+		}
+		break
+	}
+}
+
+func TestParseMAC(t *testing.T) {
+	want := [6]byte{0x02, 0x20, 0x6a, 0x7e, 0x51, 0x01}
+	for _, tc := range []struct {
+		in string
+		ok bool
+	}{
+		{"02:20:6A:7E:51:01", true},
+		{"02-20-6a-7e-51-01", true},
+		{"02206A7E5101", true},
+		{"02:20:6A:7E:51", false},
+		{"02:20:6A:7E:51:01:00", false},
+		{"02:20:6A:7E:51:0G", false},
+		{"", false},
+	} {
+		got, err := parseMAC(tc.in)
+		if tc.ok && (err != nil || got != want) {
+			t.Errorf("parseMAC(%q) = %x, %v; want %x", tc.in, got, err, want)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("parseMAC(%q) = %x, want an error", tc.in, got)
+		}
+	}
+}
+
+func TestDeriveMAC(t *testing.T) {
+	id := "bmi260||/devices/platform/i2c-1/1-0068"
+	mac := deriveMAC(id)
+	if deriveMAC(id) != mac {
+		t.Error("deriveMAC is not deterministic")
+	}
+	if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 {
+		t.Errorf("%x is not a locally administered unicast MAC", mac)
+	}
+	if other := deriveMAC("bmi260||/devices/platform/i2c-2/2-0069"); other == mac {
+		t.Errorf("two devices share the MAC %x", mac)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+const (
+	// dumpFirst packets of each message type are always dumped, then one every dumpEvery.
+	dumpFirst = 5
+	dumpEvery = 250
+)
+
+// packetDumper hex-dumps outgoing DSU packets for --dump-packets, rate limited per message
+// type so a 250 Hz data stream stays readable.
+type packetDumper struct {
+	mu     sync.Mutex
+	counts map[uint32]int
+}
+
+func newPacketDumper() *packetDumper {
+	return &packetDumper{counts: make(map[uint32]int)}
+}
+
+// Dump prints pkt if its message type is due.
+func (d *packetDumper) Dump(dir string, pkt []byte) {
+	var mt uint32
+	if len(pkt) >= 20 {
+		mt = binary.LittleEndian.Uint32(pkt[16:20])
+	}
+	d.mu.Lock()
+	n := d.counts[mt]
+	d.counts[mt] = n + 1
+	d.mu.Unlock()
+	if n < dumpFirst || (n-dumpFirst+1)%dumpEvery == 0 {
+		fmt.Printf("%s #%d %s", dir, n+1, formatDSUPacket(pkt))
+	}
+}
+
+// dsuField describes one field of a DSU packet for the annotated dump. off is from the start
+// of the packet.
+type dsuField struct {
+	off, size int
+	name      string
+	kind      byte // 's' string, 'u' unsigned, 'h' unsigned in hex, 'f' float32, 'x' raw bytes
+}
+
+var dsuHeaderFields = []dsuField{
+	{0, 4, "magic", 's'},
+	{4, 2, "version", 'u'},
+	{6, 2, "length", 'u'},
+	{8, 4, "crc32", 'h'},
+	{12, 4, "server id", 'h'},
+	{16, 4, "message type", 'h'},
+}
+
+// dsuSharedFields is the shared beginning of info and data payloads.
+var dsuSharedFields = []dsuField{
+	{20, 1, "slot", 'u'},
+	{21, 1, "state", 'u'},
+	{22, 1, "model", 'u'},
+	{23, 1, "connection", 'u'},
+	{24, 6, "mac", 'x'},
+	{30, 1, "battery", 'u'},
+}
+
+var dsuPayloadFields = map[uint32][]dsuField{
+	dsuMsgVersion: {
+		{20, 2, "protocol version", 'u'},
+	},
+	dsuMsgInfo: append(append([]dsuField{}, dsuSharedFields...),
+		dsuField{31, 1, "active", 'u'},
+	),
+	dsuMsgData: append(append([]dsuField{}, dsuSharedFields...),
+		dsuField{31, 1, "connected", 'u'},
+		dsuField{32, 4, "packet number", 'u'},
+		dsuField{36, 4, "buttons/home/touch", 'x'},
+		dsuField{40, 4, "sticks", 'x'},
+		dsuField{44, 12, "analog buttons", 'x'},
+		dsuField{56, 12, "touches", 'x'},
+		dsuField{68, 8, "motion timestamp (us)", 'u'},
+		dsuField{76, 4, "accel x (g)", 'f'},
+		dsuField{80, 4, "accel y (g)", 'f'},
+		dsuField{84, 4, "accel z (g)", 'f'},
+		dsuField{88, 4, "gyro pitch (deg/s)", 'f'},
+		dsuField{92, 4, "gyro yaw (deg/s)", 'f'},
+		dsuField{96, 4, "gyro roll (deg/s)", 'f'},
+	),
+}
+
+var dsuMsgNames = map[uint32]string{
+	dsuMsgVersion: "Version",
+	dsuMsgInfo:    "ControllerInfo",
+	dsuMsgData:    "ControllerData",
+}
+
+// formatDSUPacket renders pkt as one header line followed by one line per field: offset, raw
+// bytes and decoded value. Bytes not covered by a known field are listed at the end.
+func formatDSUPacket(pkt []byte) string {
+	var sb strings.Builder
+	if len(pkt) < 20 {
+		fmt.Fprintf(&sb, "short packet, %d bytes: % x\n", len(pkt), pkt)
+		return sb.String()
+	}
+	mt := binary.LittleEndian.Uint32(pkt[16:20])
+	name := dsuMsgNames[mt]
+	if name == "" {
+		name = fmt.Sprintf("message 0x%08x", mt)
+	}
+	fmt.Fprintf(&sb, "%s, %d bytes\n", name, len(pkt))
+
+	fields := dsuHeaderFields
+	if string(pkt[:4]) != dsuMagicClient { // requests lay out their payloads differently
+		fields = append(append([]dsuField{}, dsuHeaderFields...), dsuPayloadFields[mt]...)
+	}
+	end := 0
+	for _, f := range fields {
+		if f.off+f.size > len(pkt) {
+			fmt.Fprintf(&sb, "  %04x  %-36s %s: truncated\n", f.off, "", f.name)
+			break
+		}
+		b := pkt[f.off : f.off+f.size]
+		var val string
+		switch f.kind {
+		case 's':
+			val = fmt.Sprintf("%q", b)
+		case 'u', 'h':
+			var v uint64
+			for i := len(b) - 1; i >= 0; i-- { // little endian
+				v = v<<8 | uint64(b[i])
+			}
+			if f.kind == 'h' {
+				val = fmt.Sprintf("0x%0*x", 2*f.size, v)
+			} else {
+				val = fmt.Sprint(v)
+			}
+		case 'f':
+			val = fmt.Sprintf("%g", math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		default:
+			val = fmt.Sprintf("%x", b)
+		}
+		fmt.Fprintf(&sb, "  %04x  %-36s %s = %s\n", f.off, fmt.Sprintf("% x", b), f.name, val)
+		end = f.off + f.size
+	}
+	if end < len(pkt) {
+		fmt.Fprintf(&sb, "  %04x  % x (unannotated)\n", end, pkt[end:])
+	}
+	return sb.String()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SampleReader is a source of IMU samples in SI units (rad/s, m/s^2). The main loop polls it
+// once per tick.
+type SampleReader interface {
+	readSample() (IMUSample, error)
+}
+
+// readMerged reads a sample from primary and, for split sensors, takes the gyro and accel
+// from the complementary readers (nil when not split). A failed complementary read keeps the
+// primary's values. The timestamp is combined by tsPolicy (see splitTimestamps), and the
+// complementary devices' skew from the primary goes to skew. The loop only sees
+// SampleReaders, so any source (or a scripted one) can stand in for the devices.
+func readMerged(primary, gyro, accel SampleReader, tsPolicy string, skew *skewStats) (IMUSample, error) {
+	s, err := primary.readSample()
+	if err != nil {
+		return s, err
+	}
+	stamps := []uint64{s.TSus}
+	if gyro != nil {
+		if gs, err := gyro.readSample(); err == nil {
+			s.Gyro, s.RawGyro = gs.Gyro, gs.RawGyro
+			stamps = append(stamps, gs.TSus)
+		}
+	}
+	if accel != nil {
+		if as, err := accel.readSample(); err == nil {
+			s.Accel, s.RawAccel = as.Accel, as.RawAccel
+			stamps = append(stamps, as.TSus)
+		}
+	}
+	for _, ts := range stamps[1:] {
+		skew.Add(int64(ts) - int64(stamps[0]))
+	}
+	s.TSus = combineSplitTS(tsPolicy, stamps)
+	return s, nil
+}
+
+// sampleSources are the selectable values of source / --source. auto uses IIO and falls back
+// to evdev when no IIO device is found; iio-buffer reads IIO through the buffer interface.
+var sampleSources = []string{"auto", "iio", "iio-buffer", "evdev"}
+
+// evdevDir holds the eventN nodes scanned for motion devices.
+var evdevDir = "/dev/input"
+
+// Linux input constants (linux/input.h, linux/input-event-codes.h).
+const (
+	evSyn = 0x00
+	evAbs = 0x03
+
+	synReport  = 0
+	synDropped = 3
+
+	absX  = 0x00
+	absY  = 0x01
+	absZ  = 0x02
+	absRX = 0x03
+	absRY = 0x04
+	absRZ = 0x05
+
+	inputPropAccelerometer = 0x06
+
+	// inputEventSize is sizeof(struct input_event) on this platform.
+	inputEventSize = int(unsafe.Sizeof(inputEvent{}))
+)
+
+// inputEvent mirrors struct input_event.
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// decodeInputEvent decodes one inputEventSize record; ts is the event time in microseconds.
+func decodeInputEvent(ev []byte) (ts uint64, typ, code uint16, value int32) {
+	var sec, usec int64
+	off := int(unsafe.Sizeof(syscall.Timeval{}))
+	if off == 16 {
+		sec, usec = int64(binary.LittleEndian.Uint64(ev)), int64(binary.LittleEndian.Uint64(ev[8:]))
+	} else {
+		sec, usec = int64(int32(binary.LittleEndian.Uint32(ev))), int64(int32(binary.LittleEndian.Uint32(ev[4:])))
+	}
+	return uint64(sec*1e6 + usec), binary.LittleEndian.Uint16(ev[off:]), binary.LittleEndian.Uint16(ev[off+2:]),
+		int32(binary.LittleEndian.Uint32(ev[off+4:]))
+}
+
+// evdev ioctls, as built by the _IOC macros with direction read.
+func eviocgname(n int) uintptr    { return 2<<30 | uintptr(n)<<16 | 'E'<<8 | 0x06 }
+func eviocgprop(n int) uintptr    { return 2<<30 | uintptr(n)<<16 | 'E'<<8 | 0x09 }
+func eviocgbit(ev, n int) uintptr { return 2<<30 | uintptr(n)<<16 | 'E'<<8 | uintptr(0x20+ev) }
+func eviocgabs(abs int) uintptr {
+	return 2<<30 | unsafe.Sizeof(absInfo{})<<16 | 'E'<<8 | uintptr(0x40+abs)
+}
+
+// absInfo mirrors struct input_absinfo.
+type absInfo struct {
+	Value, Minimum, Maximum, Fuzz, Flat, Resolution int32
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// EvdevDevice reads a kernel motion-sensor input device (INPUT_PROP_ACCELEROMETER), as
+// exposed by hid-playstation, hid-nintendo and some handheld drivers. Accel comes on
+// ABS_X/Y/Z in units per g, gyro on ABS_RX/RY/RZ in units per deg/s; the per-axis
+// resolution gives the scale.
+//
+// Events arrive as a stream, so a goroutine applies them and readSample returns the state of
+// the last complete report.
+type EvdevDevice struct {
+	Path       string
+	Name       string
+	SysPath    string // /sys/class/input/eventN, for the connection type
+	HaveGyro   bool
+	HaveAccel  bool
+	GyroScale  Vec3 // rad/s per unit
+	AccelScale Vec3 // m/s^2 per unit
+
+	f        *os.File
+	mu       sync.Mutex
+	pending  [6]int32 // values of the report being assembled, indexed by ABS code
+	latest   [6]int32 // values as of the last SYN_REPORT
+	latestTS uint64   // event time of the last SYN_REPORT, µs; 0 before the first
+	err      error    // set when the reader stops
+}
+
+// isEvdevMotionDevice reports whether the device at path is an input motion sensor.
+func isEvdevMotionDevice(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var props [8]byte
+	if err := ioctl(f.Fd(), eviocgprop(len(props)), unsafe.Pointer(&props[0])); err != nil {
+		return false
+	}
+	return props[inputPropAccelerometer/8]&(1<<(inputPropAccelerometer%8)) != 0
+}
+
+// findEvdevMotionDevice returns the first event node of a motion sensor, in device order.
+func findEvdevMotionDevice() (string, error) {
+	paths, _ := filepath.Glob(filepath.Join(evdevDir, "event*"))
+	num := func(p string) int {
+		n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(p), "event"))
+		return n
+	}
+	sort.Slice(paths, func(i, j int) bool { return num(paths[i]) < num(paths[j]) })
+	for _, p := range paths {
+		if isEvdevMotionDevice(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no evdev motion device found in %s (need read access to the event nodes)", evdevDir)
+}
+
+// openEvdevDevice opens path, reads the axis info and starts the event reader.
+func openEvdevDevice(path string) (*EvdevDevice, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &EvdevDevice{Path: path, f: f, SysPath: filepath.Join("/sys/class/input", filepath.Base(path))}
+
+	var name [256]byte
+	if err := ioctl(f.Fd(), eviocgname(len(name)), unsafe.Pointer(&name[0])); err == nil {
+		d.Name = strings.TrimRight(string(name[:]), "\x00")
+	}
+	var absBits [8]byte
+	if err := ioctl(f.Fd(), eviocgbit(evAbs, len(absBits)), unsafe.Pointer(&absBits[0])); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: not an evdev device: %w", path, err)
+	}
+	has := func(code int) bool { return absBits[code/8]&(1<<(code%8)) != 0 }
+
+	// scale returns the SI factor for one axis: unit converts one resolution step (1 g or 1 deg/s)
+	scale := func(code int, unit float64) float64 {
+		var ai absInfo
+		if err := ioctl(f.Fd(), eviocgabs(code), unsafe.Pointer(&ai)); err != nil || ai.Resolution <= 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: %s: axis 0x%02x has no resolution; assuming 1 unit = 1\n", path, code)
+			return unit
+		}
+		d.pending[code], d.latest[code] = ai.Value, ai.Value
+		return unit / float64(ai.Resolution)
+	}
+	if has(absX) && has(absY) && has(absZ) {
+		d.HaveAccel = true
+		d.AccelScale = Vec3{X: scale(absX, standardGravity), Y: scale(absY, standardGravity), Z: scale(absZ, standardGravity)}
+	}
+	if has(absRX) && has(absRY) && has(absRZ) {
+		d.HaveGyro = true
+		d.GyroScale = Vec3{X: scale(absRX, math.Pi/180), Y: scale(absRY, math.Pi/180), Z: scale(absRZ, math.Pi/180)}
+	}
+	if !d.HaveGyro && !d.HaveAccel {
+		f.Close()
+		return nil, fmt.Errorf("%s: no accel (ABS_X/Y/Z) or gyro (ABS_RX/RY/RZ) axes", path)
+	}
+
+	go d.run(f)
+	return d, nil
+}
+
+// run decodes events from r until it fails.
+func (d *EvdevDevice) run(r io.Reader) {
+	buf := make([]byte, inputEventSize*64)
+	for {
+		n, err := io.ReadAtLeast(r, buf, inputEventSize)
+		for off := 0; off+inputEventSize <= n; off += inputEventSize {
+			d.handleEvent(decodeInputEvent(buf[off : off+inputEventSize]))
+		}
+		if err != nil {
+			d.mu.Lock()
+			d.err = err
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// handleEvent applies one input event. Axis values are staged until SYN_REPORT so a sample
+// never mixes two reports; after SYN_DROPPED the staged values are discarded. ts is the event
+// time; the report's SYN_REPORT time becomes the sample timestamp.
+func (d *EvdevDevice) handleEvent(ts uint64, typ, code uint16, value int32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch typ {
+	case evAbs:
+		if int(code) < len(d.pending) {
+			d.pending[code] = value
+		}
+	case evSyn:
+		switch code {
+		case synReport:
+			d.latest, d.latestTS = d.pending, ts
+		case synDropped:
+			d.pending = d.latest
+		}
+	}
+}
+
+// readSample returns the last complete report, timestamped with the kernel's event time
+// (CLOCK_REALTIME, like time.Now, which stands in until the first report).
+func (d *EvdevDevice) readSample() (IMUSample, error) {
+	d.mu.Lock()
+	v, ts, err := d.latest, d.latestTS, d.err
+	d.mu.Unlock()
+	if ts == 0 {
+		ts = uint64(time.Now().UnixMicro())
+	}
+	s := IMUSample{TSus: ts}
+	if err != nil {
+		if errors.Is(err, syscall.ENODEV) {
+			err = fmt.Errorf("%s: device removed", d.Path)
+		}
+		return s, err
+	}
+	if d.HaveAccel {
+		s.RawAccel = [3]int64{int64(v[absX]), int64(v[absY]), int64(v[absZ])}
+		s.Accel = Vec3{
+			X: float64(v[absX]) * d.AccelScale.X,
+			Y: float64(v[absY]) * d.AccelScale.Y,
+			Z: float64(v[absZ]) * d.AccelScale.Z,
+		}
+	}
+	if d.HaveGyro {
+		s.RawGyro = [3]int64{int64(v[absRX]), int64(v[absRY]), int64(v[absRZ])}
+		s.Gyro = Vec3{
+			X: float64(v[absRX]) * d.GyroScale.X,
+			Y: float64(v[absRY]) * d.GyroScale.Y,
+			Z: float64(v[absRZ]) * d.GyroScale.Z,
+		}
+	}
+	return s, nil
+}
+
+func (d *EvdevDevice) Close() error { return d.f.Close() }
+
+// openEvdevSource opens evdev_path, or the first motion device in evdevDir, with the sensors
+// disabled in the config dropped.
+func openEvdevSource(cfg *Config) (*EvdevDevice, error) {
+	path := cfg.EvdevPath
+	if path == "" {
+		p, err := findEvdevMotionDevice()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+	d, err := openEvdevDevice(path)
+	if err != nil {
+		return nil, err
+	}
+	d.HaveGyro = d.HaveGyro && *cfg.EnableGyro
+	d.HaveAccel = d.HaveAccel && *cfg.EnableAccel
+	return d, nil
+}
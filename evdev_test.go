@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unsafe"
+)
+
+// evStream encodes input events as the kernel writes them to an event node.
+type evStream struct{ bytes.Buffer }
+
+func (s *evStream) event(tsUS int64, typ, code uint16, value int32) {
+	binary.Write(&s.Buffer, binary.LittleEndian, inputEvent{
+		Time: syscall.NsecToTimeval(tsUS * 1000), Type: typ, Code: code, Value: value,
+	})
+}
+
+// report writes one motion report: accel on ABS_X/Y/Z, gyro on ABS_RX/RY/RZ, then SYN_REPORT.
+func (s *evStream) report(tsUS int64, accel, gyro [3]int32) {
+	for i, v := range accel {
+		s.event(tsUS, evAbs, uint16(absX+i), v)
+	}
+	for i, v := range gyro {
+		s.event(tsUS, evAbs, uint16(absRX+i), v)
+	}
+	s.event(tsUS, evSyn, synReport, 0)
+}
+
+// heldReader returns its data, then blocks until the test ends, like an idle event node.
+type heldReader struct {
+	r    io.Reader
+	done chan struct{}
+}
+
+func (h *heldReader) Read(p []byte) (int, error) {
+	if n, _ := h.r.Read(p); n > 0 {
+		return n, nil
+	}
+	<-h.done
+	return 0, io.EOF
+}
+
+// evdevFixture is a motion device with hid-playstation's resolutions: 8192 units per g and
+// 1024 units per deg/s.
+func evdevFixture() *EvdevDevice {
+	g, d := standardGravity/8192, math.Pi/180/1024
+	return &EvdevDevice{
+		Path: "/dev/input/event9", HaveGyro: true, HaveAccel: true,
+		AccelScale: Vec3{g, g, g}, GyroScale: Vec3{d, d, d},
+	}
+}
+
+// feed runs d's reader on stream and waits until it has applied the report at lastTS.
+func feed(t *testing.T, d *EvdevDevice, stream *evStream, lastTS uint64) IMUSample {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go d.run(&heldReader{r: stream, done: done})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s, err := d.readSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.TSus == lastTS {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("report at %d µs never applied", lastTS)
+	return IMUSample{}
+}
+
+func TestInputEventSize(t *testing.T) {
+	// timeval plus type, code and value
+	if want := int(unsafe.Sizeof(syscall.Timeval{})) + 8; inputEventSize != want {
+		t.Errorf("inputEventSize = %d, want %d", inputEventSize, want)
+	}
+}
+
+func TestEvdevReports(t *testing.T) {
+	d := evdevFixture()
+	var stream evStream
+	stream.report(1_700_000_000_000_000, [3]int32{0, 0, 8192}, [3]int32{1024, 0, -2048})
+	stream.report(1_700_000_000_004_000, [3]int32{8192, 0, 0}, [3]int32{0, 512, 0})
+	// a report cut short by SYN_DROPPED is discarded, the next full one is taken
+	stream.event(1_700_000_000_008_000, evAbs, absX, 1)
+	stream.event(1_700_000_000_008_000, evSyn, synDropped, 0)
+	stream.event(1_700_000_000_012_000, evAbs, absRZ, 4096)
+	stream.event(1_700_000_000_012_000, evSyn, synReport, 0)
+	// values without SYN_REPORT are not visible yet
+	stream.event(1_700_000_000_016_000, evAbs, absY, 8192)
+
+	s := feed(t, d, &stream, 1_700_000_000_012_000)
+	wantAccel := Vec3{X: standardGravity}
+	wantGyro := Vec3{Y: 0.5 * math.Pi / 180, Z: 4 * math.Pi / 180}
+	if !near(s.Accel, wantAccel, 1e-9) || !near(s.Gyro, wantGyro, 1e-9) {
+		t.Errorf("sample accel %+v gyro %+v, want %+v and %+v", s.Accel, s.Gyro, wantAccel, wantGyro)
+	}
+	if s.RawAccel != [3]int64{8192, 0, 0} || s.RawGyro != [3]int64{0, 512, 4096} {
+		t.Errorf("raw accel %v gyro %v", s.RawAccel, s.RawGyro)
+	}
+	// a poll without a new report returns the same sample and timestamp
+	if again, _ := d.readSample(); again != s {
+		t.Errorf("second poll = %+v, want %+v", again, s)
+	}
+}
+
+func TestEvdevDisabledSensor(t *testing.T) {
+	d := evdevFixture()
+	d.HaveGyro = false
+	var stream evStream
+	stream.report(1000, [3]int32{0, 8192, 0}, [3]int32{1024, 1024, 1024})
+	s := feed(t, d, &stream, 1000)
+	if s.Gyro != (Vec3{}) || !near(s.Accel, Vec3{Y: standardGravity}, 1e-9) {
+		t.Errorf("gyro off: got gyro %+v accel %+v", s.Gyro, s.Accel)
+	}
+}
+
+func TestEvdevReaderStops(t *testing.T) {
+	d := evdevFixture()
+	var stream evStream
+	stream.report(1000, [3]int32{}, [3]int32{})
+	d.run(&stream) // returns at EOF
+	if _, err := d.readSample(); err != io.EOF {
+		t.Errorf("after the reader stopped: %v, want EOF", err)
+	}
+	d = evdevFixture()
+	d.run(iotest.ErrReader(syscall.ENODEV))
+	if _, err := d.readSample(); err == nil || err.Error() != "/dev/input/event9: device removed" {
+		t.Errorf("after ENODEV: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import "math"
+
+// standardGravity is 1 g in m/s^2.
+const standardGravity = 9.80665
+
+// restGravity is the accel reading in the DSU frame (after the mount matrix) with the device
+// lying flat, screen up. It matches the shipped example configs.
+var restGravity = Vec3{Z: -standardGravity}
+
+func (a Vec3) Add(b Vec3) Vec3      { return Vec3{a.X + b.X, a.Y + b.Y, a.Z + b.Z} }
+func (a Vec3) Sub(b Vec3) Vec3      { return Vec3{a.X - b.X, a.Y - b.Y, a.Z - b.Z} }
+func (a Vec3) Scale(k float64) Vec3 { return Vec3{a.X * k, a.Y * k, a.Z * k} }
+func (a Vec3) Mul(b Vec3) Vec3      { return Vec3{a.X * b.X, a.Y * b.Y, a.Z * b.Z} } // per component
+func (a Vec3) Dot(b Vec3) float64   { return a.X*b.X + a.Y*b.Y + a.Z*b.Z }
+func (a Vec3) Norm() float64        { return math.Sqrt(a.Dot(a)) }
+func (a Vec3) Cross(b Vec3) Vec3 {
+	return Vec3{a.Y*b.Z - a.Z*b.Y, a.Z*b.X - a.X*b.Z, a.X*b.Y - a.Y*b.X}
+}
+
+// rotateVec rotates v by angle (radians) about axis using Rodrigues' formula.
+func rotateVec(v, axis Vec3, angle float64) Vec3 {
+	n := axis.Norm()
+	if n == 0 || angle == 0 {
+		return v
+	}
+	k := axis.Scale(1 / n)
+	c, s := math.Cos(angle), math.Sin(angle)
+	return v.Scale(c).Add(k.Cross(v).Scale(s)).Add(k.Scale(k.Dot(v) * (1 - c)))
+}
+
+// gravitySynth keeps a gravity estimate in the DSU frame by rotating it with the gyro, for
+// devices that have no accelerometer (--synth-accel). It starts from restGravity, so it
+// assumes the device starts flat and still; drift is never corrected.
+type gravitySynth struct {
+	g      Vec3
+	lastTS uint64
+}
+
+func newGravitySynth() *gravitySynth {
+	return &gravitySynth{g: restGravity}
+}
+
+// Update advances the estimate with one gyro sample (rad/s, DSU frame) and returns it.
+func (gs *gravitySynth) Update(gyro Vec3, tsUS uint64) Vec3 {
+	if gs.lastTS != 0 && tsUS > gs.lastTS {
+		dt := float64(tsUS-gs.lastTS) / 1e6
+		// skip integration across stalls (suspend, long read errors)
+		if dt < 0.5 {
+			// a vector fixed in the world turns the opposite way in a frame rotating at gyro
+			gs.g = rotateVec(gs.g, gyro, -gyro.Norm()*dt)
+			gs.g = gs.g.Scale(standardGravity / gs.g.Norm())
+		}
+	}
+	gs.lastTS = tsUS
+	return gs.g
+}
+
+// Quat is a unit quaternion. In the orientation filter it rotates device-frame vectors into
+// the world frame.
+type Quat struct{ W, X, Y, Z float64 }
+
+var identityQuat = Quat{W: 1}
+
+func (q Quat) Mul(r Quat) Quat {
+	return Quat{
+		W: q.W*r.W - q.X*r.X - q.Y*r.Y - q.Z*r.Z,
+		X: q.W*r.X + q.X*r.W + q.Y*r.Z - q.Z*r.Y,
+		Y: q.W*r.Y - q.X*r.Z + q.Y*r.W + q.Z*r.X,
+		Z: q.W*r.Z + q.X*r.Y - q.Y*r.X + q.Z*r.W,
+	}
+}
+
+func (q Quat) Conj() Quat { return Quat{q.W, -q.X, -q.Y, -q.Z} }
+
+func (q Quat) Norm() float64 { return math.Sqrt(q.W*q.W + q.X*q.X + q.Y*q.Y + q.Z*q.Z) }
+
+// Normalize returns q scaled to unit length, with a non-negative W so equal rotations
+// print the same.
+func (q Quat) Normalize() Quat {
+	n := q.Norm()
+	if n == 0 {
+		return identityQuat
+	}
+	if q.W < 0 {
+		n = -n
+	}
+	return Quat{q.W / n, q.X / n, q.Y / n, q.Z / n}
+}
+
+// Rotate applies the rotation q to v.
+func (q Quat) Rotate(v Vec3) Vec3 {
+	p := q.Mul(Quat{0, v.X, v.Y, v.Z}).Mul(q.Conj())
+	return Vec3{p.X, p.Y, p.Z}
+}
+
+// quatFromAxisAngle returns the rotation by angle (radians) about axis.
+func quatFromAxisAngle(axis Vec3, angle float64) Quat {
+	n := axis.Norm()
+	if n == 0 || angle == 0 {
+		return identityQuat
+	}
+	s := math.Sin(angle/2) / n
+	return Quat{math.Cos(angle / 2), axis.X * s, axis.Y * s, axis.Z * s}
+}
+
+// quatBetween returns the shortest rotation taking direction a onto direction b.
+func quatBetween(a, b Vec3) Quat {
+	a, b = a.Scale(1/a.Norm()), b.Scale(1/b.Norm())
+	axis := a.Cross(b)
+	d := math.Max(-1, math.Min(1, a.Dot(b)))
+	if axis.Norm() < 1e-9 {
+		if d > 0 {
+			return identityQuat
+		}
+		// opposite: any perpendicular axis does
+		axis = a.Cross(Vec3{X: 1})
+		if axis.Norm() < 1e-9 {
+			axis = a.Cross(Vec3{Y: 1})
+		}
+	}
+	return quatFromAxisAngle(axis, math.Acos(d))
+}
+
+// EulerDeg returns roll (about X), pitch (about Y) and yaw (about Z) in degrees.
+func (q Quat) EulerDeg() (roll, pitch, yaw float64) {
+	const rad2deg = 180 / math.Pi
+	roll = math.Atan2(2*(q.W*q.X+q.Y*q.Z), 1-2*(q.X*q.X+q.Y*q.Y)) * rad2deg
+	pitch = math.Asin(math.Max(-1, math.Min(1, 2*(q.W*q.Y-q.Z*q.X)))) * rad2deg
+	yaw = math.Atan2(2*(q.W*q.Z+q.X*q.Y), 1-2*(q.Y*q.Y+q.Z*q.Z)) * rad2deg
+	return roll, pitch, yaw
+}
+
+const (
+	// orientationGain is how fast (1/s) the filter pulls its tilt toward the accelerometer.
+	// Low enough that hand motion does not tilt the estimate, high enough to cancel gyro drift.
+	orientationGain = 0.5
+	// orientationAccelTol is how far (fraction of 1 g) the accel magnitude may be from 1 g for
+	// the sample to be used as a gravity reference.
+	orientationAccelTol = 0.15
+)
+
+// orientationFilter fuses gyro and accel into an orientation (a complementary filter: the
+// gyro is integrated and the accel slowly corrects roll and pitch). Yaw has no reference and
+// drifts with the gyro. Inputs are in the DSU frame (after the mount matrices).
+type orientationFilter struct {
+	q      Quat
+	lastTS uint64
+	inited bool
+}
+
+func newOrientationFilter() *orientationFilter {
+	return &orientationFilter{q: identityQuat}
+}
+
+// Update advances the filter with one sample (gyro in rad/s, accel in m/s^2, timestamp in
+// microseconds) and returns the orientation.
+func (f *orientationFilter) Update(gyro, accel Vec3, tsUS uint64) Quat {
+	an := accel.Norm()
+	useAccel := an > 0 && math.Abs(an-standardGravity) < orientationAccelTol*standardGravity
+	if !f.inited {
+		// start level with the measured gravity so the first output is not a slow slide
+		if useAccel {
+			f.q = quatBetween(accel, restGravity)
+		}
+		f.lastTS, f.inited = tsUS, true
+		return f.q
+	}
+	if tsUS <= f.lastTS {
+		return f.q
+	}
+	dt := float64(tsUS-f.lastTS) / 1e6
+	f.lastTS = tsUS
+	// skip integration across stalls (suspend, long read errors)
+	if dt >= 0.5 {
+		return f.q
+	}
+	w := gyro
+	if useAccel {
+		// the error between measured and predicted gravity (device frame) becomes an extra
+		// rotation rate that turns the estimate toward the measurement
+		predicted := f.q.Conj().Rotate(restGravity).Scale(1 / standardGravity)
+		w = w.Add(predicted.Cross(accel.Scale(1 / an)).Scale(-orientationGain))
+	}
+	f.q = f.q.Mul(quatFromAxisAngle(w, w.Norm()*dt)).Normalize()
+	return f.q
+}
+
+// defaultGravityCutoffHz is the corner of the gravity estimate's low-pass (gravity_cutoff_hz).
+// It only feeds fusion and sanity checks, so it can be much smoother than the DSU accel.
+const defaultGravityCutoffHz = 2.0
+
+// vecLowPass is a first-order low-pass on a vector, stepped by sample timestamps.
+type vecLowPass struct {
+	tau    float64 // time constant, s; 0 passes samples through
+	v      Vec3
+	lastTS uint64
+	inited bool
+}
+
+// newVecLowPass returns a low-pass with corner cutoffHz; 0 or less disables filtering.
+func newVecLowPass(cutoffHz float64) *vecLowPass {
+	if cutoffHz <= 0 {
+		return &vecLowPass{}
+	}
+	return &vecLowPass{tau: 1 / (2 * math.Pi * cutoffHz)}
+}
+
+// SetCutoff changes the corner frequency, keeping the filtered value; 0 or less disables
+// filtering.
+func (f *vecLowPass) SetCutoff(cutoffHz float64) {
+	f.tau = 0
+	if cutoffHz > 0 {
+		f.tau = 1 / (2 * math.Pi * cutoffHz)
+	}
+}
+
+// Update feeds one sample and returns the filtered value. The first sample is taken as is.
+func (f *vecLowPass) Update(v Vec3, tsUS uint64) Vec3 {
+	if !f.inited || f.tau == 0 {
+		f.v, f.lastTS, f.inited = v, tsUS, true
+		return f.v
+	}
+	if tsUS > f.lastTS {
+		dt := float64(tsUS-f.lastTS) / 1e6
+		f.v = f.v.Add(v.Sub(f.v).Scale(dt / (f.tau + dt)))
+		f.lastTS = tsUS
+	}
+	return f.v
+}
+
+// linearAccelCutoffHz is the corner of the gravity low-pass in linearAccelFilter. Gravity
+// only changes as fast as the device is turned, user acceleration is mostly above this.
+const linearAccelCutoffHz = 0.3
+
+// linearAccelFilter separates user (linear) acceleration from gravity: a first-order
+// low-pass tracks gravity and is subtracted from the reading, which makes the output a
+// high-pass of the accel. DSU clients expect gravity-inclusive accel, so this is only for
+// outputs that ask for linear acceleration.
+type linearAccelFilter struct {
+	gravity *vecLowPass
+}
+
+func newLinearAccelFilter(cutoffHz float64) *linearAccelFilter {
+	return &linearAccelFilter{gravity: newVecLowPass(cutoffHz)}
+}
+
+// Update feeds one accel sample (m/s^2) and returns it with gravity removed. The low-pass
+// starts from the first reading, so a resting device outputs zero right away.
+func (f *linearAccelFilter) Update(accel Vec3, tsUS uint64) Vec3 {
+	return accel.Sub(f.gravity.Update(accel, tsUS))
+}
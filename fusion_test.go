@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGravitySynthFollowsRotation(t *testing.T) {
+	gs := newGravitySynth()
+	if g := gs.Update(Vec3{}, 1_000_000); g != restGravity {
+		t.Fatalf("start = %+v, want %+v", g, restGravity)
+	}
+	// turn 90 degrees about X over one second
+	rate := Vec3{X: math.Pi / 2}
+	var g Vec3
+	for i := 1; i <= 1000; i++ {
+		g = gs.Update(rate, 1_000_000+uint64(i)*1000)
+	}
+	// a world-fixed vector turns the other way in the device frame: -Z becomes -Y
+	if want := (Vec3{Y: -standardGravity}); !near(g, want, 1e-6) {
+		t.Errorf("after +90 deg about X gravity = %+v, want %+v", g, want)
+	}
+	if math.Abs(g.Norm()-standardGravity) > 1e-9 {
+		t.Errorf("|g| = %g, want 1 g", g.Norm())
+	}
+
+	// a stall (suspend) is not integrated
+	if got := gs.Update(Vec3{Z: 10}, 3_000_000); got != g {
+		t.Errorf("integrated across a 1 s gap: %+v -> %+v", g, got)
+	}
+	// spinning about the gravity axis leaves it alone
+	gs = newGravitySynth()
+	gs.Update(Vec3{}, 1000)
+	for i := 2; i <= 500; i++ {
+		g = gs.Update(Vec3{Z: 3}, uint64(i)*1000)
+	}
+	if !near(g, restGravity, 1e-9) {
+		t.Errorf("yaw changed gravity to %+v", g)
+	}
+}
+
+func TestQuatNormalize(t *testing.T) {
+	for _, q := range []Quat{{2, 0, 0, 0}, {1, 1, 1, 1}, {-0.5, 0.1, 0, 3}, {0, 0, 0, 1e-12}} {
+		n := q.Normalize()
+		if math.Abs(n.Norm()-1) > 1e-12 || n.W < 0 {
+			t.Errorf("Normalize(%+v) = %+v, |q| = %g", q, n, n.Norm())
+		}
+		// the sign flip keeps the rotation
+		k := 1 / q.Norm()
+		if v := (Vec3{1, 2, 3}); !near(n.Rotate(v), (Quat{q.W * k, q.X * k, q.Y * k, q.Z * k}).Rotate(v), 1e-9) {
+			t.Errorf("Normalize(%+v) changed the rotation", q)
+		}
+	}
+	if got := (Quat{}).Normalize(); got != identityQuat {
+		t.Errorf("Normalize(0) = %+v, want identity", got)
+	}
+}
+
+func TestQuatKnownRotations(t *testing.T) {
+	q := quatFromAxisAngle(Vec3{Z: 2}, math.Pi/2) // the axis need not be unit length
+	if got, want := q.Rotate(Vec3{X: 1}), (Vec3{Y: 1}); !near(got, want, 1e-12) {
+		t.Errorf("90 deg about Z: X -> %+v, want %+v", got, want)
+	}
+	if roll, pitch, yaw := q.EulerDeg(); math.Abs(roll) > 1e-9 || math.Abs(pitch) > 1e-9 || math.Abs(yaw-90) > 1e-9 {
+		t.Errorf("EulerDeg = %g, %g, %g, want 0, 0, 90", roll, pitch, yaw)
+	}
+	for _, tc := range []struct{ a, b Vec3 }{
+		{Vec3{Z: -1}, Vec3{X: 3}},
+		{Vec3{1, 1, 0}, Vec3{0, 0, 5}},
+		{Vec3{Z: 1}, Vec3{Z: -1}}, // opposite
+		{Vec3{X: 1}, Vec3{X: -2}},
+	} {
+		got := quatBetween(tc.a, tc.b).Rotate(tc.a.Scale(1 / tc.a.Norm()))
+		if want := tc.b.Scale(1 / tc.b.Norm()); !near(got, want, 1e-9) {
+			t.Errorf("quatBetween(%+v, %+v) rotates a to %+v", tc.a, tc.b, got)
+		}
+	}
+}
+
+func TestOrientationFilterIntegratesGyro(t *testing.T) {
+	f := newOrientationFilter()
+	// no usable accel: pure timestamp-based gyro integration, 90 deg/s about Z for 1 s at an
+	// uneven sample spacing
+	f.Update(Vec3{}, Vec3{}, 1_000_000)
+	rate := Vec3{Z: math.Pi / 2}
+	var q Quat
+	for ts := uint64(1_000_000); ts < 2_000_000; {
+		ts += 3000 + (ts/1000)%5*1000
+		if ts > 2_000_000 {
+			ts = 2_000_000
+		}
+		q = f.Update(rate, Vec3{}, ts)
+		if math.Abs(q.Norm()-1) > 1e-12 {
+			t.Fatalf("|q| = %.15f at %d", q.Norm(), ts)
+		}
+	}
+	want := quatFromAxisAngle(Vec3{Z: 1}, math.Pi/2)
+	if math.Abs(q.W-want.W) > 1e-9 || math.Abs(q.Z-want.Z) > 1e-9 || math.Abs(q.X)+math.Abs(q.Y) > 1e-9 {
+		t.Errorf("after 90 deg about Z q = %+v, want %+v", q, want)
+	}
+	// a repeated or older timestamp does not integrate
+	if got := f.Update(rate, Vec3{}, 2_000_000); got != q {
+		t.Errorf("repeated timestamp moved q to %+v", got)
+	}
+}
+
+func TestOrientationFilterStartsLevelWithGravity(t *testing.T) {
+	f := newOrientationFilter()
+	// lying on its right side: gravity along -X in the device frame
+	accel := Vec3{X: -standardGravity}
+	q := f.Update(Vec3{}, accel, 1_000_000)
+	if got := q.Rotate(accel); !near(got, restGravity, 1e-9) {
+		t.Errorf("measured gravity maps to %+v in the world, want %+v", got, restGravity)
+	}
+	// still and level, the estimate stays put
+	for i := 1; i <= 100; i++ {
+		q = f.Update(Vec3{}, accel, 1_000_000+uint64(i)*10_000)
+	}
+	if got := q.Rotate(accel); !near(got, restGravity, 1e-9) {
+		t.Errorf("drifted at rest: gravity maps to %+v", got)
+	}
+}
+
+func TestLinearAccelFilter(t *testing.T) {
+	f := newLinearAccelFilter(linearAccelCutoffHz)
+	g := Vec3{X: 1.2, Y: -0.4, Z: -9.72}
+	ts := uint64(1_000_000)
+	// resting: gravity alone is no user acceleration, from the first sample on
+	for i := 0; i < 200; i++ {
+		ts += 10_000
+		if lin := f.Update(g, ts); !near(lin, Vec3{}, 1e-9) {
+			t.Fatalf("sample %d at rest: linear accel %+v", i, lin)
+		}
+	}
+	// a 50 ms push of 3 m/s^2 along +Y comes through almost whole
+	var peak float64
+	for i := 0; i < 5; i++ {
+		ts += 10_000
+		peak = math.Max(peak, f.Update(g.Add(Vec3{Y: 3}), ts).Y)
+	}
+	if peak < 2.7 {
+		t.Errorf("transient peak %.3f m/s^2, want close to 3", peak)
+	}
+	// and dies away once the push ends
+	var lin Vec3
+	for i := 0; i < 1000; i++ {
+		ts += 10_000
+		lin = f.Update(g, ts)
+	}
+	if !near(lin, Vec3{}, 0.01) {
+		t.Errorf("10 s after the push: linear accel %+v", lin)
+	}
+}
+
+func TestGravityAndDSUAccelPathsDiverge(t *testing.T) {
+	// resting gravity plus a 15 Hz hand tremor of ±3 m/s^2 on x, sampled at 250 Hz
+	accelAt := func(i int) Vec3 {
+		return Vec3{X: 3 * math.Sin(2*math.Pi*15*float64(i)/250), Z: -standardGravity}
+	}
+	for _, tc := range []struct {
+		accelCutoffHz      float64
+		minSwing, maxSwing float64 // peak x of the DSU accel once settled
+	}{
+		{0, 2.95, 3}, // accel_cutoff_hz off (the default): the reading as is
+		{20, 1.5, 2.8},
+		{5, 0.5, 1.5},
+	} {
+		gravity, accel := newVecLowPass(defaultGravityCutoffHz), newVecLowPass(tc.accelCutoffHz)
+		var gravPeak, accelPeak float64
+		for i := range 1000 {
+			in := accelAt(i)
+			ts := uint64(1_000_000 + i*4000)
+			g, a := gravity.Update(in, ts), accel.Update(in, ts)
+			if i >= 750 { // the last second
+				gravPeak, accelPeak = max(gravPeak, math.Abs(g.X)), max(accelPeak, math.Abs(a.X))
+				if math.Abs(g.Z+standardGravity) > 1e-9 || math.Abs(a.Z+standardGravity) > 1e-9 {
+					t.Fatalf("the constant gravity was changed: %+v, %+v", g, a)
+				}
+			}
+		}
+		// fusion sees a steady gravity whatever the DSU accel is filtered at
+		if gravPeak > 0.5 {
+			t.Errorf("accel cutoff %g Hz: gravity estimate swings ±%.2f, want under ±0.5", tc.accelCutoffHz, gravPeak)
+		}
+		if accelPeak < tc.minSwing || accelPeak > tc.maxSwing {
+			t.Errorf("accel cutoff %g Hz: DSU accel swings ±%.2f, want %g-%g", tc.accelCutoffHz, accelPeak, tc.minSwing, tc.maxSwing)
+		}
+	}
+}
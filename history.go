@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultHistorySize is how many sent samples are kept for diagnostics (about 2 s at 250 Hz).
+const defaultHistorySize = 500
+
+// historyEntry is one sample as sent to the outputs, with the raw counts it came from.
+type historyEntry struct {
+	Time     time.Time  `json:"time"`
+	TSus     uint64     `json:"ts_us"`
+	Gyro     [3]float64 `json:"gyro"`  // rad/s
+	Accel    [3]float64 `json:"accel"` // m/s^2
+	RawGyro  [3]int64   `json:"raw_gyro"`
+	RawAccel [3]int64   `json:"raw_accel"`
+}
+
+// sampleHistory is a ring of the last samples sent, for "it glitched once" reports: GET
+// /history on the control API and SIGQUIT return it without recording anything to disk.
+type sampleHistory struct {
+	mu   sync.Mutex
+	buf  []historyEntry
+	next int // slot the next sample goes to
+	full bool
+}
+
+// newSampleHistory returns a ring holding the last size samples; nil when size is 0.
+func newSampleHistory(size int) *sampleHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &sampleHistory{buf: make([]historyEntry, size)}
+}
+
+// Add records s, sent at now, replacing the oldest sample when the ring is full.
+func (h *sampleHistory) Add(s IMUSample, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf[h.next] = historyEntry{
+		Time:     now,
+		TSus:     s.TSus,
+		Gyro:     [3]float64{s.Gyro.X, s.Gyro.Y, s.Gyro.Z},
+		Accel:    [3]float64{s.Accel.X, s.Accel.Y, s.Accel.Z},
+		RawGyro:  s.RawGyro,
+		RawAccel: s.RawAccel,
+	}
+	h.next = (h.next + 1) % len(h.buf)
+	h.full = h.full || h.next == 0
+}
+
+// Snapshot returns the recorded samples, oldest first.
+func (h *sampleHistory) Snapshot() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]historyEntry(nil), h.buf[:h.next]...)
+	}
+	return append(append([]historyEntry(nil), h.buf[h.next:]...), h.buf[:h.next]...)
+}
+
+// Dump writes the recorded samples, oldest first, one per line.
+func (h *sampleHistory) Dump(w io.Writer) {
+	entries := h.Snapshot()
+	fmt.Fprintf(w, "Sample history: last %d samples sent (gyro rad/s, accel m/s^2)\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s ts=%d G=(% .5f,% .5f,% .5f) A=(% .3f,% .3f,% .3f) counts G=%v A=%v\n",
+			e.Time.Format("15:04:05.000000"), e.TSus, e.Gyro[0], e.Gyro[1], e.Gyro[2],
+			e.Accel[0], e.Accel[1], e.Accel[2], e.RawGyro, e.RawAccel)
+	}
+}
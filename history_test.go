@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyTS lists the timestamps of the recorded samples, oldest first.
+func historyTS(h *sampleHistory) []uint64 {
+	var ts []uint64
+	for _, e := range h.Snapshot() {
+		ts = append(ts, e.TSus)
+	}
+	return ts
+}
+
+func TestSampleHistory(t *testing.T) {
+	if h := newSampleHistory(0); h != nil {
+		t.Errorf("size 0: %+v, want nil (off)", h)
+	}
+	start := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		size, added int
+		want        []uint64
+	}{
+		{3, 0, nil},
+		{3, 2, []uint64{1, 2}},
+		{3, 3, []uint64{1, 2, 3}},
+		{3, 4, []uint64{2, 3, 4}},
+		{3, 7, []uint64{5, 6, 7}},
+		{3, 9, []uint64{7, 8, 9}}, // wrapped around exactly
+		{1, 5, []uint64{5}},
+	} {
+		h := newSampleHistory(tc.size)
+		for i := 1; i <= tc.added; i++ {
+			h.Add(IMUSample{TSus: uint64(i), Gyro: Vec3{X: float64(i)}, RawAccel: [3]int64{2: int64(i)}}, start.Add(time.Duration(i)*time.Millisecond))
+		}
+		got := historyTS(h)
+		if len(got) != len(tc.want) {
+			t.Errorf("size %d after %d: %v, want %v", tc.size, tc.added, got, tc.want)
+			continue
+		}
+		for i, e := range h.Snapshot() {
+			n := tc.want[i]
+			if e.TSus != n || e.Gyro != [3]float64{float64(n)} || e.RawAccel != [3]int64{2: int64(n)} || !e.Time.Equal(start.Add(time.Duration(n)*time.Millisecond)) {
+				t.Errorf("size %d after %d: entry %d is %+v, want sample %d", tc.size, tc.added, i, e, n)
+			}
+		}
+	}
+
+	// a snapshot is a copy: later samples don't change it
+	h := newSampleHistory(2)
+	h.Add(IMUSample{TSus: 1}, start)
+	snap := h.Snapshot()
+	h.Add(IMUSample{TSus: 2}, start)
+	h.Add(IMUSample{TSus: 3}, start)
+	if len(snap) != 1 || snap[0].TSus != 1 {
+		t.Errorf("snapshot changed to %+v", snap)
+	}
+}
+
+func TestSampleHistoryDump(t *testing.T) {
+	h := newSampleHistory(2)
+	for i := 1; i <= 3; i++ {
+		h.Add(IMUSample{TSus: uint64(i) * 1000, RawGyro: [3]int64{int64(i), 0, 0}}, time.Unix(1000, 0))
+	}
+	var b strings.Builder
+	h.Dump(&b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "last 2 samples") ||
+		!strings.Contains(lines[1], "ts=2000") || !strings.Contains(lines[2], "ts=3000 ") || !strings.Contains(lines[2], "G=[3 0 0]") {
+		t.Errorf("dump:\n%s", b.String())
+	}
+}
+
+func TestControlHistory(t *testing.T) {
+	c, h, _ := newTestControl(t)
+	if rec := serve(h, "GET", "/history", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /history with history off: %d, want 404", rec.Code)
+	}
+	c.history = newSampleHistory(2)
+	for i := 1; i <= 3; i++ {
+		c.history.Add(IMUSample{TSus: uint64(i), Accel: Vec3{Z: -9.81}}, time.Unix(1000, 0))
+	}
+	rec := serve(h, "GET", "/history", "")
+	var got []historyEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("GET /history: %d %v %s", rec.Code, err, rec.Body)
+	}
+	if len(got) != 2 || got[0].TSus != 2 || got[1].TSus != 3 || got[1].Accel != [3]float64{2: -9.81} {
+		t.Errorf("GET /history: %+v", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// iioClocks maps the values of an IIO device's current_timestamp_clock to clock ids for
+// clock_gettime(2).
+var iioClocks = map[string]uintptr{
+	"realtime":         0,
+	"monotonic":        1,
+	"monotonic_raw":    4,
+	"realtime_coarse":  5,
+	"monotonic_coarse": 6,
+	"boottime":         7,
+	"tai":              11,
+}
+
+// defaultIIOClock is the clock IIO stamps with unless current_timestamp_clock says otherwise.
+const defaultIIOClock = "realtime"
+
+// readTimestampClock returns the clock dev's in_timestamp uses. Without the attribute (old
+// kernels) it is realtime; an unknown value is warned about and taken as realtime too.
+func readTimestampClock(base string) string {
+	b, err := os.ReadFile(filepath.Join(base, "current_timestamp_clock"))
+	if err != nil {
+		return defaultIIOClock
+	}
+	clock := strings.TrimSpace(string(b))
+	if _, ok := iioClocks[clock]; !ok {
+		fmt.Fprintf(os.Stderr, "WARNING: %s: unknown current_timestamp_clock %q; taking timestamps as %s\n", base, clock, defaultIIOClock)
+		return defaultIIOClock
+	}
+	return clock
+}
+
+// clockNowNs reads clock id in nanoseconds.
+func clockNowNs(id uintptr) (int64, error) {
+	var ts syscall.Timespec
+	if _, _, e := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, id, uintptr(unsafe.Pointer(&ts)), 0); e != 0 {
+		return 0, e
+	}
+	return ts.Nano(), nil
+}
+
+// iioTimestamp converts in_timestamp values (nanoseconds on the device's clock) to the
+// realtime microseconds every other source stamps samples with, so deltas stay right when
+// the driver uses monotonic or boottime. The offset between the clocks is read again on
+// every conversion: it moves across suspend (monotonic) and when the wall clock is stepped.
+type iioTimestamp struct {
+	clock string
+	id    uintptr
+}
+
+func newIIOTimestamp(base string) iioTimestamp {
+	clock := readTimestampClock(base)
+	return iioTimestamp{clock: clock, id: iioClocks[clock]}
+}
+
+// Micros converts ns, a timestamp on t's clock, to realtime microseconds.
+func (t iioTimestamp) Micros(ns int64) uint64 {
+	if t.id != iioClocks["realtime"] {
+		wall, err1 := clockNowNs(iioClocks["realtime"])
+		now, err2 := clockNowNs(t.id)
+		if err1 == nil && err2 == nil {
+			ns += wall - now
+		}
+	}
+	return uint64(ns) / 1000
+}
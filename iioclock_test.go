@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTimestampClock(t *testing.T) {
+	for _, tc := range []struct {
+		attr     *string // nil: no attribute
+		want     string
+		wantWarn bool
+	}{
+		{nil, "realtime", false},
+		{ptr("realtime\n"), "realtime", false},
+		{ptr("monotonic\n"), "monotonic", false},
+		{ptr("monotonic_raw"), "monotonic_raw", false},
+		{ptr("boottime\n"), "boottime", false},
+		{ptr("tai\n"), "tai", false},
+		{ptr("realtime_coarse\n"), "realtime_coarse", false},
+		{ptr("monotonic_coarse\n"), "monotonic_coarse", false},
+		{ptr("sundial\n"), "realtime", true},
+		{ptr(""), "realtime", true},
+	} {
+		dir := filepath.Join(t.TempDir(), "iio:device0")
+		writeAttrs(t, dir, map[string]string{"name": "bmi323-imu"})
+		if tc.attr != nil {
+			writeAttrs(t, dir, map[string]string{"current_timestamp_clock": *tc.attr})
+		}
+		var got string
+		warn := captureStderr(t, func() { got = readTimestampClock(dir) })
+		if got != tc.want || strings.Contains(warn, "unknown current_timestamp_clock") != tc.wantWarn {
+			t.Errorf("current_timestamp_clock %q: %s, warning %q; want %s, warning %v", deref(tc.attr), got, warn, tc.want, tc.wantWarn)
+		}
+		if ts := newIIOTimestamp(dir); ts.clock != tc.want || ts.id != iioClocks[tc.want] {
+			t.Errorf("current_timestamp_clock %q: newIIOTimestamp = %+v", deref(tc.attr), ts)
+		}
+	}
+}
+
+func ptr(s string) *string { return &s }
+
+func deref(s *string) string {
+	if s == nil {
+		return "<absent>"
+	}
+	return *s
+}
+
+func TestIIOTimestampMicros(t *testing.T) {
+	for clock, id := range iioClocks {
+		t.Run(clock, func(t *testing.T) {
+			ts := iioTimestamp{clock: clock, id: id}
+			now, err := clockNowNs(id)
+			if err != nil {
+				t.Skipf("clock_gettime(%s): %v", clock, err)
+			}
+			// a reading of now on the device's clock is now on the wall clock; the coarse
+			// clocks lag by up to a tick
+			got := ts.Micros(now)
+			want := uint64(time.Now().UnixMicro())
+			if diff := int64(want) - int64(got); diff < -1000 || diff > 20_000 {
+				t.Errorf("now on %s converts to %d us, %d us from the wall clock", clock, got, diff)
+			}
+			// deltas between samples survive the conversion
+			a, b := ts.Micros(now-4_000_000), ts.Micros(now+1_000_000)
+			if d := int64(b - a); d < 4990 || d > 5010 {
+				t.Errorf("5 ms apart on %s: %d us apart after conversion", clock, d)
+			}
+		})
+	}
+}
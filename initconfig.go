@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kernelMountMatrixAttrs are the sysfs attributes a driver may describe the sensor's placement
+// with, most specific first.
+var kernelMountMatrixAttrs = []string{"in_mount_matrix", "in_anglvel_mount_matrix", "in_accel_mount_matrix"}
+
+// readKernelMountMatrix reads the driver's mount matrix of dev ("x1, y1, z1; x2, y2, z2;
+// x3, y3, z3", one row per axis). It returns the attribute used, or false when there is none
+// or it is the identity, which drivers report when the firmware says nothing.
+func readKernelMountMatrix(dev string) (MountMatrix, string, bool) {
+	for _, attr := range kernelMountMatrixAttrs {
+		b, err := os.ReadFile(filepath.Join(dev, attr))
+		if err != nil {
+			continue
+		}
+		rows := strings.Split(strings.TrimSpace(string(b)), ";")
+		if len(rows) != 3 {
+			continue
+		}
+		var r [3][]float64
+		ok := true
+		for i, row := range rows {
+			for _, f := range strings.Split(row, ",") {
+				v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+				if err != nil {
+					ok = false
+				}
+				r[i] = append(r[i], v)
+			}
+		}
+		if !ok {
+			continue
+		}
+		m, valid := parseMatrix(r[0], r[1], r[2])
+		if !valid || m == identityMatrix {
+			continue
+		}
+		return m, attr, true
+	}
+	return MountMatrix{}, "", false
+}
+
+// starterMatrices returns the matrix keys for a new config and where they came from: the
+// built-in quirk for this model, the driver's mount matrix, or the identity.
+func starterMatrices(dev string) (map[string]matrixYAML, string) {
+	if q := matchDeviceQuirk(dmiProduct()); q != nil {
+		var qc struct {
+			MountMatrix *matrixYAML `yaml:"mount_matrix"`
+			AccelMatrix *matrixYAML `yaml:"accel_matrix"`
+			GyroMatrix  *matrixYAML `yaml:"gyro_matrix"`
+		}
+		if err := yaml.Unmarshal([]byte(q.Config), &qc); err == nil {
+			out := map[string]matrixYAML{}
+			for k, m := range map[string]*matrixYAML{"mount_matrix": qc.MountMatrix, "accel_matrix": qc.AccelMatrix, "gyro_matrix": qc.GyroMatrix} {
+				if m != nil {
+					out[k] = *m
+				}
+			}
+			if len(out) > 0 {
+				return out, "built-in quirks (" + q.Name + ")"
+			}
+		}
+	}
+	if m, attr, ok := readKernelMountMatrix(dev); ok {
+		return map[string]matrixYAML{"mount_matrix": toMatrixYAML(m)}, "the driver's " + attr
+	}
+	return map[string]matrixYAML{"mount_matrix": toMatrixYAML(identityMatrix)}, "identity, nothing better known"
+}
+
+// writeStarterConfig writes a first config for the IIO device dev to path: its name, the
+// iio_path as a comment, and a best-guess matrix. An existing file is only replaced with
+// force. The result is loaded back and validated before it is reported as written.
+func writeStarterConfig(path, dev string, force bool) error {
+	if fileExists(path) && !force {
+		return fmt.Errorf("%s already exists (use --force to overwrite it)", path)
+	}
+	nameBytes, _ := os.ReadFile(filepath.Join(dev, "name"))
+	name := strings.TrimSpace(string(nameBytes))
+	matrices, matrixSrc := starterMatrices(dev)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Starter config written by iio-dsu-bridge --init-config.\n")
+	fmt.Fprintf(&b, "# Matrix from %s: check it with --check and fix it with --auto-mount\n", matrixSrc)
+	fmt.Fprintf(&b, "# or --check-alignment if motion comes out on the wrong axes.\n")
+	if name != "" {
+		fmt.Fprintf(&b, "name: %s\n", strconv.Quote(name))
+	}
+	fmt.Fprintf(&b, "# iio:deviceN numbers can change between boots; name (or device_id) is more stable.\n")
+	fmt.Fprintf(&b, "# iio_path: %s\n", dev)
+	for _, k := range []string{"mount_matrix", "accel_matrix", "gyro_matrix"} {
+		m, ok := matrices[k]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n", k)
+		for _, row := range []struct {
+			axis string
+			v    []float64
+		}{{"x", m.X}, {"y", m.Y}, {"z", m.Z}} {
+			fmt.Fprintf(&b, "  %s: [%g, %g, %g]\n", row.axis, row.v[0], row.v[1], row.v[2])
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	check := &Config{}
+	if err := check.mergeYAML([]byte(b.String()), path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("generated config does not load: %w", err)
+	}
+	if err := validateMatrices(check); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("generated config is invalid: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s for %s (%s), matrix from %s\n", path, dev, name, matrixSrc)
+	fmt.Printf("Next steps:\n")
+	fmt.Printf("  iio-dsu-bridge --check          verify device, scales and matrix\n")
+	fmt.Printf("  iio-dsu-bridge --auto-mount     derive the matrix with the device resting screen up\n")
+	fmt.Printf("  iio-dsu-bridge                  run, then point the emulator at 127.0.0.1:26760\n")
+	return nil
+}
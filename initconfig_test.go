@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadKernelMountMatrix(t *testing.T) {
+	swap := MountMatrix{X: Vec3{0, 1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, -1}}
+	for _, tc := range []struct {
+		name     string
+		attrs    map[string]string
+		want     MountMatrix
+		wantAttr string
+	}{
+		{"none", nil, MountMatrix{}, ""},
+		{"device-wide", map[string]string{"in_mount_matrix": "0, 1, 0; 1, 0, 0; 0, 0, -1\n"}, swap, "in_mount_matrix"},
+		{"no spaces", map[string]string{"in_mount_matrix": "0,1,0;1,0,0;0,0,-1"}, swap, "in_mount_matrix"},
+		{"identity says nothing", map[string]string{"in_mount_matrix": "1, 0, 0; 0, 1, 0; 0, 0, 1\n"}, MountMatrix{}, ""},
+		{"per channel after an identity", map[string]string{
+			"in_mount_matrix": "1, 0, 0; 0, 1, 0; 0, 0, 1\n", "in_anglvel_mount_matrix": "0, 1, 0; 1, 0, 0; 0, 0, -1\n",
+		}, swap, "in_anglvel_mount_matrix"},
+		{"accel channel", map[string]string{"in_accel_mount_matrix": "0, 1, 0; 1, 0, 0; 0, 0, -1\n"}, swap, "in_accel_mount_matrix"},
+		{"two rows", map[string]string{"in_mount_matrix": "0, 1, 0; 1, 0, 0\n"}, MountMatrix{}, ""},
+		{"short row", map[string]string{"in_mount_matrix": "0, 1; 1, 0, 0; 0, 0, -1\n"}, MountMatrix{}, ""},
+		{"not a number", map[string]string{"in_mount_matrix": "0, one, 0; 1, 0, 0; 0, 0, -1\n"}, MountMatrix{}, ""},
+	} {
+		dir := filepath.Join(t.TempDir(), "iio:device0")
+		writeAttrs(t, dir, map[string]string{"name": "bmi260"})
+		writeAttrs(t, dir, tc.attrs)
+		m, attr, ok := readKernelMountMatrix(dir)
+		if ok != (tc.wantAttr != "") || attr != tc.wantAttr || m != tc.want {
+			t.Errorf("%s: %s from %q (%v), want %s from %q", tc.name, formatMatrix(m), attr, ok, formatMatrix(tc.want), tc.wantAttr)
+		}
+	}
+}
+
+func TestWriteStarterConfig(t *testing.T) {
+	swap := MountMatrix{X: Vec3{0, 1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, -1}}
+	for _, tc := range []struct {
+		name, product string
+		attrs         map[string]string
+		accel, gyro   MountMatrix
+		wantSrc       string
+	}{
+		{"identity", "Generic PC", nil, identityMatrix, identityMatrix, "identity"},
+		{"driver matrix", "Generic PC", map[string]string{"in_mount_matrix": "0, 1, 0; 1, 0, 0; 0, 0, -1\n"}, swap, swap, "in_mount_matrix"},
+		// a quirk wins over the driver's matrix
+		{"quirk", "RC71L", map[string]string{"in_mount_matrix": "0, 1, 0; 1, 0, 0; 0, 0, -1\n"},
+			MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, -1, 0}, Z: Vec3{0, 0, -1}}, MountMatrix{X: Vec3{1, 0, 0}, Y: Vec3{0, -1, 0}, Z: Vec3{0, 0, -1}}, "ROG Ally"},
+		{"split quirk", "83L3 Legion Go S", nil,
+			MountMatrix{X: Vec3{X: 1}, Y: Vec3{Y: 1}, Z: Vec3{Z: -1}}, MountMatrix{X: Vec3{X: -1}, Y: Vec3{Z: 1}, Z: Vec3{Y: 1}}, "Legion Go S"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useQuirkDevice(t, tc.product, "")
+			dev := filepath.Join(useSysfs(t), "iio:device0")
+			// a name YAML would read as something else unquoted
+			writeAttrs(t, dev, axes(axes(map[string]string{"name": "imu: #1\n"}, "anglvel", [3]int{}), "accel", [3]int{}))
+			writeAttrs(t, dev, tc.attrs)
+			path := filepath.Join(t.TempDir(), "sub", configFileName)
+			if err := writeStarterConfig(path, dev, false); err != nil {
+				t.Fatal(err)
+			}
+			body, _ := os.ReadFile(path)
+			if !strings.Contains(string(body), tc.wantSrc) || !strings.Contains(string(body), "# iio_path: "+dev) {
+				t.Errorf("config lacks the matrix source %q or the iio_path comment:\n%s", tc.wantSrc, body)
+			}
+			if fileExists(path + ".tmp") {
+				t.Error("temporary file left behind")
+			}
+
+			// the file alone loads, is valid and carries the matrices
+			var cfg Config
+			if err := cfg.mergeFile(path); err != nil {
+				t.Fatalf("generated config does not load: %v\n%s", err, body)
+			}
+			if err := validateMatrices(&cfg); err != nil {
+				t.Fatalf("generated config invalid: %v\n%s", err, body)
+			}
+			accel, gyro, _, _ := resolveMatrices(&cfg)
+			if cfg.Name != "imu: #1" || accel != tc.accel || gyro != tc.gyro {
+				t.Errorf("loaded name %q, accel %s gyro %s; want accel %s gyro %s", cfg.Name, formatMatrix(accel), formatMatrix(gyro), formatMatrix(tc.accel), formatMatrix(tc.gyro))
+			}
+			// and as the bridge loads it, over the quirks
+			if _, _, err := loadConfigFile(path); err != nil {
+				t.Errorf("loadConfigFile: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteStarterConfigExisting(t *testing.T) {
+	useQuirkDevice(t, "Generic PC", "")
+	dev := filepath.Join(useSysfs(t), "iio:device0")
+	writeAttrs(t, dev, axes(map[string]string{"name": "bmi260"}, "anglvel", [3]int{}))
+	path := filepath.Join(t.TempDir(), configFileName)
+	const mine = "name: mine\n"
+	writeAttrs(t, filepath.Dir(path), map[string]string{configFileName: mine})
+
+	if err := writeStarterConfig(path, dev, false); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("overwrite without force: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != mine {
+		t.Errorf("existing config changed:\n%s", b)
+	}
+	if err := writeStarterConfig(path, dev, true); err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	if err := cfg.mergeFile(path); err != nil || cfg.Name != "bmi260" {
+		t.Errorf("after --force: name %q, %v", cfg.Name, err)
+	}
+}
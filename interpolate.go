@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// maxInterpolationPeriod is the longest gap between sensor samples that is interpolated;
+// after a longer stall the new sample is sent as is.
+const maxInterpolationPeriod = 100 * time.Millisecond
+
+// sampleInterpolator smooths upsampled output (--interpolate): when the bridge sends faster
+// than the sensor updates, the same sample would be repeated and the motion would step. It
+// instead glides from the value being sent when a new sample arrives to that sample over the
+// interval between the last two arrivals, which delays motion by about one sensor period.
+// A sample is new when its raw counts change.
+type sampleInterpolator struct {
+	from, to IMUSample
+	start    time.Time     // arrival of to
+	period   time.Duration // since the arrival before it
+	have     bool
+}
+
+// Update takes the sample read this tick and returns the one to send.
+func (ip *sampleInterpolator) Update(s IMUSample, now time.Time) IMUSample {
+	if !ip.have {
+		ip.from, ip.to, ip.start, ip.have = s, s, now, true
+		return s
+	}
+	if s.RawGyro != ip.to.RawGyro || s.RawAccel != ip.to.RawAccel {
+		ip.from = ip.at(now)
+		ip.to, ip.period, ip.start = s, now.Sub(ip.start), now
+		if ip.period > maxInterpolationPeriod {
+			ip.from = s
+		}
+	}
+	out := ip.at(now)
+	out.TSus = s.TSus
+	return out
+}
+
+// at returns the interpolated sample at now.
+func (ip *sampleInterpolator) at(now time.Time) IMUSample {
+	f := 1.0
+	if ip.period > 0 {
+		f = min(float64(now.Sub(ip.start))/float64(ip.period), 1)
+	}
+	s := ip.to
+	s.Gyro = ip.from.Gyro.Add(ip.to.Gyro.Sub(ip.from.Gyro).Scale(f))
+	s.Accel = ip.from.Accel.Add(ip.to.Accel.Sub(ip.from.Accel).Scale(f))
+	return s
+}
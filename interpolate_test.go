@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInterpolatedRamp(t *testing.T) {
+	// a 100 Hz sensor ramping 1 rad/s per sample, sent at 400 Hz
+	const perSample = 4
+	sensorPeriod := 10 * time.Millisecond
+	tick := sensorPeriod / perSample
+	start := time.Unix(1_700_000_000, 0)
+	sample := func(k int) IMUSample {
+		return IMUSample{RawGyro: [3]int64{int64(k)}, Gyro: Vec3{X: float64(k)}, TSus: uint64(k)}
+	}
+
+	var ip sampleInterpolator
+	var held, smooth []float64
+	for i := 0; i < 40*perSample; i++ {
+		s := sample(i / perSample)
+		held = append(held, s.Gyro.X)
+		smooth = append(smooth, ip.Update(s, start.Add(time.Duration(i)*tick)).Gyro.X)
+	}
+
+	// held output stairs: three repeats, then a whole step
+	maxStep := func(out []float64) (lo, hi float64) {
+		lo = math.Inf(1)
+		for i := 2 * perSample; i < len(out); i++ {
+			d := out[i] - out[i-1]
+			lo, hi = min(lo, d), max(hi, d)
+		}
+		return lo, hi
+	}
+	if lo, hi := maxStep(held); lo != 0 || hi != 1 {
+		t.Errorf("held output steps between %g and %g, want 0 and 1", lo, hi)
+	}
+	// interpolated output rises evenly, a quarter step per tick, about one sensor period late
+	if lo, hi := maxStep(smooth); math.Abs(lo-0.25) > 1e-9 || math.Abs(hi-0.25) > 1e-9 {
+		t.Errorf("interpolated output steps between %g and %g, want 0.25 each", lo, hi)
+	}
+	for i := 2 * perSample; i < len(smooth); i++ {
+		if lag := held[i] - smooth[i]; lag < 0 || lag > 1 {
+			t.Fatalf("tick %d: interpolated %g is %g behind the held %g", i, smooth[i], lag, held[i])
+		}
+	}
+
+	// the timestamp is the sample's, not interpolated
+	if s := ip.Update(sample(41), start.Add(41*sensorPeriod)); s.TSus != 41 {
+		t.Errorf("timestamp %d, want the sample's 41", s.TSus)
+	}
+	// after a stall the new sample is sent as is
+	stalled := start.Add(41*sensorPeriod + 2*maxInterpolationPeriod)
+	if s := ip.Update(sample(50), stalled); s.Gyro.X != 50 {
+		t.Errorf("after a stall: %g, want the new sample's 50", s.Gyro.X)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeviceLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		attrs map[string]string
+		want  string
+	}{
+		{"label present", map[string]string{"name": "bmi260", "label": "accel-display\n"}, "accel-display"},
+		{"label absent", map[string]string{"name": "bmi260\n"}, "bmi260"},
+		{"empty label", map[string]string{"name": "bmi260", "label": " \n"}, "bmi260"},
+		{"neither", map[string]string{}, ""},
+	} {
+		dir := filepath.Join(t.TempDir(), "iio:device0")
+		writeAttrs(t, dir, axes(tc.attrs, "accel", [3]int{}))
+		if got := deviceLabel(dir); got != tc.want {
+			t.Errorf("%s: deviceLabel = %q, want %q", tc.name, got, tc.want)
+		}
+		dev, err := openIIODevice(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.Label != tc.want {
+			t.Errorf("%s: IIODevice.Label = %q, want %q", tc.name, dev.Label, tc.want)
+		}
+	}
+}
+
+// labelledPair is a convertible's two accelerometers, the same chip told apart by label only,
+// and an IMU without a label.
+func labelledPair(t *testing.T) string {
+	t.Helper()
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(map[string]string{"name": "bmi260", "label": "accel-base"}, "accel", [3]int{}))
+	writeAttrs(t, filepath.Join(base, "iio:device1"), axes(map[string]string{"name": "bmi260", "label": "accel-display"}, "accel", [3]int{}))
+	writeAttrs(t, filepath.Join(base, "iio:device2"), axes(axes(map[string]string{"name": "bmi323-imu"}, "anglvel", [3]int{}), "accel", [3]int{}))
+	return base
+}
+
+func TestListIIODevicesLabel(t *testing.T) {
+	base := labelledPair(t)
+	var b strings.Builder
+	listIIODevices(&b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines:\n%s", len(lines), b.String())
+	}
+	for i, want := range []string{
+		filepath.Join(base, "iio:device0") + `  name="bmi260"  label="accel-base"  gyro=false accel=true`,
+		filepath.Join(base, "iio:device1") + `  name="bmi260"  label="accel-display"  gyro=false accel=true`,
+		filepath.Join(base, "iio:device2") + `  name="bmi323-imu"  gyro=true accel=true`,
+	} {
+		if !strings.HasPrefix(lines[i], want) {
+			t.Errorf("line %d: %q, want it to start with %q", i, lines[i], want)
+		}
+	}
+}
+
+func TestLabelNotMatched(t *testing.T) {
+	base := labelledPair(t)
+	// name is the matching key: a label finds nothing, so the first IMU is picked, not the
+	// device carrying that label
+	if got, err := findIIODeviceByName(io.Discard, "accel-display", nil); err != nil || got != filepath.Join(base, "iio:device0") {
+		t.Errorf("by label: %s, %v", got, err)
+	}
+	if got, err := findIIODeviceByName(io.Discard, "bmi323-imu", nil); err != nil || got != filepath.Join(base, "iio:device2") {
+		t.Errorf("by name: %s, %v", got, err)
+	}
+}
+
+func TestDBusDeviceLabel(t *testing.T) {
+	d, _ := newTestDBus(t)
+	if p, ok := d.properties()["DeviceLabel"]; !ok || p.Value != "accel-display" {
+		t.Errorf("DeviceLabel property: %+v, %v", p, ok)
+	}
+	if !strings.Contains(dbusIntrospection, `<property name="DeviceLabel" type="s" access="read"/>`) {
+		t.Error("DeviceLabel missing from the introspection data")
+	}
+}
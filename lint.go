@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// lintMaxDeadzone (deg/s) is the gyro_deadzone above which slow aiming motion is swallowed.
+const lintMaxDeadzone = 10.0
+
+// lintConfig looks for settings that are valid on their own but make no sense together or
+// for the device, and returns a warning with a suggestion for each. devs are the IIO devices
+// the bridge would read (nil entries are skipped).
+func lintConfig(cfg *Config, rate float64, setRate bool, devs ...*IIODevice) []string {
+	var out []string
+
+	if setRate {
+		for _, d := range devs {
+			if d == nil {
+				continue
+			}
+			// one warning per device, even when gyro and accel share the rate attribute
+			top := 0.0
+			for _, ch := range []struct {
+				name string
+				have bool
+			}{{"anglvel", d.HaveGyro}, {"accel", d.HaveAccel}} {
+				if avail, err := readRateAvailable(d.Base, ch.name); ch.have && err == nil && len(avail) > 0 {
+					top = max(top, slices.Max(avail))
+				}
+			}
+			if top > 0 && rate > top {
+				out = append(out, fmt.Sprintf("rate %g Hz is above the fastest rate of %s (%g Hz); set rate: %g or set_rate: false",
+					rate, d.Base, top, top))
+			}
+		}
+	}
+
+	gyroUnit, accelUnit := rawUnitFactors(cfg)
+	for _, d := range devs {
+		if d != nil {
+			out = append(out, implausibleScales(d, gyroUnit, accelUnit)...)
+		}
+	}
+
+	if cfg.GyroDeadzone > lintMaxDeadzone {
+		out = append(out, fmt.Sprintf("gyro_deadzone %g deg/s hides slow aiming motion; values of 0.5-2 are typical", cfg.GyroDeadzone))
+	}
+	if cfg.GyroSensitivity != nil && *cfg.GyroSensitivity <= 0 {
+		out = append(out, fmt.Sprintf("gyro_sensitivity %g would zero or invert the gyro (the bridge refuses it); use 1 for unscaled output", *cfg.GyroSensitivity))
+	}
+
+	base, hasBase := parseMatrix(cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z)
+	accel, hasAccel := parseMatrix(cfg.AccelMatrix.X, cfg.AccelMatrix.Y, cfg.AccelMatrix.Z)
+	gyro, hasGyro := parseMatrix(cfg.GyroMatrix.X, cfg.GyroMatrix.Y, cfg.GyroMatrix.Z)
+	for _, m := range []struct {
+		name string
+		m    MountMatrix
+		ok   bool
+	}{{"mount_matrix", base, hasBase}, {"accel_matrix", accel, hasAccel}, {"gyro_matrix", gyro, hasGyro}} {
+		if m.ok && m.m == (MountMatrix{}) {
+			out = append(out, fmt.Sprintf("%s is all zeros, so that sensor is always sent as zero; start from the identity matrix", m.name))
+		}
+	}
+	switch {
+	case hasBase && hasAccel && hasGyro:
+		out = append(out, "mount_matrix is unused because accel_matrix and gyro_matrix are both set; remove it")
+	case hasBase && hasAccel && !matricesClose(base, accel):
+		out = append(out, "accel_matrix and mount_matrix describe different orientations; accel_matrix wins for the accelerometer, so remove whichever is stale")
+	case hasBase && hasGyro && !matricesClose(base, gyro):
+		out = append(out, "gyro_matrix and mount_matrix describe different orientations; gyro_matrix wins for the gyroscope, so remove whichever is stale")
+	}
+	return out
+}
+
+// matricesClose reports whether two matrices are equal up to rounding in the config values.
+func matricesClose(a, b MountMatrix) bool {
+	ra, rb := []Vec3{a.X, a.Y, a.Z}, []Vec3{b.X, b.Y, b.Z}
+	for i := range ra {
+		if ra[i].Sub(rb[i]).Norm() > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
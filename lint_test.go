@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	base := useSysfs(t)
+	dev := &IIODevice{Base: filepath.Join(base, "iio:device0"), HaveGyro: true, HaveAccel: true}
+	writeAttrs(t, dev.Base, map[string]string{"in_anglvel_sampling_frequency_available": "100 200 400\n"})
+	zero, half := 0.0, 0.5
+	ident := [3][]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	swap := [3][]float64{{0, 1, 0}, {1, 0, 0}, {0, 0, 1}}
+
+	for _, tc := range []struct {
+		name    string
+		edit    func(*Config)
+		rate    float64
+		setRate bool
+		want    string // substring of the only warning, "" for none
+	}{
+		{"clean", func(*Config) {}, 200, true, ""},
+		{"rate above device max", func(*Config) {}, 800, true, "rate 800 Hz is above the fastest rate of " + dev.Base + " (400 Hz); set rate: 400"},
+		{"rate not written", func(*Config) {}, 800, false, ""},
+		{"huge deadzone", func(c *Config) { c.GyroDeadzone = 25 }, 200, false, "gyro_deadzone 25 deg/s hides slow aiming motion"},
+		{"zero sensitivity", func(c *Config) { c.GyroSensitivity = &zero }, 200, false, "gyro_sensitivity 0 would zero or invert the gyro"},
+		{"fractional sensitivity", func(c *Config) { c.GyroSensitivity = &half }, 200, false, ""},
+		{"all-zero mount matrix", func(c *Config) {
+			c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z = []float64{0, 0, 0}, []float64{0, 0, 0}, []float64{0, 0, 0}
+		}, 200, false, "mount_matrix is all zeros"},
+		{"conflicting accel matrix", func(c *Config) {
+			c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z = ident[0], ident[1], ident[2]
+			c.AccelMatrix.X, c.AccelMatrix.Y, c.AccelMatrix.Z = swap[0], swap[1], swap[2]
+		}, 200, false, "accel_matrix and mount_matrix describe different orientations"},
+		{"conflicting gyro matrix", func(c *Config) {
+			c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z = ident[0], ident[1], ident[2]
+			c.GyroMatrix.X, c.GyroMatrix.Y, c.GyroMatrix.Z = swap[0], swap[1], swap[2]
+		}, 200, false, "gyro_matrix and mount_matrix describe different orientations"},
+		{"agreeing gyro matrix", func(c *Config) {
+			c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z = swap[0], swap[1], swap[2]
+			c.GyroMatrix.X, c.GyroMatrix.Y, c.GyroMatrix.Z = swap[0], swap[1], swap[2]
+		}, 200, false, ""},
+		{"unused mount matrix", func(c *Config) {
+			c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z = ident[0], ident[1], ident[2]
+			c.AccelMatrix.X, c.AccelMatrix.Y, c.AccelMatrix.Z = swap[0], swap[1], swap[2]
+			c.GyroMatrix.X, c.GyroMatrix.Y, c.GyroMatrix.Z = swap[0], swap[1], swap[2]
+		}, 200, false, "mount_matrix is unused"},
+	} {
+		cfg := &Config{}
+		tc.edit(cfg)
+		got := lintConfig(cfg, tc.rate, tc.setRate, dev, nil)
+		switch {
+		case tc.want == "" && len(got) != 0:
+			t.Errorf("%s: unexpected warnings %q", tc.name, got)
+		case tc.want != "" && (len(got) != 1 || !strings.Contains(got[0], tc.want)):
+			t.Errorf("%s: warnings %q, want one containing %q", tc.name, got, tc.want)
+		}
+	}
+}
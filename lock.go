@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// instanceLock keeps two bridges from driving the same device, which would fight over its
+// sysfs scales and rate. It is an flock on a file keyed by the resolved device path, so the
+// kernel drops it when the holder dies and a stale file left by a crash never blocks a start.
+type instanceLock struct {
+	f *os.File
+}
+
+// errLocked is returned by acquireInstanceLock when a live instance holds the lock.
+var errLocked = errors.New("device is in use by another iio-dsu-bridge")
+
+// lockDir returns where lock files go: XDG_RUNTIME_DIR, or the temp dir without one.
+func lockDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// lockPath returns the lock file for device, keyed by its path with symlinks resolved so that
+// iio:deviceN and its /sys/devices path share one lock.
+func lockPath(dir, device string) string {
+	if p, err := filepath.EvalSymlinks(device); err == nil {
+		device = p
+	}
+	key := strings.NewReplacer("/", "_", ":", "_").Replace(strings.Trim(device, "/"))
+	return filepath.Join(dir, "iio-dsu-bridge-"+key+".lock")
+}
+
+// acquireInstanceLock takes the lock for device. If another instance holds it, the error
+// wraps errLocked and names its pid.
+func acquireInstanceLock(dir, device string) (*instanceLock, error) {
+	path := lockPath(dir, device)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b, _ := os.ReadFile(path)
+			if pid := strings.TrimSpace(string(b)); pid != "" {
+				return nil, fmt.Errorf("%w (pid %s, lock %s)", errLocked, pid, path)
+			}
+			return nil, fmt.Errorf("%w (lock %s)", errLocked, path)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	// the holder's pid, for the message above
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &instanceLock{f: f}, nil
+}
+
+// Release removes the lock file and drops the lock.
+func (l *instanceLock) Release() {
+	if l == nil {
+		return
+	}
+	os.Remove(l.f.Name())
+	l.f.Close()
+}
+
+// lockDevice takes the instance lock for device. Another instance holding it is an error
+// unless force is set; a lock that can't be created (read-only runtime dir) only warns. The
+// returned lock may be nil; Release accepts that.
+func lockDevice(device string, force bool) (*instanceLock, error) {
+	l, err := acquireInstanceLock(lockDir(), device)
+	switch {
+	case err == nil:
+		return l, nil
+	case errors.Is(err, errLocked) && !force:
+		return nil, &exitError{code: exitFailure, err: fmt.Errorf("%s: %w", device, err),
+			hint: "Stop the other instance, or pass --force to run anyway.\n"}
+	case errors.Is(err, errLocked):
+		fmt.Fprintf(os.Stderr, "WARNING: %s: %v; continuing because of --force\n", device, err)
+	default:
+		fmt.Fprintf(os.Stderr, "WARNING: instance lock: %v\n", err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstanceLock(t *testing.T) {
+	dir := t.TempDir()
+	// the device as iio:device0 and as the /sys/devices path it links to
+	root := t.TempDir()
+	base := filepath.Join(root, "bus")
+	if err := os.Mkdir(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+	real := linkDevice(t, root, base, "iio:device0", "devices/i2c-0/iio:device0", map[string]string{"name": "bmi323-imu"})
+	link := filepath.Join(base, "iio:device0")
+
+	l, err := acquireInstanceLock(dir, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(lockPath(dir, real)); string(b) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("lock file holds %q, want our pid", b)
+	}
+	// a second instance is refused, through either path, and told who holds it
+	for _, dev := range []string{link, real} {
+		_, err := acquireInstanceLock(dir, dev)
+		if !errors.Is(err, errLocked) || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+			t.Errorf("second acquire of %s: %v, want errLocked naming the holder", dev, err)
+		}
+	}
+	// another device is not affected
+	other, err := acquireInstanceLock(dir, filepath.Join(root, "devices/i2c-1/iio:device1"))
+	if err != nil {
+		t.Errorf("another device: %v", err)
+	}
+	other.Release()
+
+	l.Release()
+	if _, err := os.Stat(lockPath(dir, real)); !os.IsNotExist(err) {
+		t.Errorf("lock file left after release: %v", err)
+	}
+	l, err = acquireInstanceLock(dir, real)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	l.Release()
+	var none *instanceLock
+	none.Release() // lockDevice may return nil
+}
+
+func TestLockDeviceForce(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	dev := "/sys/bus/iio/devices/iio:device7"
+	held, err := lockDevice(dev, false)
+	if err != nil || held == nil {
+		t.Fatalf("first lock: %v, %v", held, err)
+	}
+	defer held.Release()
+
+	_, err = lockDevice(dev, false)
+	var ee *exitError
+	if !errors.As(err, &ee) || ee.code != exitFailure || !errors.Is(err, errLocked) || !strings.Contains(ee.hint, "--force") {
+		t.Errorf("second instance: %v, want an exit error suggesting --force", err)
+	}
+	var l *instanceLock
+	stderr := captureStderr(t, func() { l, err = lockDevice(dev, true) })
+	if l != nil || err != nil || !strings.Contains(stderr, "continuing because of --force") {
+		t.Errorf("with --force: %v, %v, stderr %q", l, err, stderr)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyOutput simulates a bad path in front of an Output: it drops a fraction of the samples
+// and hands another fraction to next only after delay, so they arrive after later ones.
+type lossyOutput struct {
+	next       Output
+	drop, late float64 // fractions of samples
+	delay      time.Duration
+	mu         sync.Mutex
+	rng        *rand.Rand
+	sent, lost int
+	pending    sync.WaitGroup
+}
+
+var _ Output = (*lossyOutput)(nil)
+
+func newLossyOutput(next Output, drop, late float64, delay time.Duration, seed int64) *lossyOutput {
+	return &lossyOutput{next: next, drop: drop, late: late, delay: delay, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (o *lossyOutput) Send(s IMUSample) {
+	o.mu.Lock()
+	r := o.rng.Float64()
+	if r < o.drop {
+		o.lost++
+		o.mu.Unlock()
+		return
+	}
+	o.sent++
+	o.mu.Unlock()
+	if r < o.drop+o.late {
+		o.pending.Add(1)
+		time.AfterFunc(o.delay, func() {
+			defer o.pending.Done()
+			o.next.Send(s)
+		})
+		return
+	}
+	o.next.Send(s)
+}
+
+// Flush waits for the delayed samples.
+func (o *lossyOutput) Flush() { o.pending.Wait() }
+
+func (o *lossyOutput) Close() error {
+	o.Flush()
+	return o.next.Close()
+}
+
+// subscribe adds another client to out's server and waits until it is tracked.
+func subscribe(t *testing.T, out *dsuOutput, clients int) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, out.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write(subscribeRequest())
+	deadline := time.Now().Add(2 * time.Second)
+	for n, _ := out.Stats(); n < clients; n, _ = out.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return conn
+}
+
+// motions reads every motion packet that arrives on conn until it has been quiet for a while.
+func motions(conn *net.UDPConn) []dsuMotion {
+	var out []dsuMotion
+	buf := make([]byte, 2048)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return out
+		}
+		if h, payload, err := parseDSUPacket(buf[:n], dsuMagicServer); err == nil && h.MsgType == dsuMsgData {
+			out = append(out, decodeMotion(payload))
+		}
+	}
+}
+
+func TestClientTrackingUnderLoss(t *testing.T) {
+	out, first := subscribedOutput(t, outputConfig{})
+	lossy := newLossyOutput(out, 0.3, 0, 0, 1)
+
+	// a client joining mid-stream is tracked from then on, with its own packet numbers
+	const total = 200
+	var second *net.UDPConn
+	for i := range total {
+		if i == total/2 {
+			second = subscribe(t, out, 2)
+		}
+		lossy.Send(IMUSample{TSus: uint64(1_000_000 + i*4000), Gyro: Vec3{X: float64(i)}})
+	}
+	if lossy.lost == 0 || lossy.sent == 0 {
+		t.Fatalf("sent %d, lost %d: the simulator did nothing", lossy.sent, lossy.lost)
+	}
+
+	a, b := motions(first), motions(second)
+	if len(a) != lossy.sent {
+		t.Errorf("first client got %d packets, %d samples got through", len(a), lossy.sent)
+	}
+	if len(b) == 0 || len(b) >= len(a) {
+		t.Errorf("second client got %d packets, the first %d", len(b), len(a))
+	}
+	// lost samples leave no gaps: every client counts its own packets from 1
+	for name, ms := range map[string][]dsuMotion{"first": a, "second": b} {
+		for i, m := range ms {
+			if m.PktNo != uint32(i+1) {
+				t.Errorf("%s client: packet %d numbered %d", name, i+1, m.PktNo)
+				break
+			}
+		}
+	}
+	if clients, packets := out.Stats(); clients != 2 || int(packets) != len(a)+len(b) {
+		t.Errorf("Stats = %d clients, %d packets; want 2 and %d", clients, packets, len(a)+len(b))
+	}
+}
+
+func TestLateSamplesKeepClientTimestampsMonotonic(t *testing.T) {
+	out, conn := subscribedOutput(t, outputConfig{})
+	lossy := newLossyOutput(out, 0, 0.2, 20*time.Millisecond, 2)
+
+	const total = 100
+	for i := range total {
+		lossy.Send(IMUSample{TSus: uint64(1_000_000 + i*4000), Gyro: Vec3{X: float64(i)}})
+		time.Sleep(time.Millisecond)
+	}
+	lossy.Flush()
+
+	ms := motions(conn)
+	if len(ms) != total {
+		t.Fatalf("got %d packets, want all %d", len(ms), total)
+	}
+	reordered := false
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Gyro.X < ms[i-1].Gyro.X {
+			reordered = true
+		}
+		// a late sample is sent, but its old timestamp is moved past the newest one
+		if ms[i].TS <= ms[i-1].TS {
+			t.Errorf("packet %d: timestamp %d after %d", i+1, ms[i].TS, ms[i-1].TS)
+		}
+		if ms[i].PktNo != ms[i-1].PktNo+1 {
+			t.Errorf("packet %d numbered %d after %d", i+1, ms[i].PktNo, ms[i-1].PktNo)
+		}
+	}
+	if !reordered {
+		t.Error("no sample arrived late; the simulator did nothing")
+	}
+}
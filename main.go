@@ -2,30 +2,212 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"math"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Exit codes, for scripts and systemd (documented in --help and the README). 0 is a clean
+// shutdown; failures not listed exit 1.
+const (
+	// exitFailure: any other failure
+	exitFailure = 1
+	// exitDeviceNotFound: no usable IIO or evdev device
+	exitDeviceNotFound = 2
+	// exitConfig: invalid config file, flag or environment value
+	exitConfig = 3
+	// exitBindFailed: the DSU port (or the control API address) cannot be bound
+	exitBindFailed = 4
+	// exitNoMatrix: no mount matrix configured
+	exitNoMatrix = 5
+)
+
+// exitCodesHelp is appended to --help.
+const exitCodesHelp = `
+Exit codes:
+  0  clean shutdown
+  1  other failure (runtime error, --drop-action exit, device in use)
+  2  device not found or not usable
+  3  invalid config, flag or environment value
+  4  DSU port or control address cannot be bound
+  5  no mount matrix configured
+`
+
+const (
+	// zeroGyroWarnAfter is how many consecutive all-zero gyro samples trigger the warning.
+	zeroGyroWarnAfter = 100
+	// zeroGyroRecoverAfter is how many consecutive non-zero samples re-arm it, so a sensor
+	// flickering between zero and noise warns once instead of on every zero run.
+	zeroGyroRecoverAfter = 500
+)
+
+// zeroGyroWatch decides when to warn about a gyro stuck at zero: after zeroGyroWarnAfter
+// all-zero samples in a row, and again only after zeroGyroRecoverAfter live samples in a row
+// re-armed it.
+type zeroGyroWatch struct {
+	zeros, live int
+	warned      bool
+}
+
+// Update feeds whether the gyro read all zeros and returns the length of the zero run when
+// the warning is due, 0 otherwise.
+func (w *zeroGyroWatch) Update(zero bool) int {
+	if !zero {
+		w.zeros = 0
+		if w.live++; w.live >= zeroGyroRecoverAfter {
+			w.warned = false
+		}
+		return 0
+	}
+	w.zeros++
+	w.live = 0
+	if w.zeros >= zeroGyroWarnAfter && !w.warned {
+		w.warned = true
+		return w.zeros
+	}
+	return 0
+}
+
 type Config struct {
-	IIOPath   string `yaml:"iio_path"`
-	Name      string `yaml:"name"`
-	Addr      string `yaml:"addr"`
-	Rate      int    `yaml:"rate"`
-	LogEvery  int    `yaml:"log_every"`
-	SetScales *bool  `yaml:"set_scales"`
-	SetRate   *bool  `yaml:"set_rate"`
+	IIOPath   string  `yaml:"iio_path"`
+	Name      string  `yaml:"name"`
+	Bind      string  `yaml:"bind"`
+	Rate      float64 `yaml:"rate"`
+	LogEvery  int     `yaml:"log_every"`
+	SetScales *bool   `yaml:"set_scales"`
+	SetRate   *bool   `yaml:"set_rate"`
+	// GyroRate and AccelRate (Hz) set that sensor's sampling rate instead of rate, for
+	// combined IMUs with independent rates; the output still runs at rate
+	GyroRate  float64 `yaml:"gyro_rate"`
+	AccelRate float64 `yaml:"accel_rate"`
+	// RateMin and RateMax (Hz, 0 = no bound) limit the sampling frequencies picked from the
+	// driver's available list, e.g. to keep power or latency in check
+	RateMin float64 `yaml:"rate_min"`
+	RateMax float64 `yaml:"rate_max"`
+	// DeviceAliases are name substrings that also identify the device, for kernels that name
+	// the same IMU differently (e.g. "bmi323-imu" vs "i2c-BMI0160:00")
+	DeviceAliases []string `yaml:"device_aliases"`
+	// DeviceID picks the device by a stable identifier instead of iio:deviceN (see
+	// resolveDeviceID); it wins over name
+	DeviceID string `yaml:"device_id"`
+	// Source selects where samples come from: auto (IIO, else evdev), iio, iio-buffer (one
+	// buffered scan per sample on combined devices) or evdev
+	Source string `yaml:"source"`
+	// BufferDrain is what source iio-buffer sends when several scans arrived in one tick:
+	// latest (default) or average
+	BufferDrain string `yaml:"buffer_drain"`
+	// BufferDev is the character device source iio-buffer reads (default /dev/iio:deviceN
+	// named like the sysfs device)
+	BufferDev string `yaml:"buffer_dev"`
+	// SplitTimestamp is the timestamp of a sample merged from a split accel/gyro pair: primary
+	// (default), average or newer of the two devices' stamps
+	SplitTimestamp string `yaml:"split_timestamp"`
+	// SourceDevices lists the IIO devices to read and what each provides, replacing the
+	// automatic merge of a split accel/gyro pair
+	SourceDevices []SourceDevice `yaml:"source_devices"`
+	// EvdevPath is an explicit /dev/input/eventN motion device (default: first one found)
+	EvdevPath string `yaml:"evdev_path"`
+	// ScalePolicy selects how set_scales picks from scales_available (middle, auto-noise)
+	ScalePolicy string `yaml:"scale_policy"`
+	// SwapAccelGyro swaps the gyro and accel vectors right after reading, for drivers that
+	// publish each sensor under the other's channels
+	SwapAccelGyro bool `yaml:"swap_accel_gyro"`
+	// GyroRawUnits and AccelRawUnits override the unit of raw*scale for drivers that don't
+	// follow the IIO ABI: rad_s (default) or deg_s, m_s2 (default) or g. They apply after
+	// swap_accel_gyro, to the vector that ends up as gyro or accel.
+	GyroRawUnits  string `yaml:"gyro_raw_units"`
+	AccelRawUnits string `yaml:"accel_raw_units"`
+	// OutputAccelUnits and OutputGyroUnits are the units sent to DSU clients: g (default) or
+	// m_s2, deg_s (default) or rad_s, for forks that expect SI units
+	OutputAccelUnits string `yaml:"output_accel_units"`
+	OutputGyroUnits  string `yaml:"output_gyro_units"`
+	// GyroSensitivity multiplies the gyro after the mount matrix (default 1)
+	GyroSensitivity *float64 `yaml:"gyro_sensitivity"`
+	// GyroAxisSensitivity and AccelAxisSensitivity ([x, y, z]) multiply each axis after the
+	// mount matrix, on top of gyro_sensitivity, for mild per-axis scale errors
+	GyroAxisSensitivity  []float64 `yaml:"gyro_axis_sensitivity,flow"`
+	AccelAxisSensitivity []float64 `yaml:"accel_axis_sensitivity,flow"`
+	// GyroDeadzone (deg/s): angular rates below it are sent as zero
+	GyroDeadzone float64 `yaml:"gyro_deadzone"`
+	// CorrectionAfterMount applies the calibration correction to the mount-adjusted sample
+	// instead of the sensor-frame one
+	CorrectionAfterMount bool `yaml:"correction_after_mount"`
+	// SensitivityBeforeMount applies gyro_sensitivity to the sensor-frame gyro, ahead of the
+	// mount matrix and bias correction, instead of right before the deadzone
+	SensitivityBeforeMount bool `yaml:"sensitivity_before_mount"`
+	// ControlAddr enables the HTTP control API (host defaults to 127.0.0.1)
+	ControlAddr string `yaml:"control_addr"`
+	// HistorySize is how many sent samples are kept for GET /history and SIGQUIT (default
+	// 500, 0 = off)
+	HistorySize *int `yaml:"history_size"`
+	// RecenterRampMs is how long POST /recenter eases the fused heading to straight ahead
+	// (default 300, 0 = snap)
+	RecenterRampMs *int `yaml:"recenter_ramp_ms"`
+	// Resting detector (calibration): accel magnitude within RestAccelTolerance (m/s^2) of 1 g
+	// and gyro variance below RestGyroVariance ((deg/s)^2) on the RestAxes (e.g. "xy") for at
+	// least RestMinMs. Zero/empty means the default.
+	RestAccelTolerance float64 `yaml:"rest_accel_tolerance"`
+	RestGyroVariance   float64 `yaml:"rest_gyro_variance"`
+	RestMinMs          int     `yaml:"rest_min_ms"`
+	RestAxes           string  `yaml:"rest_axes"`
+	// GyroBiasRate (1/s) enables online gyro bias correction: while the device rests, the bias
+	// estimate moves toward the gyro reading at this rate. 0 disables it.
+	GyroBiasRate float64 `yaml:"gyro_bias_rate"`
+	// GravityCutoffHz low-passes the gravity estimate used by fusion and the resting checks
+	// (default 2, 0 = unfiltered); AccelCutoffHz low-passes the accel sent to DSU clients
+	// (default 0 = unfiltered). Both filter the same reading independently.
+	GravityCutoffHz *float64 `yaml:"gravity_cutoff_hz"`
+	AccelCutoffHz   float64  `yaml:"accel_cutoff_hz"`
+	// RecalibrateButton is an evdev key (BTN_MODE, or a code like 0x13c) on
+	// RecalibrateButtonDevice that, held for RecalibrateHoldMs (default 1500), re-measures the
+	// gyro bias once the device rests
+	RecalibrateButton       string `yaml:"recalibrate_button"`
+	RecalibrateButtonDevice string `yaml:"recalibrate_button_device"`
+	RecalibrateHoldMs       int    `yaml:"recalibrate_hold_ms"`
+	// CalibrationFile holds the per-unit correction matrices (default: next to the config)
+	CalibrationFile string `yaml:"calibration_file"`
+	// CalibrationMinQuality (0-100) is the lowest quality score --calibrate-full accepts
+	// (default 50)
+	CalibrationMinQuality *float64 `yaml:"calibration_min_quality"`
+	// ScreenRotation (0, 90, 180, 270 degrees counter-clockwise) turns motion with the display
+	// of a convertible; it can be changed at runtime through the control API
+	ScreenRotation int `yaml:"screen_rotation"`
+	// ControllerMAC is the MAC sent to DSU clients, which may key saved settings on it
+	// (default: derived from the device identity, see deviceIdentity)
+	ControllerMAC string `yaml:"controller_mac"`
+	// Outputs lists the DSU servers to run, each with an optional axis convention (default:
+	// one on bind)
+	Outputs []outputConfig `yaml:"outputs"`
+	// Profiles are named sets of matrices/sensitivity/deadzone over the top-level ones;
+	// Profile is the one active at startup (see profiles.go)
+	Profiles map[string]profileConfig `yaml:"profiles"`
+	Profile  string                   `yaml:"profile"`
+	// WarmupSamples / WarmupMs: samples read and discarded after configuring the sensors
+	// (warmup_ms wins when both are set)
+	WarmupSamples int `yaml:"warmup_samples"`
+	WarmupMs      int `yaml:"warmup_ms"`
+	// EnableGyro / EnableAccel turn a sensor off even when present (default both on)
+	EnableGyro  *bool `yaml:"enable_gyro"`
+	EnableAccel *bool `yaml:"enable_accel"`
 	// MountMatrix applies to both sensors (legacy/fallback)
 	MountMatrix struct {
 		X []float64 `yaml:"x"`
@@ -44,19 +226,119 @@ type Config struct {
 		Y []float64 `yaml:"y"`
 		Z []float64 `yaml:"z"`
 	} `yaml:"gyro_matrix"`
+	// MountAxisAngle, AccelAxisAngle and GyroAxisAngle give a matrix block as a rotation
+	// axis and angle instead; they are turned into the matrix when the config is loaded
+	MountAxisAngle *axisAngleYAML `yaml:"mount_axisangle"`
+	AccelAxisAngle *axisAngleYAML `yaml:"accel_axisangle"`
+	GyroAxisAngle  *axisAngleYAML `yaml:"gyro_axisangle"`
+
+	// sources maps config keys to where their value came from (see noteSource)
+	sources map[string]string
 }
 
-func loadConfigFile() (*Config, error) {
-	cfgPath := filepath.Join(os.Getenv("HOME"), ".config", "iio-dsu-bridge.yaml")
-	b, err := os.ReadFile(cfgPath)
+// configFileName is the config file looked up in the user's config directory.
+const configFileName = "iio-dsu-bridge.yaml"
+
+// userConfigPath returns ~/.config/iio-dsu-bridge.yaml. When HOME is unset (some service
+// contexts) it falls back to XDG_CONFIG_HOME through os.UserConfigDir, and returns "" if
+// neither is set.
+func userConfigPath() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", configFileName)
+	}
+	dir, err := os.UserConfigDir()
 	if err != nil {
-		return &Config{}, nil // silencioso si no existe
+		fmt.Fprintf(os.Stderr, "WARNING: HOME and XDG_CONFIG_HOME are unset; no config file will be loaded (use --config)\n")
+		return ""
 	}
-	var c Config
-	if err := yaml.Unmarshal(b, &c); err != nil {
-		return nil, err
+	fmt.Fprintf(os.Stderr, "WARNING: HOME is unset; looking for the config in %s\n", dir)
+	return filepath.Join(dir, configFileName)
+}
+
+// systemConfigPath is the system-wide config (distro or vendor defaults). It is loaded first
+// and the user's config is merged on top of it.
+var systemConfigPath = "/etc/" + configFileName
+
+// loadConfigFile loads the built-in quirks for this device and the system config, then merges
+// the config at path (or the user config when path is empty) on top, key by key. It returns
+// the user-level path it used. Missing system or user configs are not an error; a missing
+// explicit path is.
+func loadConfigFile(path string) (*Config, string, error) {
+	explicit := path != ""
+	c := &Config{}
+	quirkSrc := ""
+	if q := matchDeviceQuirk(dmiProduct()); q != nil {
+		quirkSrc = "built-in quirks (" + q.Name + ")"
+		if err := c.mergeYAML([]byte(q.Config), quirkSrc); err != nil {
+			return nil, path, err
+		}
+	}
+	if err := c.mergeFile(systemConfigPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, path, err
+	}
+	if !explicit {
+		path = userConfigPath()
+	}
+	if path != "" {
+		if err := c.mergeFile(path); err != nil {
+			if explicit || !errors.Is(err, os.ErrNotExist) {
+				return nil, path, err
+			}
+		}
+	}
+	if quirkSrc != "" {
+		c.dropQuirkMatrices(quirkSrc)
+	}
+	if err := c.applyAxisAngles(); err != nil {
+		return nil, path, err
+	}
+	return c, path, nil
+}
+
+// mergeFile merges the YAML file at path over c (see mergeYAML).
+func (c *Config) mergeFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.mergeYAML(b, path)
+}
+
+// mergeYAML decodes b over c: keys present in b replace the current values (nested blocks key
+// by key), the rest are kept. Each key is recorded as coming from src.
+func (c *Config) mergeYAML(b []byte, src string) error {
+	var keys map[string]yaml.Node
+	if err := yaml.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	for k := range keys {
+		c.noteSource(k, src)
+	}
+	return nil
+}
+
+// noteSource records where config key got its value (a file, env variable or flag).
+func (c *Config) noteSource(key, src string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[key] = src
+}
+
+// printConfigSources logs which file, env variable or flag each setting came from.
+func printConfigSources(c *Config) {
+	bySrc := make(map[string][]string)
+	for k, src := range c.sources {
+		bySrc[src] = append(bySrc[src], k)
+	}
+	for _, src := range slices.Sorted(maps.Keys(bySrc)) {
+		keys := bySrc[src]
+		sort.Strings(keys)
+		fmt.Printf("Config from %s: %s\n", src, strings.Join(keys, ", "))
 	}
-	return &c, nil
 }
 
 type Vec3 struct{ X, Y, Z float64 }
@@ -65,6 +347,15 @@ type IMUSample struct {
 	Gyro  Vec3 // rad/s
 	Accel Vec3 // m/s^2
 	TSus  uint64
+
+	// Gravity is a smoothed copy of Accel (DSU frame) for fusion and sanity checks; Accel,
+	// what DSU clients get, is filtered separately (gravity_cutoff_hz vs accel_cutoff_hz)
+	Gravity Vec3
+
+	// RawGyro/RawAccel are the integer counts read from the device, before offset and scale,
+	// in the sensor frame; the pipeline leaves them untouched
+	RawGyro  [3]int64
+	RawAccel [3]int64
 }
 
 type MountMatrix struct {
@@ -83,6 +374,27 @@ func (m MountMatrix) Apply(v Vec3) Vec3 {
 
 // ---------- IIO helpers ----------
 
+// sysfsBase is the directory holding the iio:deviceX entries. It can be pointed at a
+// bind-mounted sysfs (containers) or a fixture tree with --sysfs-base / IIO_DSU_SYSFS_BASE.
+var sysfsBase = "/sys/bus/iio/devices"
+
+// iioMissingError is returned when the sysfs base doesn't exist, which usually means the
+// kernel has no IIO support or /sys isn't mounted (containers), not that the IMU is missing.
+type iioMissingError struct{ Path string }
+
+func (e *iioMissingError) Error() string {
+	return fmt.Sprintf("IIO subsystem not found (%s does not exist); is CONFIG_IIO enabled and is /sys mounted?", e.Path)
+}
+
+// readIIODir lists the sysfs base, reporting a missing one as an *iioMissingError.
+func readIIODir(base string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(base)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &iioMissingError{Path: base}
+	}
+	return entries, err
+}
+
 // isIIODevice checks if a DirEntry is an IIO device (directory or symlink starting with "iio:device")
 func isIIODevice(e os.DirEntry) bool {
 	if !strings.HasPrefix(e.Name(), "iio:device") {
@@ -99,16 +411,19 @@ func isIIODevice(e os.DirEntry) bool {
 	return false
 }
 
-func findIIODeviceByName(name string) (string, error) {
-	base := "/sys/bus/iio/devices"
-	entries, err := os.ReadDir(base)
+// findIIODeviceByName finds the IIO device called name: an exact match, else a partial one,
+// else one whose name contains any of aliases (other kernels' names for the same part), else
+// the first device with IMU channels. An alias match is logged to w.
+func findIIODeviceByName(w io.Writer, name string, aliases []string) (string, error) {
+	base := sysfsBase
+	entries, err := readIIODir(base)
 	if err != nil {
 		return "", err
 	}
 	name = strings.TrimSpace(name)
 	nameLower := strings.ToLower(name)
 
-	var exact, partial, firstWithIMU string
+	var exact, partial, aliased, aliasUsed, firstWithIMU string
 
 	for _, e := range entries {
 		if !isIIODevice(e) {
@@ -119,14 +434,24 @@ func findIIODeviceByName(name string) (string, error) {
 		devName := strings.TrimSpace(string(b))
 		devLower := strings.ToLower(devName)
 
-		hasGyro := fileExists(filepath.Join(dev, "in_anglvel_x_raw"))
-		hasAccel := fileExists(filepath.Join(dev, "in_accel_x_raw"))
-		if firstWithIMU == "" && (hasGyro || hasAccel) {
+		_, hasGyro := channelAxisNames(dev, "anglvel")
+		_, hasAccel := channelAxisNames(dev, "accel")
+		if !hasGyro && !hasAccel {
+			// a name match on a non-IMU device (e.g. "bmi323" vs a "bmi323-trigger") is useless
+			continue
+		}
+		if firstWithIMU == "" {
 			firstWithIMU = dev
 		}
-		// si no se pidió nombre, devolvemos el primero con IMU
+		// alias
+		for _, a := range aliases {
+			if a = strings.ToLower(strings.TrimSpace(a)); a != "" && aliased == "" && strings.Contains(devLower, a) {
+				aliased, aliasUsed = dev, a
+			}
+		}
+		// si no se pidió nombre (ni alias), devolvemos el primero con IMU
 		if nameLower == "" {
-			if firstWithIMU != "" {
+			if firstWithIMU != "" && len(aliases) == 0 {
 				return firstWithIMU, nil
 			}
 			continue
@@ -136,7 +461,7 @@ func findIIODeviceByName(name string) (string, error) {
 			exact = dev
 		}
 		// match parcial
-		if strings.Contains(devLower, nameLower) || strings.Contains(nameLower, devLower) {
+		if devLower != "" && (strings.Contains(devLower, nameLower) || strings.Contains(nameLower, devLower)) {
 			if partial == "" {
 				partial = dev
 			}
@@ -147,6 +472,9 @@ func findIIODeviceByName(name string) (string, error) {
 		return exact, nil
 	case partial != "":
 		return partial, nil
+	case aliased != "":
+		fmt.Fprintf(w, "Device %s matched alias %q\n", aliased, aliasUsed)
+		return aliased, nil
 	case firstWithIMU != "":
 		return firstWithIMU, nil
 	default:
@@ -158,8 +486,8 @@ func findFirstIIODeviceWith(wantGyro, wantAccel bool) (string, error) {
 	if !wantGyro && !wantAccel {
 		return "", fmt.Errorf("must request gyro and/or accel")
 	}
-	base := "/sys/bus/iio/devices"
-	entries, err := os.ReadDir(base)
+	base := sysfsBase
+	entries, err := readIIODir(base)
 	if err != nil {
 		return "", err
 	}
@@ -174,8 +502,8 @@ func findFirstIIODeviceWith(wantGyro, wantAccel bool) (string, error) {
 
 	for _, n := range names {
 		dev := filepath.Join(base, n)
-		hasGyro := fileExists(filepath.Join(dev, "in_anglvel_x_raw"))
-		hasAccel := fileExists(filepath.Join(dev, "in_accel_x_raw"))
+		_, hasGyro := channelAxisNames(dev, "anglvel")
+		_, hasAccel := channelAxisNames(dev, "accel")
 		if (wantGyro && !hasGyro) || (wantAccel && !hasAccel) {
 			continue
 		}
@@ -184,12 +512,19 @@ func findFirstIIODeviceWith(wantGyro, wantAccel bool) (string, error) {
 	return "", fmt.Errorf("no matching IIO device found (gyro=%v accel=%v)", wantGyro, wantAccel)
 }
 
+// errEmptyRead is returned when a sysfs attribute reads back empty, which some drivers do
+// briefly while changing state.
+var errEmptyRead = errors.New("empty read")
+
 func readFloat(path string) (float64, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return 0, err
 	}
 	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return 0, fmt.Errorf("%s: %w", path, errEmptyRead)
+	}
 	// soporta notación científica
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
@@ -203,9 +538,12 @@ func readInt(path string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	s := strings.TrimSpace(string(b))
 	// algunos kernels dejan un \n extra; otros tifilan con espacios
-	s = strings.Fields(s)[0]
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%s: %w", path, errEmptyRead)
+	}
+	s := fields[0]
 	v, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
 		return 0, fmt.Errorf("parseInt %q: %w", s, err)
@@ -226,22 +564,33 @@ func readFloatIfExists(path string) (float64, bool) {
 	return f, true
 }
 
+// commaDecimal makes readFloatList accept comma decimal separators ("0,0012"), as written by
+// some locale-affected tools (--comma-decimal).
+var commaDecimal bool
+
+// readFloatList parses a whitespace separated list of floats, such as *_available attributes.
+// Surrounding brackets are ignored. Every token must parse: a partial list could make us pick
+// the wrong value silently.
 func readFloatList(path string) ([]float64, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	fields := strings.Fields(string(b))
+	s := strings.NewReplacer("[", " ", "]", " ").Replace(string(b))
+	fields := strings.Fields(s)
 	out := make([]float64, 0, len(fields))
 	for _, f := range fields {
+		if commaDecimal {
+			f = strings.Replace(f, ",", ".", 1)
+		}
 		v, err := strconv.ParseFloat(f, 64)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("%s: parseFloat %q: %w", path, f, err)
 		}
 		out = append(out, v)
 	}
 	if len(out) == 0 {
-		return nil, fmt.Errorf("no floats in %s", path)
+		return nil, fmt.Errorf("%s: %w", path, errEmptyRead)
 	}
 	return out, nil
 }
@@ -255,14 +604,36 @@ func writeInt(path string, v int) error {
 	return os.WriteFile(path, []byte(strconv.Itoa(v)), 0644)
 }
 
+var writeDeniedOnce sync.Once
+
+// warnWriteDenied explains, once per run, that --set-scales/--set-rate need write access to
+// the IIO attributes when err is a permission error. It reports whether it was one.
+func warnWriteDenied(path string, err error) bool {
+	if !errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	writeDeniedOnce.Do(func() {
+		fmt.Fprintf(os.Stderr, "ERROR: no permission to write %s; scales/rates were left as the driver set them.\n", path)
+		fmt.Fprintf(os.Stderr, "       Run as root, or allow writes with a udev rule, e.g. in /etc/udev/rules.d/99-iio-dsu-bridge.rules:\n")
+		fmt.Fprintf(os.Stderr, "       SUBSYSTEM==\"iio\", RUN+=\"/bin/sh -c 'chmod a+w /sys%%p/in_*_scale /sys%%p/*sampling_frequency'\"\n")
+	})
+	return true
+}
+
+// nearest returns the entry of avail closest to target: an exact match if there is one, and
+// of two equally close entries the higher (more headroom), whatever the list order. An empty
+// list returns target.
 func nearest(avail []float64, target float64) float64 {
-	if len(avail) == 0 {
+	if len(avail) == 0 || slices.Contains(avail, target) {
 		return target
 	}
+	// differences within tieEps are a tie (list entries may be rescaled, e.g. mHz -> Hz)
+	const tieEps = 1e-9
 	best := avail[0]
 	minDiff := math.Abs(avail[0] - target)
 	for _, a := range avail[1:] {
-		if d := math.Abs(a - target); d < minDiff {
+		d := math.Abs(a - target)
+		if d < minDiff-tieEps || (d <= minDiff+tieEps && a > best) {
 			minDiff = d
 			best = a
 		}
@@ -270,10 +641,268 @@ func nearest(avail []float64, target float64) float64 {
 	return best
 }
 
-func listIIODevices() {
-	base := "/sys/bus/iio/devices"
-	entries, err := os.ReadDir(base)
+const (
+	// minPlausibleRateHz / maxPlausibleRateHz bound the sampling frequencies we take at face
+	// value. IMUs run between a few Hz and a few kHz.
+	minPlausibleRateHz = 1
+	maxPlausibleRateHz = 10000
+)
+
+// normalizeRateHz interprets a sampling_frequency reading. The ABI says Hz, but a few drivers
+// report mHz; factor is what the raw value was divided by (1 or 1000). ok is false when the
+// value is implausible either way and should not be trusted for timing.
+func normalizeRateHz(v float64) (hz, factor float64, ok bool) {
+	switch {
+	case v >= minPlausibleRateHz && v <= maxPlausibleRateHz:
+		return v, 1, true
+	case v > maxPlausibleRateHz && v/1000 >= minPlausibleRateHz && v/1000 <= maxPlausibleRateHz:
+		return v / 1000, 1000, true
+	default:
+		return 0, 1, false
+	}
+}
+
+// readRateHz reads a sampling_frequency attribute in Hz, warning about converted or
+// implausible readings. It returns 0 when the rate is missing or not trustworthy. Some
+// drivers put several values (or a bracketed list) in the attribute; the first one is taken.
+func readRateHz(path string) float64 {
+	vals, err := readFloatList(path)
+	if err != nil {
+		return 0
+	}
+	v := vals[0]
+	hz, factor, ok := normalizeRateHz(v)
+	switch {
+	case !ok:
+		fmt.Fprintf(os.Stderr, "WARNING: %s reads %g, which is not a plausible rate in Hz; ignoring it\n", path, v)
+	case factor != 1:
+		fmt.Fprintf(os.Stderr, "WARNING: %s reads %g; treating it as mHz (%g Hz)\n", path, v, hz)
+	}
+	return hz
+}
+
+// rateBand bounds the sampling frequencies (Hz) picked for a sensor (rate_min, rate_max);
+// a zero bound is open.
+type rateBand struct{ Min, Max float64 }
+
+func (b rateBand) contains(hz float64) bool {
+	return (b.Min == 0 || hz >= b.Min) && (b.Max == 0 || hz <= b.Max)
+}
+
+// clamp returns hz moved into the band.
+func (b rateBand) clamp(hz float64) float64 {
+	if b.Min > 0 {
+		hz = math.Max(hz, b.Min)
+	}
+	if b.Max > 0 {
+		hz = math.Min(hz, b.Max)
+	}
+	return hz
+}
+
+// filter returns the entries of avail (Hz) inside the band. When none is, it warns and
+// returns avail, so the closest one overall is used.
+func (b rateBand) filter(avail []float64) []float64 {
+	in := slices.DeleteFunc(slices.Clone(avail), func(hz float64) bool { return !b.contains(hz) })
+	if len(in) == 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: no available sampling frequency (%v Hz) is within rate_min %g and rate_max %g; using the closest one\n", avail, b.Min, b.Max)
+		return avail
+	}
+	return in
+}
+
+// pickRate chooses the entry of a sampling_frequency_available list closest to rate (Hz),
+// among those within band. It returns the value to write, in the list's own unit, and the
+// same rate in Hz.
+func pickRate(avail []float64, rate float64, band rateBand) (write, hz float64) {
+	factor := 1.0
+	if _, f, ok := normalizeRateHz(slices.Max(avail)); ok {
+		factor = f
+	}
+	hzAvail := make([]float64, len(avail))
+	for i, a := range avail {
+		hzAvail[i] = a / factor
+	}
+	hz = nearest(band.filter(hzAvail), rate)
+	return hz * factor, hz
+}
+
+// parseRateHz parses a rate such as 250, 12.5, 250hz or 1khz (the unit is case-insensitive
+// and may follow a space) into Hz.
+func parseRateHz(s string) (float64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	factor := 1.0
+	switch {
+	case strings.HasSuffix(v, "khz"):
+		v, factor = strings.TrimSuffix(v, "khz"), 1000
+	case strings.HasSuffix(v, "hz"):
+		v = strings.TrimSuffix(v, "hz")
+	}
+	hz, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || !(hz > 0) || math.IsInf(hz, 0) { // !(hz > 0) rejects NaN too
+		return 0, fmt.Errorf("bad rate %q (want a positive number of Hz, e.g. 250, 12.5, 250hz or 1khz)", s)
+	}
+	return hz * factor, nil
+}
+
+// rateFlag is --rate: an output rate in Hz, or "native" to follow the sensor's own rate.
+type rateFlag struct {
+	hz     float64
+	native bool
+}
+
+func (r *rateFlag) String() string {
+	if r.native {
+		return "native"
+	}
+	return strconv.FormatFloat(r.hz, 'g', -1, 64)
+}
+
+func (r *rateFlag) Set(s string) error {
+	if s == "native" {
+		r.native = true
+		return nil
+	}
+	hz, err := parseRateHz(s)
+	if err != nil {
+		return fmt.Errorf("want a positive number of Hz (e.g. 12.5 or 1khz) or native")
+	}
+	r.hz, r.native = hz, false
+	return nil
+}
+
+// phaseLockedRate returns the output rate closest to target that is the native sensor rate
+// divided by an integer, and that divisor, so every output tick lands on a sensor sample.
+// Targets at or above native follow the sensor.
+func phaseLockedRate(native, target float64) (hz float64, div int) {
+	if target >= native {
+		return native, 1
+	}
+	div = max(1, int(math.Round(native/target)))
+	return native / float64(div), div
+}
+
+// defaultRate is the output rate when neither the user nor the device gives one.
+const defaultRate = 250
+
+// deviceOutputRate returns the output rate used when none is configured: the slowest sampling
+// rate of the motion channels in use, so no sample is sent twice. 0 when none is known.
+func deviceOutputRate(devs ...*IIODevice) float64 {
+	hz := 0.0
+	for _, d := range devs {
+		if d == nil {
+			continue
+		}
+		for _, ch := range []struct {
+			have bool
+			hz   float64
+		}{{d.HaveGyro, d.AngVelRateHz}, {d.HaveAccel, d.AccelRateHz}} {
+			if ch.have && ch.hz > 0 && (hz == 0 || ch.hz < hz) {
+				hz = ch.hz
+			}
+		}
+	}
+	return hz
+}
+
+// sensorNativeRate returns the sampling rate the motion data is produced at: the gyro's, or
+// the accel's when there is no gyro. 0 when unknown.
+func sensorNativeRate(dev, gyroDev, accelDev *IIODevice) float64 {
+	switch {
+	case gyroDev != nil && gyroDev.AngVelRateHz > 0:
+		return gyroDev.AngVelRateHz
+	case dev != nil && dev.HaveGyro && dev.AngVelRateHz > 0:
+		return dev.AngVelRateHz
+	case accelDev != nil && accelDev.AccelRateHz > 0:
+		return accelDev.AccelRateHz
+	case dev != nil && dev.HaveAccel:
+		return dev.AccelRateHz
+	}
+	return 0
+}
+
+// rateAttrs lists, most specific first, the attributes (relative to the device directory)
+// that may hold a channel's sampling frequency. Some drivers only expose the device-wide one
+// or the one under buffer/.
+func rateAttrs(channel string) []string {
+	return []string{
+		"in_" + channel + "_sampling_frequency",
+		"sampling_frequency",
+		filepath.Join("buffer", "sampling_frequency"),
+	}
+}
+
+// firstRateAttr returns the first sampling frequency attribute variant present for channel,
+// or "" when there is none.
+func firstRateAttr(base, channel string) string {
+	for _, attr := range rateAttrs(channel) {
+		if fileExists(filepath.Join(base, attr)) {
+			return attr
+		}
+	}
+	return ""
+}
+
+// readChannelRateHz reads a channel's sampling frequency from the first attribute variant
+// present, in Hz (0 when unknown).
+func readChannelRateHz(base, channel string) float64 {
+	if attr := firstRateAttr(base, channel); attr != "" {
+		return readRateHz(filepath.Join(base, attr))
+	}
+	return 0
+}
+
+// readRateAvailable reads the channel's sampling_frequency_available list, falling back to
+// the device-wide one.
+func readRateAvailable(base, channel string) ([]float64, error) {
+	avail, err := readFloatList(filepath.Join(base, "in_"+channel+"_sampling_frequency_available"))
+	if err != nil && os.IsNotExist(err) {
+		avail, err = readFloatList(filepath.Join(base, "sampling_frequency_available"))
+	}
+	return avail, err
+}
+
+// planChannelRate picks the value to write for rate: the closest available entry within band,
+// or rate itself, moved into band, when the driver lists none. hz is the same rate in Hz.
+func planChannelRate(base, channel string, rate float64, band rateBand) (write, hz float64) {
+	if avail, err := readRateAvailable(base, channel); err == nil {
+		return pickRate(avail, rate, band)
+	}
+	rate = band.clamp(rate)
+	return rate, rate
+}
+
+// setChannelRate writes the planned rate to each existing attribute variant in turn until one
+// accepts it, and returns that attribute. attr and err are both empty when the device has no
+// sampling frequency attribute.
+func setChannelRate(dev *IIODevice, channel string, rate float64, band rateBand) (attr string, write, hz float64, err error) {
+	write, hz = planChannelRate(dev.Base, channel, rate, band)
+	var errs []error
+	for _, a := range rateAttrs(channel) {
+		p := filepath.Join(dev.Base, a)
+		if !fileExists(p) {
+			continue
+		}
+		if err := writeFloat(p, write); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a, err))
+			continue
+		}
+		return a, write, hz, nil
+	}
+	return "", write, hz, errors.Join(errs...) // nil when there is no attribute at all
+}
+
+// listIIODevices writes one line per IIO device under the sysfs base to w: its name, label
+// if it has one, sensors and scales. Errors reading the base go to stderr.
+func listIIODevices(w io.Writer) {
+	base := sysfsBase
+	entries, err := readIIODir(base)
 	if err != nil {
+		var missing *iioMissingError
+		if errors.As(err, &missing) {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return
+		}
 		fmt.Fprintf(os.Stderr, "read %s: %v\n", base, err)
 		return
 	}
@@ -288,12 +917,123 @@ func listIIODevices() {
 		dev := filepath.Join(base, n)
 		nameBytes, _ := os.ReadFile(filepath.Join(dev, "name"))
 		name := strings.TrimSpace(string(nameBytes))
-		hasGyro := fileExists(filepath.Join(dev, "in_anglvel_x_raw"))
-		hasAccel := fileExists(filepath.Join(dev, "in_accel_x_raw"))
+		_, hasGyro := channelAxisNames(dev, "anglvel")
+		_, hasAccel := channelAxisNames(dev, "accel")
 		gScale, _ := readFloatIfExists(filepath.Join(dev, "in_anglvel_scale"))
 		aScale, _ := readFloatIfExists(filepath.Join(dev, "in_accel_scale"))
-		fmt.Printf("%s  name=%q  gyro=%v accel=%v  gScale=%g aScale=%g\n", dev, name, hasGyro, hasAccel, gScale, aScale)
+		label := ""
+		if b, err := os.ReadFile(filepath.Join(dev, "label")); err == nil {
+			label = fmt.Sprintf("  label=%q", strings.TrimSpace(string(b)))
+		}
+		fmt.Fprintf(w, "%s  name=%q%s  gyro=%v accel=%v  gScale=%g aScale=%g\n", dev, name, label, hasGyro, hasAccel, gScale, aScale)
+	}
+}
+
+// deviceLabel returns the human-friendly name of the IIO device at base: its label attribute
+// (set from the firmware, e.g. "accel-base" vs "accel-display" on convertibles), else its
+// name, else "".
+func deviceLabel(base string) string {
+	for _, attr := range []string{"label", "name"} {
+		if b, err := os.ReadFile(filepath.Join(base, attr)); err == nil {
+			if s := strings.TrimSpace(string(b)); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// dsuModelFor maps the sensors actually sent to the DSU device model.
+func dsuModelFor(haveGyro, haveAccel bool) uint8 {
+	switch {
+	case haveGyro && haveAccel:
+		return dsuModelFull
+	case haveGyro || haveAccel:
+		return dsuModelPartial
+	default:
+		return dsuModelNone
+	}
+}
+
+// detectConnType guesses the transport of an IIO device from its resolved sysfs path. HID
+// sensor hubs sit below a Bluetooth adapter (HID bus 0005) or a USB port (HID bus 0003).
+// Built-in I2C/SPI parts are reported as USB, which is what clients always got from us.
+func detectConnType(base string) uint8 {
+	p, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return dsuConnUSB
+	}
+	parts := strings.Split(p, "/")
+	// Bluetooth adapters are often USB devices themselves, so look for them first
+	for _, part := range parts {
+		if part == "bluetooth" || strings.HasPrefix(part, "0005:") {
+			return dsuConnBT
+		}
+	}
+	return dsuConnUSB
+}
+
+// deviceIdentity names the physical sensor behind a sysfs device (an iio:deviceN directory or
+// /sys/class/input/eventN) in a way that survives reboots and replugging: its name, serial
+// (evdev uniq) and resolved sysfs path without the parts the kernel numbers at enumeration
+// (iio:deviceN, inputN, eventN and HID instance suffixes like 0003:1234:5678.000A). An empty
+// name is read from the device's name attribute.
+func deviceIdentity(sysPath, name string) string {
+	if name == "" {
+		b, _ := os.ReadFile(filepath.Join(sysPath, "name"))
+		name = strings.TrimSpace(string(b))
+	}
+	p, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		p = sysPath
+	}
+	var keep []string
+parts:
+	for _, part := range strings.Split(p, "/") {
+		for _, prefix := range []string{"iio:device", "input", "event"} {
+			if n, ok := strings.CutPrefix(part, prefix); ok && n != "" && strings.Trim(n, "0123456789") == "" {
+				continue parts
+			}
+		}
+		if len(part) == 19 && part[4] == ':' && part[9] == ':' && part[14] == '.' {
+			part = part[:14]
+		}
+		keep = append(keep, part)
+	}
+	uniq, _ := os.ReadFile(filepath.Join(sysPath, "device", "uniq"))
+	return name + "|" + strings.TrimSpace(string(uniq)) + "|" + strings.Join(keep, "/")
+}
+
+// needsSysfsBase reports whether source can only read IIO devices, so a missing sysfs base
+// is fatal. auto falls back to evdev without one (see Run) and evdev never looks at it.
+func needsSysfsBase(source string) bool {
+	return source == "iio" || source == "iio-buffer"
+}
+
+// reportSysfsBase prints why the sysfs base from checkSysfsBase is unusable.
+func reportSysfsBase(err error) {
+	var missing *iioMissingError
+	if errors.As(err, &missing) {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "ERROR: IIO sysfs base unusable: %v\n", err)
+	}
+	fmt.Fprintf(os.Stderr, "       Use --sysfs-base or IIO_DSU_SYSFS_BASE to point at the iio devices directory.\n")
+}
+
+// checkSysfsBase makes sure the configured IIO base is an existing directory.
+func checkSysfsBase(base string) error {
+	st, err := os.Stat(base)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &iioMissingError{Path: base}
+	}
+	if err != nil {
+		return err
 	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", base)
+	}
+	return nil
 }
 
 func fileExists(p string) bool {
@@ -305,42 +1045,33 @@ type IIODevice struct {
 	Base         string
 	GyroScale    Vec3
 	AccelScale   Vec3
+	GyroOffset   Vec3 // added to raw before scaling (in_<ch>_offset), usually 0
+	AccelOffset  Vec3
 	HaveAccel    bool
 	HaveGyro     bool
 	AngVelPaths  [3]string
 	AccelPaths   [3]string
 	AngVelScaleP [3]string
 	AccelScaleP  [3]string
+	AngVelChans  [3]string // per-axis channel names, e.g. in_anglvel_x (see channelAxisNames)
+	AccelChans   [3]string
 	SampleRateHz float64
 	AccelRateHz  float64
 	AngVelRateHz float64
+	Label        string // for logs (see deviceLabel); matching still uses name
 }
 
 func openIIODevice(base string) (*IIODevice, error) {
-	dev := &IIODevice{Base: base}
-
-	// canales raw
-	dev.AngVelPaths[0] = filepath.Join(base, "in_anglvel_x_raw")
-	dev.AngVelPaths[1] = filepath.Join(base, "in_anglvel_y_raw")
-	dev.AngVelPaths[2] = filepath.Join(base, "in_anglvel_z_raw")
-	dev.AccelPaths[0] = filepath.Join(base, "in_accel_x_raw")
-	dev.AccelPaths[1] = filepath.Join(base, "in_accel_y_raw")
-	dev.AccelPaths[2] = filepath.Join(base, "in_accel_z_raw")
-
-	// escalas
-	dev.AngVelScaleP[0] = filepath.Join(base, "in_anglvel_x_scale")
-	dev.AngVelScaleP[1] = filepath.Join(base, "in_anglvel_y_scale")
-	dev.AngVelScaleP[2] = filepath.Join(base, "in_anglvel_z_scale")
-	dev.AccelScaleP[0] = filepath.Join(base, "in_accel_x_scale")
-	dev.AccelScaleP[1] = filepath.Join(base, "in_accel_y_scale")
-	dev.AccelScaleP[2] = filepath.Join(base, "in_accel_z_scale")
-
-	// detectar presencia
-	if _, err := os.Stat(dev.AngVelPaths[0]); err == nil {
-		dev.HaveGyro = true
-	}
-	if _, err := os.Stat(dev.AccelPaths[0]); err == nil {
-		dev.HaveAccel = true
+	dev := &IIODevice{Base: base, Label: deviceLabel(base)}
+
+	// canales raw y escalas, con los nombres que use el driver
+	dev.AngVelChans, dev.HaveGyro = channelAxisNames(base, "anglvel")
+	dev.AccelChans, dev.HaveAccel = channelAxisNames(base, "accel")
+	for i := range 3 {
+		dev.AngVelPaths[i] = filepath.Join(base, dev.AngVelChans[i]+"_raw")
+		dev.AngVelScaleP[i] = filepath.Join(base, dev.AngVelChans[i]+"_scale")
+		dev.AccelPaths[i] = filepath.Join(base, dev.AccelChans[i]+"_raw")
+		dev.AccelScaleP[i] = filepath.Join(base, dev.AccelChans[i]+"_scale")
 	}
 	if !dev.HaveGyro && !dev.HaveAccel {
 		return nil, errors.New("no gyro/accel channels found in IIO device")
@@ -348,111 +1079,182 @@ func openIIODevice(base string) (*IIODevice, error) {
 
 	// leer escalas (si falta o da 0, intentar global)
 	if dev.HaveGyro {
-		var sx, sy, sz float64
-		if v, ok := readFloatIfExists(dev.AngVelScaleP[0]); ok {
-			sx = v
-		}
-		if v, ok := readFloatIfExists(dev.AngVelScaleP[1]); ok {
-			sy = v
+		dev.GyroScale = readChannelScale(dev.AngVelScaleP, filepath.Join(base, "in_anglvel_scale"))
+	}
+	if dev.HaveAccel {
+		dev.AccelScale = readChannelScale(dev.AccelScaleP, filepath.Join(base, "in_accel_scale"))
+	}
+
+	if dev.HaveGyro {
+		dev.GyroOffset = readChannelOffset(base, "anglvel", dev.AngVelChans)
+	}
+	if dev.HaveAccel {
+		dev.AccelOffset = readChannelOffset(base, "accel", dev.AccelChans)
+	}
+
+	// sample rates (si existen)
+	if dev.HaveGyro {
+		dev.AngVelRateHz = readChannelRateHz(base, "anglvel")
+	}
+	if dev.HaveAccel {
+		dev.AccelRateHz = readChannelRateHz(base, "accel")
+	}
+
+	return dev, nil
+}
+
+// readChannelScale reads the per-axis scales from paths. An axis whose file is missing, empty
+// or 0 takes the channel-wide scale at global; if that is missing too it borrows the scale of
+// another axis, and stays 0 only when no axis has one.
+func readChannelScale(paths [3]string, global string) Vec3 {
+	all, _ := readFloatIfExists(global)
+	var sc [3]float64
+	for i, p := range paths {
+		if v, ok := readFloatIfExists(p); ok && v != 0 {
+			sc[i] = v
 		} else {
-			sy = sx
+			sc[i] = all
 		}
-		if v, ok := readFloatIfExists(dev.AngVelScaleP[2]); ok {
-			sz = v
-		} else {
-			sz = sx
+	}
+	if all == 0 {
+		known := 0.0
+		for _, v := range sc {
+			if v != 0 {
+				known = v
+				break
+			}
 		}
-		// fallback global
-		if sx == 0 && sy == 0 && sz == 0 {
-			if v, ok := readFloatIfExists(filepath.Join(base, "in_anglvel_scale")); ok {
-				sx, sy, sz = v, v, v
+		for i := range sc {
+			if sc[i] == 0 {
+				sc[i] = known
 			}
 		}
-		dev.GyroScale = Vec3{X: sx, Y: sy, Z: sz}
 	}
-	if dev.HaveAccel {
-		var sx, sy, sz float64
-		if v, ok := readFloatIfExists(dev.AccelScaleP[0]); ok {
-			sx = v
-		}
-		if v, ok := readFloatIfExists(dev.AccelScaleP[1]); ok {
-			sy = v
-		} else {
-			sy = sx
+	return Vec3{X: sc[0], Y: sc[1], Z: sc[2]}
+}
+
+// readChannelOffset reads the per-axis <chan>_offset attributes, falling back to the
+// channel-wide in_<channel>_offset for axes without one. Missing offsets are 0.
+func readChannelOffset(base, channel string, chans [3]string) Vec3 {
+	all, _ := readFloatIfExists(filepath.Join(base, "in_"+channel+"_offset"))
+	axis := func(i int) float64 {
+		if v, ok := readFloatIfExists(filepath.Join(base, chans[i]+"_offset")); ok {
+			return v
 		}
-		if v, ok := readFloatIfExists(dev.AccelScaleP[2]); ok {
-			sz = v
-		} else {
-			sz = sx
+		return all
+	}
+	return Vec3{X: axis(0), Y: axis(1), Z: axis(2)}
+}
+
+// channelAxisNames returns the X, Y and Z channel names of a motion channel type ("anglvel"
+// or "accel"): in_<channel>_x/_y/_z, or in_<channel>0/1/2 for drivers that number the axes.
+// Numbered axes are taken in scan index order when scan_elements has one, else by number.
+// ok is false when the device has neither.
+func channelAxisNames(base, channel string) (names [3]string, ok bool) {
+	prefix := "in_" + channel
+	if fileExists(filepath.Join(base, prefix+"_x_raw")) {
+		return [3]string{prefix + "_x", prefix + "_y", prefix + "_z"}, true
+	}
+	raws, _ := filepath.Glob(filepath.Join(base, prefix+"[0-9]*_raw"))
+	type numbered struct {
+		name  string
+		order int64
+	}
+	var found []numbered
+	for _, p := range raws {
+		name := strings.TrimSuffix(filepath.Base(p), "_raw")
+		n, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 32)
+		if err != nil {
+			continue // e.g. in_accel0_x_raw, not a numbered axis
 		}
-		// fallback global
-		if sx == 0 && sy == 0 && sz == 0 {
-			if v, ok := readFloatIfExists(filepath.Join(base, "in_accel_scale")); ok {
-				sx, sy, sz = v, v, v
-			}
+		if idx, err := readInt(filepath.Join(base, "scan_elements", name+"_index")); err == nil {
+			n = idx
 		}
-		dev.AccelScale = Vec3{X: sx, Y: sy, Z: sz}
+		found = append(found, numbered{name, n})
 	}
+	if len(found) < 3 {
+		return names, false
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].order < found[j].order })
+	return [3]string{found[0].name, found[1].name, found[2].name}, true
+}
 
-	// sample rates (si existen)
-	if f, err := readFloat(filepath.Join(base, "in_anglvel_sampling_frequency")); err == nil {
-		dev.AngVelRateHz = f
+// sensorRates are the sampling rates (Hz) configureDevice aims each sensor at; 0 leaves that
+// sensor's rate alone. Band bounds what is picked for either.
+type sensorRates struct {
+	Gyro, Accel float64
+	Band        rateBand
+}
+
+// sensorRatesFor returns rate for both sensors, overridden per sensor by gyro_rate and
+// accel_rate.
+func sensorRatesFor(cfg *Config, rate float64) sensorRates {
+	r := sensorRates{Gyro: rate, Accel: rate, Band: rateBand{Min: cfg.RateMin, Max: cfg.RateMax}}
+	if cfg.GyroRate > 0 {
+		r.Gyro = cfg.GyroRate
 	}
-	if f, err := readFloat(filepath.Join(base, "in_accel_sampling_frequency")); err == nil {
-		dev.AccelRateHz = f
+	if cfg.AccelRate > 0 {
+		r.Accel = cfg.AccelRate
 	}
-
-	return dev, nil
+	return r
 }
 
 // configureDevice sets scales and sampling rates on an IIODevice if they are zero.
 // This is extracted as a reusable function to support split devices (separate accel/gyro).
-func configureDevice(dev *IIODevice, rate int, setScales, setRate bool) {
+// scalePolicy names the entry of scalePolicies used to pick from scales_available.
+func configureDevice(dev *IIODevice, rates sensorRates, setScales, setRate bool, scalePolicy string) {
 	if dev == nil {
 		return
 	}
 
 	if setScales {
-		// Gyro scales
-		if dev.HaveGyro && dev.GyroScale.X == 0 && dev.GyroScale.Y == 0 && dev.GyroScale.Z == 0 {
-			if avail, err := readFloatList(filepath.Join(dev.Base, "in_anglvel_scales_available")); err == nil {
-				pick := avail[len(avail)/2] // pick middle value
-				if err := writeFloat(filepath.Join(dev.Base, "in_anglvel_scale"), pick); err == nil {
-					fmt.Printf("Set %s in_anglvel_scale=%g\n", dev.Base, pick)
-					dev.GyroScale = Vec3{X: pick, Y: pick, Z: pick}
-				}
+		pick, ok := scalePolicies[scalePolicy]
+		if !ok {
+			pick = pickMiddleScale
+		}
+		// Gyro scales (auto-noise re-evaluates a scale the driver already set)
+		if dev.HaveGyro && ((dev.GyroScale.X == 0 && dev.GyroScale.Y == 0 && dev.GyroScale.Z == 0) || scalePolicy == "auto-noise") {
+			if v, ok := setChannelScale(dev, "anglvel", pick); ok {
+				dev.GyroScale = Vec3{X: v, Y: v, Z: v}
 			}
 		}
 		// Accel scales
 		if dev.HaveAccel && dev.AccelScale.X == 0 && dev.AccelScale.Y == 0 && dev.AccelScale.Z == 0 {
-			if avail, err := readFloatList(filepath.Join(dev.Base, "in_accel_scales_available")); err == nil {
-				pick := avail[len(avail)/2]
-				if err := writeFloat(filepath.Join(dev.Base, "in_accel_scale"), pick); err == nil {
-					fmt.Printf("Set %s in_accel_scale=%g\n", dev.Base, pick)
-					dev.AccelScale = Vec3{X: pick, Y: pick, Z: pick}
-				}
+			if v, ok := setChannelScale(dev, "accel", pick); ok {
+				dev.AccelScale = Vec3{X: v, Y: v, Z: v}
 			}
 		}
 	}
 
 	if setRate {
-		// Gyro sampling frequency
-		if dev.HaveGyro {
-			if avail, err := readFloatList(filepath.Join(dev.Base, "in_anglvel_sampling_frequency_available")); err == nil {
-				pick := nearest(avail, float64(rate))
-				if err := writeFloat(filepath.Join(dev.Base, "in_anglvel_sampling_frequency"), pick); err == nil {
-					fmt.Printf("Set %s in_anglvel_sampling_frequency=%g\n", dev.Base, pick)
-				}
+		written := map[string]float64{} // attribute -> rate, to catch sensors sharing one
+		for _, ch := range []struct {
+			name string
+			have bool
+			rate float64
+			hz   *float64
+		}{{"anglvel", dev.HaveGyro, rates.Gyro, &dev.AngVelRateHz}, {"accel", dev.HaveAccel, rates.Accel, &dev.AccelRateHz}} {
+			if !ch.have || ch.rate <= 0 {
+				continue
 			}
-		}
-		// Accel sampling frequency
-		if dev.HaveAccel {
-			if avail, err := readFloatList(filepath.Join(dev.Base, "in_accel_sampling_frequency_available")); err == nil {
-				pick := nearest(avail, float64(rate))
-				if err := writeFloat(filepath.Join(dev.Base, "in_accel_sampling_frequency"), pick); err == nil {
-					fmt.Printf("Set %s in_accel_sampling_frequency=%g\n", dev.Base, pick)
+			attr, pick, hz, err := setChannelRate(dev, ch.name, ch.rate, rates.Band)
+			if err != nil {
+				if warnWriteDenied(filepath.Join(dev.Base, firstRateAttr(dev.Base, ch.name)), err) {
+					continue
 				}
+				fmt.Fprintf(os.Stderr, "WARNING: could not set %s sampling frequency on %s: %v\n", ch.name, dev.Base, err)
+				continue
+			}
+			if attr == "" {
+				continue // fixed-rate device
 			}
+			if prev, ok := written[attr]; ok && prev != ch.rate {
+				fmt.Fprintf(os.Stderr, "WARNING: %s has one %s for both sensors; gyro_rate and accel_rate can't differ, %s wins\n", dev.Base, attr, ch.name)
+				dev.AngVelRateHz = hz
+			}
+			written[attr] = ch.rate
+			fmt.Printf("Set %s %s=%g (%s at %g Hz)\n", dev.Base, attr, pick, ch.name, hz)
+			*ch.hz = hz
 		}
 	}
 }
@@ -472,11 +1274,12 @@ func (d *IIODevice) readSample() (IMUSample, error) {
 		if err != nil {
 			return s, err
 		}
-		// convertir a rad/s (IIO suministra en unidades del sensor: raw * scale = rad/s)
+		s.RawGyro = [3]int64{rx, ry, rz}
+		// convertir a rad/s (IIO suministra en unidades del sensor: (raw + offset) * scale = rad/s)
 		s.Gyro = Vec3{
-			X: float64(rx) * d.GyroScale.X,
-			Y: float64(ry) * d.GyroScale.Y,
-			Z: float64(rz) * d.GyroScale.Z,
+			X: (float64(rx) + d.GyroOffset.X) * d.GyroScale.X,
+			Y: (float64(ry) + d.GyroOffset.Y) * d.GyroScale.Y,
+			Z: (float64(rz) + d.GyroOffset.Z) * d.GyroScale.Z,
 		}
 	}
 	if d.HaveAccel {
@@ -492,16 +1295,327 @@ func (d *IIODevice) readSample() (IMUSample, error) {
 		if err != nil {
 			return s, err
 		}
-		// convertir a m/s^2 (raw * scale = m/s^2)
+		s.RawAccel = [3]int64{ax, ay, az}
+		// convertir a m/s^2 ((raw + offset) * scale = m/s^2)
 		s.Accel = Vec3{
-			X: float64(ax) * d.AccelScale.X,
-			Y: float64(ay) * d.AccelScale.Y,
-			Z: float64(az) * d.AccelScale.Z,
+			X: (float64(ax) + d.AccelOffset.X) * d.AccelScale.X,
+			Y: (float64(ay) + d.AccelOffset.Y) * d.AccelScale.Y,
+			Z: (float64(az) + d.AccelOffset.Z) * d.AccelScale.Z,
 		}
 	}
 	return s, nil
 }
 
+// parseMatrix builds a MountMatrix from the x/y/z rows of a config block.
+func parseMatrix(x, y, z []float64) (MountMatrix, bool) {
+	if len(x) == 3 && len(y) == 3 && len(z) == 3 {
+		return MountMatrix{
+			X: Vec3{x[0], x[1], x[2]},
+			Y: Vec3{y[0], y[1], y[2]},
+			Z: Vec3{z[0], z[1], z[2]},
+		}, true
+	}
+	return MountMatrix{}, false
+}
+
+// checkMatrixBlock reports a matrix block that is only partly filled in (some rows present,
+// or a row without exactly 3 values). An empty block is fine: it is simply not configured.
+func checkMatrixBlock(name string, x, y, z []float64) error {
+	if len(x) == 0 && len(y) == 0 && len(z) == 0 {
+		return nil
+	}
+	for _, row := range []struct {
+		axis string
+		v    []float64
+	}{{"x", x}, {"y", y}, {"z", z}} {
+		switch len(row.v) {
+		case 3:
+		case 0:
+			return fmt.Errorf("%s: row %s is missing (a matrix needs x, y and z rows of 3 values each)", name, row.axis)
+		default:
+			return fmt.Errorf("%s: row %s has %d values, want 3", name, row.axis, len(row.v))
+		}
+	}
+	return nil
+}
+
+// validateMatrices checks every matrix block and per-axis sensitivity in the config, so a
+// typo is reported instead of silently falling back to another block.
+func validateMatrices(cfg *Config) error {
+	var errs []error
+	for _, a := range []struct {
+		name string
+		v    []float64
+	}{{"gyro_axis_sensitivity", cfg.GyroAxisSensitivity}, {"accel_axis_sensitivity", cfg.AccelAxisSensitivity}} {
+		if len(a.v) != 0 && len(a.v) != 3 {
+			errs = append(errs, fmt.Errorf("%s has %d values, want 3 (x, y, z)", a.name, len(a.v)))
+		} else if slices.ContainsFunc(a.v, func(f float64) bool { return f <= 0 }) {
+			errs = append(errs, fmt.Errorf("%s %v: values must be > 0 (flip axes with the mount matrix)", a.name, a.v))
+		}
+	}
+	for _, b := range []struct {
+		name    string
+		x, y, z []float64
+	}{
+		{"mount_matrix", cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z},
+		{"accel_matrix", cfg.AccelMatrix.X, cfg.AccelMatrix.Y, cfg.AccelMatrix.Z},
+		{"gyro_matrix", cfg.GyroMatrix.X, cfg.GyroMatrix.Y, cfg.GyroMatrix.Z},
+	} {
+		if err := checkMatrixBlock(b.name, b.x, b.y, b.z); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveMatrices picks the accel and gyro matrices from the config: accel_matrix/gyro_matrix
+// take precedence over mount_matrix. The returned sources name the config block each came
+// from, or are empty when that sensor has no matrix configured.
+func resolveMatrices(cfg *Config) (accelMount, gyroMount MountMatrix, accelSrc, gyroSrc string) {
+	// Parse base mount_matrix (used as fallback for accel/gyro if not specified separately)
+	baseMatrix, hasMountMatrix := parseMatrix(cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z)
+
+	// Set accel matrix: accel_matrix > mount_matrix
+	if m, ok := parseMatrix(cfg.AccelMatrix.X, cfg.AccelMatrix.Y, cfg.AccelMatrix.Z); ok {
+		accelMount, accelSrc = m, "accel_matrix"
+	} else if hasMountMatrix {
+		accelMount, accelSrc = baseMatrix, "mount_matrix"
+	}
+
+	// Set gyro matrix: gyro_matrix > mount_matrix
+	if m, ok := parseMatrix(cfg.GyroMatrix.X, cfg.GyroMatrix.Y, cfg.GyroMatrix.Z); ok {
+		gyroMount, gyroSrc = m, "gyro_matrix"
+	} else if hasMountMatrix {
+		gyroMount, gyroSrc = baseMatrix, "mount_matrix"
+	}
+	return accelMount, gyroMount, accelSrc, gyroSrc
+}
+
+func formatMatrix(m MountMatrix) string {
+	return fmt.Sprintf("X=[%.1f,%.1f,%.1f] Y=[%.1f,%.1f,%.1f] Z=[%.1f,%.1f,%.1f]",
+		m.X.X, m.X.Y, m.X.Z, m.Y.X, m.Y.Y, m.Y.Z, m.Z.X, m.Z.Y, m.Z.Z)
+}
+
+// resolveDeviceID finds the IIO device matching a stable identifier, which survives the
+// iio:deviceN renumbering between boots:
+//
+//	of_node:<path>   device tree node (suffix of the resolved of_node link)
+//	i2c:<bus-addr>   I2C client, e.g. i2c:1-0068
+//	name:<name>[#N]  the N-th (0-based, in sysfs order) device with this exact name
+//	path:<text>      text contained in the resolved sysfs device path (PCI/USB topology)
+func resolveDeviceID(id string) (string, error) {
+	kind, val, ok := strings.Cut(id, ":")
+	if !ok || val == "" || !slices.Contains([]string{"of_node", "i2c", "name", "path"}, kind) {
+		return "", fmt.Errorf("device_id %q: want of_node:, i2c:, name: or path: followed by a value", id)
+	}
+	index := 0
+	if kind == "name" {
+		if n, i, found := strings.Cut(val, "#"); found {
+			v, err := strconv.Atoi(i)
+			if err != nil || v < 0 {
+				return "", fmt.Errorf("device_id %q: bad index %q", id, i)
+			}
+			val, index = n, v
+		}
+	}
+
+	entries, err := readIIODir(sysfsBase)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if isIIODevice(e) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		dev := filepath.Join(sysfsBase, n)
+		var match bool
+		switch kind {
+		case "of_node":
+			p, err := filepath.EvalSymlinks(filepath.Join(dev, "of_node"))
+			match = err == nil && strings.HasSuffix(p, val)
+		case "i2c":
+			p, err := filepath.EvalSymlinks(dev)
+			match = err == nil && slices.Contains(strings.Split(p, "/"), val)
+		case "path":
+			p, err := filepath.EvalSymlinks(dev)
+			match = err == nil && strings.Contains(p, val)
+		case "name":
+			b, _ := os.ReadFile(filepath.Join(dev, "name"))
+			if strings.TrimSpace(string(b)) == val {
+				match = index == 0
+				index--
+			}
+		}
+		if match {
+			return dev, nil
+		}
+	}
+	return "", fmt.Errorf("no IIO device matches device_id %q", id)
+}
+
+// selectIIOBase resolves the IIO device directory from iio_path, device_id, or by name with
+// a fallback to iio:device0. How it was found is logged to w.
+func selectIIOBase(w io.Writer, cfg *Config) (string, error) {
+	if cfg.IIOPath != "" {
+		return cfg.IIOPath, nil
+	}
+	if cfg.DeviceID != "" {
+		base, err := resolveDeviceID(cfg.DeviceID)
+		if err == nil {
+			fmt.Fprintf(w, "device_id %q resolved to %s\n", cfg.DeviceID, base)
+		}
+		return base, err
+	}
+	base, err := findIIODeviceByName(w, cfg.Name, cfg.DeviceAliases)
+	if err == nil {
+		return base, nil
+	}
+	// fallback duro si existe iio:device0
+	if dev0 := filepath.Join(sysfsBase, "iio:device0"); fileExists(dev0) {
+		fmt.Fprintf(os.Stderr, "WARN: name=%q not found; falling back to %s\n", cfg.Name, dev0)
+		return dev0, nil
+	}
+	return "", err
+}
+
+// openComplementary opens the device providing a wanted sensor dev lacks, for split devices
+// (accel-only or gyro-only), logging it to w. At most one of the returned devices is non-nil.
+func openComplementary(w io.Writer, dev *IIODevice, wantGyro, wantAccel bool) (gyroDev, accelDev *IIODevice) {
+	baseClean := filepath.Clean(dev.Base)
+
+	if wantAccel && !dev.HaveAccel {
+		if p, err := findFirstIIODeviceWith(false, true); err == nil && filepath.Clean(p) != baseClean {
+			if d2, err := openIIODevice(p); err == nil && d2.HaveAccel {
+				d2.HaveGyro = false
+				accelDev = d2
+				fmt.Fprintf(w, "Using additional accel device: %s\n", p)
+			}
+		}
+	} else if wantGyro && !dev.HaveGyro {
+		if p, err := findFirstIIODeviceWith(true, false); err == nil && filepath.Clean(p) != baseClean {
+			if d2, err := openIIODevice(p); err == nil && d2.HaveGyro {
+				d2.HaveAccel = false
+				gyroDev = d2
+				fmt.Fprintf(w, "Using additional gyro device: %s\n", p)
+			}
+		}
+	}
+	return gyroDev, accelDev
+}
+
+// applySensorEnables drops the sensors the user disabled, so they are neither read nor
+// configured and their channels stay zero in the packet.
+func applySensorEnables(dev *IIODevice, enableGyro, enableAccel bool) {
+	if !enableGyro {
+		dev.HaveGyro = false
+	}
+	if !enableAccel {
+		dev.HaveAccel = false
+	}
+}
+
+// warmUp reads and discards samples from every device at the output rate, so the first
+// readings after enabling a sensor (often garbage while the part settles) never reach clients.
+// It runs for ms milliseconds when ms > 0, otherwise for n samples.
+func warmUp(devs []SampleReader, n, ms int, rate float64) (int, time.Duration) {
+	start := time.Now()
+	period := time.Duration(float64(time.Second) / rate)
+	count := 0
+	for {
+		if ms > 0 {
+			if time.Since(start) >= time.Duration(ms)*time.Millisecond {
+				break
+			}
+		} else if count >= n {
+			break
+		}
+		for _, d := range devs {
+			d.readSample()
+		}
+		count++
+		time.Sleep(period)
+	}
+	return count, time.Since(start)
+}
+
+// listenAddr fills in a default host of 127.0.0.1 (and defaultPort, when addr is a bare
+// host) and reports whether the result is reachable from other machines.
+func listenAddr(addr, defaultPort string) (string, bool, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil && defaultPort != "" {
+		host, port, err = net.SplitHostPort(net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort))
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	public := true
+	if host == "localhost" {
+		public = false
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		public = false
+	}
+	return net.JoinHostPort(host, port), public, nil
+}
+
+// listenDSU starts a DSU server on bind (host[:port], port 26760 by default), or returns
+// an exitBindFailed error explaining the failure.
+func listenDSU(bind string) (*DSUServer, error) {
+	bindAddr, public, err := listenAddr(bind, "26760")
+	if err != nil {
+		return nil, exitErrorf(exitBindFailed, "invalid bind address %q: %v", bind, err)
+	}
+	bindHost, bindPort, _ := net.SplitHostPort(bindAddr)
+	srv, err := NewDSUServer(bindAddr)
+	if err != nil {
+		e := &exitError{code: exitBindFailed}
+		switch classifyBindError(err) {
+		case bindErrInUse:
+			e.err = fmt.Errorf("DSU port %s is already in use.", bindPort)
+			if probeDSUServer(net.JoinHostPort("127.0.0.1", bindPort), 500*time.Millisecond) {
+				e.hint = "       Another DSU server is answering on it (SteamDeckGyroDSU, or a second iio-dsu-bridge).\n"
+			}
+			e.hint += "       Stop the other service first, e.g. systemctl --user stop iio-dsu-bridge or sdgyrodsu.\n"
+			if p, err := strconv.Atoi(bindPort); err == nil && p < 65535 {
+				e.hint += fmt.Sprintf("       Or leave port %s to it and listen elsewhere, e.g. --bind %s (config bind),\n", bindPort, net.JoinHostPort(bindHost, strconv.Itoa(p+1)))
+				e.hint += "       and point the emulator's DSU client at that port.\n"
+			}
+		case bindErrPermission:
+			e.err = fmt.Errorf("not allowed to bind the DSU port: %v", err)
+			e.hint = "       Check sandboxing (flatpak, systemd RestrictAddressFamilies) or SELinux/AppArmor policy.\n"
+		case bindErrAddress:
+			e.err = fmt.Errorf("invalid DSU address: %v", err)
+			e.hint = "       The address must be host:port with a host that belongs to this machine.\n"
+		default:
+			e.err = fmt.Errorf("DSU listen: %v", err)
+		}
+		return nil, e
+	}
+	fmt.Printf("DSU server listening on %s\n", bindAddr)
+	if public {
+		fmt.Fprintf(os.Stderr, "WARNING: DSU server on %s is reachable from the network; motion data is sent to any client that asks\n", bindAddr)
+	}
+	return srv, nil
+}
+
+// isFlagSet reports whether a flag was given explicitly on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // ---------- DSU packet builders (PLACEHOLDER: pegar serializer conocido) ----------
 
 // buildControllerInfo debe devolver un paquete DSU "ControllerInfo" válido.
@@ -526,36 +1640,234 @@ func buildControllerData(s IMUSample) []byte {
 func main() {
 	name := flag.String("name", "", "IIO device name (from /sys/bus/iio/devices/iio:deviceX/name, empty=auto)")
 	iioPath := flag.String("iio-path", "", "Explicit /sys/bus/iio/devices/iio:deviceX path (overrides --name)")
+	source := flag.String("source", "", "Sample source: auto, iio, iio-buffer or evdev (default auto: IIO, else an evdev motion device)")
+	evdevPath := flag.String("evdev-path", "", "Explicit /dev/input/eventN motion device for --source=evdev")
+	deviceID := flag.String("device-id", "", "Stable device identifier: of_node:<path>, i2c:<bus-addr>, name:<name>[#N] or path:<text> (overrides --name)")
+	configPath := flag.String("config", "", "Config file to load (default ~/.config/"+configFileName+")")
+	profile := flag.String("profile", "", "Profile from the config's profiles to start with (overrides profile)")
+	printConfig := flag.Bool("print-config", false, "Print the effective config (file, profile, quirks, environment and flags merged) and what it resolves to (device, rate, scales, matrices) as YAML and exit")
+	showCapabilities := flag.Bool("capabilities", false, "Print the supported outputs, sources, scale policies, presets and filters as JSON and exit")
 	listIIO := flag.Bool("list-iio", false, "List detected IIO devices and exit")
-	addr := flag.String("addr", "127.0.0.1:26760", "DSU UDP destination")
-	rate := flag.Int("rate", 250, "Output rate (Hz)")
+	initConfig := flag.Bool("init-config", false, "Detect the IIO device, write a starter config (name and a best-guess matrix) to --config or ~/.config/"+configFileName+" and exit")
+	bind := flag.String("bind", "", "Address the DSU server listens on: host[:port] (default 127.0.0.1:26760; 0.0.0.0 exposes it on the LAN)")
+	rateOpt := &rateFlag{}
+	flag.Var(rateOpt, "rate", "Output rate in Hz, e.g. 250, 12.5, 250hz or 1khz (default: the sensor's sampling rate, else 250), or native to follow the sensor's sampling rate")
+	rate := &rateOpt.hz
+	gyroRate, accelRate := &rateFlag{}, &rateFlag{}
+	flag.Var(gyroRate, "gyro-rate", "Gyro sampling rate in Hz like --rate, if it should differ from --rate (overrides gyro_rate)")
+	flag.Var(accelRate, "accel-rate", "Accel sampling rate in Hz like --rate, if it should differ from --rate (overrides accel_rate)")
+	rateMin := flag.Float64("rate-min", 0, "Lowest sampling frequency (Hz) --set-rate may pick from the available list; 0 = no bound (overrides rate_min)")
+	rateMax := flag.Float64("rate-max", 0, "Highest sampling frequency (Hz) --set-rate may pick from the available list; 0 = no bound (overrides rate_max)")
+	phaseLock := flag.Bool("phase-lock", false, "Snap --rate to the sensor's native rate divided by an integer")
+	interpolate := flag.Bool("interpolate", false, "When --rate exceeds the sensor rate, interpolate between sensor samples instead of repeating them (adds about one sensor period of latency)")
 	logEvery := flag.Int("log-every", 25, "Print one IMU line every N samples (0=off)")
+	var quiet, verbose bool
+	flag.BoolVar(&quiet, "q", false, "Quiet: print only warnings and errors (no banner, matrices or IMU lines)")
+	flag.BoolVar(&quiet, "quiet", false, "Same as -q")
+	flag.BoolVar(&verbose, "v", false, "Verbose: IMU lines with raw and DSU values (--debug-raw, --debug-dsu)")
+	flag.BoolVar(&verbose, "verbose", false, "Same as -v")
+	debugVerbose := flag.Bool("vv", false, "Debug: -v plus the resting detector, and an IMU line every 5 samples unless --log-every is given")
 	setScales := flag.Bool("set-scales", true, "If scales read as 0, set them to a valid value automatically")
 	setRate := flag.Bool("set-rate", true, "Try to set sampling_frequency close to --rate")
-	debugRaw := flag.Bool("debug-raw", false, "Show raw sensor values before mount matrix transformation")
+	enableGyro := flag.Bool("enable-gyro", true, "Read and send the gyroscope")
+	enableAccel := flag.Bool("enable-accel", true, "Read and send the accelerometer")
+	bufferDev := flag.String("buffer-dev", "", "With --source=iio-buffer, read the buffer from this character device instead of /dev/iio:deviceN")
+	splitTS := flag.String("split-timestamp", "", "Timestamp of samples merged from split accel/gyro devices: primary, average or newer (default primary)")
+	bufferDrain := flag.String("buffer-drain", "", "With --source=iio-buffer, send the latest scan of each tick or the average of them: latest or average (default latest)")
+	scalePolicy := flag.String("scale-policy", "", "How --set-scales picks a scale: middle or auto-noise (default middle)")
+	debugRaw := flag.Bool("debug-raw", false, "Show raw sensor values (scaled, and the integer counts read) before mount matrix transformation")
+	debugOrientation := flag.Bool("debug-orientation", false, "Fuse gyro+accel into an orientation quaternion and print it (with roll/pitch/yaw)")
+	orientationUDP := flag.String("orientation-udp", "", "Stream the fused orientation quaternion as JSON over UDP to host:port, for a 3D viewer (off by default)")
+	recenterRamp := flag.Int("recenter-ramp-ms", defaultRecenterRampMs, "Ease the fused heading to center over this many ms on POST /recenter; 0 = snap (overrides recenter_ramp_ms)")
+	historySize := flag.Int("history-size", defaultHistorySize, "Keep the last N samples sent for GET /history and SIGQUIT; 0 = off (overrides history_size)")
+	gravityCutoff := flag.Float64("gravity-cutoff-hz", defaultGravityCutoffHz, "Low-pass corner (Hz) of the gravity estimate used by fusion; 0 = unfiltered (overrides gravity_cutoff_hz)")
+	accelCutoff := flag.Float64("accel-cutoff-hz", 0, "Low-pass corner (Hz) of the accel sent to DSU clients; 0 = unfiltered (overrides accel_cutoff_hz)")
+	gyroBiasRate := flag.Float64("gyro-bias-rate", 0, "Learn and subtract the gyro bias while the device rests, at this rate (1/s, e.g. 0.2; 0 = off)")
+	debugCalib := flag.Bool("debug-calib", false, "Print the resting detector verdict (still/moving, accel error, gyro variance)")
+	decodeFile := flag.String("decode", "", "Decode DSU packets from a hex dump in this file (- for stdin), e.g. --dump-packets output from a support log, and exit")
+	dumpPackets := flag.Bool("dump-packets", false, "Hex-dump outgoing DSU packets with field annotations (first few of each type, then periodically)")
+	maxDropRate := flag.Float64("max-drop-rate", 0, "Act when more than this percentage of output ticks is dropped over 10 s (0=off)")
+	dropAction := flag.String("drop-action", "warn", "What --max-drop-rate does: warn or exit")
+	dbus := flag.Bool("dbus", false, "Expose settings and tuning methods as a D-Bus service on the session bus")
+	tui := flag.Bool("tui", false, "Show a live terminal monitor (motion bars, rest state, rate, clients) instead of log lines")
+	debugLinearAccel := flag.Bool("debug-linear-accel", false, "Print the accel with gravity removed (low-pass gravity estimate subtracted); DSU output unchanged")
 	debugDSU := flag.Bool("debug-dsu", false, "Show final DSU packet values (in g and deg/s)")
-	flag.Parse()
+	udpDSCP := flag.Int("udp-dscp", 0, "DSCP class for outgoing DSU packets, 0-63 (46 = EF, low latency; 0 = OS default)")
+	udpTTL := flag.Int("udp-ttl", 0, "IP TTL for outgoing DSU packets, 1-255 (1 keeps them on the local network; 0 = OS default)")
+	strictCRC := flag.Bool("strict-crc", false, "Drop DSU requests with a wrong CRC instead of serving them (some clients send none)")
+	writeTimeout := flag.Duration("write-timeout", dsuWriteTimeout, "Drop a DSU packet that cannot be sent within this time instead of stalling the output loop (0 = block)")
+	recalButton := flag.String("recalibrate-button", "", "Evdev key (e.g. BTN_MODE or 0x13c) that recalibrates the gyro when held (overrides recalibrate_button)")
+	recalButtonDevice := flag.String("recalibrate-button-device", "", "/dev/input/eventN with the recalibrate button (overrides recalibrate_button_device)")
+	screenRotationDeg := flag.Int("screen-rotation", 0, "Display rotation in degrees counter-clockwise (0, 90, 180, 270); motion is turned with it (overrides screen_rotation)")
+	synthAccel := flag.Bool("synth-accel", false, "Without an accelerometer, synthesize gravity by integrating the gyro")
+	flag.BoolVar(&commaDecimal, "comma-decimal", false, "Accept comma decimal separators in sysfs *_available lists")
+	warmupSamples := flag.Int("warmup-samples", 0, "Read and discard N samples after configuring the sensors")
+	warmupMs := flag.Int("warmup-ms", 0, "Read and discard samples for N ms after configuring the sensors (overrides --warmup-samples)")
+	controlAddr := flag.String("control-addr", "", "Serve the HTTP control API on this address, e.g. :26780 (localhost unless a host is given)")
+	calibrationFile := flag.String("calibration-file", "", "Calibration file (default "+calibrationFileName+" next to the config)")
+	autoMount := flag.Bool("auto-mount", false, "Derive mount_matrix from gravity with the device resting screen up, save it to the config file and run with it")
+	testPatternFlag := flag.Bool("test-pattern", false, "Ignore the sensor and send a slow, known yaw swing to check that the DSU client reacts to motion")
+	calibrateFull := flag.Bool("calibrate-full", false, "Measure the sensor calibration with the device resting flat, write it to the calibration file and exit")
+	checkAlignment := flag.Bool("check-alignment", false, "Have the device tilted by hand, check that the gyro agrees with the accel frame, suggest a gyro_matrix if not and exit")
+	check := flag.Bool("check", false, "Validate config and device, report what would be set, print PASS/FAIL and exit")
+	apply := flag.Bool("apply", false, "With --check, actually write the scales/rates it reports")
+	force := flag.Bool("force", false, "Run even if another instance is bridging the same device; with --init-config, overwrite an existing config")
+	sysfsBaseFlag := flag.String("sysfs-base", "", "Directory holding the iio:deviceX entries (default "+sysfsBase+")")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitCodesHelp)
+	}
+	// bad flags are config errors; the flag package would exit 2, the device-not-found code
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(exitConfig)
+	}
+	level, verr := verbosityFromFlags(quiet, verbose, *debugVerbose)
+	if verr != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", verr)
+		os.Exit(exitConfig)
+	}
+	output := outputSettings{LogEvery: *logEvery, DebugRaw: *debugRaw, DebugDSU: *debugDSU, DebugCalib: *debugCalib}.apply(level, isFlagSet("log-every"))
+	*logEvery, *debugRaw, *debugDSU, *debugCalib = output.LogEvery, output.DebugRaw, output.DebugDSU, output.DebugCalib
+	// modes whose output is the point keep stdout
+	if level == verbosityQuiet && !*showCapabilities && *decodeFile == "" && !*listIIO && !*printConfig && !*check {
+		silenceStdout()
+	}
+
+	if *showCapabilities {
+		if err := printCapabilities(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *decodeFile != "" {
+		in := os.Stdin
+		if *decodeFile != "-" {
+			f, err := os.Open(*decodeFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				os.Exit(exitConfig)
+			}
+			defer f.Close()
+			in = f
+		}
+		bad, err := decodeDSUDump(in, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: decode: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		if bad > 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: %d packet(s) failed validation\n", bad)
+			os.Exit(exitFailure)
+		}
+		os.Exit(0)
+	}
+
+	// The sysfs base is needed before anything touches the device tree (including --list-iio);
+	// whether a missing one is fatal depends on the source, checked once the config is loaded
+	if v := os.Getenv("IIO_DSU_SYSFS_BASE"); v != "" {
+		sysfsBase = v
+	}
+	if *sysfsBaseFlag != "" {
+		sysfsBase = *sysfsBaseFlag
+	}
 
 	if *listIIO {
-		listIIODevices()
+		if err := checkSysfsBase(sysfsBase); err != nil {
+			reportSysfsBase(err)
+			os.Exit(exitDeviceNotFound)
+		}
+		listIIODevices(os.Stdout)
 		os.Exit(0)
 	}
 
-	cfg, _ := loadConfigFile()
+	if *configPath == "" {
+		*configPath = os.Getenv("IIO_DSU_CONFIG")
+	}
+	if *initConfig {
+		path := *configPath
+		if path == "" {
+			path = userConfigPath()
+		}
+		if path == "" {
+			fmt.Fprintf(os.Stderr, "ERROR: no config path to write to (use --config)\n")
+			os.Exit(exitConfig)
+		}
+		dev, err := selectIIOBase(os.Stdout, &Config{Name: *name, IIOPath: *iioPath, DeviceID: *deviceID})
+		if err == nil && !fileExists(dev) {
+			err = fmt.Errorf("%s does not exist", dev)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: no IIO device to write a config for: %v\n", err)
+			fmt.Fprintf(os.Stderr, "       Try --list-iio, then --name or --iio-path.\n")
+			os.Exit(exitDeviceNotFound)
+		}
+		if err := writeStarterConfig(path, dev, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(0)
+	}
+	cfg, cfgPath, cfgErr := loadConfigFile(*configPath)
+	if cfgErr == nil {
+		if *profile != "" {
+			cfg.Profile = *profile
+		}
+		cfgErr = applyProfile(cfg, cfg.Profile)
+	}
+	if cfgErr == nil {
+		cfgErr = errors.Join(validateMatrices(cfg), validateOutputs(cfg.Outputs))
+	}
+	if cfgErr != nil {
+		if !*check {
+			fmt.Fprintf(os.Stderr, "ERROR: config: %v\n", cfgErr)
+			os.Exit(exitConfig)
+		}
+		if cfg == nil {
+			cfg = &Config{}
+		}
+	}
 
 	// ENV override
 	if v := os.Getenv("IIO_DSU_PATH"); v != "" {
 		cfg.IIOPath = v
+		cfg.noteSource("iio_path", "$IIO_DSU_PATH")
 	}
 	if v := os.Getenv("IIO_DSU_NAME"); v != "" {
 		cfg.Name = v
+		cfg.noteSource("name", "$IIO_DSU_NAME")
+	}
+	if v := os.Getenv("IIO_DSU_DEVICE_ID"); v != "" {
+		cfg.DeviceID = v
+		cfg.noteSource("device_id", "$IIO_DSU_DEVICE_ID")
 	}
-	if v := os.Getenv("IIO_DSU_ADDR"); v != "" {
-		cfg.Addr = v
+	if v := os.Getenv("IIO_DSU_BIND"); v != "" {
+		cfg.Bind = v
+		cfg.noteSource("bind", "$IIO_DSU_BIND")
 	}
 	if v := os.Getenv("IIO_DSU_RATE"); v != "" {
+		if hz, err := parseRateHz(v); err == nil {
+			cfg.Rate = hz
+			cfg.noteSource("rate", "$IIO_DSU_RATE")
+		}
+	}
+	if v := os.Getenv("IIO_DSU_SCREEN_ROTATION"); v != "" {
 		if iv, err := strconv.Atoi(v); err == nil {
-			cfg.Rate = iv
+			cfg.ScreenRotation = iv
+			cfg.noteSource("screen_rotation", "$IIO_DSU_SCREEN_ROTATION")
+		}
+	}
+	// DSU_MAC is the older name of IIO_DSU_CONTROLLER_MAC
+	for _, env := range []string{"DSU_MAC", "IIO_DSU_CONTROLLER_MAC"} {
+		if v := os.Getenv(env); v != "" {
+			cfg.ControllerMAC = v
+			cfg.noteSource("controller_mac", "$"+env)
 		}
 	}
 	if v := os.Getenv("IIO_DSU_LOG_EVERY"); v != "" {
@@ -571,20 +1883,76 @@ func main() {
 		b := v == "1" || strings.ToLower(v) == "true"
 		cfg.SetRate = &b
 	}
+	if v := os.Getenv("IIO_DSU_ENABLE_GYRO"); v != "" {
+		b := v == "1" || strings.ToLower(v) == "true"
+		cfg.EnableGyro = &b
+	}
+	if v := os.Getenv("IIO_DSU_ENABLE_ACCEL"); v != "" {
+		b := v == "1" || strings.ToLower(v) == "true"
+		cfg.EnableAccel = &b
+	}
+	if v := os.Getenv("IIO_DSU_SOURCE"); v != "" {
+		cfg.Source = v
+		cfg.noteSource("source", "$IIO_DSU_SOURCE")
+	}
+	if v := os.Getenv("IIO_DSU_SCALE_POLICY"); v != "" {
+		cfg.ScalePolicy = v
+		cfg.noteSource("scale_policy", "$IIO_DSU_SCALE_POLICY")
+	}
 
 	// Flags ganan sobre todo
 	if *iioPath != "" {
 		cfg.IIOPath = *iioPath
+		cfg.noteSource("iio_path", "--iio-path")
+	}
+	if *deviceID != "" {
+		cfg.DeviceID = *deviceID
+		cfg.noteSource("device_id", "--device-id")
 	}
 	if *name != "" {
 		cfg.Name = *name
+		cfg.noteSource("name", "--name")
 	} // solo si el flag trae algo
-	if *addr != "" {
-		cfg.Addr = *addr
+	if *bind != "" {
+		cfg.Bind = *bind
+		cfg.noteSource("bind", "--bind")
 	}
 	if *rate != 0 {
 		cfg.Rate = *rate
+		cfg.noteSource("rate", "--rate")
+	} else {
+		*rate = cfg.Rate
+	}
+	if gyroRate.native || accelRate.native {
+		fmt.Fprintf(os.Stderr, "ERROR: --gyro-rate and --accel-rate take a rate in Hz, not native\n")
+		os.Exit(exitConfig)
+	}
+	if gyroRate.hz > 0 {
+		cfg.GyroRate = gyroRate.hz
+		cfg.noteSource("gyro_rate", "--gyro-rate")
 	}
+	if accelRate.hz > 0 {
+		cfg.AccelRate = accelRate.hz
+		cfg.noteSource("accel_rate", "--accel-rate")
+	}
+	if cfg.GyroRate < 0 || cfg.AccelRate < 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: gyro_rate and accel_rate must not be negative\n")
+		os.Exit(exitConfig)
+	}
+	if isFlagSet("rate-min") {
+		cfg.RateMin = *rateMin
+		cfg.noteSource("rate_min", "--rate-min")
+	}
+	if isFlagSet("rate-max") {
+		cfg.RateMax = *rateMax
+		cfg.noteSource("rate_max", "--rate-max")
+	}
+	if cfg.RateMin < 0 || cfg.RateMax < 0 || (cfg.RateMax > 0 && cfg.RateMin > cfg.RateMax) {
+		fmt.Fprintf(os.Stderr, "ERROR: rate_min and rate_max must not be negative, and rate_min must not exceed rate_max (got %g and %g)\n", cfg.RateMin, cfg.RateMax)
+		os.Exit(exitConfig)
+	}
+	// no rate anywhere: output at the device's own rate, found once it is open
+	rateFromDevice := *rate == 0 && !rateOpt.native
 	if *logEvery >= 0 {
 		cfg.LogEvery = *logEvery
 	}
@@ -598,234 +1966,233 @@ func main() {
 	} else {
 		*setRate = *cfg.SetRate
 	}
-
-	if cfg.Addr == "" {
-		cfg.Addr = "127.0.0.1:26760"
+	if rateOpt.native && *setRate {
+		fmt.Println("--rate native: leaving the device sampling rate unchanged")
+		*setRate = false
 	}
-	if cfg.Rate == 0 {
-		cfg.Rate = 250
+	if rateFromDevice && cfg.GyroRate == 0 && cfg.AccelRate == 0 {
+		*setRate = false
 	}
-
-	// Elegir device
-	var iioBase string
-	var err error
-	if cfg.IIOPath != "" {
-		iioBase = cfg.IIOPath
-	} else {
-		iioBase, err = findIIODeviceByName(cfg.Name)
-		if err != nil {
-			// fallback duro si existe iio:device0
-			if fileExists("/sys/bus/iio/devices/iio:device0") {
-				iioBase = "/sys/bus/iio/devices/iio:device0"
-				fmt.Fprintf(os.Stderr, "WARN: name=%q not found; falling back to %s\n", cfg.Name, iioBase)
-			} else {
-				fmt.Fprintf(os.Stderr, "IIO device not found (name=%q). Tip: try --list-iio or --iio-path=/sys/bus/iio/devices/iio:deviceX\n", cfg.Name)
-				listIIODevices()
-				os.Exit(1)
-			}
-		}
+	if cfg.EnableGyro == nil {
+		cfg.EnableGyro = enableGyro
 	}
-
-	dev, err := openIIODevice(iioBase)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "openIIODevice: %v\n", err)
-		os.Exit(1)
+	if cfg.EnableAccel == nil {
+		cfg.EnableAccel = enableAccel
 	}
-	fmt.Printf("IIO base: %s\n", iioBase)
-	fmt.Printf("HaveGyro=%v GyroScale=(%.6f,%.6f,%.6f)  HaveAccel=%v AccelScale=(%.6f,%.6f,%.6f)\n",
-		dev.HaveGyro, dev.GyroScale.X, dev.GyroScale.Y, dev.GyroScale.Z,
-		dev.HaveAccel, dev.AccelScale.X, dev.AccelScale.Y, dev.AccelScale.Z)
-
-	// If the selected IIO device is split (accel-only or gyro-only), try to open the complementary device.
-	var gyroDev *IIODevice
-	var accelDev *IIODevice
-	baseClean := filepath.Clean(dev.Base)
-
-	if dev.HaveGyro && !dev.HaveAccel {
-		if p, err := findFirstIIODeviceWith(false, true); err == nil && filepath.Clean(p) != baseClean {
-			if d2, err := openIIODevice(p); err == nil && d2.HaveAccel {
-				accelDev = d2
-				fmt.Printf("Using additional accel device: %s\n", p)
-			}
-		}
-	} else if dev.HaveAccel && !dev.HaveGyro {
-		if p, err := findFirstIIODeviceWith(true, false); err == nil && filepath.Clean(p) != baseClean {
-			if d2, err := openIIODevice(p); err == nil && d2.HaveGyro {
-				gyroDev = d2
-				fmt.Printf("Using additional gyro device: %s\n", p)
-			}
-		}
+	if *maxDropRate < 0 || *maxDropRate > 100 {
+		fmt.Fprintf(os.Stderr, "ERROR: --max-drop-rate must be between 0 and 100 (got %g)\n", *maxDropRate)
+		os.Exit(exitConfig)
 	}
-
-	// Configure scales and rates for all devices (primary + secondary)
-	configureDevice(dev, *rate, *setScales, *setRate)
-	if gyroDev != nil {
-		configureDevice(gyroDev, *rate, *setScales, *setRate)
-		fmt.Printf("Secondary gyro device: %s GyroScale=(%.6f,%.6f,%.6f)\n",
-			gyroDev.Base, gyroDev.GyroScale.X, gyroDev.GyroScale.Y, gyroDev.GyroScale.Z)
+	if *dropAction != "warn" && *dropAction != "exit" {
+		fmt.Fprintf(os.Stderr, "ERROR: --drop-action must be warn or exit (got %q)\n", *dropAction)
+		os.Exit(exitConfig)
 	}
-	if accelDev != nil {
-		configureDevice(accelDev, *rate, *setScales, *setRate)
-		fmt.Printf("Secondary accel device: %s AccelScale=(%.6f,%.6f,%.6f)\n",
-			accelDev.Base, accelDev.AccelScale.X, accelDev.AccelScale.Y, accelDev.AccelScale.Z)
+	if *udpDSCP < 0 || *udpDSCP > 63 {
+		fmt.Fprintf(os.Stderr, "ERROR: --udp-dscp must be between 0 and 63 (got %d)\n", *udpDSCP)
+		os.Exit(exitConfig)
 	}
-
-	// Validate we have working sensors after configuration
-	hasWorkingGyro := (dev.HaveGyro && dev.GyroScale.X != 0) ||
-		(gyroDev != nil && gyroDev.GyroScale.X != 0)
-	hasWorkingAccel := (dev.HaveAccel && dev.AccelScale.X != 0) ||
-		(accelDev != nil && accelDev.AccelScale.X != 0)
-
-	if !hasWorkingGyro {
-		fmt.Fprintf(os.Stderr, "WARNING: No working gyroscope found (scale=0). Motion controls will not work!\n")
-		fmt.Fprintf(os.Stderr, "         Try running with elevated permissions or check if the device driver is loaded.\n")
+	if *udpTTL < 0 || *udpTTL > 255 {
+		fmt.Fprintf(os.Stderr, "ERROR: --udp-ttl must be between 0 and 255 (got %d)\n", *udpTTL)
+		os.Exit(exitConfig)
 	}
-	if !hasWorkingAccel {
-		fmt.Fprintf(os.Stderr, "WARNING: No working accelerometer found (scale=0). Motion controls will not work!\n")
-		fmt.Fprintf(os.Stderr, "         Try running with elevated permissions or check if the device driver is loaded.\n")
+	if !*cfg.EnableGyro && !*cfg.EnableAccel {
+		fmt.Fprintf(os.Stderr, "ERROR: both gyro and accel are disabled; nothing to send\n")
+		os.Exit(exitConfig)
 	}
-
-	// Helper to parse matrix from config
-	parseMatrix := func(x, y, z []float64) (MountMatrix, bool) {
-		if len(x) == 3 && len(y) == 3 && len(z) == 3 {
-			return MountMatrix{
-				X: Vec3{x[0], x[1], x[2]},
-				Y: Vec3{y[0], y[1], y[2]},
-				Z: Vec3{z[0], z[1], z[2]},
-			}, true
-		}
-		return MountMatrix{}, false
+	if !*cfg.EnableGyro {
+		fmt.Println("Gyro disabled by config; sending accel only")
 	}
-
-	// Check if any matrix is configured (config file is required)
-	hasAccelMatrix := len(cfg.AccelMatrix.X) == 3 && len(cfg.AccelMatrix.Y) == 3 && len(cfg.AccelMatrix.Z) == 3
-	hasGyroMatrix := len(cfg.GyroMatrix.X) == 3 && len(cfg.GyroMatrix.Y) == 3 && len(cfg.GyroMatrix.Z) == 3
-	hasMountMatrix := len(cfg.MountMatrix.X) == 3 && len(cfg.MountMatrix.Y) == 3 && len(cfg.MountMatrix.Z) == 3
-
-	if !hasAccelMatrix && !hasGyroMatrix && !hasMountMatrix {
-		fmt.Fprintf(os.Stderr, "ERROR: No mount matrix configured.\n")
-		fmt.Fprintf(os.Stderr, "Please create a config file at ~/.config/iio-dsu-bridge.yaml\n")
-		fmt.Fprintf(os.Stderr, "Example configs for supported devices:\n")
-		fmt.Fprintf(os.Stderr, "  - Legion Go S: https://github.com/Sebalvarez97/iio-dsu-bridge/blob/main/examples/legion-go-s.yaml\n")
-		fmt.Fprintf(os.Stderr, "  - ROG Ally:    https://github.com/Sebalvarez97/iio-dsu-bridge/blob/main/examples/rog-ally.yaml\n")
-		os.Exit(1)
+	if !*cfg.EnableAccel {
+		fmt.Println("Accel disabled by config; sending gyro only")
 	}
 
-	// Parse base mount_matrix (used as fallback for accel/gyro if not specified separately)
-	var baseMatrix MountMatrix
-	if m, ok := parseMatrix(cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z); ok {
-		baseMatrix = m
+	if *scalePolicy != "" {
+		cfg.ScalePolicy = *scalePolicy
+		cfg.noteSource("scale_policy", "--scale-policy")
 	}
-
-	// Set accel matrix: accel_matrix > mount_matrix
-	var accelMount MountMatrix
-	if m, ok := parseMatrix(cfg.AccelMatrix.X, cfg.AccelMatrix.Y, cfg.AccelMatrix.Z); ok {
-		accelMount = m
-		fmt.Println("Accel matrix: from config accel_matrix")
-	} else if hasMountMatrix {
-		accelMount = baseMatrix
-		fmt.Println("Accel matrix: from config mount_matrix")
+	if *splitTS != "" {
+		cfg.SplitTimestamp = *splitTS
 	}
-
-	// Set gyro matrix: gyro_matrix > mount_matrix
-	var gyroMount MountMatrix
-	if m, ok := parseMatrix(cfg.GyroMatrix.X, cfg.GyroMatrix.Y, cfg.GyroMatrix.Z); ok {
-		gyroMount = m
-		fmt.Println("Gyro matrix: from config gyro_matrix")
-	} else if hasMountMatrix {
-		gyroMount = baseMatrix
-		fmt.Println("Gyro matrix: from config mount_matrix")
-	}
-
-	// Log the actual matrices being used
-	fmt.Printf("  Accel: X=[%.1f,%.1f,%.1f] Y=[%.1f,%.1f,%.1f] Z=[%.1f,%.1f,%.1f]\n",
-		accelMount.X.X, accelMount.X.Y, accelMount.X.Z,
-		accelMount.Y.X, accelMount.Y.Y, accelMount.Y.Z,
-		accelMount.Z.X, accelMount.Z.Y, accelMount.Z.Z)
-	fmt.Printf("  Gyro:  X=[%.1f,%.1f,%.1f] Y=[%.1f,%.1f,%.1f] Z=[%.1f,%.1f,%.1f]\n",
-		gyroMount.X.X, gyroMount.X.Y, gyroMount.X.Z,
-		gyroMount.Y.X, gyroMount.Y.Y, gyroMount.Y.Z,
-		gyroMount.Z.X, gyroMount.Z.Y, gyroMount.Z.Z)
-
-	// DSU server: escucha en 0.0.0.0:26760 (lo espera Yuzu/Cemuhook)
-	srv, err := NewDSUServer("0.0.0.0:26760")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "DSU listen: %v\n", err)
-		os.Exit(1)
+	if *bufferDrain != "" {
+		cfg.BufferDrain = *bufferDrain
+	}
+	if *bufferDev != "" {
+		cfg.BufferDev = *bufferDev
+	}
+	if *source != "" {
+		cfg.Source = *source
+		cfg.noteSource("source", "--source")
+	}
+	if *evdevPath != "" {
+		cfg.EvdevPath = *evdevPath
+	}
+	if *controlAddr != "" {
+		cfg.ControlAddr = *controlAddr
+	}
+	if *calibrationFile != "" {
+		cfg.CalibrationFile = *calibrationFile
+	}
+	if isFlagSet("gyro-bias-rate") {
+		cfg.GyroBiasRate = *gyroBiasRate
+	}
+	if *recalButton != "" {
+		cfg.RecalibrateButton = *recalButton
+	}
+	if *recalButtonDevice != "" {
+		cfg.RecalibrateButtonDevice = *recalButtonDevice
+	}
+	if isFlagSet("gravity-cutoff-hz") || cfg.GravityCutoffHz == nil {
+		cfg.GravityCutoffHz = gravityCutoff
+	}
+	if isFlagSet("history-size") || cfg.HistorySize == nil {
+		cfg.HistorySize = historySize
+	}
+	if *cfg.HistorySize < 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: history_size must not be negative (got %d)\n", *cfg.HistorySize)
+		os.Exit(exitConfig)
+	}
+	if isFlagSet("recenter-ramp-ms") || cfg.RecenterRampMs == nil {
+		cfg.RecenterRampMs = recenterRamp
+	}
+	if *cfg.RecenterRampMs < 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: recenter_ramp_ms must not be negative (got %d)\n", *cfg.RecenterRampMs)
+		os.Exit(exitConfig)
+	}
+	if isFlagSet("accel-cutoff-hz") {
+		cfg.AccelCutoffHz = *accelCutoff
+	}
+	if isFlagSet("screen-rotation") {
+		cfg.ScreenRotation = *screenRotationDeg
+		cfg.noteSource("screen_rotation", "--screen-rotation")
+	}
+	if isFlagSet("warmup-samples") {
+		cfg.WarmupSamples = *warmupSamples
+	}
+	if isFlagSet("warmup-ms") {
+		cfg.WarmupMs = *warmupMs
 	}
-	defer srv.Close()
-	fmt.Println("DSU server listening on :26760")
-
-	// Main loop at fixed rate
-	ticker := time.NewTicker(time.Second / time.Duration(*rate))
-	defer ticker.Stop()
-
-	count := 0
-	zeroGyroCount := 0
-	zeroGyroWarned := false
-	for range ticker.C {
-		s, err := dev.readSample()
-		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				fmt.Fprintf(os.Stderr, "readSample: %v\n", err)
-			}
-			continue
-		}
-		// Merge complementary split-device sample.
-		if gyroDev != nil {
-			if gs, err2 := gyroDev.readSample(); err2 == nil {
-				s.Gyro = gs.Gyro
-			}
-		}
-		if accelDev != nil {
-			if as, err2 := accelDev.readSample(); err2 == nil {
-				s.Accel = as.Accel
-			}
-		}
 
-		// Debug: show raw values before mount matrix transformation
-		if *debugRaw && *logEvery > 0 && count%*logEvery == 0 {
-			fmt.Printf("RAW  G(rad/s)=(% .5f,% .5f,% .5f)  A(m/s^2)=(% .3f,% .3f,% .3f)\n",
-				s.Gyro.X, s.Gyro.Y, s.Gyro.Z, s.Accel.X, s.Accel.Y, s.Accel.Z)
+	if cfg.ScalePolicy == "" {
+		cfg.ScalePolicy = "middle"
+	}
+	if _, ok := scalePolicies[cfg.ScalePolicy]; !ok {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown scale_policy %q (want middle or auto-noise)\n", cfg.ScalePolicy)
+		os.Exit(exitConfig)
+	}
+	if cfg.BufferDrain == "" {
+		cfg.BufferDrain = "latest"
+	}
+	if !slices.Contains(bufferDrains, cfg.BufferDrain) {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown buffer_drain %q (want %s)\n", cfg.BufferDrain, strings.Join(bufferDrains, " or "))
+		os.Exit(exitConfig)
+	}
+	if cfg.SplitTimestamp == "" {
+		cfg.SplitTimestamp = "primary"
+	}
+	if !slices.Contains(splitTimestamps, cfg.SplitTimestamp) {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown split_timestamp %q (want %s)\n", cfg.SplitTimestamp, strings.Join(splitTimestamps, ", "))
+		os.Exit(exitConfig)
+	}
+	if _, ok := gyroRawUnits[cfg.GyroRawUnits]; !ok && cfg.GyroRawUnits != "" {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown gyro_raw_units %q (want rad_s or deg_s)\n", cfg.GyroRawUnits)
+		os.Exit(exitConfig)
+	}
+	if _, ok := accelRawUnits[cfg.AccelRawUnits]; !ok && cfg.AccelRawUnits != "" {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown accel_raw_units %q (want m_s2 or g)\n", cfg.AccelRawUnits)
+		os.Exit(exitConfig)
+	}
+	if _, ok := dsuAccelUnits[cfg.OutputAccelUnits]; !ok && cfg.OutputAccelUnits != "" {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown output_accel_units %q (want g or m_s2)\n", cfg.OutputAccelUnits)
+		os.Exit(exitConfig)
+	}
+	if _, ok := dsuGyroUnits[cfg.OutputGyroUnits]; !ok && cfg.OutputGyroUnits != "" {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown output_gyro_units %q (want deg_s or rad_s)\n", cfg.OutputGyroUnits)
+		os.Exit(exitConfig)
+	}
+	if cfg.ControllerMAC != "" {
+		if _, err := parseMAC(cfg.ControllerMAC); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: controller_mac: %v\n", err)
+			os.Exit(exitConfig)
 		}
-
-		// Apply separate mount matrices for gyro and accel
-		s.Gyro = gyroMount.Apply(s.Gyro)
-		s.Accel = accelMount.Apply(s.Accel)
-
-		// Warn if gyro stays zero for extended period (likely misconfigured)
-		if s.Gyro.X == 0 && s.Gyro.Y == 0 && s.Gyro.Z == 0 {
-			zeroGyroCount++
-			if zeroGyroCount >= 100 && !zeroGyroWarned {
-				fmt.Fprintf(os.Stderr, "WARNING: Gyro has been zero for %d samples. Check device scales or permissions.\n", zeroGyroCount)
-				zeroGyroWarned = true
-			}
-		} else {
-			zeroGyroCount = 0
-			zeroGyroWarned = false
+	}
+	if err := validateSourceDevices(cfg.SourceDevices); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.Source == "" {
+		cfg.Source = "auto"
+	}
+	if !slices.Contains(sampleSources, cfg.Source) {
+		fmt.Fprintf(os.Stderr, "ERROR: unknown source %q (want %s)\n", cfg.Source, strings.Join(sampleSources, ", "))
+		os.Exit(exitConfig)
+	}
+	if needsSysfsBase(cfg.Source) && !*testPatternFlag {
+		if err := checkSysfsBase(sysfsBase); err != nil {
+			reportSysfsBase(err)
+			os.Exit(exitDeviceNotFound)
 		}
-
-		if *logEvery > 0 {
-			count++
-			if count%*logEvery == 0 {
-				fmt.Printf("IMU  ts=%d  G(rad/s)=(% .5f,% .5f,% .5f)  A(m/s^2)=(% .3f,% .3f,% .3f)\n",
-					s.TSus, s.Gyro.X, s.Gyro.Y, s.Gyro.Z, s.Accel.X, s.Accel.Y, s.Accel.Z)
-			}
+	}
+	if *printConfig {
+		if err := printEffectiveConfig(os.Stdout, cfg, *rate, *setScales, *setRate); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(exitFailure)
 		}
-
-		// Debug: show DSU packet values (in g and deg/s)
-		if *debugDSU && *logEvery > 0 && count%*logEvery == 0 {
-			const rad2deg = 180.0 / math.Pi
-			ax := s.Accel.X / 9.80665
-			ay := s.Accel.Y / 9.80665
-			az := s.Accel.Z / 9.80665
-			gx := s.Gyro.X * rad2deg
-			gy := s.Gyro.Y * rad2deg
-			gz := s.Gyro.Z * rad2deg
-			fmt.Printf("DSU  G(deg/s)=(% .2f,% .2f,% .2f)  A(g)=(% .3f,% .3f,% .3f)\n",
-				gx, gy, gz, ax, ay, az)
+		os.Exit(0)
+	}
+	printConfigSources(cfg)
+
+	if *testPatternFlag && (*autoMount || *calibrateFull || *checkAlignment) {
+		fmt.Fprintf(os.Stderr, "ERROR: --test-pattern can't be combined with --auto-mount, --calibrate-full or --check-alignment, which measure the sensor\n")
+		os.Exit(exitConfig)
+	}
+
+	if *check {
+		os.Exit(runCheck(os.Stdout, cfg, cfgErr, *rate, *setScales, *setRate, *apply))
+	}
+
+	opts := Options{
+		ConfigPath:       cfgPath,
+		Rate:             *rate,
+		RateNative:       rateOpt.native,
+		RateFromDevice:   rateFromDevice,
+		PhaseLock:        *phaseLock,
+		Interpolate:      *interpolate,
+		SetScales:        *setScales,
+		SetRate:          *setRate,
+		Force:            *force,
+		LogEvery:         *logEvery,
+		DebugRaw:         *debugRaw,
+		DebugDSU:         *debugDSU,
+		DebugCalib:       *debugCalib,
+		DebugOrientation: *debugOrientation,
+		DebugLinearAccel: *debugLinearAccel,
+		DumpPackets:      *dumpPackets,
+		TUI:              *tui,
+		OrientationUDP:   *orientationUDP,
+		MaxDropRate:      *maxDropRate,
+		DropAction:       *dropAction,
+		UDPDSCP:          *udpDSCP,
+		UDPTTL:           *udpTTL,
+		WriteTimeout:     *writeTimeout,
+		StrictCRC:        *strictCRC,
+		DBus:             *dbus,
+		SynthAccel:       *synthAccel,
+		AutoMount:        *autoMount,
+		CalibrateFull:    *calibrateFull,
+		CheckAlignment:   *checkAlignment,
+		TestPattern:      *testPatternFlag,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := Run(ctx, *cfg, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		code := exitFailure
+		var ee *exitError
+		if errors.As(err, &ee) {
+			fmt.Fprint(os.Stderr, ee.hint)
+			code = ee.code
 		}
-
-		srv.Broadcast(s)
+		stop()
+		os.Exit(code)
 	}
 }
@@ -0,0 +1,1371 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSysfs points sysfsBase at a fresh fixture tree for the duration of the test.
+func useSysfs(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	old := sysfsBase
+	sysfsBase = base
+	t.Cleanup(func() { sysfsBase = old })
+	return base
+}
+
+// writeAttrs writes sysfs attributes below dir; names may contain slashes (buffer/...).
+func writeAttrs(t *testing.T, dir string, attrs map[string]string) {
+	t.Helper()
+	for name, v := range attrs {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// axes adds the x/y/z _raw attributes of channel ("anglvel" or "accel") to attrs.
+func axes(attrs map[string]string, channel string, raw [3]int) map[string]string {
+	for i, a := range []string{"x", "y", "z"} {
+		attrs[fmt.Sprintf("in_%s_%s_raw", channel, a)] = fmt.Sprint(raw[i])
+	}
+	return attrs
+}
+
+func TestFindIIODeviceByName(t *testing.T) {
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), map[string]string{"name": "bmi323-trigger\n"})
+	writeAttrs(t, filepath.Join(base, "iio:device1"), axes(axes(map[string]string{"name": "bmi323-imu\n"}, "anglvel", [3]int{}), "accel", [3]int{}))
+	writeAttrs(t, filepath.Join(base, "iio:device2"), axes(map[string]string{"name": "accel_3d\n"}, "accel", [3]int{}))
+	writeAttrs(t, base, map[string]string{"not-a-device/name": "bmi323-imu"})
+
+	tests := []struct {
+		name, query string
+		aliases     []string
+		want        string
+	}{
+		{"exact", "accel_3d", nil, "iio:device2"},
+		{"exact ignores case", "ACCEL_3D", nil, "iio:device2"},
+		{"partial", "bmi323", nil, "iio:device1"},
+		{"empty takes the first IMU", "", nil, "iio:device1"},
+		{"unknown falls back to the first IMU", "lsm6dsox", nil, "iio:device1"},
+		{"alias", "lsm6dsox", []string{"accel_3"}, "iio:device2"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := findIIODeviceByName(io.Discard, tc.query, tc.aliases)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(base, tc.want); got != want {
+				t.Errorf("findIIODeviceByName(%q) = %s, want %s", tc.query, got, want)
+			}
+		})
+	}
+}
+
+func TestFindIIODeviceByNameSkipsNonIMU(t *testing.T) {
+	base := useSysfs(t)
+	// a trigger and a nameless device come first and collide with every query by name
+	writeAttrs(t, filepath.Join(base, "iio:device0"), map[string]string{"name": "bmi323\n", "sampling_frequency": "100"})
+	writeAttrs(t, filepath.Join(base, "iio:device1"), map[string]string{"sampling_frequency": "100"})
+	writeAttrs(t, filepath.Join(base, "iio:device2"), axes(map[string]string{"name": "gyro_3d\n"}, "anglvel", [3]int{}))
+	writeAttrs(t, filepath.Join(base, "iio:device3"), axes(map[string]string{"name": "bmi323-imu\n"}, "accel", [3]int{}))
+
+	for _, tc := range []struct {
+		name, query string
+		aliases     []string
+		want        string
+	}{
+		{"exact name of a non-IMU device", "bmi323", nil, "iio:device3"},
+		{"partial name of a non-IMU device only", "bmi32", nil, "iio:device3"},
+		{"no match falls back past the non-IMU devices", "lsm6dsox", nil, "iio:device2"},
+		{"alias of a non-IMU device", "lsm6dsox", []string{"bmi323"}, "iio:device3"},
+		{"empty", "", nil, "iio:device2"},
+	} {
+		got, err := findIIODeviceByName(io.Discard, tc.query, tc.aliases)
+		if want := filepath.Join(base, tc.want); err != nil || got != want {
+			t.Errorf("%s: findIIODeviceByName(%q) = %s, %v; want %s", tc.name, tc.query, got, err, want)
+		}
+	}
+
+	// with no IMU device at all the collision is not picked
+	base = useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), map[string]string{"name": "bmi323\n"})
+	if got, err := findIIODeviceByName(io.Discard, "bmi323", nil); err == nil {
+		t.Errorf("only a non-IMU device: got %s, want an error", got)
+	}
+}
+
+func TestFindFirstIIODeviceWith(t *testing.T) {
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(map[string]string{"name": "accel_3d"}, "accel", [3]int{}))
+	writeAttrs(t, filepath.Join(base, "iio:device1"), axes(map[string]string{"name": "gyro_3d"}, "anglvel", [3]int{}))
+
+	for _, tc := range []struct {
+		gyro, accel bool
+		want        string
+	}{
+		{false, true, "iio:device0"},
+		{true, false, "iio:device1"},
+		{true, true, ""},
+		{false, false, ""},
+	} {
+		got, err := findFirstIIODeviceWith(tc.gyro, tc.accel)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("gyro=%v accel=%v: got %s, want an error", tc.gyro, tc.accel, got)
+			}
+			continue
+		}
+		if want := filepath.Join(base, tc.want); err != nil || got != want {
+			t.Errorf("gyro=%v accel=%v: got %s, %v, want %s", tc.gyro, tc.accel, got, err, want)
+		}
+	}
+}
+
+func TestSelectIIOBaseFallsBackToDevice0(t *testing.T) {
+	base := useSysfs(t)
+	// no device has IMU channels, so the name lookup fails
+	writeAttrs(t, filepath.Join(base, "iio:device0"), map[string]string{"name": "als"})
+	got, err := selectIIOBase(io.Discard, &Config{Name: "bmi323"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(base, "iio:device0"); got != want {
+		t.Errorf("selectIIOBase = %s, want %s", got, want)
+	}
+
+	os.RemoveAll(filepath.Join(base, "iio:device0"))
+	if got, err := selectIIOBase(io.Discard, &Config{Name: "bmi323"}); err == nil {
+		t.Errorf("selectIIOBase on an empty tree = %s, want an error", got)
+	}
+	if got, _ := selectIIOBase(io.Discard, &Config{IIOPath: "/elsewhere/iio:device3"}); got != "/elsewhere/iio:device3" {
+		t.Errorf("iio_path not taken as is: %s", got)
+	}
+}
+
+func TestCheckSysfsBase(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkSysfsBase(dir); err != nil {
+		t.Errorf("existing directory: %v", err)
+	}
+	var missing *iioMissingError
+	if err := checkSysfsBase(filepath.Join(dir, "nope")); !errors.As(err, &missing) {
+		t.Errorf("missing directory: got %v, want an *iioMissingError", err)
+	}
+	file := filepath.Join(dir, "file")
+	writeAttrs(t, dir, map[string]string{"file": ""})
+	if err := checkSysfsBase(file); err == nil || errors.As(err, &missing) {
+		t.Errorf("regular file: got %v, want a not-a-directory error", err)
+	}
+}
+
+func TestIIOMissingLookups(t *testing.T) {
+	sysfsBase = filepath.Join(useSysfs(t), "nonexistent")
+	for name, lookup := range map[string]func() (string, error){
+		"findIIODeviceByName":    func() (string, error) { return findIIODeviceByName(io.Discard, "bmi323", nil) },
+		"findFirstIIODeviceWith": func() (string, error) { return findFirstIIODeviceWith(true, true) },
+		"resolveDeviceID":        func() (string, error) { return resolveDeviceID("name:bmi323") },
+	} {
+		var missing *iioMissingError
+		if _, err := lookup(); !errors.As(err, &missing) || missing.Path != sysfsBase {
+			t.Errorf("%s: got %v, want an *iioMissingError for %s", name, err, sysfsBase)
+		}
+	}
+}
+
+func TestListenDSUPortInUse(t *testing.T) {
+	other, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	addr := other.conn.LocalAddr().String()
+
+	srv, err := listenDSU(addr)
+	if err == nil {
+		srv.Close()
+		t.Fatalf("listenDSU(%s) on a busy port succeeded", addr)
+	}
+	var e *exitError
+	if !errors.As(err, &e) || e.code != exitBindFailed {
+		t.Fatalf("got %v, want an exitError with code %d", err, exitBindFailed)
+	}
+	if !strings.Contains(e.Error(), "already in use") {
+		t.Errorf("error %q does not say the port is in use", e.Error())
+	}
+	// the holder answers version requests, so the hint names the usual suspects
+	if !strings.Contains(e.hint, "Another DSU server") || !strings.Contains(e.hint, "sdgyrodsu") {
+		t.Errorf("hint %q does not point at the other DSU server", e.hint)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	if next := "--bind " + net.JoinHostPort(host, strconv.Itoa(p+1)); !strings.Contains(e.hint, "port "+port) || !strings.Contains(e.hint, next) {
+		t.Errorf("hint %q does not suggest %s instead of port %s", e.hint, next, port)
+	}
+}
+
+func TestListenDSUPortInUseByOther(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = listenDSU(conn.LocalAddr().String())
+	var e *exitError
+	if !errors.As(err, &e) || e.code != exitBindFailed {
+		t.Fatalf("got %v, want an exitError with code %d", err, exitBindFailed)
+	}
+	if strings.Contains(e.hint, "Another DSU server") {
+		t.Errorf("hint %q claims a DSU server holds the port, but nothing answers on it", e.hint)
+	}
+}
+
+func TestReadFloatList(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		comma   bool
+		want    []float64
+		wantErr bool
+	}{
+		{"plain", "0.000133 0.000266 0.000532\n", false, []float64{0.000133, 0.000266, 0.000532}, false},
+		{"scientific", "1.33e-4 2.66E-4", false, []float64{0.000133, 0.000266}, false},
+		{"bracketed range", "[12.5 25 800]\n", false, []float64{12.5, 25, 800}, false},
+		{"brackets without spaces", "[0.5][1]", false, []float64{0.5, 1}, false},
+		{"comma decimals", "0,000133 0,000266", true, []float64{0.000133, 0.000266}, false},
+		{"comma decimals need the flag", "0,000133 0,000266", false, nil, true},
+		{"a bad token fails the list", "0.1 abc 0.3", false, nil, true},
+		{"comma flag keeps dots working", "0.25 1,5", true, []float64{0.25, 1.5}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old := commaDecimal
+			commaDecimal = tc.comma
+			defer func() { commaDecimal = old }()
+			dir := t.TempDir()
+			writeAttrs(t, dir, map[string]string{"list": tc.content})
+			got, err := readFloatList(filepath.Join(dir, "list"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("readFloatList(%q) error = %v, want error %v", tc.content, err, tc.wantErr)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("readFloatList(%q) = %v, want %v", tc.content, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDSUModelFor(t *testing.T) {
+	for _, tc := range []struct {
+		gyro, accel bool
+		want        uint8
+	}{
+		{true, true, dsuModelFull},
+		{true, false, dsuModelPartial},
+		{false, true, dsuModelPartial},
+		{false, false, dsuModelNone},
+	} {
+		if got := dsuModelFor(tc.gyro, tc.accel); got != tc.want {
+			t.Errorf("dsuModelFor(gyro=%v, accel=%v) = %d, want %d", tc.gyro, tc.accel, got, tc.want)
+		}
+	}
+}
+
+func TestDetectConnType(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name, target string
+		want         uint8
+	}{
+		{"i2c", "devices/platform/AMDI0010:00/i2c-0/i2c-BMI0160:00/iio:device0", dsuConnUSB},
+		{"usb hid", "devices/pci0000:00/usb1/1-2/1-2:1.0/0003:046D:C52B.0003/HID-SENSOR-200073.1/iio:device1", dsuConnUSB},
+		{"bluetooth hid", "devices/virtual/misc/uhid/0005:057E:2009.0004/iio:device2", dsuConnBT},
+		{"bluetooth adapter", "devices/pci0000:00/usb1/1-5/bluetooth/hci0/hci0:256/iio:device3", dsuConnBT},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			target := filepath.Join(root, tc.target)
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			// detection follows the class symlink like /sys/bus/iio/devices/iio:deviceN
+			link := filepath.Join(root, fmt.Sprintf("link%d", i))
+			if err := os.Symlink(target, link); err != nil {
+				t.Fatal(err)
+			}
+			if got := detectConnType(link); got != tc.want {
+				t.Errorf("detectConnType(-> %s) = %d, want %d", tc.target, got, tc.want)
+			}
+		})
+	}
+	if got := detectConnType(filepath.Join(root, "missing")); got != dsuConnUSB {
+		t.Errorf("detectConnType of a missing path = %d, want USB", got)
+	}
+}
+
+// countingReader counts the samples read from it.
+type countingReader struct{ n int }
+
+func (r *countingReader) readSample() (IMUSample, error) {
+	r.n++
+	return IMUSample{}, nil
+}
+
+func TestWarmUpDiscardsCount(t *testing.T) {
+	gyro, accel := &countingReader{}, &countingReader{}
+	got, _ := warmUp([]SampleReader{gyro, accel}, 7, 0, 1000)
+	if got != 7 || gyro.n != 7 || accel.n != 7 {
+		t.Errorf("warmUp(7) = %d, read gyro %d and accel %d times; want 7 each", got, gyro.n, accel.n)
+	}
+	none := &countingReader{}
+	if got, _ := warmUp([]SampleReader{none}, 0, 0, 1000); got != 0 || none.n != 0 {
+		t.Errorf("warmUp(0) read %d samples", none.n)
+	}
+}
+
+func TestWarmUpByDuration(t *testing.T) {
+	r := &countingReader{}
+	got, took := warmUp([]SampleReader{r}, 1000, 30, 1000)
+	// the duration wins over the count
+	if took < 30*time.Millisecond || got != r.n || got == 0 || got >= 1000 {
+		t.Errorf("warmUp(30 ms) read %d samples (reported %d) in %v", r.n, got, took)
+	}
+}
+
+func TestUserConfigPath(t *testing.T) {
+	home, xdg := t.TempDir(), t.TempDir()
+	tests := []struct {
+		name, home, xdg, want string
+	}{
+		{"HOME set", home, xdg, filepath.Join(home, ".config", configFileName)},
+		{"HOME unset, XDG set", "", xdg, filepath.Join(xdg, configFileName)},
+		{"neither", "", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("HOME", tc.home)
+			t.Setenv("XDG_CONFIG_HOME", tc.xdg)
+			if got := userConfigPath(); got != tc.want {
+				t.Errorf("userConfigPath() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileWithoutHome(t *testing.T) {
+	old := systemConfigPath
+	systemConfigPath = filepath.Join(t.TempDir(), "none.yaml")
+	defer func() { systemConfigPath = old }()
+	xdg := t.TempDir()
+	writeAttrs(t, xdg, map[string]string{configFileName: "name: from-xdg\n"})
+	t.Setenv("HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+
+	cfg, path, err := loadConfigFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(xdg, configFileName) || cfg.Name != "from-xdg" {
+		t.Errorf("loaded %q from %s, want the XDG config", cfg.Name, path)
+	}
+
+	// with neither set there is no user config, which is not an error
+	t.Setenv("XDG_CONFIG_HOME", "")
+	if cfg, path, err := loadConfigFile(""); err != nil || path != "" || cfg.Name != "" {
+		t.Errorf("without HOME and XDG_CONFIG_HOME: %+v, %q, %v", cfg, path, err)
+	}
+}
+
+func TestLoadConfigFileSystemUnderUser(t *testing.T) {
+	old, oldDMI := systemConfigPath, dmiDir
+	defer func() { systemConfigPath, dmiDir = old, oldDMI }()
+	dir := t.TempDir()
+	systemConfigPath, dmiDir = filepath.Join(dir, "etc.yaml"), filepath.Join(dir, "no-dmi")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeAttrs(t, dir, map[string]string{"etc.yaml": `name: bmi260
+rate: 100
+gyro_deadzone: 0.1
+mount_matrix:
+  x: [0, 1, 0]
+  y: [1, 0, 0]
+  z: [0, 0, 1]
+`})
+	writeAttrs(t, filepath.Join(home, ".config"), map[string]string{configFileName: `rate: 200
+mount_matrix:
+  z: [0, 0, -1]
+`})
+
+	cfg, path, err := loadConfigFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPath := filepath.Join(home, ".config", configFileName)
+	if path != userPath {
+		t.Errorf("path = %q, want %q", path, userPath)
+	}
+	// the user wins where it sets a key, the system config fills in the rest
+	if cfg.Name != "bmi260" || cfg.Rate != 200 || cfg.GyroDeadzone != 0.1 {
+		t.Errorf("merged name %q rate %v deadzone %v", cfg.Name, cfg.Rate, cfg.GyroDeadzone)
+	}
+	// nested blocks merge row by row
+	mm := cfg.MountMatrix
+	if !slices.Equal(mm.X, []float64{0, 1, 0}) || !slices.Equal(mm.Y, []float64{1, 0, 0}) || !slices.Equal(mm.Z, []float64{0, 0, -1}) {
+		t.Errorf("merged mount_matrix = %+v", mm)
+	}
+	for key, want := range map[string]string{"name": systemConfigPath, "gyro_deadzone": systemConfigPath, "rate": userPath, "mount_matrix": userPath} {
+		if got := cfg.sources[key]; got != want {
+			t.Errorf("source of %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// an explicit --config replaces the user config, still over the system one
+	writeAttrs(t, dir, map[string]string{"other.yaml": "gyro_deadzone: 0.3\n"})
+	cfg, _, err = loadConfigFile(filepath.Join(dir, "other.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "bmi260" || cfg.Rate != 100 || cfg.GyroDeadzone != 0.3 {
+		t.Errorf("with --config: name %q rate %v deadzone %v", cfg.Name, cfg.Rate, cfg.GyroDeadzone)
+	}
+
+	// a broken system config is an error, not silently skipped
+	writeAttrs(t, dir, map[string]string{"etc.yaml": "rate: [\n"})
+	if _, _, err := loadConfigFile(""); err == nil || !strings.Contains(err.Error(), systemConfigPath) {
+		t.Errorf("broken system config: %v", err)
+	}
+}
+
+func TestPhaseLockedRate(t *testing.T) {
+	for _, tc := range []struct {
+		native, target, hz float64
+		div                int
+	}{
+		{400, 400, 400, 1},
+		{400, 200, 200, 2},
+		{400, 250, 200, 2},     // 1.6 rounds to 2
+		{400, 120, 133.333, 3}, // 3.33 rounds to 3
+		{1600, 250, 266.667, 6},
+		{104, 60, 52, 2},
+		// at or above native the output follows the sensor
+		{200, 250, 200, 1},
+		// far below native the divisor keeps growing
+		{1000, 1, 1, 1000},
+	} {
+		hz, div := phaseLockedRate(tc.native, tc.target)
+		if div != tc.div || math.Abs(hz-tc.hz) > 1e-3 {
+			t.Errorf("phaseLockedRate(%g, %g) = %g Hz / %d, want %g / %d", tc.native, tc.target, hz, div, tc.hz, tc.div)
+		}
+		if hz*float64(div) != tc.native {
+			t.Errorf("phaseLockedRate(%g, %g): %g Hz is not native / %d", tc.native, tc.target, hz, div)
+		}
+	}
+}
+
+func TestSensorNativeRate(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		dev, gyroDev, accelDev *IIODevice
+		want                   float64
+	}{
+		{"combined device follows the gyro", &IIODevice{HaveGyro: true, HaveAccel: true, AngVelRateHz: 400, AccelRateHz: 100}, nil, nil, 400},
+		{"gyro rate unknown falls back to accel", &IIODevice{HaveGyro: true, HaveAccel: true, AccelRateHz: 100}, nil, nil, 100},
+		{"split gyro device wins", &IIODevice{HaveAccel: true, AccelRateHz: 100}, &IIODevice{HaveGyro: true, AngVelRateHz: 1600}, nil, 1600},
+		{"split accel device", &IIODevice{HaveGyro: true}, nil, &IIODevice{HaveAccel: true, AccelRateHz: 200}, 200},
+		{"unknown", &IIODevice{HaveGyro: true, HaveAccel: true}, nil, nil, 0},
+		{"no device", nil, nil, nil, 0},
+	} {
+		if got := sensorNativeRate(tc.dev, tc.gyroDev, tc.accelDev); got != tc.want {
+			t.Errorf("%s: %g, want %g", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceOutputRate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		devs []*IIODevice
+		want float64
+	}{
+		{"slower of gyro and accel", []*IIODevice{{HaveGyro: true, HaveAccel: true, AngVelRateHz: 400, AccelRateHz: 100}}, 100},
+		{"only gyro known", []*IIODevice{{HaveGyro: true, HaveAccel: true, AngVelRateHz: 200}}, 200},
+		{"only accel known", []*IIODevice{{HaveGyro: true, HaveAccel: true, AccelRateHz: 62.5}}, 62.5},
+		{"disabled accel ignored", []*IIODevice{{HaveGyro: true, AngVelRateHz: 400, AccelRateHz: 100}}, 400},
+		{"split devices", []*IIODevice{{HaveGyro: true, AngVelRateHz: 1600}, nil, {HaveAccel: true, AccelRateHz: 800}}, 800},
+		{"unknown", []*IIODevice{{HaveGyro: true, HaveAccel: true}}, 0},
+		{"no device", []*IIODevice{nil}, 0},
+	} {
+		if got := deviceOutputRate(tc.devs...); got != tc.want {
+			t.Errorf("%s: %g, want %g", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRateFlag(t *testing.T) {
+	var r rateFlag
+	if err := r.Set("native"); err != nil || !r.native || r.String() != "native" {
+		t.Errorf("Set(native): %+v, %v", r, err)
+	}
+	// a number turns native off again
+	if err := r.Set("12.5"); err != nil || r.native || r.hz != 12.5 || r.String() != "12.5" {
+		t.Errorf("Set(12.5): %+v, %v", r, err)
+	}
+	if err := r.Set("Native"); err == nil {
+		t.Error("Set(Native) accepted")
+	}
+	if err := r.Set("1khz"); err != nil || r.hz != 1000 || r.String() != "1000" {
+		t.Errorf("Set(1khz): %+v, %v", r, err)
+	}
+}
+
+func TestParseRateHz(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"250", 250, false},
+		{"12.5", 12.5, false},
+		{"250hz", 250, false},
+		{"250Hz", 250, false},
+		{"250 HZ", 250, false},
+		{"1khz", 1000, false},
+		{"1.6kHz", 1600, false},
+		{" 0.5 hz ", 0.5, false},
+		{"", 0, true},
+		{"hz", 0, true},
+		{"0", 0, true},
+		{"-100", 0, true},
+		{"inf", 0, true},
+		{"NaN", 0, true},
+		{"250mhz", 0, true},
+		{"fast", 0, true},
+	} {
+		got, err := parseRateHz(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseRateHz(%q) = %g, %v; want %g, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		avail  []float64
+		target float64
+		want   float64
+	}{
+		{"empty list keeps the target", nil, 250, 250},
+		{"exact match", []float64{100, 200, 400}, 200, 200},
+		{"exact match among near ties", []float64{199.5, 200, 200.5}, 200, 200},
+		{"closest below", []float64{100, 200, 400}, 180, 200},
+		{"closest above", []float64{100, 200, 400}, 350, 400},
+		{"beyond the list", []float64{100, 200, 400}, 1600, 400},
+		{"tie takes the higher", []float64{100, 200, 300}, 250, 300},
+		{"tie in any order", []float64{300, 200, 100}, 250, 300},
+		{"tie after rescaling", []float64{0.1 + 0.2, 0.2}, 0.25, 0.1 + 0.2},
+		{"single entry", []float64{25}, 1000, 25},
+	} {
+		if got := nearest(tc.avail, tc.target); got != tc.want {
+			t.Errorf("%s: nearest(%v, %g) = %g, want %g", tc.name, tc.avail, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeRateHz(t *testing.T) {
+	tests := []struct {
+		in, hz, factor float64
+		ok             bool
+	}{
+		{100, 100, 1, true},
+		{1.5625, 1.5625, 1, true},
+		{1600, 1600, 1, true},
+		{200000, 200, 1000, true}, // mHz
+		{12500, 12.5, 1000, true},
+		{0, 0, 1, false},
+		{-100, 0, 1, false},
+		{0.5, 0, 1, false},
+		{1e9, 0, 1, false}, // too large even as mHz
+	}
+	for _, tc := range tests {
+		hz, factor, ok := normalizeRateHz(tc.in)
+		if hz != tc.hz || factor != tc.factor || ok != tc.ok {
+			t.Errorf("normalizeRateHz(%g) = %g, %g, %v; want %g, %g, %v", tc.in, hz, factor, ok, tc.hz, tc.factor, tc.ok)
+		}
+	}
+}
+
+func TestReadRateHz(t *testing.T) {
+	dir := t.TempDir()
+	writeAttrs(t, dir, map[string]string{
+		"hz":         "400\n",
+		"mhz":        "400000\n",
+		"list":       "[25 50 100]\n",
+		"bogus":      "0.001\n",
+		"unreadable": "fast\n",
+	})
+	for name, want := range map[string]float64{"hz": 400, "mhz": 400, "list": 25, "bogus": 0, "unreadable": 0, "missing": 0} {
+		if got := readRateHz(filepath.Join(dir, name)); got != want {
+			t.Errorf("readRateHz(%s) = %g, want %g", name, got, want)
+		}
+	}
+}
+
+func TestOpenIIODeviceRateContents(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+		want          float64
+	}{
+		{"scalar", "400\n", 400},
+		{"scalar with decimals", "12.500000\n", 12.5},
+		{"several values", "200 400 800\n", 200},
+		{"bracketed", "[100 200]\n", 100},
+		{"bracketed range", "[25.000000 25.000000 1600.000000]\n", 25},
+		{"empty", "\n", 0},
+		{"unparsable", "fast\n", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(useSysfs(t), "iio:device0")
+			writeAttrs(t, dir, axes(axes(map[string]string{
+				"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+				"in_anglvel_sampling_frequency": tc.content, "in_accel_sampling_frequency": tc.content,
+			}, "anglvel", [3]int{}), "accel", [3]int{}))
+			dev, err := openIIODevice(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev.AngVelRateHz != tc.want || dev.AccelRateHz != tc.want {
+				t.Errorf("rates %g and %g Hz from %q, want %g", dev.AngVelRateHz, dev.AccelRateHz, tc.content, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckMatrixBlock(t *testing.T) {
+	row := []float64{1, 0, 0}
+	tests := []struct {
+		name    string
+		x, y, z []float64
+		wantErr string
+	}{
+		{"full", row, row, row, ""},
+		{"empty", nil, nil, nil, ""},
+		{"missing row", row, row, nil, "gyro_matrix: row z is missing"},
+		{"only one row", nil, row, nil, "gyro_matrix: row x is missing"},
+		{"short row", row, []float64{0, 1}, row, "gyro_matrix: row y has 2 values, want 3"},
+		{"long row", []float64{1, 0, 0, 0}, row, row, "gyro_matrix: row x has 4 values, want 3"},
+	}
+	for _, tc := range tests {
+		err := checkMatrixBlock("gyro_matrix", tc.x, tc.y, tc.z)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+		} else if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateAndResolveMatrices(t *testing.T) {
+	cfg := runConfig(t, `
+mount_matrix:
+  x: [1, 0, 0]
+  y: [0, 1, 0]
+  z: [0, 0, 1]
+accel_matrix:
+  x: [0, 1, 0]
+  y: [1, 0]
+gyro_axis_sensitivity: [1, 1]
+`)
+	err := validateMatrices(&cfg)
+	if err == nil {
+		t.Fatal("a partial accel_matrix passed validation")
+	}
+	for _, want := range []string{"accel_matrix: row y has 2 values", "gyro_axis_sensitivity has 2 values"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "mount_matrix") {
+		t.Errorf("error %q blames the complete mount_matrix", err)
+	}
+
+	// complete blocks: the specific matrix wins over mount_matrix, per sensor
+	cfg.AccelMatrix.Y, cfg.AccelMatrix.Z = []float64{-1, 0, 0}, []float64{0, 0, 1}
+	cfg.GyroAxisSensitivity = nil
+	if err := validateMatrices(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	accel, gyro, accelSrc, gyroSrc := resolveMatrices(&cfg)
+	if accelSrc != "accel_matrix" || accel != (MountMatrix{X: Vec3{Y: 1}, Y: Vec3{X: -1}, Z: Vec3{Z: 1}}) {
+		t.Errorf("accel from %s: %+v", accelSrc, accel)
+	}
+	if gyroSrc != "mount_matrix" || gyro != identityMatrix {
+		t.Errorf("gyro from %s: %+v", gyroSrc, gyro)
+	}
+
+	if _, _, a, g := resolveMatrices(&Config{}); a != "" || g != "" {
+		t.Errorf("no matrices configured, but resolved from %q and %q", a, g)
+	}
+}
+
+func TestSetChannelRateVariants(t *testing.T) {
+	tests := []struct {
+		name     string
+		attrs    map[string]string
+		dirs     []string // attributes that exist but reject writes
+		wantAttr string
+		wantErr  bool
+	}{
+		{"channel attribute", map[string]string{"in_anglvel_sampling_frequency": "100", "sampling_frequency": "100"}, nil, "in_anglvel_sampling_frequency", false},
+		{"device-wide only", map[string]string{"sampling_frequency": "100"}, nil, "sampling_frequency", false},
+		{"buffer only", map[string]string{"buffer/sampling_frequency": "100"}, nil, "buffer/sampling_frequency", false},
+		{"channel attribute rejects the write", map[string]string{"sampling_frequency": "100"}, []string{"in_anglvel_sampling_frequency"}, "sampling_frequency", false},
+		{"every variant rejects it", nil, []string{"sampling_frequency", "buffer/sampling_frequency"}, "", true},
+		{"no attribute", nil, nil, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeAttrs(t, dir, tc.attrs)
+			for _, d := range tc.dirs {
+				os.MkdirAll(filepath.Join(dir, d), 0755)
+			}
+			attr, write, hz, err := setChannelRate(&IIODevice{Base: dir}, "anglvel", 200, rateBand{})
+			if attr != tc.wantAttr || (err != nil) != tc.wantErr {
+				t.Fatalf("setChannelRate = %q, %v; want %q, error %v", attr, err, tc.wantAttr, tc.wantErr)
+			}
+			if write != 200 || hz != 200 {
+				t.Errorf("planned %g (%g Hz), want 200", write, hz)
+			}
+			if attr == "" {
+				return
+			}
+			if b, _ := os.ReadFile(filepath.Join(dir, attr)); string(b) != "200" {
+				t.Errorf("%s = %q after the write, want 200", attr, b)
+			}
+			// the variants after the one that took the write are left alone
+			for a, v := range tc.attrs {
+				if a == attr {
+					continue
+				}
+				if b, _ := os.ReadFile(filepath.Join(dir, a)); string(b) != v {
+					t.Errorf("%s was written too: %q", a, b)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanChannelRate(t *testing.T) {
+	dir := t.TempDir()
+	writeAttrs(t, dir, map[string]string{
+		"in_accel_sampling_frequency_available": "12.5 25 50 100 200 400",
+		"sampling_frequency_available":          "10 20",
+	})
+	// the channel's list wins, and the closest entry is taken
+	if write, hz := planChannelRate(dir, "accel", 180, rateBand{}); write != 200 || hz != 200 {
+		t.Errorf("accel: %g (%g Hz), want 200", write, hz)
+	}
+	// a channel without its own list uses the device-wide one
+	if write, _ := planChannelRate(dir, "anglvel", 180, rateBand{}); write != 20 {
+		t.Errorf("anglvel: %g, want 20", write)
+	}
+	// without any list the rate is written as asked, moved into the band
+	empty := t.TempDir()
+	if write, hz := planChannelRate(empty, "accel", 1000, rateBand{Max: 400}); write != 400 || hz != 400 {
+		t.Errorf("no list: %g (%g Hz), want 400", write, hz)
+	}
+}
+
+func TestPickRateBounded(t *testing.T) {
+	hz := []float64{25, 50, 100, 200, 400, 800, 1600}
+	mhz := []float64{25000, 50000, 100000, 200000, 400000, 800000, 1600000}
+	for _, tc := range []struct {
+		name      string
+		avail     []float64
+		rate      float64
+		band      rateBand
+		write, hz float64
+		wantWarn  bool
+	}{
+		{"unbounded", hz, 1000, rateBand{}, 800, 800, false},
+		{"max keeps it lower", hz, 1000, rateBand{Max: 400}, 400, 400, false},
+		{"max between entries", hz, 1000, rateBand{Max: 500}, 400, 400, false},
+		{"min keeps it higher", hz, 30, rateBand{Min: 100}, 100, 100, false},
+		{"inside the band", hz, 180, rateBand{Min: 50, Max: 800}, 200, 200, false},
+		{"bounds are inclusive", hz, 1000, rateBand{Min: 50, Max: 200}, 200, 200, false},
+		{"a one-entry band", hz, 30, rateBand{Min: 400, Max: 400}, 400, 400, false},
+		// the closest one overall when the band holds none
+		{"empty band", hz, 1000, rateBand{Min: 150, Max: 180}, 800, 800, true},
+		{"empty band, closest to the rate", hz, 170, rateBand{Min: 150, Max: 180}, 200, 200, true},
+		{"band above the list", hz, 100, rateBand{Min: 2000}, 100, 100, true},
+		// a list in mHz: the band is in Hz, the value written in the list's unit
+		{"mHz list", mhz, 1000, rateBand{Max: 400}, 400000, 400, false},
+		{"mHz list, min", mhz, 10, rateBand{Min: 60}, 100000, 100, false},
+	} {
+		var write, got float64
+		warn := captureStderr(t, func() { write, got = pickRate(tc.avail, tc.rate, tc.band) })
+		if write != tc.write || got != tc.hz || strings.Contains(warn, "no available sampling frequency") != tc.wantWarn {
+			t.Errorf("%s: %g (%g Hz), warning %q; want %g (%g Hz), warning %v", tc.name, write, got, warn, tc.write, tc.hz, tc.wantWarn)
+		}
+	}
+}
+
+func TestRateBandClamp(t *testing.T) {
+	for _, tc := range []struct {
+		band     rateBand
+		in, want float64
+	}{
+		{rateBand{}, 1000, 1000},
+		{rateBand{Max: 400}, 1000, 400},
+		{rateBand{Min: 100}, 30, 100},
+		{rateBand{Min: 100, Max: 400}, 250, 250},
+		{rateBand{Min: 100, Max: 400}, 12.5, 100},
+	} {
+		if got := tc.band.clamp(tc.in); got != tc.want {
+			t.Errorf("%+v clamp(%g) = %g, want %g", tc.band, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSensorRatesFor(t *testing.T) {
+	for _, tc := range []struct {
+		body        string
+		rate        float64
+		gyro, accel float64
+	}{
+		{"", 250, 250, 250},
+		{"gyro_rate: 500\n", 250, 500, 250},
+		{"accel_rate: 100\n", 250, 250, 100},
+		{"gyro_rate: 500\naccel_rate: 100\n", 250, 500, 100},
+		// following the device: an unset sensor is left alone
+		{"gyro_rate: 500\n", 0, 500, 0},
+		// low-rate sensors run at fractions of a Hz
+		{"accel_rate: 12.5\n", 250, 250, 12.5},
+	} {
+		cfg := runConfig(t, tc.body+"rate_min: 10\nrate_max: 800\n")
+		r := sensorRatesFor(&cfg, tc.rate)
+		if r.Gyro != tc.gyro || r.Accel != tc.accel || r.Band != (rateBand{Min: 10, Max: 800}) {
+			t.Errorf("%q at %g Hz: %+v, want gyro %g accel %g", tc.body, tc.rate, r, tc.gyro, tc.accel)
+		}
+	}
+}
+
+func TestConfigurePerSensorRates(t *testing.T) {
+	open := func(t *testing.T, attrs map[string]string) *IIODevice {
+		t.Helper()
+		dir := filepath.Join(t.TempDir(), "iio:device0")
+		writeAttrs(t, dir, axes(axes(map[string]string{"in_anglvel_scale": "0.001", "in_accel_scale": "0.001"}, "anglvel", [3]int{}), "accel", [3]int{}))
+		writeAttrs(t, dir, attrs)
+		dev, err := openIIODevice(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dev
+	}
+	attr := func(dev *IIODevice, name string) string {
+		b, _ := os.ReadFile(filepath.Join(dev.Base, name))
+		return string(b)
+	}
+
+	t.Run("per-channel attributes", func(t *testing.T) {
+		dev := open(t, map[string]string{
+			"in_anglvel_sampling_frequency": "100", "in_anglvel_sampling_frequency_available": "100 200 400 800",
+			"in_accel_sampling_frequency": "100", "in_accel_sampling_frequency_available": "12.5 25 50 100 200",
+		})
+		// each sensor gets the closest rate its own list offers
+		configureDevice(dev, sensorRates{Gyro: 500, Accel: 60}, false, true, "middle")
+		if g, a := attr(dev, "in_anglvel_sampling_frequency"), attr(dev, "in_accel_sampling_frequency"); g != "400" || a != "50" {
+			t.Errorf("written gyro %q accel %q, want 400 and 50", g, a)
+		}
+		if dev.AngVelRateHz != 400 || dev.AccelRateHz != 50 {
+			t.Errorf("achieved gyro %g Hz accel %g Hz", dev.AngVelRateHz, dev.AccelRateHz)
+		}
+	})
+
+	t.Run("unset sensor left alone", func(t *testing.T) {
+		dev := open(t, map[string]string{"in_anglvel_sampling_frequency": "100", "in_accel_sampling_frequency": "100"})
+		configureDevice(dev, sensorRates{Gyro: 200}, false, true, "middle")
+		if g, a := attr(dev, "in_anglvel_sampling_frequency"), attr(dev, "in_accel_sampling_frequency"); g != "200" || a != "100" {
+			t.Errorf("written gyro %q accel %q, want 200 and the untouched 100", g, a)
+		}
+	})
+
+	t.Run("one shared attribute", func(t *testing.T) {
+		dev := open(t, map[string]string{"sampling_frequency": "100"})
+		warn := captureStderr(t, func() { configureDevice(dev, sensorRates{Gyro: 400, Accel: 100}, false, true, "middle") })
+		if !strings.Contains(warn, "can't differ, accel wins") {
+			t.Errorf("no shared-attribute warning: %q", warn)
+		}
+		if attr(dev, "sampling_frequency") != "100" || dev.AngVelRateHz != 100 || dev.AccelRateHz != 100 {
+			t.Errorf("written %q, achieved gyro %g accel %g; want the accel's 100 for both", attr(dev, "sampling_frequency"), dev.AngVelRateHz, dev.AccelRateHz)
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		dev := open(t, map[string]string{"sampling_frequency": "100", "sampling_frequency_available": "25 50 100 200 400 800 1600"})
+		// rate_max keeps a 1 kHz request at 400, for both sensors
+		configureDevice(dev, sensorRates{Gyro: 1000, Accel: 1000, Band: rateBand{Min: 50, Max: 400}}, false, true, "middle")
+		if attr(dev, "sampling_frequency") != "400" || dev.AngVelRateHz != 400 || dev.AccelRateHz != 400 {
+			t.Errorf("written %q, achieved gyro %g accel %g; want 400", attr(dev, "sampling_frequency"), dev.AngVelRateHz, dev.AccelRateHz)
+		}
+	})
+}
+
+func TestDeviceAliases(t *testing.T) {
+	base := useSysfs(t)
+	// the first IMU is a different sensor, so only the alias finds the right one
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(map[string]string{"name": "accel_3d"}, "accel", [3]int{}))
+	writeAttrs(t, filepath.Join(base, "iio:device1"), map[string]string{"name": "BMI0160-trigger"})
+	writeAttrs(t, filepath.Join(base, "iio:device2"), axes(axes(map[string]string{"name": "i2c-BMI0160:00"}, "anglvel", [3]int{}), "accel", [3]int{}))
+
+	cfg := runConfig(t, `
+name: bmi323-imu
+device_aliases: [bmi0160, "  "]
+`)
+	got, err := selectIIOBase(io.Discard, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(base, "iio:device2"); got != want {
+		t.Errorf("selected %s, want %s through the alias", got, want)
+	}
+
+	// without a name the alias still picks the device over the first IMU
+	if got, _ := findIIODeviceByName(io.Discard, "", []string{"BMI0160"}); got != filepath.Join(base, "iio:device2") {
+		t.Errorf("alias without a name selected %s", got)
+	}
+	// a matching name wins over an alias
+	if got, _ := findIIODeviceByName(io.Discard, "accel_3d", []string{"bmi0160"}); got != filepath.Join(base, "iio:device0") {
+		t.Errorf("name and alias: selected %s", got)
+	}
+	// an alias matching nothing falls back to the first IMU
+	if got, _ := findIIODeviceByName(io.Discard, "bmi323-imu", []string{"lsm6ds"}); got != filepath.Join(base, "iio:device0") {
+		t.Errorf("unmatched alias: selected %s", got)
+	}
+}
+
+func TestEmptySysfsReads(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{"", "\n", "  \t\n", "[ ]"} {
+		writeAttrs(t, dir, map[string]string{"attr": content})
+		p := filepath.Join(dir, "attr")
+		if _, err := readFloatList(p); !errors.Is(err, errEmptyRead) {
+			t.Errorf("readFloatList(%q) = %v, want errEmptyRead", content, err)
+		}
+		if content == "[ ]" {
+			continue // brackets are only stripped from lists
+		}
+		if _, err := readInt(p); !errors.Is(err, errEmptyRead) {
+			t.Errorf("readInt(%q) = %v, want errEmptyRead", content, err)
+		}
+		if _, err := readFloat(p); !errors.Is(err, errEmptyRead) {
+			t.Errorf("readFloat(%q) = %v, want errEmptyRead", content, err)
+		}
+	}
+
+	// the usual trailing newline and padding still parse
+	writeAttrs(t, dir, map[string]string{"int": " -1234 \n", "float": "0.001064724\n"})
+	if v, err := readInt(filepath.Join(dir, "int")); v != -1234 || err != nil {
+		t.Errorf("readInt = %d, %v", v, err)
+	}
+	if v, err := readFloat(filepath.Join(dir, "float")); v != 0.001064724 || err != nil {
+		t.Errorf("readFloat = %g, %v", v, err)
+	}
+}
+
+func TestReadSampleEmptyRead(t *testing.T) {
+	base := useSysfs(t)
+	dir := filepath.Join(base, "iio:device0")
+	writeAttrs(t, dir, axes(axes(map[string]string{"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001"},
+		"anglvel", [3]int{1, 2, 3}), "accel", [3]int{4, 5, 6}))
+	dev, err := openIIODevice(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAttrs(t, dir, map[string]string{"in_anglvel_y_raw": "\n"})
+	if _, err := dev.readSample(); !errors.Is(err, errEmptyRead) {
+		t.Errorf("readSample with an empty channel = %v, want errEmptyRead", err)
+	}
+	// the next read after the driver settles succeeds
+	writeAttrs(t, dir, map[string]string{"in_anglvel_y_raw": "2\n"})
+	if s, err := dev.readSample(); err != nil || s.RawGyro != [3]int64{1, 2, 3} {
+		t.Errorf("readSample after recovery = %v, %v", s.RawGyro, err)
+	}
+}
+
+func TestReadSampleOffsets(t *testing.T) {
+	dir := filepath.Join(useSysfs(t), "iio:device0")
+	writeAttrs(t, dir, axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.01",
+		// a channel-wide gyro offset that z overrides, and per-axis accel offsets on x and y only
+		"in_anglvel_offset": "-10", "in_anglvel_z_offset": "5",
+		"in_accel_x_offset": "2", "in_accel_y_offset": "-3.5",
+	}, "anglvel", [3]int{110, 10, -5}), "accel", [3]int{98, 0, -981}))
+	dev, err := openIIODevice(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.GyroOffset != (Vec3{-10, -10, 5}) || dev.AccelOffset != (Vec3{2, -3.5, 0}) {
+		t.Fatalf("offsets: gyro %+v accel %+v", dev.GyroOffset, dev.AccelOffset)
+	}
+	s, err := dev.readSample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (raw + offset) * scale
+	if !near(s.Gyro, Vec3{0.1, 0, 0}, 1e-12) || !near(s.Accel, Vec3{1, -0.035, -9.81}, 1e-12) {
+		t.Errorf("gyro %+v accel %+v", s.Gyro, s.Accel)
+	}
+	// raw counts are reported as read, without the offset
+	if s.RawGyro != [3]int64{110, 10, -5} {
+		t.Errorf("raw gyro %v", s.RawGyro)
+	}
+
+	// without offset attributes the conversion is raw * scale
+	dir = filepath.Join(useSysfs(t), "iio:device0")
+	writeAttrs(t, dir, axes(axes(map[string]string{"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.01"},
+		"anglvel", [3]int{110, 10, -5}), "accel", [3]int{98, 0, -981}))
+	if dev, err = openIIODevice(dir); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := dev.readSample(); err != nil || !near(s.Gyro, Vec3{0.11, 0.01, -0.005}, 1e-12) || !near(s.Accel, Vec3{0.98, 0, -9.81}, 1e-12) {
+		t.Errorf("no offsets: gyro %+v accel %+v, %v", s.Gyro, s.Accel, err)
+	}
+}
+
+func TestChannelAxisNames(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		attrs map[string]string
+		want  [3]string // zero when there are no axes
+	}{
+		{"named", axes(map[string]string{}, "anglvel", [3]int{}), [3]string{"in_anglvel_x", "in_anglvel_y", "in_anglvel_z"}},
+		{"numbered", map[string]string{"in_anglvel0_raw": "0", "in_anglvel1_raw": "0", "in_anglvel2_raw": "0"}, [3]string{"in_anglvel0", "in_anglvel1", "in_anglvel2"}},
+		{"numbered past 9 sort by number", map[string]string{"in_anglvel2_raw": "0", "in_anglvel10_raw": "0", "in_anglvel9_raw": "0"}, [3]string{"in_anglvel2", "in_anglvel9", "in_anglvel10"}},
+		{"scan index wins over the number", map[string]string{
+			"in_anglvel0_raw": "0", "in_anglvel1_raw": "0", "in_anglvel2_raw": "0",
+			"scan_elements/in_anglvel0_index": "5", "scan_elements/in_anglvel1_index": "3", "scan_elements/in_anglvel2_index": "4",
+		}, [3]string{"in_anglvel1", "in_anglvel2", "in_anglvel0"}},
+		{"named wins over numbered", axes(map[string]string{"in_anglvel0_raw": "0", "in_anglvel1_raw": "0", "in_anglvel2_raw": "0"}, "anglvel", [3]int{}),
+			[3]string{"in_anglvel_x", "in_anglvel_y", "in_anglvel_z"}},
+		{"two numbered axes", map[string]string{"in_anglvel0_raw": "0", "in_anglvel1_raw": "0"}, [3]string{}},
+		{"indexed sensors are not axes", map[string]string{"in_anglvel0_x_raw": "0", "in_anglvel0_y_raw": "0", "in_anglvel0_z_raw": "0"}, [3]string{}},
+		{"other channel", axes(map[string]string{}, "accel", [3]int{}), [3]string{}},
+	} {
+		dir := t.TempDir()
+		writeAttrs(t, dir, tc.attrs)
+		got, ok := channelAxisNames(dir, "anglvel")
+		if ok != (tc.want != [3]string{}) || got != tc.want {
+			t.Errorf("%s: %v, %v; want %v", tc.name, got, ok, tc.want)
+		}
+	}
+}
+
+func TestOpenIIODeviceNumberedChannels(t *testing.T) {
+	dir := filepath.Join(useSysfs(t), "iio:device0")
+	writeAttrs(t, dir, map[string]string{
+		"name": "imu-numbered", "in_anglvel_scale": "0.001", "in_accel_scale": "0.01",
+		"in_anglvel0_raw": "100", "in_anglvel1_raw": "-200", "in_anglvel2_raw": "300",
+		"in_accel0_raw": "0", "in_accel1_raw": "0", "in_accel2_raw": "-981",
+	})
+	dev, err := openIIODevice(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dev.HaveGyro || !dev.HaveAccel || dev.AngVelChans[1] != "in_anglvel1" || dev.AccelChans[2] != "in_accel2" {
+		t.Fatalf("device: gyro %v %v, accel %v %v", dev.HaveGyro, dev.AngVelChans, dev.HaveAccel, dev.AccelChans)
+	}
+	s, err := dev.readSample()
+	if err != nil || !near(s.Gyro, Vec3{0.1, -0.2, 0.3}, 1e-12) || !near(s.Accel, Vec3{Z: -9.81}, 1e-12) {
+		t.Errorf("readSample = gyro %+v accel %+v, %v", s.Gyro, s.Accel, err)
+	}
+}
+
+func TestReadChannelScale(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		attrs map[string]string // x, y, z and the channel-wide scale; absent keys are no file
+		want  Vec3
+	}{
+		{"all per-axis", map[string]string{"x": "0.1", "y": "0.2", "z": "0.3", "all": "9"}, Vec3{0.1, 0.2, 0.3}},
+		{"only channel-wide", map[string]string{"all": "0.5"}, Vec3{0.5, 0.5, 0.5}},
+		{"empty x takes channel-wide, not y", map[string]string{"x": "\n", "y": "0.2", "z": "0.3", "all": "0.5"}, Vec3{0.5, 0.2, 0.3}},
+		{"zero and missing axes take channel-wide", map[string]string{"x": "0.1", "y": "0", "all": "0.5"}, Vec3{0.1, 0.5, 0.5}},
+		{"empty x, no channel-wide: borrowed", map[string]string{"x": "", "y": "0.2", "z": "0.3"}, Vec3{0.2, 0.2, 0.3}},
+		{"only z, no channel-wide", map[string]string{"z": "0.3"}, Vec3{0.3, 0.3, 0.3}},
+		{"unparsable x", map[string]string{"x": "n/a", "y": "0.2", "z": "0.2", "all": "0.5"}, Vec3{0.5, 0.2, 0.2}},
+		{"nothing", map[string]string{"x": "", "all": "0"}, Vec3{}},
+	} {
+		dir := t.TempDir()
+		files := map[string]string{}
+		for k, v := range tc.attrs {
+			if k == "all" {
+				files["in_anglvel_scale"] = v
+			} else {
+				files["in_anglvel_"+k+"_scale"] = v
+			}
+		}
+		writeAttrs(t, dir, files)
+		paths := [3]string{filepath.Join(dir, "in_anglvel_x_scale"), filepath.Join(dir, "in_anglvel_y_scale"), filepath.Join(dir, "in_anglvel_z_scale")}
+		if got := readChannelScale(paths, filepath.Join(dir, "in_anglvel_scale")); got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// linkDevice creates the device directory at target (below root) with attrs and links it as
+// sysfs base/name, like /sys/bus/iio/devices.
+func linkDevice(t *testing.T, root, base, name, target string, attrs map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(root, target)
+	writeAttrs(t, dir, attrs)
+	if err := os.Symlink(dir, filepath.Join(base, name)); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDeviceIdentityStable(t *testing.T) {
+	root := t.TempDir()
+	base := useSysfs(t)
+	imu := axes(map[string]string{"name": "bmi260"}, "anglvel", [3]int{})
+	first := linkDevice(t, root, base, "iio:device0", "devices/platform/i2c-1/1-0068/iio:device0", imu)
+	// the same IMU after a reboot that enumerated it later
+	again := linkDevice(t, root, base, "iio:device3", "devices/platform/i2c-1/1-0068/iio:device3", imu)
+	other := linkDevice(t, root, base, "iio:device1", "devices/platform/i2c-2/2-0069/iio:device1", imu)
+	hid := linkDevice(t, root, base, "iio:device2", "devices/platform/usb1/1-3/0003:1234:5678.0001/iio:device2", imu)
+	rehid := linkDevice(t, root, base, "iio:device4", "devices/platform/usb1/1-3/0003:1234:5678.000A/iio:device4", imu)
+
+	id := deviceIdentity(filepath.Join(base, "iio:device0"), "")
+	if !strings.HasPrefix(id, "bmi260|") {
+		t.Errorf("identity %q does not start with the device name", id)
+	}
+	for _, tc := range []struct {
+		a, b string
+		same bool
+	}{
+		{first, again, true},
+		{hid, rehid, true},
+		{first, other, false},
+	} {
+		if got := deviceIdentity(tc.a, "") == deviceIdentity(tc.b, ""); got != tc.same {
+			t.Errorf("%s and %s: same identity %v, want %v", tc.a, tc.b, got, tc.same)
+		}
+	}
+	if deviceIdentity(first, "") == deviceIdentity(first, "other-name") {
+		t.Error("the name is not part of the identity")
+	}
+}
+
+func TestResolveDeviceID(t *testing.T) {
+	root := t.TempDir()
+	base := useSysfs(t)
+	imu := func(name string) map[string]string {
+		return axes(map[string]string{"name": name}, "anglvel", [3]int{})
+	}
+	// two identical IMUs on different I2C buses, enumerated in the "wrong" order this boot
+	right := linkDevice(t, root, base, "iio:device0", "devices/platform/i2c-2/2-0069/iio:device0", imu("bmi260"))
+	left := linkDevice(t, root, base, "iio:device1", "devices/platform/i2c-1/1-0068/iio:device1", imu("bmi260"))
+	linkDevice(t, root, base, "iio:device2", "devices/platform/usb1/1-3/0003:1234:5678.0001/iio:device2", imu("gyro_3d"))
+	for dev, node := range map[string]string{left: "soc/i2c@1/imu@68", right: "soc/i2c@2/imu@69"} {
+		n := filepath.Join(root, "firmware/devicetree/base", node)
+		os.MkdirAll(n, 0755)
+		if err := os.Symlink(n, filepath.Join(dev, "of_node")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id, want string
+	}{
+		{"of_node:i2c@1/imu@68", "iio:device1"},
+		{"of_node:imu@69", "iio:device0"},
+		{"i2c:1-0068", "iio:device1"},
+		{"i2c:2-0069", "iio:device0"},
+		{"name:bmi260", "iio:device0"},
+		{"name:bmi260#1", "iio:device1"},
+		{"name:gyro_3d#0", "iio:device2"},
+		{"path:0003:1234:5678", "iio:device2"},
+	}
+	for _, tc := range tests {
+		got, err := resolveDeviceID(tc.id)
+		if want := filepath.Join(base, tc.want); err != nil || got != want {
+			t.Errorf("resolveDeviceID(%q) = %s, %v; want %s", tc.id, got, err, want)
+		}
+	}
+
+	for _, id := range []string{
+		"i2c:1-006",     // an address prefix is not the address
+		"name:bmi260#2", // only two of them
+		"name:bmi260#x",
+		"serial:1234",
+		"i2c:",
+		"iio:device0",
+	} {
+		if got, err := resolveDeviceID(id); err == nil {
+			t.Errorf("resolveDeviceID(%q) = %s, want an error", id, got)
+		}
+	}
+
+	// device_id wins over the name, and a miss is an error instead of the iio:device0 fallback
+	cfg := runConfig(t, "name: gyro_3d\ndevice_id: \"i2c:1-0068\"\n")
+	if got, err := selectIIOBase(io.Discard, &cfg); err != nil || got != filepath.Join(base, "iio:device1") {
+		t.Errorf("selectIIOBase with device_id = %s, %v", got, err)
+	}
+	cfg.DeviceID = "i2c:3-0068"
+	if got, err := selectIIOBase(io.Discard, &cfg); err == nil {
+		t.Errorf("selectIIOBase with an unmatched device_id = %s, want an error", got)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		in, port string
+		want     string
+		public   bool
+	}{
+		{"", "26760", "127.0.0.1:26760", false}, // the default: loopback only
+		{":26761", "26760", "127.0.0.1:26761", false},
+		{"localhost", "26760", "localhost:26760", false},
+		{"127.0.0.2:9000", "26760", "127.0.0.2:9000", false},
+		{"[::1]", "26760", "[::1]:26760", false},
+		{"0.0.0.0", "26760", "0.0.0.0:26760", true}, // explicit LAN opt-in
+		{"192.168.1.20:26760", "26760", "192.168.1.20:26760", true},
+		{"::", "26760", "[::]:26760", true},
+		{"127.0.0.1:26780", "", "127.0.0.1:26780", false}, // control API: no default port
+	}
+	for _, tc := range tests {
+		got, public, err := listenAddr(tc.in, tc.port)
+		if err != nil || got != tc.want || public != tc.public {
+			t.Errorf("listenAddr(%q) = %s, public %v, %v; want %s, public %v", tc.in, got, public, err, tc.want, tc.public)
+		}
+	}
+	if got, _, err := listenAddr("127.0.0.1", ""); err == nil {
+		t.Errorf("listenAddr without a port and no default = %s, want an error", got)
+	}
+}
+
+func TestListenDSUDefaultBind(t *testing.T) {
+	// an explicit port, as the default one may be taken on the test machine
+	srv, err := listenDSU(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if ip := srv.conn.LocalAddr().(*net.UDPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("default bind listens on %s, want loopback", ip)
+	}
+
+	srv2, err := listenDSU("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv2.Close()
+	if ip := srv2.conn.LocalAddr().(*net.UDPAddr).IP; !ip.IsUnspecified() {
+		t.Errorf("--bind 0.0.0.0 listens on %s", ip)
+	}
+}
+
+func TestZeroGyroWatchFlicker(t *testing.T) {
+	var w zeroGyroWatch
+	warnings := 0
+	feed := func(zero bool, n int) {
+		for range n {
+			if w.Update(zero) > 0 {
+				warnings++
+			}
+		}
+	}
+	feed(true, zeroGyroWarnAfter-1)
+	if warnings != 0 {
+		t.Fatal("warned before a sustained zero run")
+	}
+	feed(true, 1)
+	if warnings != 1 {
+		t.Fatalf("%d warnings after %d zero samples, want 1", warnings, zeroGyroWarnAfter)
+	}
+	// a sensor flickering between zero and noise: short live runs do not re-arm the warning
+	for range 20 {
+		feed(false, 3)
+		feed(true, zeroGyroWarnAfter*2)
+	}
+	if warnings != 1 {
+		t.Errorf("%d warnings while flickering, want still 1", warnings)
+	}
+	// a live run just short of the recovery period does not re-arm it either
+	feed(false, zeroGyroRecoverAfter-1)
+	feed(true, zeroGyroWarnAfter)
+	if warnings != 1 {
+		t.Errorf("%d warnings after a short recovery, want still 1", warnings)
+	}
+	// a sustained recovery, then a new sustained zero run, warns again with the run length
+	feed(false, zeroGyroRecoverAfter)
+	feed(true, zeroGyroWarnAfter-1)
+	if n := w.Update(true); n != zeroGyroWarnAfter {
+		t.Errorf("re-warning reported a run of %d, want %d", n, zeroGyroWarnAfter)
+	}
+	// a zero run shorter than the threshold after recovery does not warn
+	feed(false, zeroGyroRecoverAfter)
+	feed(true, zeroGyroWarnAfter-1)
+	feed(false, 1)
+	feed(true, zeroGyroWarnAfter-1)
+	if warnings != 1 {
+		t.Errorf("%d warnings from interrupted zero runs", warnings)
+	}
+}
+
+func TestRawCountsThroughPipeline(t *testing.T) {
+	// a split pair: the gyro device is primary, the accel comes from the other device
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(map[string]string{"name": "gyro_3d", "in_anglvel_scale": "0.001"}, "anglvel", [3]int{100, -200, 300}))
+	writeAttrs(t, filepath.Join(base, "iio:device1"), axes(map[string]string{"name": "accel_3d", "in_accel_scale": "0.01", "in_accel_offset": "5"}, "accel", [3]int{-7, 0, -981}))
+	gyro, err := openIIODevice(filepath.Join(base, "iio:device0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accel, err := openIIODevice(filepath.Join(base, "iio:device1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := readMerged(gyro, nil, accel, "primary", &skewStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the counts as read, before the offset and scale that made the physical values
+	if s.RawGyro != [3]int64{100, -200, 300} || s.RawAccel != [3]int64{-7, 0, -981} {
+		t.Fatalf("raw gyro %v accel %v", s.RawGyro, s.RawAccel)
+	}
+	if !near(s.Accel, Vec3{-0.02, 0.05, -9.76}, 1e-12) {
+		t.Errorf("accel %+v", s.Accel)
+	}
+	// matrices and tuning work on the physical values and leave the counts in the sensor frame
+	ls := &liveSettings{
+		AccelMatrix: swapXY, GyroMatrix: swapXY, AccelCorrection: scaleX, GyroCorrection: scaleX,
+		GyroSensitivity: 2, GyroAxisScale: Vec3{1, 1, 1}, AccelAxisScale: Vec3{1, 1, 1},
+	}
+	out := ls.applyMatrices(s)
+	if out.RawGyro != s.RawGyro || out.RawAccel != s.RawAccel || out.Gyro == s.Gyro {
+		t.Errorf("after the matrices: raw gyro %v accel %v, gyro %+v", out.RawGyro, out.RawAccel, out.Gyro)
+	}
+}
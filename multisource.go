@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SourceDevice is one entry of source_devices: an IIO device and the sensors, or single axes
+// of them, taken from it.
+type SourceDevice struct {
+	// Path is the sysfs device directory, or its name (iio:deviceN) under the sysfs base
+	Path string `yaml:"path"`
+	// Roles are gyro, accel, or one axis such as gyro.x or accel.z
+	Roles []string `yaml:"roles,flow"`
+}
+
+// sensorAxes is which axes of each sensor a source device provides.
+type sensorAxes struct {
+	Gyro, Accel [3]bool
+}
+
+// parseRoles turns the roles of a source device into the axes it provides.
+func parseRoles(roles []string) (sensorAxes, error) {
+	var a sensorAxes
+	if len(roles) == 0 {
+		return a, fmt.Errorf("no roles (want gyro, accel or an axis such as accel.z)")
+	}
+	for _, r := range roles {
+		sensor, axis, hasAxis := strings.Cut(strings.ToLower(strings.TrimSpace(r)), ".")
+		var axes *[3]bool
+		switch sensor {
+		case "gyro":
+			axes = &a.Gyro
+		case "accel":
+			axes = &a.Accel
+		default:
+			return a, fmt.Errorf("unknown role %q (want gyro, accel or an axis such as accel.z)", r)
+		}
+		if !hasAxis {
+			*axes = [3]bool{true, true, true}
+			continue
+		}
+		i := strings.Index("xyz", axis)
+		if len(axis) != 1 || i < 0 {
+			return a, fmt.Errorf("unknown axis in role %q (want x, y or z)", r)
+		}
+		axes[i] = true
+	}
+	return a, nil
+}
+
+// sourceDevicePath resolves the path of a source device against the sysfs base.
+func sourceDevicePath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(sysfsBase, p)
+}
+
+// validateSourceDevices checks the roles of source_devices: each axis may come from one device
+// only. Axes no device provides stay zero, like a sensor that is missing.
+func validateSourceDevices(devs []SourceDevice) error {
+	var seen sensorAxes
+	for _, d := range devs {
+		if d.Path == "" {
+			return fmt.Errorf("source_devices: an entry has no path")
+		}
+		a, err := parseRoles(d.Roles)
+		if err != nil {
+			return fmt.Errorf("source_devices: %s: %w", d.Path, err)
+		}
+		for i := range 3 {
+			if a.Gyro[i] && seen.Gyro[i] {
+				return fmt.Errorf("source_devices: %s: gyro.%c is already taken from another device", d.Path, "xyz"[i])
+			}
+			if a.Accel[i] && seen.Accel[i] {
+				return fmt.Errorf("source_devices: %s: accel.%c is already taken from another device", d.Path, "xyz"[i])
+			}
+			seen.Gyro[i] = seen.Gyro[i] || a.Gyro[i]
+			seen.Accel[i] = seen.Accel[i] || a.Accel[i]
+		}
+	}
+	return nil
+}
+
+// sourcePart is an opened source device and the axes taken from it.
+type sourcePart struct {
+	dev  *IIODevice
+	axes sensorAxes
+}
+
+// multiSource assembles each sample from several IIO devices (source_devices), for handhelds
+// that spread the motion sensors over more than the two devices the automatic split merge
+// handles. The timestamp is the first device's.
+type multiSource struct {
+	parts []sourcePart
+}
+
+// openMultiSource opens the source devices. Only the sensors a device has roles for are
+// read from it.
+func openMultiSource(devs []SourceDevice, enableGyro, enableAccel bool) (*multiSource, error) {
+	m := &multiSource{}
+	for _, sd := range devs {
+		axes, err := parseRoles(sd.Roles)
+		if err != nil {
+			return nil, err
+		}
+		dev, err := openIIODevice(sourceDevicePath(sd.Path))
+		if err != nil {
+			return nil, err
+		}
+		if axes.Gyro != [3]bool{} && !dev.HaveGyro {
+			return nil, fmt.Errorf("%s has no gyro channels", dev.Base)
+		}
+		if axes.Accel != [3]bool{} && !dev.HaveAccel {
+			return nil, fmt.Errorf("%s has no accel channels", dev.Base)
+		}
+		dev.HaveGyro = dev.HaveGyro && axes.Gyro != [3]bool{}
+		dev.HaveAccel = dev.HaveAccel && axes.Accel != [3]bool{}
+		applySensorEnables(dev, enableGyro, enableAccel)
+		m.parts = append(m.parts, sourcePart{dev: dev, axes: axes})
+	}
+	return m, nil
+}
+
+// devices returns the opened IIO devices, in config order.
+func (m *multiSource) devices() []*IIODevice {
+	devs := make([]*IIODevice, len(m.parts))
+	for i, p := range m.parts {
+		devs[i] = p.dev
+	}
+	return devs
+}
+
+// covers reports whether every axis of the gyro and of the accel comes from a device with a
+// working scale.
+func (m *multiSource) covers() (gyro, accel bool) {
+	var g, a [3]bool
+	for _, p := range m.parts {
+		for i := range 3 {
+			g[i] = g[i] || (p.axes.Gyro[i] && p.dev.HaveGyro && p.dev.GyroScale.X != 0)
+			a[i] = a[i] || (p.axes.Accel[i] && p.dev.HaveAccel && p.dev.AccelScale.X != 0)
+		}
+	}
+	return g == [3]bool{true, true, true}, a == [3]bool{true, true, true}
+}
+
+func (m *multiSource) readSample() (IMUSample, error) {
+	var out IMUSample
+	for i, p := range m.parts {
+		s, err := p.dev.readSample()
+		if err != nil {
+			return out, err
+		}
+		if i == 0 {
+			out.TSus = s.TSus
+		}
+		take := func(axes [3]bool, dst *Vec3, raw *[3]int64, src Vec3, srcRaw [3]int64) {
+			v, sv := []*float64{&dst.X, &dst.Y, &dst.Z}, []float64{src.X, src.Y, src.Z}
+			for a := range 3 {
+				if axes[a] {
+					*v[a], raw[a] = sv[a], srcRaw[a]
+				}
+			}
+		}
+		if p.dev.HaveGyro {
+			take(p.axes.Gyro, &out.Gyro, &out.RawGyro, s.Gyro, s.RawGyro)
+		}
+		if p.dev.HaveAccel {
+			take(p.axes.Accel, &out.Accel, &out.RawAccel, s.Accel, s.RawAccel)
+		}
+	}
+	return out, nil
+}
+
+// reset reopens and reconfigures every source device after repeated bus errors, like
+// resetIIODevice does for a single one.
+func (m *multiSource) reset(rates sensorRates, setScales, setRate bool, scalePolicy string, enableGyro, enableAccel bool) error {
+	for i, p := range m.parts {
+		dev, err := openIIODevice(p.dev.Base)
+		if err != nil {
+			return err
+		}
+		dev.HaveGyro = dev.HaveGyro && p.dev.HaveGyro
+		dev.HaveAccel = dev.HaveAccel && p.dev.HaveAccel
+		applySensorEnables(dev, enableGyro, enableAccel)
+		configureDevice(dev, rates, setScales, setRate, scalePolicy)
+		m.parts[i].dev = dev
+	}
+	return nil
+}
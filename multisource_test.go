@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRoles(t *testing.T) {
+	all := [3]bool{true, true, true}
+	for _, tc := range []struct {
+		roles   []string
+		want    sensorAxes
+		wantErr bool
+	}{
+		{[]string{"gyro"}, sensorAxes{Gyro: all}, false},
+		{[]string{"accel", "gyro"}, sensorAxes{Gyro: all, Accel: all}, false},
+		{[]string{"accel.x", " Accel.Y "}, sensorAxes{Accel: [3]bool{true, true, false}}, false},
+		{[]string{"gyro.z", "accel.z"}, sensorAxes{Gyro: [3]bool{2: true}, Accel: [3]bool{2: true}}, false},
+		{nil, sensorAxes{}, true},
+		{[]string{"magn"}, sensorAxes{}, true},
+		{[]string{"gyro.w"}, sensorAxes{}, true},
+		{[]string{"gyro.xy"}, sensorAxes{}, true},
+		{[]string{"accel."}, sensorAxes{}, true},
+	} {
+		got, err := parseRoles(tc.roles)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("parseRoles(%q) = %+v, %v; want %+v, error %v", tc.roles, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateSourceDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		devs    []SourceDevice
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"three devices", []SourceDevice{
+			{Path: "iio:device1", Roles: []string{"gyro"}},
+			{Path: "iio:device0", Roles: []string{"accel.x", "accel.y"}},
+			{Path: "iio:device2", Roles: []string{"accel.z"}},
+		}, false},
+		{"axes left out", []SourceDevice{{Path: "iio:device0", Roles: []string{"gyro.x"}}}, false},
+		{"no path", []SourceDevice{{Roles: []string{"gyro"}}}, true},
+		{"no roles", []SourceDevice{{Path: "iio:device0"}}, true},
+		{"bad role", []SourceDevice{{Path: "iio:device0", Roles: []string{"gyro.q"}}}, true},
+		{"axis taken twice", []SourceDevice{
+			{Path: "iio:device0", Roles: []string{"accel"}},
+			{Path: "iio:device1", Roles: []string{"accel.z"}},
+		}, true},
+		{"gyro taken twice", []SourceDevice{
+			{Path: "iio:device0", Roles: []string{"gyro.y"}},
+			{Path: "iio:device1", Roles: []string{"gyro"}},
+		}, true},
+	} {
+		if err := validateSourceDevices(tc.devs); (err != nil) != tc.wantErr {
+			t.Errorf("%s: %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// threeSourceDevices writes a gyro-only device and two accel devices, the second one with a
+// different scale and only its z axis used, and returns the source_devices reading them.
+func threeSourceDevices(t *testing.T) []SourceDevice {
+	t.Helper()
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{"name": "accel-a", "in_accel_scale": "0.01", "in_anglvel_scale": "0.001"},
+		"accel", [3]int{100, -200, 555}), "anglvel", [3]int{7, 7, 7}))
+	writeAttrs(t, filepath.Join(base, "iio:device1"), axes(map[string]string{"name": "gyro", "in_anglvel_scale": "0.001"}, "anglvel", [3]int{1000, -2000, 3000}))
+	writeAttrs(t, filepath.Join(base, "iio:device2"), axes(map[string]string{"name": "accel-b", "in_accel_scale": "0.001"}, "accel", [3]int{444, 444, -9810}))
+	return []SourceDevice{
+		{Path: "iio:device1", Roles: []string{"gyro"}},
+		// device0 has a gyro too; only its accel x and y are taken
+		{Path: "iio:device0", Roles: []string{"accel.x", "accel.y"}},
+		{Path: filepath.Join(base, "iio:device2"), Roles: []string{"accel.z"}},
+	}
+}
+
+func TestMultiSourceAssembly(t *testing.T) {
+	m, err := openMultiSource(threeSourceDevices(t), true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devs := m.devices(); len(devs) != 3 || filepath.Base(devs[0].Base) != "iio:device1" || filepath.Base(devs[2].Base) != "iio:device2" {
+		t.Fatalf("devices %v", devs)
+	}
+	if gyro, accel := m.covers(); !gyro || !accel {
+		t.Errorf("covers() = %v, %v; want both", gyro, accel)
+	}
+	s, err := m.readSample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(s.Gyro, Vec3{1, -2, 3}, 1e-12) || s.RawGyro != [3]int64{1000, -2000, 3000} {
+		t.Errorf("gyro %+v raw %v, want device1's", s.Gyro, s.RawGyro)
+	}
+	// x and y from device0, z from device2, each with its own scale
+	if !near(s.Accel, Vec3{1, -2, -9.81}, 1e-12) || s.RawAccel != [3]int64{100, -200, -9810} {
+		t.Errorf("accel %+v raw %v", s.Accel, s.RawAccel)
+	}
+
+	// without a gyro role on any device the gyro isn't covered
+	noGyro := threeSourceDevices(t)[1:]
+	if m, err = openMultiSource(noGyro, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if gyro, accel := m.covers(); gyro || !accel {
+		t.Errorf("covers() without a gyro role = %v, %v", gyro, accel)
+	}
+	// nor with the gyro disabled
+	if m, err = openMultiSource(threeSourceDevices(t), false, true); err != nil {
+		t.Fatal(err)
+	}
+	if gyro, accel := m.covers(); gyro || !accel {
+		t.Errorf("covers() with the gyro disabled = %v, %v", gyro, accel)
+	}
+}
+
+func TestOpenMultiSourceErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		devs []SourceDevice
+	}{
+		{"missing device", []SourceDevice{{Path: "iio:device9", Roles: []string{"gyro"}}}},
+		{"gyro role on an accel device", []SourceDevice{{Path: "iio:device2", Roles: []string{"gyro.x"}}}},
+		{"accel role on a gyro device", []SourceDevice{{Path: "iio:device1", Roles: []string{"accel"}}}},
+	} {
+		threeSourceDevices(t)
+		if _, err := openMultiSource(tc.devs, true, true); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// orientationStreamEvery rate-limits --orientation-udp; 30 messages/s is plenty for a viewer.
+const orientationStreamEvery = time.Second / 30
+
+// orientationMessage is the JSON datagram sent by --orientation-udp, e.g.
+// {"ts":123456,"w":1,"x":0,"y":0,"z":0}. The quaternion rotates the DSU frame into the world
+// frame (Z up); ts is the motion timestamp in microseconds.
+type orientationMessage struct {
+	TS uint64  `json:"ts"`
+	W  float64 `json:"w"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	Z  float64 `json:"z"`
+}
+
+// encodeOrientation builds the datagram for q, normalized.
+func encodeOrientation(q Quat, tsUS uint64) []byte {
+	q = q.Normalize()
+	b, _ := json.Marshal(orientationMessage{TS: tsUS, W: q.W, X: q.X, Y: q.Y, Z: q.Z})
+	return b
+}
+
+// orientationStream sends the fused orientation to a visualizer over UDP, independent of DSU.
+type orientationStream struct {
+	conn *net.UDPConn
+	last time.Time
+}
+
+func newOrientationStream(addr string) (*orientationStream, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", addr, err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &orientationStream{conn: conn}, nil
+}
+
+// Send sends q unless the previous message went out less than orientationStreamEvery ago.
+// Errors (nobody listening) are ignored: the stream is best effort.
+func (o *orientationStream) Send(q Quat, tsUS uint64, now time.Time) {
+	if now.Sub(o.last) < orientationStreamEvery {
+		return
+	}
+	o.last = now
+	_, _ = o.conn.Write(encodeOrientation(q, tsUS))
+}
+
+func (o *orientationStream) Close() error { return o.conn.Close() }
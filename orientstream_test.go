@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeOrientation(t *testing.T) {
+	// an unnormalized 90° yaw comes out as a unit quaternion
+	var m orientationMessage
+	if err := json.Unmarshal(encodeOrientation(Quat{W: 2, Z: 2}, 123456), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.TS != 123456 || math.Abs(m.W-math.Sqrt2/2) > 1e-12 || m.X != 0 || m.Y != 0 || math.Abs(m.Z-math.Sqrt2/2) > 1e-12 {
+		t.Errorf("message %+v", m)
+	}
+	if n := (Quat{m.W, m.X, m.Y, m.Z}).Norm(); math.Abs(n-1) > 1e-12 {
+		t.Errorf("norm %g, want 1", n)
+	}
+}
+
+func TestOrientationStreamRateLimit(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	o, err := newOrientationStream(ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	t0 := time.Unix(1000, 0)
+	for i, at := range []time.Duration{0, orientationStreamEvery / 2, orientationStreamEvery} {
+		o.Send(Quat{W: 1}, uint64(i), t0.Add(at))
+	}
+	// the message half a period after the first is dropped
+	buf := make([]byte, 256)
+	for _, want := range []uint64{0, 2} {
+		ln.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := ln.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m orientationMessage
+		if err := json.Unmarshal(buf[:n], &m); err != nil || m.TS != want {
+			t.Errorf("got %s, %v; want the message with ts %d", buf[:n], err, want)
+		}
+	}
+}
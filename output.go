@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Output is a destination for processed samples. All outputs get the same sample from the
+// main loop; each may reorient it to its own axis convention before sending.
+type Output interface {
+	Send(s IMUSample)
+	Close() error
+}
+
+// outputConfig is one entry of the outputs list. Without the list there is a single DSU
+// output on bind.
+type outputConfig struct {
+	// Type is the backend; only dsu exists so far (default)
+	Type string `yaml:"type"`
+	// Bind is the DSU listen address, host[:port]
+	Bind string `yaml:"bind"`
+	// Convention remaps both sensors for this output only, after the global pipeline
+	Convention *matrixYAML `yaml:"convention"`
+	// AccelUnits and GyroUnits override output_accel_units and output_gyro_units for this
+	// output only
+	AccelUnits string `yaml:"accel_units"`
+	GyroUnits  string `yaml:"gyro_units"`
+	// LinearAccel sends the accel with gravity removed, for clients that want user
+	// acceleration; DSU clients normally expect gravity in it
+	LinearAccel bool `yaml:"linear_accel"`
+}
+
+// validateOutputs checks the outputs list: known types, distinct addresses and well-formed
+// convention matrices.
+func validateOutputs(outs []outputConfig) error {
+	var errs []error
+	binds := map[string]int{}
+	for i, o := range outs {
+		name := fmt.Sprintf("outputs[%d]", i)
+		if o.Type != "" && o.Type != "dsu" {
+			errs = append(errs, fmt.Errorf("%s: unknown type %q (want dsu)", name, o.Type))
+		}
+		if j, dup := binds[o.Bind]; dup {
+			errs = append(errs, fmt.Errorf("%s: bind %q is also used by outputs[%d]", name, o.Bind, j))
+		}
+		binds[o.Bind] = i
+		if c := o.Convention; c != nil {
+			if err := checkMatrixBlock(name+".convention", c.X, c.Y, c.Z); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if _, ok := dsuAccelUnits[o.AccelUnits]; !ok && o.AccelUnits != "" {
+			errs = append(errs, fmt.Errorf("%s: unknown accel_units %q (want g or m_s2)", name, o.AccelUnits))
+		}
+		if _, ok := dsuGyroUnits[o.GyroUnits]; !ok && o.GyroUnits != "" {
+			errs = append(errs, fmt.Errorf("%s: unknown gyro_units %q (want deg_s or rad_s)", name, o.GyroUnits))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dsuOutput sends samples to the clients of one DSU server.
+type dsuOutput struct {
+	*DSUServer
+	convention *MountMatrix       // nil sends the shared sample as is
+	linear     *linearAccelFilter // non-nil takes gravity out of the accel (linear_accel)
+}
+
+func newDSUOutput(srv *DSUServer, oc outputConfig) *dsuOutput {
+	o := &dsuOutput{DSUServer: srv}
+	if c := oc.Convention; c != nil {
+		if m, ok := parseMatrix(c.X, c.Y, c.Z); ok {
+			o.convention = &m
+		}
+	}
+	if oc.LinearAccel {
+		o.linear = newLinearAccelFilter(linearAccelCutoffHz)
+	}
+	return o
+}
+
+func (o *dsuOutput) Send(s IMUSample) {
+	if o.linear != nil {
+		s.Accel = o.linear.Update(s.Accel, s.TSus)
+	}
+	if o.convention != nil {
+		s.Gyro = o.convention.Apply(s.Gyro)
+		s.Accel = o.convention.Apply(s.Accel)
+	}
+	o.Broadcast(s)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateOutputs(t *testing.T) {
+	swap := &matrixYAML{X: []float64{0, 1, 0}, Y: []float64{1, 0, 0}, Z: []float64{0, 0, 1}}
+	for _, tc := range []struct {
+		name string
+		outs []outputConfig
+		want string // substring of the error, "" for none
+	}{
+		{"none", nil, ""},
+		{"two dsu outputs", []outputConfig{{Bind: ":26760"}, {Type: "dsu", Bind: ":26761", Convention: swap, GyroUnits: "rad_s"}}, ""},
+		{"unknown type", []outputConfig{{Type: "osc", Bind: ":9000"}}, `outputs[0]: unknown type "osc"`},
+		{"shared bind", []outputConfig{{Bind: ":26760"}, {Bind: ":26760"}}, `outputs[1]: bind ":26760" is also used by outputs[0]`},
+		{"short convention row", []outputConfig{{Bind: ":1", Convention: &matrixYAML{X: []float64{1, 0}, Y: []float64{0, 1, 0}, Z: []float64{0, 0, 1}}}}, "outputs[0].convention"},
+		{"bad units", []outputConfig{{Bind: ":1", AccelUnits: "ft_s2"}}, `unknown accel_units "ft_s2"`},
+	} {
+		err := validateOutputs(tc.outs)
+		if (tc.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// subscribedOutput starts a DSU output on a loopback port with oc and returns it with a
+// client subscribed to it.
+func subscribedOutput(t *testing.T, oc outputConfig) (*dsuOutput, *net.UDPConn) {
+	t.Helper()
+	srv, err := NewDSUServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	conn, err := net.DialUDP("udp", nil, srv.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write(subscribeRequest())
+	deadline := time.Now().Add(2 * time.Second)
+	for clients, _ := srv.Stats(); clients == 0; clients, _ = srv.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return newDSUOutput(srv, oc), conn
+}
+
+// nextMotion reads packets from conn until a motion packet arrives.
+func nextMotion(t *testing.T, conn *net.UDPConn) dsuMotion {
+	t.Helper()
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, payload, err := parseDSUPacket(buf[:n], dsuMagicServer); err == nil && h.MsgType == dsuMsgData {
+			return decodeMotion(payload)
+		}
+	}
+}
+
+func TestOutputsApplyOwnConvention(t *testing.T) {
+	// one output takes the shared sample as is; the other swaps x and y and flips z
+	plain, plainConn := subscribedOutput(t, outputConfig{})
+	remapped, remappedConn := subscribedOutput(t, outputConfig{
+		Convention: &matrixYAML{X: []float64{0, 1, 0}, Y: []float64{1, 0, 0}, Z: []float64{0, 0, -1}},
+	})
+
+	s := IMUSample{Gyro: Vec3{1, 2, 3}.Scale(math.Pi / 180), Accel: Vec3{Z: -standardGravity}, TSus: 1_000_000}
+	for _, o := range []Output{plain, remapped} {
+		o.Send(s)
+	}
+	a, b := nextMotion(t, plainConn), nextMotion(t, remappedConn)
+	if !near(a.Gyro, Vec3{1, 2, 3}, 1e-4) || !near(a.Accel, Vec3{Z: -1}, 1e-6) {
+		t.Errorf("plain output: gyro %+v accel %+v", a.Gyro, a.Accel)
+	}
+	if !near(b.Gyro, Vec3{2, 1, -3}, 1e-4) || !near(b.Accel, Vec3{Z: 1}, 1e-6) {
+		t.Errorf("remapped output: gyro %+v accel %+v", b.Gyro, b.Accel)
+	}
+	// the shared sample is not changed by an output's convention
+	if s.Gyro != (Vec3{1, 2, 3}.Scale(math.Pi / 180)) {
+		t.Errorf("shared sample modified: %+v", s.Gyro)
+	}
+}
+
+func TestOutputLinearAccel(t *testing.T) {
+	plain, plainConn := subscribedOutput(t, outputConfig{})
+	linear, linearConn := subscribedOutput(t, outputConfig{LinearAccel: true})
+	linear.SetUnits("m_s2", "deg_s")
+	send := func(accel Vec3, tsUS uint64) (a, b dsuMotion) {
+		s := IMUSample{Accel: accel, TSus: tsUS}
+		plain.Send(s)
+		linear.Send(s)
+		return nextMotion(t, plainConn), nextMotion(t, linearConn)
+	}
+	// resting: gravity only, which the linear output takes out
+	rest := Vec3{Z: -standardGravity}
+	var ts uint64
+	for range 50 {
+		ts += 10_000
+		a, b := send(rest, ts)
+		if !near(a.Accel, Vec3{Z: -1}, 1e-6) || !near(b.Accel, Vec3{}, 1e-3) {
+			t.Fatalf("resting: plain %+v, linear %+v", a.Accel, b.Accel)
+		}
+	}
+	// a 2 m/s^2 push along x shows on the linear output and fades as gravity re-settles
+	ts += 10_000
+	if _, b := send(rest.Add(Vec3{X: 2}), ts); b.Accel.X < 1.9 || math.Abs(b.Accel.Z) > 1e-3 {
+		t.Errorf("push: linear %+v, want about 2 m/s^2 along x", b.Accel)
+	}
+	for range 500 {
+		ts += 10_000
+		send(rest.Add(Vec3{X: 2}), ts)
+	}
+	if _, b := send(rest.Add(Vec3{X: 2}), ts+10_000); math.Abs(b.Accel.X) > 0.05 {
+		t.Errorf("held push after 5 s: linear %+v, want it faded", b.Accel)
+	}
+}
+
+func TestDSUServerUnits(t *testing.T) {
+	// 90 deg/s about z and 1 g down
+	s := IMUSample{Gyro: Vec3{Z: math.Pi / 2}, Accel: Vec3{Z: -standardGravity}, TSus: 1_000_000}
+	for _, tc := range []struct {
+		accel, gyro         string
+		wantAccel, wantGyro Vec3
+		wantErr             bool
+	}{
+		{"g", "deg_s", Vec3{Z: -1}, Vec3{Z: 90}, false},
+		{"m_s2", "deg_s", Vec3{Z: -standardGravity}, Vec3{Z: 90}, false},
+		{"g", "rad_s", Vec3{Z: -1}, Vec3{Z: math.Pi / 2}, false},
+		{"m_s2", "rad_s", Vec3{Z: -standardGravity}, Vec3{Z: math.Pi / 2}, false},
+		{"", "deg_s", Vec3{}, Vec3{}, true},
+		{"g", "rpm", Vec3{}, Vec3{}, true},
+	} {
+		out, conn := subscribedOutput(t, outputConfig{})
+		if err := out.SetUnits(tc.accel, tc.gyro); (err != nil) != tc.wantErr {
+			t.Errorf("SetUnits(%q, %q) = %v, want error %v", tc.accel, tc.gyro, err, tc.wantErr)
+		}
+		if tc.wantErr {
+			// a rejected unit leaves the standard ones
+			tc.wantAccel, tc.wantGyro = Vec3{Z: -1}, Vec3{Z: 90}
+		}
+		out.Send(s)
+		m := nextMotion(t, conn)
+		if !near(m.Accel, tc.wantAccel, 1e-5) || !near(m.Gyro, tc.wantGyro, 1e-4) {
+			t.Errorf("%s, %s: accel %+v gyro %+v, want %+v and %+v", tc.accel, tc.gyro, m.Accel, m.Gyro, tc.wantAccel, tc.wantGyro)
+		}
+	}
+}
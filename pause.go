@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// pauseSwitch freezes motion output without stopping the bridge (SIGUSR2, PUT /pause). While
+// paused the DSU slot keeps streaming, so clients stay connected, but the gyro reads zero and
+// the accel holds the last value from before the pause.
+type pauseSwitch struct {
+	on atomic.Bool
+
+	held Vec3 // accel sent while paused; main loop only
+}
+
+// Set pauses or resumes output and logs the change; why names the trigger.
+func (p *pauseSwitch) Set(on bool, why string) {
+	if p.on.Swap(on) == on {
+		return
+	}
+	if on {
+		fmt.Printf("Output paused (%s)\n", why)
+	} else {
+		fmt.Printf("Output resumed (%s)\n", why)
+	}
+}
+
+// Toggle flips the pause state.
+func (p *pauseSwitch) Toggle(why string) {
+	for {
+		cur := p.on.Load()
+		if p.on.CompareAndSwap(cur, !cur) {
+			if cur {
+				fmt.Printf("Output resumed (%s)\n", why)
+			} else {
+				fmt.Printf("Output paused (%s)\n", why)
+			}
+			return
+		}
+	}
+}
+
+func (p *pauseSwitch) Paused() bool { return p.on.Load() }
+
+// Apply returns the sample to send: s itself, or the zero-motion keepalive while paused.
+func (p *pauseSwitch) Apply(s IMUSample) IMUSample {
+	if !p.on.Load() {
+		p.held = s.Accel
+		return s
+	}
+	s.Gyro, s.Accel = Vec3{}, p.held
+	return s
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPausedOutputKeepsSlotAlive(t *testing.T) {
+	out, conn := subscribedOutput(t, outputConfig{})
+	p := &pauseSwitch{}
+	moving := IMUSample{Gyro: Vec3{X: 1}, Accel: Vec3{Z: -standardGravity}}
+
+	out.Send(p.Apply(moving))
+	if m := nextMotion(t, conn); m.Gyro == (Vec3{}) || m.PktNo != 1 {
+		t.Fatalf("before the pause: %+v", m)
+	}
+
+	// while paused the client keeps getting packets, with no rotation and the accel from
+	// before the pause, whatever the sensor does
+	p.Set(true, "test")
+	for i, s := range []IMUSample{moving, {Gyro: Vec3{Y: -3}, Accel: Vec3{X: standardGravity}}} {
+		out.Send(p.Apply(s))
+		m := nextMotion(t, conn)
+		if m.Gyro != (Vec3{}) || !near(m.Accel, Vec3{Z: -1}, 1e-6) {
+			t.Errorf("paused packet %d: gyro %+v accel %+v, want zero motion", i, m.Gyro, m.Accel)
+		}
+		if m.PktNo != uint32(i+2) {
+			t.Errorf("paused packet %d numbered %d: the slot is not kept alive", i, m.PktNo)
+		}
+	}
+	if clients, _ := out.Stats(); clients != 1 {
+		t.Errorf("%d clients while paused, want 1", clients)
+	}
+
+	// resuming sends motion again
+	p.Toggle("test")
+	out.Send(p.Apply(moving))
+	if m := nextMotion(t, conn); !near(m.Gyro, Vec3{X: 57.29578}, 1e-3) {
+		t.Errorf("after resuming: gyro %+v", m.Gyro)
+	}
+}
+
+func TestControlPause(t *testing.T) {
+	c, h, _ := newTestControl(t)
+	c.pause = &pauseSwitch{}
+	if rec := serve(h, "PUT", "/pause", `{"paused": true}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"paused":true`) {
+		t.Errorf("PUT /pause: %d %s", rec.Code, rec.Body)
+	}
+	if !c.pause.Paused() {
+		t.Error("not paused after PUT /pause")
+	}
+	if rec := serve(h, "GET", "/pause", ""); !strings.Contains(rec.Body.String(), `"paused":true`) {
+		t.Errorf("GET /pause: %s", rec.Body)
+	}
+	if rec := serve(h, "PUT", "/pause", `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT /pause without a state: %d", rec.Code)
+	}
+	c.pause.Toggle("SIGUSR2")
+	if c.pause.Paused() {
+		t.Error("still paused after a toggle")
+	}
+}
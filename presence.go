@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+const (
+	// devicePresentDebounce is how long a device that went away must be back before it is
+	// reopened; during suspend/resume the sysfs node can come and go several times.
+	devicePresentDebounce = 500 * time.Millisecond
+	// deviceAbsentDebounce is how long it must be missing before it is taken as gone.
+	deviceAbsentDebounce = time.Second
+)
+
+// presenceDebouncer tracks whether the IIO device is there, changing its stable state only
+// after the new state held for devicePresentDebounce or deviceAbsentDebounce. It starts
+// present.
+type presenceDebouncer struct {
+	present  bool // stable state
+	changing bool // the observed state differs from present since since
+	since    time.Time
+}
+
+func newPresenceDebouncer() *presenceDebouncer {
+	return &presenceDebouncer{present: true}
+}
+
+// Present is the stable state.
+func (d *presenceDebouncer) Present() bool { return d.present }
+
+// Settled reports whether the last observation agreed with the stable state.
+func (d *presenceDebouncer) Settled() bool { return !d.changing }
+
+// Update feeds whether the device is there at now and reports whether the stable state
+// changed.
+func (d *presenceDebouncer) Update(present bool, now time.Time) bool {
+	if present == d.present {
+		d.changing = false
+		return false
+	}
+	if !d.changing {
+		d.changing, d.since = true, now
+		return false
+	}
+	hold := deviceAbsentDebounce
+	if present {
+		hold = devicePresentDebounce
+	}
+	if now.Sub(d.since) < hold {
+		return false
+	}
+	d.present, d.changing = present, false
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresenceDebouncer(t *testing.T) {
+	// one observation every 100 ms: + present, - absent
+	const step = 100 * time.Millisecond
+	gone := "+" + strings.Repeat("-", 11) // missing from 100 ms, gone at 1.1 s
+	for _, tc := range []struct {
+		name        string
+		seen        string
+		changes     []int // observations at which the stable state flipped
+		wantPresent bool
+	}{
+		{"steady", "++++++", nil, true},
+		{"blips are not a disappearance", "+-+-+--+-+", nil, true},
+		{"gone after a second missing", gone, []int{11}, false},
+		{"not yet gone", gone[:11], nil, true},
+		{"flapping while suspending", "+--+---+" + strings.Repeat("-", 11), []int{18}, false},
+		{"back after half a second present", gone + "++++++", []int{11, 17}, true},
+		{"not yet back", gone + "+++++", []int{11}, false},
+		{"flickering on resume", gone + "+-+-++++++", []int{11, 21}, true},
+		{"gone again before settling back", gone + "+++-" + strings.Repeat("-", 10), []int{11}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newPresenceDebouncer()
+			start := time.Unix(1000, 0)
+			var changes []int
+			for i, c := range tc.seen {
+				if d.Update(c == '+', start.Add(time.Duration(i)*step)) {
+					changes = append(changes, i)
+				}
+			}
+			if !slices.Equal(changes, tc.changes) || d.Present() != tc.wantPresent {
+				t.Errorf("%s: changes at %v, present %v; want %v and %v", tc.seen, changes, d.Present(), tc.changes, tc.wantPresent)
+			}
+			// the last observation agreed with the final state in every case but the unsettled ones
+			if want := (tc.seen[len(tc.seen)-1] == '+') == d.Present(); d.Settled() != want {
+				t.Errorf("settled %v, want %v", d.Settled(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// resolvedConfig is what the bridge derives from the config for --print-config: the device
+// it would open, the rate it would run at, the scales it would end up with and the matrices
+// it would apply, plus where each setting came from.
+type resolvedConfig struct {
+	Device      string            `yaml:"device"`
+	Rate        float64           `yaml:"rate"`
+	GyroScale   []float64         `yaml:"gyro_scale,flow,omitempty"`
+	AccelScale  []float64         `yaml:"accel_scale,flow,omitempty"`
+	AccelMatrix *matrixYAML       `yaml:"accel_matrix,omitempty"`
+	GyroMatrix  *matrixYAML       `yaml:"gyro_matrix,omitempty"`
+	Sources     map[string]string `yaml:"sources,omitempty"`
+}
+
+// printEffectiveConfig writes cfg after the config file, profile, quirks, environment and
+// flags were merged, as a YAML document that loads as a config file, followed by a second
+// document with the resolvedConfig. Nothing is written to sysfs; scales are planned like
+// --check does. What the device lookup logs goes to stderr, keeping w a YAML stream.
+func printEffectiveConfig(w io.Writer, cfg *Config, rate float64, setScales, setRate bool) error {
+	res := resolvedConfig{Rate: rate, Sources: cfg.sources}
+
+	var dev *IIODevice
+	switch base, err := selectIIOBase(os.Stderr, cfg); {
+	case cfg.Source != "evdev" && err == nil:
+		if dev, err = openIIODevice(base); err != nil {
+			res.Device = fmt.Sprintf("%s (unusable: %v)", base, err)
+		}
+	case cfg.Source != "iio" && cfg.Source != "iio-buffer":
+		ev, err := openEvdevSource(cfg)
+		if err != nil {
+			res.Device = fmt.Sprintf("(none: %v)", err)
+			break
+		}
+		ev.Close()
+		res.Device = ev.Path
+		if ev.HaveGyro {
+			res.GyroScale = []float64{ev.GyroScale.X, ev.GyroScale.Y, ev.GyroScale.Z}
+		}
+		if ev.HaveAccel {
+			res.AccelScale = []float64{ev.AccelScale.X, ev.AccelScale.Y, ev.AccelScale.Z}
+		}
+	default:
+		res.Device = fmt.Sprintf("(none: %v)", err)
+	}
+	if dev != nil {
+		applySensorEnables(dev, *cfg.EnableGyro, *cfg.EnableAccel)
+		gyroDev, accelDev := openComplementary(os.Stderr, dev, *cfg.EnableGyro, *cfg.EnableAccel)
+		rates := sensorRatesFor(cfg, rate)
+		planDevice(dev, rates, setScales, setRate, cfg.ScalePolicy)
+		gyro, accel := dev, dev
+		if gyroDev != nil {
+			planDevice(gyroDev, rates, setScales, setRate, cfg.ScalePolicy)
+			gyro = gyroDev
+		}
+		if accelDev != nil {
+			planDevice(accelDev, rates, setScales, setRate, cfg.ScalePolicy)
+			accel = accelDev
+		}
+		res.Device = dev.Base
+		if gyro.HaveGyro {
+			res.GyroScale = []float64{gyro.GyroScale.X, gyro.GyroScale.Y, gyro.GyroScale.Z}
+		}
+		if accel.HaveAccel {
+			res.AccelScale = []float64{accel.AccelScale.X, accel.AccelScale.Y, accel.AccelScale.Z}
+		}
+		if rate == 0 {
+			res.Rate = deviceOutputRate(dev, gyroDev, accelDev)
+		}
+	}
+	if res.Rate == 0 {
+		res.Rate = defaultRate
+	}
+
+	if len(cfg.SourceDevices) > 0 {
+		// source_devices replaces the selection above; scales come from several devices
+		var parts []string
+		for _, sd := range cfg.SourceDevices {
+			parts = append(parts, fmt.Sprintf("%s (%s)", sourceDevicePath(sd.Path), strings.Join(sd.Roles, ",")))
+		}
+		res.Device, res.GyroScale, res.AccelScale = strings.Join(parts, ", "), nil, nil
+	}
+
+	accelMount, gyroMount, accelSrc, gyroSrc := resolveMatrices(cfg)
+	if accelSrc != "" {
+		m := toMatrixYAML(accelMount)
+		res.AccelMatrix = &m
+	}
+	if gyroSrc != "" {
+		m := toMatrixYAML(gyroMount)
+		res.GyroMatrix = &m
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	if err := enc.Encode(map[string]resolvedConfig{"resolved": res}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPrintEffectiveConfigRate(t *testing.T) {
+	base := useSysfs(t)
+	imu := map[string]string{
+		"in_anglvel_x_raw": "0", "in_anglvel_y_raw": "0", "in_anglvel_z_raw": "0", "in_anglvel_scale": "0.001",
+		"in_accel_x_raw": "0", "in_accel_y_raw": "0", "in_accel_z_raw": "0", "in_accel_scale": "0.01",
+	}
+	known := filepath.Join(base, "iio:device0")
+	writeAttrs(t, known, imu)
+	writeAttrs(t, known, map[string]string{"in_anglvel_sampling_frequency": "400", "in_accel_sampling_frequency": "100"})
+	unknown := filepath.Join(base, "iio:device1")
+	writeAttrs(t, unknown, imu)
+
+	for _, tc := range []struct {
+		name string
+		dir  string
+		rate float64 // what the user set, 0 for nothing
+		want float64
+	}{
+		{"device rate known: the slower sensor", known, 0, 100},
+		{"device rate unknown", unknown, 0, defaultRate},
+		{"user rate wins", known, 60, 60},
+	} {
+		cfg := runConfig(t, fmt.Sprintf("iio_path: %q\n", tc.dir))
+		var out bytes.Buffer
+		if err := printEffectiveConfig(&out, &cfg, tc.rate, false, false); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		dec := yaml.NewDecoder(&out)
+		var merged map[string]any
+		var doc struct{ Resolved resolvedConfig }
+		if err := dec.Decode(&merged); err != nil {
+			t.Fatalf("%s: config document: %v", tc.name, err)
+		}
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatalf("%s: resolved document: %v", tc.name, err)
+		}
+		res := doc.Resolved
+		if res.Device != tc.dir || res.Rate != tc.want {
+			t.Errorf("%s: resolved %s at %g Hz, want %s at %g", tc.name, res.Device, res.Rate, tc.dir, tc.want)
+		}
+	}
+}
+
+// TestPrintConfigPrecedence runs the test binary as the bridge (see mainArgsEnv) with a config
+// file, environment and flags all setting keys, and reads --print-config's output.
+func TestPrintConfigPrecedence(t *testing.T) {
+	if args := os.Getenv(mainArgsEnv); args != "" {
+		os.Args = append([]string{"iio-dsu-bridge"}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+	dir := t.TempDir()
+	base := filepath.Join(dir, "iio")
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(map[string]string{"name": "bmi323-imu"}, "anglvel", [3]int{}))
+	cfgPath := filepath.Join(dir, "config.yaml")
+	writeAttrs(t, dir, map[string]string{"config.yaml": `
+name: file-imu
+device_aliases: [bmi323]
+bind: 127.0.0.1:26761
+rate: 100
+gyro_deadzone: 0.5
+accel_rate: 62.5
+`})
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPrintConfigPrecedence$")
+	cmd.Env = append(os.Environ(),
+		mainArgsEnv+"="+strings.Join([]string{"--config", cfgPath, "--print-config", "--rate", "300", "--gyro-rate", "12.5hz"}, "\n"),
+		"HOME="+dir, "IIO_DSU_SYSFS_BASE="+base,
+		"IIO_DSU_NAME=env-imu", "IIO_DSU_RATE=200")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("--print-config: %v\n%s", err, &stderr)
+	}
+
+	// stdout is only YAML: the device lookup logs the alias match to stderr
+	dec := yaml.NewDecoder(&stdout)
+	var merged Config
+	var doc struct{ Resolved resolvedConfig }
+	if err := dec.Decode(&merged); err != nil {
+		t.Fatalf("config document: %v", err)
+	}
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatalf("resolved document: %v", err)
+	}
+	if !strings.Contains(stderr.String(), `matched alias "bmi323"`) {
+		t.Errorf("stderr lacks the alias match:\n%s", &stderr)
+	}
+
+	// flag over environment over file, and the file where nothing else sets a key
+	if merged.Rate != 300 || merged.Name != "env-imu" || merged.Bind != "127.0.0.1:26761" || merged.GyroDeadzone != 0.5 ||
+		merged.GyroRate != 12.5 || merged.AccelRate != 62.5 {
+		t.Errorf("merged rate %g name %q bind %q deadzone %g gyro_rate %g accel_rate %g",
+			merged.Rate, merged.Name, merged.Bind, merged.GyroDeadzone, merged.GyroRate, merged.AccelRate)
+	}
+	res := doc.Resolved
+	for key, want := range map[string]string{"rate": "--rate", "name": "$IIO_DSU_NAME", "bind": cfgPath, "gyro_deadzone": cfgPath, "gyro_rate": "--gyro-rate"} {
+		if got := res.Sources[key]; got != want {
+			t.Errorf("source of %s = %q, want %q", key, got, want)
+		}
+	}
+	if res.Rate != 300 || res.Device != filepath.Join(base, "iio:device0") {
+		t.Errorf("resolved %s at %g Hz", res.Device, res.Rate)
+	}
+}
+
+// mainArgsEnv, when set, makes TestPrintConfigPrecedence run main with these newline-separated
+// arguments instead of testing.
+const mainArgsEnv = "IIO_DSU_TEST_MAIN_ARGS"
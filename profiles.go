@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// profileConfig is one entry of the profiles map: the tuning that differs between uses of the
+// same device (docked, handheld, ...). Unset fields keep the top-level value. Profiles don't
+// select a device, so switching one never reopens it and DSU clients stay connected.
+type profileConfig struct {
+	MountMatrix     *matrixYAML    `yaml:"mount_matrix"`
+	AccelMatrix     *matrixYAML    `yaml:"accel_matrix"`
+	GyroMatrix      *matrixYAML    `yaml:"gyro_matrix"`
+	MountAxisAngle  *axisAngleYAML `yaml:"mount_axisangle"`
+	AccelAxisAngle  *axisAngleYAML `yaml:"accel_axisangle"`
+	GyroAxisAngle   *axisAngleYAML `yaml:"gyro_axisangle"`
+	GyroSensitivity *float64       `yaml:"gyro_sensitivity"`
+	GyroDeadzone    *float64       `yaml:"gyro_deadzone"`
+
+	GyroAxisSensitivity  []float64 `yaml:"gyro_axis_sensitivity,flow"`
+	AccelAxisSensitivity []float64 `yaml:"accel_axis_sensitivity,flow"`
+}
+
+// applyProfile overlays profile name onto cfg; "" applies none. Like a user config over a
+// quirk, a profile that sets any matrix replaces all of the top-level ones.
+func applyProfile(cfg *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q (have %v)", name, profileNames(cfg))
+	}
+	src := "profile " + name
+	if p.MountMatrix != nil || p.AccelMatrix != nil || p.GyroMatrix != nil ||
+		p.MountAxisAngle != nil || p.AccelAxisAngle != nil || p.GyroAxisAngle != nil {
+		cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z = nil, nil, nil
+		cfg.AccelMatrix.X, cfg.AccelMatrix.Y, cfg.AccelMatrix.Z = nil, nil, nil
+		cfg.GyroMatrix.X, cfg.GyroMatrix.Y, cfg.GyroMatrix.Z = nil, nil, nil
+		for _, k := range matrixKeys {
+			delete(cfg.sources, k)
+		}
+	}
+	if m := p.MountMatrix; m != nil {
+		cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z = m.X, m.Y, m.Z
+		cfg.noteSource("mount_matrix", src)
+	}
+	if m := p.AccelMatrix; m != nil {
+		cfg.AccelMatrix.X, cfg.AccelMatrix.Y, cfg.AccelMatrix.Z = m.X, m.Y, m.Z
+		cfg.noteSource("accel_matrix", src)
+	}
+	if m := p.GyroMatrix; m != nil {
+		cfg.GyroMatrix.X, cfg.GyroMatrix.Y, cfg.GyroMatrix.Z = m.X, m.Y, m.Z
+		cfg.noteSource("gyro_matrix", src)
+	}
+	for _, b := range []struct {
+		name, matrixName string
+		a                *axisAngleYAML
+		x, y, z          *[]float64
+	}{
+		{"mount_axisangle", "mount_matrix", p.MountAxisAngle, &cfg.MountMatrix.X, &cfg.MountMatrix.Y, &cfg.MountMatrix.Z},
+		{"accel_axisangle", "accel_matrix", p.AccelAxisAngle, &cfg.AccelMatrix.X, &cfg.AccelMatrix.Y, &cfg.AccelMatrix.Z},
+		{"gyro_axisangle", "gyro_matrix", p.GyroAxisAngle, &cfg.GyroMatrix.X, &cfg.GyroMatrix.Y, &cfg.GyroMatrix.Z},
+	} {
+		if b.a == nil {
+			continue
+		}
+		if err := axisAngleToBlock(b.name, b.matrixName, *b.a, b.x, b.y, b.z); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+		cfg.noteSource(b.name, src)
+	}
+	if p.GyroSensitivity != nil {
+		cfg.GyroSensitivity = p.GyroSensitivity
+		cfg.noteSource("gyro_sensitivity", src)
+	}
+	if p.GyroDeadzone != nil {
+		cfg.GyroDeadzone = *p.GyroDeadzone
+		cfg.noteSource("gyro_deadzone", src)
+	}
+	if p.GyroAxisSensitivity != nil {
+		cfg.GyroAxisSensitivity = p.GyroAxisSensitivity
+		cfg.noteSource("gyro_axis_sensitivity", src)
+	}
+	if p.AccelAxisSensitivity != nil {
+		cfg.AccelAxisSensitivity = p.AccelAxisSensitivity
+		cfg.noteSource("accel_axis_sensitivity", src)
+	}
+	return nil
+}
+
+func profileNames(cfg *Config) []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for n := range cfg.Profiles {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// profileSwitcher tracks the active profile and swaps it at runtime (PUT /profile, D-Bus
+// SelectProfile). A switch re-reads the config file with the new profile, like a reload.
+type profileSwitcher struct {
+	mu       sync.Mutex
+	active   string
+	settings *settingsStore
+	cfgPath  string
+	calPath  string
+}
+
+// Active returns the active profile name, "" for none.
+func (p *profileSwitcher) Active() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// Select makes name the active profile ("" for the top-level settings); the current settings
+// are kept if it fails.
+func (p *profileSwitcher) Select(name, why string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := reloadSettings(p.settings, p.cfgPath, p.calPath, name); err != nil {
+		return err
+	}
+	fmt.Printf("Profile %q -> %q (%s)\n", p.active, name, why)
+	p.active = name
+	return nil
+}
+
+// Reload re-reads the config file keeping the active profile (SIGHUP, ReloadConfig).
+func (p *profileSwitcher) Reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return reloadSettings(p.settings, p.cfgPath, p.calPath, p.active)
+}
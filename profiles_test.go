@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProfileSwitchSharedDevice(t *testing.T) {
+	// one device, docked upright or held flat
+	useQuirkDevice(t, "Generic PC", "")
+	path := filepath.Join(t.TempDir(), configFileName)
+	writeAttrs(t, filepath.Dir(path), map[string]string{configFileName: `name: bmi323-imu
+mount_matrix: {x: [1, 0, 0], y: [0, 1, 0], z: [0, 0, 1]}
+gyro_sensitivity: 1
+profiles:
+  docked:
+    mount_matrix: {x: [0, 1, 0], y: [1, 0, 0], z: [0, 0, 1]}
+    gyro_sensitivity: 2
+  handheld:
+    gyro_deadzone: 0.5
+`})
+	c, h, _ := newTestControl(t)
+	c.profiles = &profileSwitcher{settings: c.settings, cfgPath: path}
+	ls := c.settings.Load()
+	ls.AccelCutoffHz = 20 // from a flag: a switch keeps it
+	c.settings.Store(ls)
+	before := c.settings.Load()
+
+	if rec := serve(h, "PUT", "/profile", `{"profile": "docked"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"profile":"docked"`) {
+		t.Fatalf("PUT /profile docked: %d %s", rec.Code, rec.Body)
+	}
+	docked := c.settings.Load()
+	if docked.GyroMatrix != swapXY || docked.AccelMatrix != swapXY || docked.GyroSensitivity != 2 || docked.AccelCutoffHz != 20 {
+		t.Errorf("docked: %+v", docked)
+	}
+	// the swap replaces the settings as a whole; a reader holding the old ones is unaffected
+	if before.GyroMatrix != identityMatrix || before.GyroSensitivity != 1 {
+		t.Errorf("the previous settings were modified: %+v", before)
+	}
+
+	// handheld sets no matrix, so the top-level one applies again
+	if err := c.profiles.Select("handheld", "test"); err != nil {
+		t.Fatal(err)
+	}
+	handheld := c.settings.Load()
+	if handheld.GyroMatrix != identityMatrix || handheld.GyroSensitivity != 1 || handheld.GyroDeadzone != 0.5 {
+		t.Errorf("handheld: %+v", handheld)
+	}
+
+	// an unknown profile is refused and changes nothing
+	if rec := serve(h, "PUT", "/profile", `{"profile": "tent"}`); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `unknown profile "tent" (have [docked handheld])`) {
+		t.Errorf("PUT /profile tent: %d %s", rec.Code, rec.Body)
+	}
+	if c.profiles.Active() != "handheld" || c.settings.Load() != handheld {
+		t.Errorf("after a failed switch: profile %q", c.profiles.Active())
+	}
+
+	// "" goes back to the top-level settings; a reload keeps the active profile
+	if err := c.profiles.Select("docked", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.profiles.Reload(); err != nil || c.settings.Load().GyroMatrix != swapXY {
+		t.Errorf("reload with docked active: %v, %+v", err, c.settings.Load().GyroMatrix)
+	}
+	if err := c.profiles.Select("", "test"); err != nil || c.settings.Load().GyroMatrix != identityMatrix {
+		t.Errorf("no profile: %v, %+v", err, c.settings.Load().GyroMatrix)
+	}
+}
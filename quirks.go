@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dmiDir holds the firmware's product identification (product_name, product_version).
+var dmiDir = "/sys/class/dmi/id"
+
+// deviceQuirk is a known-good config for one handheld model. Config is YAML in the config
+// file format; it is loaded underneath the system and user configs, so any key they set wins.
+type deviceQuirk struct {
+	Name   string
+	Match  []string // substrings of the DMI product name or version; any one matches
+	Config string
+}
+
+// deviceQuirks is the built-in quirks table. To support another model, add an entry with the
+// DMI strings it reports and the config keys it needs.
+var deviceQuirks = []deviceQuirk{
+	{
+		Name:  "ROG Ally",
+		Match: []string{"RC71L"},
+		Config: `
+mount_matrix:
+    x: [1, 0, 0]
+    y: [0, -1, 0]
+    z: [0, 0, -1]
+`,
+	},
+	{
+		Name:  "Legion Go S",
+		Match: []string{"Legion Go S"},
+		Config: `
+accel_matrix:
+    x: [1, 0, 0]
+    y: [0, 1, 0]
+    z: [0, 0, -1]
+gyro_matrix:
+    x: [-1, 0, 0]
+    y: [0, 0, 1]
+    z: [0, 1, 0]
+`,
+	},
+}
+
+// matchDeviceQuirk returns the quirk for the DMI product strings, or nil.
+func matchDeviceQuirk(product string) *deviceQuirk {
+	for i := range deviceQuirks {
+		for _, m := range deviceQuirks[i].Match {
+			if strings.Contains(product, m) {
+				return &deviceQuirks[i]
+			}
+		}
+	}
+	return nil
+}
+
+// dmiProduct returns the DMI product name and version, or "" when they are not readable.
+func dmiProduct() string {
+	var parts []string
+	for _, f := range []string{"product_name", "product_version"} {
+		if b, err := os.ReadFile(filepath.Join(dmiDir, f)); err == nil {
+			parts = append(parts, strings.TrimSpace(string(b)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// matrixKeys are the config keys that together decide the mount matrices.
+var matrixKeys = []string{"mount_matrix", "accel_matrix", "gyro_matrix", "mount_axisangle", "accel_axisangle", "gyro_axisangle"}
+
+// dropQuirkMatrices clears the matrices that came from quirk src when a config file set any
+// matrix: a user mount_matrix must not end up underneath a quirk's accel_matrix.
+func (c *Config) dropQuirkMatrices(src string) {
+	userSet := false
+	for _, k := range matrixKeys {
+		if s, ok := c.sources[k]; ok && s != src {
+			userSet = true
+		}
+	}
+	if !userSet {
+		return
+	}
+	for _, k := range matrixKeys {
+		if c.sources[k] != src {
+			continue
+		}
+		switch k {
+		case "mount_matrix":
+			c.MountMatrix.X, c.MountMatrix.Y, c.MountMatrix.Z = nil, nil, nil
+		case "accel_matrix":
+			c.AccelMatrix.X, c.AccelMatrix.Y, c.AccelMatrix.Z = nil, nil, nil
+		case "gyro_matrix":
+			c.GyroMatrix.X, c.GyroMatrix.Y, c.GyroMatrix.Z = nil, nil, nil
+		case "mount_axisangle":
+			c.MountAxisAngle = nil
+		case "accel_axisangle":
+			c.AccelAxisAngle = nil
+		case "gyro_axisangle":
+			c.GyroAxisAngle = nil
+		}
+		delete(c.sources, k)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchDeviceQuirk(t *testing.T) {
+	for _, tc := range []struct {
+		product, want string
+	}{
+		{"ROG Ally RC71L_RC71L 1.0", "ROG Ally"},
+		{"83L3 Legion Go S 8APU1", "Legion Go S"},
+		{"Jupiter 1", ""},
+		{"", ""},
+	} {
+		got := ""
+		if q := matchDeviceQuirk(tc.product); q != nil {
+			got = q.Name
+		}
+		if got != tc.want {
+			t.Errorf("matchDeviceQuirk(%q) = %q, want %q", tc.product, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceQuirksValid(t *testing.T) {
+	for _, q := range deviceQuirks {
+		var c Config
+		if err := c.mergeYAML([]byte(q.Config), q.Name); err != nil {
+			t.Errorf("%s: %v", q.Name, err)
+			continue
+		}
+		if err := validateMatrices(&c); err != nil {
+			t.Errorf("%s: %v", q.Name, err)
+		}
+		if len(q.Match) == 0 {
+			t.Errorf("%s matches no device", q.Name)
+		}
+	}
+}
+
+// useQuirkDevice points the DMI and config lookups at a fixture for product, with the given
+// user config (none when empty).
+func useQuirkDevice(t *testing.T, product, userConfig string) {
+	t.Helper()
+	oldDMI, oldSys := dmiDir, systemConfigPath
+	t.Cleanup(func() { dmiDir, systemConfigPath = oldDMI, oldSys })
+	dir := t.TempDir()
+	dmiDir, systemConfigPath = filepath.Join(dir, "dmi"), filepath.Join(dir, "none.yaml")
+	writeAttrs(t, dmiDir, map[string]string{"product_name": product + "\n"})
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if userConfig != "" {
+		writeAttrs(t, filepath.Join(home, ".config"), map[string]string{configFileName: userConfig})
+	}
+}
+
+func TestQuirkDefaults(t *testing.T) {
+	useQuirkDevice(t, "83L3 Legion Go S", "")
+	cfg, _, err := loadConfigFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accel, gyro, accelSrc, gyroSrc := resolveMatrices(cfg)
+	if accelSrc != "accel_matrix" || accel != (MountMatrix{X: Vec3{X: 1}, Y: Vec3{Y: 1}, Z: Vec3{Z: -1}}) {
+		t.Errorf("accel matrix %+v from %q", accel, accelSrc)
+	}
+	if gyroSrc != "gyro_matrix" || gyro != (MountMatrix{X: Vec3{X: -1}, Y: Vec3{Z: 1}, Z: Vec3{Y: 1}}) {
+		t.Errorf("gyro matrix %+v from %q", gyro, gyroSrc)
+	}
+	if src := cfg.sources["gyro_matrix"]; src != "built-in quirks (Legion Go S)" {
+		t.Errorf("gyro_matrix source = %q", src)
+	}
+}
+
+func TestQuirkUserOverrides(t *testing.T) {
+	// a user key outside the matrices leaves the quirk matrices in place
+	useQuirkDevice(t, "83L3 Legion Go S", "name: bmi260\n")
+	cfg, _, err := loadConfigFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, a, g := resolveMatrices(cfg); a != "accel_matrix" || g != "gyro_matrix" || cfg.Name != "bmi260" {
+		t.Errorf("name %q, matrices from %q and %q", cfg.Name, a, g)
+	}
+
+	// a user mount_matrix replaces all of the quirk's matrices, even the more specific ones
+	useQuirkDevice(t, "83L3 Legion Go S", "mount_matrix:\n  x: [0, 1, 0]\n  y: [1, 0, 0]\n  z: [0, 0, 1]\n")
+	cfg, _, err = loadConfigFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accel, gyro, accelSrc, gyroSrc := resolveMatrices(cfg)
+	if accelSrc != "mount_matrix" || gyroSrc != "mount_matrix" || accel != swapXY || gyro != swapXY {
+		t.Errorf("accel %+v from %q, gyro %+v from %q; want the user mount_matrix", accel, accelSrc, gyro, gyroSrc)
+	}
+	if _, ok := cfg.sources["accel_matrix"]; ok {
+		t.Error("dropped quirk accel_matrix still listed as a config source")
+	}
+
+	// a user gyro_matrix alone also drops the quirk accel_matrix
+	useQuirkDevice(t, "83L3 Legion Go S", "gyro_matrix:\n  x: [1, 0, 0]\n  y: [0, 1, 0]\n  z: [0, 0, 1]\n")
+	cfg, _, err = loadConfigFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, gyro, accelSrc, _ := resolveMatrices(cfg); accelSrc != "" || gyro != identityMatrix {
+		t.Errorf("accel matrix from %q, gyro %+v", accelSrc, gyro)
+	}
+}
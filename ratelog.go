@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// repeatSummaryEvery is how often a message that keeps repeating is summarized.
+const repeatSummaryEvery = 5 * time.Second
+
+// dedupLogger writes messages to w but collapses runs of the same message: the first is
+// written as is, the repeats are counted and summarized at most every interval, and when a
+// different message arrives the pending count is flushed first. At 250 Hz a persistent read
+// error would otherwise print 250 identical lines a second.
+type dedupLogger struct {
+	w     io.Writer
+	every time.Duration
+
+	mu      sync.Mutex
+	last    string
+	repeats int
+	since   time.Time // last line written for the current message
+}
+
+func newDedupLogger(w io.Writer, every time.Duration) *dedupLogger {
+	return &dedupLogger{w: w, every: every}
+}
+
+// Printf formats a message (a trailing newline is added) and logs it unless it repeats the
+// previous one.
+func (l *dedupLogger) Printf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if msg == l.last {
+		l.repeats++
+		if now.Sub(l.since) >= l.every {
+			l.flush(now)
+		}
+		return
+	}
+	l.flush(now)
+	fmt.Fprintln(l.w, msg)
+	l.last, l.since = msg, now
+}
+
+// Clear ends the current run, e.g. once the failing operation succeeds again: the pending
+// repeat count is written and the next message is logged even if it is the same.
+func (l *dedupLogger) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last != "" {
+		l.flush(time.Now())
+		l.last = ""
+	}
+}
+
+// flush writes the pending repeat count, if any. Callers hold l.mu.
+func (l *dedupLogger) flush(now time.Time) {
+	if l.repeats > 0 {
+		fmt.Fprintf(l.w, "%s (repeated %d times in %.0fs)\n", l.last, l.repeats, now.Sub(l.since).Seconds())
+		l.repeats = 0
+	}
+	l.since = now
+}
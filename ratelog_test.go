@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupLoggerCollapsesRepeats(t *testing.T) {
+	var buf bytes.Buffer
+	l := newDedupLogger(&buf, time.Hour)
+	for range 250 {
+		l.Printf("read error: %s", "EIO")
+	}
+	if got := buf.String(); got != "read error: EIO\n" {
+		t.Fatalf("250 identical errors wrote %q", got)
+	}
+	// a different message flushes the count first, and is not collapsed into it
+	l.Printf("read error: %s", "ENODEV")
+	l.Printf("send failed")
+	l.Printf("read error: %s", "ENODEV")
+	want := []string{
+		"read error: EIO",
+		"read error: EIO (repeated 249 times in 0s)",
+		"read error: ENODEV",
+		"send failed",
+		"read error: ENODEV",
+	}
+	if got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("log:\n%s\nwant:\n%s", buf.String(), strings.Join(want, "\n"))
+	}
+}
+
+func TestDedupLoggerPeriodicSummary(t *testing.T) {
+	var buf bytes.Buffer
+	l := newDedupLogger(&buf, 20*time.Millisecond)
+	l.Printf("write failed")
+	l.Printf("write failed")
+	time.Sleep(25 * time.Millisecond)
+	// the repeat after the interval writes the summary of the run so far
+	l.Printf("write failed")
+	if got := buf.String(); got != "write failed\nwrite failed (repeated 2 times in 0s)\n" {
+		t.Errorf("log %q", got)
+	}
+}
+
+func TestDedupLoggerClear(t *testing.T) {
+	var buf bytes.Buffer
+	l := newDedupLogger(&buf, time.Hour)
+	l.Printf("read error")
+	l.Printf("read error")
+	// the read recovered: the count is written, and the same error later is logged again
+	l.Clear()
+	l.Printf("read error")
+	if got := buf.String(); got != "read error\nread error (repeated 1 times in 0s)\nread error\n" {
+		t.Errorf("log %q", got)
+	}
+	// clearing with nothing pending writes nothing
+	buf.Reset()
+	l.Clear()
+	l.Clear()
+	if buf.Len() != 0 {
+		t.Errorf("Clear wrote %q", buf.String())
+	}
+}
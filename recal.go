@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRecalibrateHold is how long the recalibrate button must be held.
+	defaultRecalibrateHold = 1500 * time.Millisecond
+	// recalibrateMinSamples is the fewest resting gyro samples a recalibration averages, for
+	// low output rates; otherwise it takes about a second's worth.
+	recalibrateMinSamples = 20
+	// recalibrateTimeout bounds how long a recalibration waits for the device to rest.
+	recalibrateTimeout = 10 * time.Second
+)
+
+// evKey is the input event type of buttons and keys.
+const evKey = 0x01
+
+// buttonCodes are the names accepted by recalibrate_button besides a number
+// (linux/input-event-codes.h).
+var buttonCodes = map[string]uint16{
+	"BTN_SELECT": 0x13a,
+	"BTN_START":  0x13b,
+	"BTN_MODE":   0x13c,
+	"BTN_THUMBL": 0x13d,
+	"BTN_THUMBR": 0x13e,
+	"BTN_TL":     0x136,
+	"BTN_TR":     0x137,
+	"BTN_TL2":    0x138,
+	"BTN_TR2":    0x139,
+}
+
+// parseButtonCode accepts a name from buttonCodes or a key code such as 316 or 0x13c.
+func parseButtonCode(s string) (uint16, error) {
+	if c, ok := buttonCodes[strings.ToUpper(s)]; ok {
+		return c, nil
+	}
+	n, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown button %q (want a key code or one of BTN_MODE, BTN_SELECT, BTN_START, ...)", s)
+	}
+	return uint16(n), nil
+}
+
+// buttonWatcher reports long presses of one key on an evdev device, e.g. a handheld's
+// gamepad node. The motion source is separate; this only watches the button.
+type buttonWatcher struct {
+	code uint16
+	hold time.Duration
+	f    *os.File
+
+	// LongPress receives a value each time the key has been held for hold
+	LongPress chan struct{}
+	timer     *time.Timer
+}
+
+func openButtonWatcher(path string, code uint16, hold time.Duration) (*buttonWatcher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &buttonWatcher{code: code, hold: hold, f: f, LongPress: make(chan struct{}, 1)}
+	go w.run(f)
+	return w, nil
+}
+
+// run decodes events from r until it fails.
+func (w *buttonWatcher) run(r io.Reader) {
+	buf := make([]byte, inputEventSize*64)
+	for {
+		n, err := io.ReadAtLeast(r, buf, inputEventSize)
+		for off := 0; off+inputEventSize <= n; off += inputEventSize {
+			_, typ, code, value := decodeInputEvent(buf[off : off+inputEventSize])
+			w.handleEvent(typ, code, value)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: recalibrate button: %v\n", err)
+			return
+		}
+	}
+}
+
+// handleEvent starts the hold timer on press and cancels it on release; autorepeat (value 2)
+// is ignored.
+func (w *buttonWatcher) handleEvent(typ, code uint16, value int32) {
+	if typ != evKey || code != w.code {
+		return
+	}
+	switch value {
+	case 1:
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		w.timer = time.AfterFunc(w.hold, func() {
+			select {
+			case w.LongPress <- struct{}{}:
+			default:
+			}
+		})
+	case 0:
+		if w.timer != nil {
+			w.timer.Stop()
+			w.timer = nil
+		}
+	}
+}
+
+func (w *buttonWatcher) Close() error { return w.f.Close() }
+
+// gyroRecalibration re-measures the gyro bias on request: it waits for the device to rest and
+// averages the resting gyro, like a console controller's recalibrate button.
+type gyroRecalibration struct {
+	samples  int // resting samples to average
+	active   bool
+	deadline time.Time
+	sum      Vec3
+	n        int
+}
+
+// newGyroRecalibration returns a recalibration for samples arriving at rate Hz.
+func newGyroRecalibration(rate float64) *gyroRecalibration {
+	return &gyroRecalibration{samples: max(recalibrateMinSamples, int(math.Round(rate)))}
+}
+
+// Start begins a recalibration, restarting one in progress.
+func (r *gyroRecalibration) Start(now time.Time) {
+	*r = gyroRecalibration{samples: r.samples, active: true, deadline: now.Add(recalibrateTimeout)}
+	fmt.Printf("Gyro recalibration: put the device down and don't touch it (up to %v)...\n", recalibrateTimeout)
+}
+
+// Update feeds one gyro sample (before bias correction) and whether the device rests. Once
+// enough resting samples are in it returns their mean and done; moving restarts the average.
+func (r *gyroRecalibration) Update(gyro Vec3, still bool, now time.Time) (bias Vec3, done bool) {
+	if !r.active {
+		return Vec3{}, false
+	}
+	if now.After(r.deadline) {
+		r.active = false
+		fmt.Fprintf(os.Stderr, "WARNING: gyro recalibration abandoned: the device did not rest within %v\n", recalibrateTimeout)
+		return Vec3{}, false
+	}
+	if !still {
+		r.sum, r.n = Vec3{}, 0
+		return Vec3{}, false
+	}
+	r.sum = r.sum.Add(gyro)
+	if r.n++; r.n < r.samples {
+		return Vec3{}, false
+	}
+	r.active = false
+	bias = r.sum.Scale(1 / float64(r.n))
+	b := bias.Scale(180 / math.Pi)
+	fmt.Printf("Gyro recalibrated: bias (% .3f,% .3f,% .3f) deg/s\n", b.X, b.Y, b.Z)
+	return bias, true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseButtonCode(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"BTN_MODE", 0x13c, false},
+		{"btn_select", 0x13a, false},
+		{"316", 316, false},
+		{"0x13c", 0x13c, false},
+		{"BTN_NOPE", 0, true},
+		{"70000", 0, true},
+		{"", 0, true},
+	} {
+		got, err := parseButtonCode(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseButtonCode(%q) = %#x, %v; want %#x, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestButtonLongPressStartsRecalibration(t *testing.T) {
+	const hold = 30 * time.Millisecond
+	w := &buttonWatcher{code: buttonCodes["BTN_MODE"], hold: hold, LongPress: make(chan struct{}, 1)}
+	pressed := func() bool {
+		select {
+		case <-w.LongPress:
+			return true
+		case <-time.After(3 * hold):
+			return false
+		}
+	}
+
+	// the watcher reads events as they come, like from an event node
+	r, pw := io.Pipe()
+	go w.run(r)
+	send := func(code uint16, value int32) {
+		var ev evStream
+		ev.event(0, evKey, code, value)
+		if _, err := pw.Write(ev.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a tap, another key held and autorepeat are not long presses
+	send(w.code, 1)
+	send(w.code, 0)
+	send(buttonCodes["BTN_START"], 1)
+	send(w.code, 2)
+	if pressed() {
+		t.Fatal("long press from a tap")
+	}
+
+	// holding the key is; the main loop then starts a recalibration that completes after
+	// about a second of resting samples at the output rate
+	send(w.code, 1)
+	if !pressed() {
+		t.Fatal("no long press after holding the key")
+	}
+	recal := newGyroRecalibration(250)
+	now := time.Now()
+	recal.Start(now)
+	bias := Vec3{X: 0.01, Y: -0.02}
+	for i := range 249 {
+		if _, done := recal.Update(bias, true, now.Add(time.Duration(i)*4*time.Millisecond)); done {
+			t.Fatalf("done after %d samples", i+1)
+		}
+	}
+	if got, done := recal.Update(bias, true, now.Add(time.Second)); !done || !near(got, bias, 1e-12) {
+		t.Errorf("after 250 resting samples: %+v, %v", got, done)
+	}
+}
+
+func TestRecalibrationSamplesFollowRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate float64
+		want int
+	}{
+		{250, 250},
+		{1000, 1000},
+		{12.5, recalibrateMinSamples},
+		{0, recalibrateMinSamples},
+		{66.6, 67},
+	} {
+		r := newGyroRecalibration(tc.rate)
+		now := time.Now()
+		r.Start(now)
+		n := 0
+		for done := false; !done && n < 5000; {
+			n++
+			_, done = r.Update(Vec3{}, true, now)
+		}
+		if n != tc.want {
+			t.Errorf("at %g Hz: done after %d samples, want %d", tc.rate, n, tc.want)
+		}
+	}
+
+	// moving restarts the count; giving up after the timeout
+	r := newGyroRecalibration(50)
+	now := time.Now()
+	r.Start(now)
+	for range 49 {
+		r.Update(Vec3{}, true, now)
+	}
+	if _, done := r.Update(Vec3{X: 1}, false, now); done {
+		t.Error("done on a moving sample")
+	}
+	for range 49 {
+		if _, done := r.Update(Vec3{}, true, now); done {
+			t.Fatal("done before a full resting run after moving")
+		}
+	}
+	if _, done := r.Update(Vec3{}, true, now.Add(recalibrateTimeout+time.Second)); done || r.active {
+		t.Error("recalibration kept going past its timeout")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// defaultRecenterRampMs is how long a recenter eases the fused heading to straight ahead
+// (recenter_ramp_ms); 0 snaps it.
+const defaultRecenterRampMs = 300
+
+// headingRecenter turns the heading (yaw) of the fused orientation so that where the device
+// points when a recenter is requested becomes straight ahead. The correction is ramped over
+// rampUS of sample time with a smoothstep, so a viewer eases to center instead of jumping.
+// Request may be called from any goroutine; Apply belongs to the output loop.
+type headingRecenter struct {
+	pending atomic.Bool
+	rampUS  uint64 // 0 = instant
+
+	offset   float64 // yaw correction applied now, radians
+	from, to float64 // ramp from offset from to to, starting at startTS
+	startTS  uint64
+}
+
+func newHeadingRecenter(rampMs int) *headingRecenter {
+	return &headingRecenter{rampUS: uint64(rampMs) * 1000}
+}
+
+// Request recenters at the next sample and logs it; why names the trigger.
+func (r *headingRecenter) Request(why string) {
+	r.pending.Store(true)
+	fmt.Printf("Recenter requested (%s)\n", why)
+}
+
+// Apply returns q with the heading correction, starting a recenter first if one was requested.
+func (r *headingRecenter) Apply(q Quat, tsUS uint64) Quat {
+	if r.pending.Swap(false) {
+		_, _, yaw := q.EulerDeg()
+		// from wherever the current ramp has got to by now, even if no sample came in between
+		r.from, r.to, r.startTS = r.rampedOffset(tsUS), -yaw*math.Pi/180, tsUS
+		// turn the short way round
+		r.to = r.from + math.Remainder(r.to-r.from, 2*math.Pi)
+	}
+	r.offset = r.rampedOffset(tsUS)
+	if r.offset == 0 {
+		return q
+	}
+	// a rotation about the world Z axis, applied after q, only changes the yaw
+	return quatFromAxisAngle(Vec3{Z: 1}, r.offset).Mul(q).Normalize()
+}
+
+// rampedOffset is the correction at tsUS along the current ramp.
+func (r *headingRecenter) rampedOffset(tsUS uint64) float64 {
+	if r.offset == r.to || r.rampUS == 0 || tsUS < r.startTS {
+		return r.to
+	}
+	t := float64(tsUS-r.startTS) / float64(r.rampUS)
+	if t >= 1 {
+		return r.to
+	}
+	return r.from + (r.to-r.from)*t*t*(3-2*t)
+}
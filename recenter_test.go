@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// yawQuat is a device turned yaw degrees about the vertical, after rolling it roll degrees.
+func yawQuat(yaw, roll float64) Quat {
+	return quatFromAxisAngle(Vec3{Z: 1}, yaw*math.Pi/180).Mul(quatFromAxisAngle(Vec3{X: 1}, roll*math.Pi/180))
+}
+
+func TestHeadingRecenterInstant(t *testing.T) {
+	r := newHeadingRecenter(0)
+	q := yawQuat(40, 20)
+	if got := r.Apply(q, 1000); got != q {
+		t.Errorf("before a request: %+v, want q unchanged", got)
+	}
+	r.Request("test")
+	roll, _, yaw := r.Apply(q, 2000).EulerDeg()
+	if math.Abs(yaw) > 1e-9 || math.Abs(roll-20) > 1e-9 {
+		t.Errorf("instant recenter: roll %g yaw %g, want 20 and 0", roll, yaw)
+	}
+	// the correction stays: turning on by 10 degrees reads as 10
+	if _, _, yaw := r.Apply(yawQuat(50, 20), 3000).EulerDeg(); math.Abs(yaw-10) > 1e-9 {
+		t.Errorf("after turning 10 degrees: yaw %g", yaw)
+	}
+}
+
+func TestHeadingRecenterRamp(t *testing.T) {
+	const rampMs, stepUS = 300, 10_000
+	r := newHeadingRecenter(rampMs)
+	q := yawQuat(40, 20)
+	r.Apply(q, 0)
+	r.Request("test")
+	start := uint64(1_000_000)
+	prev := 40.0
+	for ts := start; ts <= start+2*rampMs*1000; ts += stepUS {
+		roll, _, yaw := r.Apply(q, ts).EulerDeg()
+		elapsed := float64(ts-start) / 1000
+		switch {
+		case math.Abs(roll-20) > 1e-9:
+			t.Fatalf("%g ms: roll %g, the recenter must only turn the heading", elapsed, roll)
+		case yaw > prev+1e-9:
+			t.Fatalf("%g ms: yaw %g went back up from %g", elapsed, yaw, prev)
+		// a smoothstep is at most 1.5 times as steep as a straight ramp
+		case prev-yaw > 1.5*40*stepUS/(rampMs*1000)+1e-9:
+			t.Fatalf("%g ms: yaw jumped from %g to %g", elapsed, prev, yaw)
+		case elapsed < rampMs && yaw < 1e-9:
+			t.Fatalf("%g ms: centered before the %d ms ramp is over", elapsed, rampMs)
+		case elapsed >= rampMs && math.Abs(yaw) > 1e-9:
+			t.Fatalf("%g ms: yaw %g, want centered once the ramp is over", elapsed, yaw)
+		}
+		// eases in and out: slow at both ends, halfway at half time
+		if elapsed == rampMs/2 && math.Abs(yaw-20) > 1e-9 {
+			t.Errorf("halfway: yaw %g, want 20", yaw)
+		}
+		prev = yaw
+	}
+}
+
+func TestHeadingRecenterDuringRamp(t *testing.T) {
+	// a second request mid-ramp starts from the correction reached, without a jump
+	r := newHeadingRecenter(100)
+	r.Apply(yawQuat(40, 0), 0)
+	r.Request("first")
+	r.Apply(yawQuat(40, 0), 1000)
+	_, _, before := r.Apply(yawQuat(40, 0), 50_000).EulerDeg()
+	r.Request("second")
+	_, _, after := r.Apply(yawQuat(40, 0), 50_000).EulerDeg()
+	if math.Abs(after-before) > 1e-9 {
+		t.Errorf("second request at the same time: yaw %g, was %g", after, before)
+	}
+	if _, _, yaw := r.Apply(yawQuat(40, 0), 200_000).EulerDeg(); math.Abs(yaw) > 1e-9 {
+		t.Errorf("after the second ramp: yaw %g", yaw)
+	}
+}
+
+func TestHeadingRecenterShortWay(t *testing.T) {
+	// centered at 170 degrees, then turned 20 more past the ±180 seam: the new correction
+	// is 20 degrees on, not 340 back
+	r := newHeadingRecenter(100)
+	r.Request("first")
+	r.Apply(yawQuat(170, 0), 0)
+	r.Request("second")
+	r.Apply(yawQuat(-170, 0), 1_000_000)
+	prev := 20.0
+	for ts := uint64(1_000_000); ts <= 1_200_000; ts += 5000 {
+		_, _, yaw := r.Apply(yawQuat(-170, 0), ts).EulerDeg()
+		if yaw > prev+1e-9 || prev-yaw > 2 {
+			t.Fatalf("%d us: yaw %g after %g, want an easy turn from 20 to 0", ts-1_000_000, yaw, prev)
+		}
+		prev = yaw
+	}
+	if math.Abs(prev) > 1e-9 {
+		t.Errorf("yaw %g after the ramp", prev)
+	}
+}
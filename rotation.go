@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// screenRotation follows the display of convertible handhelds (screen_rotation, PUT
+// /rotation): when the screen turns, motion is turned with it about the screen normal (DSU Z)
+// so "right" stays right on screen. It is composed after the mount matrix and survives
+// config reloads and profile switches, which only change the matrices under it.
+type screenRotation struct {
+	deg atomic.Int32
+}
+
+// validRotation reports whether deg is a screen rotation: 0, 90, 180 or 270.
+func validRotation(deg int) bool {
+	return deg == 0 || deg == 90 || deg == 180 || deg == 270
+}
+
+// Set changes the rotation and logs it; why names the trigger.
+func (r *screenRotation) Set(deg int, why string) error {
+	if !validRotation(deg) {
+		return fmt.Errorf("screen rotation must be 0, 90, 180 or 270 (got %d)", deg)
+	}
+	if old := r.deg.Swap(int32(deg)); int(old) != deg {
+		fmt.Printf("Screen rotation %d -> %d degrees (%s)\n", old, deg, why)
+	}
+	return nil
+}
+
+func (r *screenRotation) Degrees() int { return int(r.deg.Load()) }
+
+// rotationMatrix returns the rotation by deg (a multiple of 90) counter-clockwise about Z,
+// with exact 0 and ±1 entries.
+func rotationMatrix(deg int) MountMatrix {
+	var c, s float64
+	switch deg {
+	case 0:
+		c = 1
+	case 90:
+		s = 1
+	case 180:
+		c = -1
+	case 270:
+		s = -1
+	}
+	return MountMatrix{
+		X: Vec3{c, s, 0},
+		Y: Vec3{-s, c, 0},
+		Z: Vec3{0, 0, 1},
+	}
+}
+
+// Apply turns a mount-adjusted sample into the rotated screen's frame.
+func (r *screenRotation) Apply(s IMUSample) IMUSample {
+	deg := r.Degrees()
+	if deg == 0 {
+		return s
+	}
+	m := rotationMatrix(deg)
+	s.Gyro, s.Accel = m.Apply(s.Gyro), m.Apply(s.Accel)
+	return s
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestScreenRotationApply(t *testing.T) {
+	in := IMUSample{Gyro: Vec3{1, 2, 3}, Accel: Vec3{0.5, -1, 0.25}}
+	for _, tc := range []struct {
+		deg         int
+		gyro, accel Vec3
+	}{
+		{0, Vec3{1, 2, 3}, Vec3{0.5, -1, 0.25}},
+		{90, Vec3{2, -1, 3}, Vec3{-1, -0.5, 0.25}},
+		{180, Vec3{-1, -2, 3}, Vec3{-0.5, 1, 0.25}},
+		{270, Vec3{-2, 1, 3}, Vec3{1, 0.5, 0.25}},
+	} {
+		var r screenRotation
+		if err := r.Set(tc.deg, "test"); err != nil {
+			t.Fatal(err)
+		}
+		// the entries are exact, so no rounding creeps in
+		if got := r.Apply(in); got.Gyro != tc.gyro || got.Accel != tc.accel {
+			t.Errorf("%d degrees: gyro %+v accel %+v, want %+v and %+v", tc.deg, got.Gyro, got.Accel, tc.gyro, tc.accel)
+		}
+		// composed after the mount matrix: the mount swaps X and Y first
+		mount := MountMatrix{X: Vec3{0, 1, 0}, Y: Vec3{1, 0, 0}, Z: Vec3{0, 0, 1}}
+		want := rotationMatrix(tc.deg).Apply(Vec3{2, 1, 3})
+		if got := r.Apply(IMUSample{Gyro: mount.Apply(in.Gyro)}).Gyro; got != want {
+			t.Errorf("%d degrees after the mount: %+v, want %+v", tc.deg, got, want)
+		}
+	}
+
+	// quarter turns add up
+	for deg := 0; deg < 360; deg += 90 {
+		for step := 0; step < 360; step += 90 {
+			got := mulMatrix(rotationMatrix(step), rotationMatrix(deg))
+			if want := rotationMatrix((deg + step) % 360); got != want {
+				t.Errorf("%d then %d degrees: %v, want %v", deg, step, got, want)
+			}
+		}
+	}
+
+	var r screenRotation
+	r.Set(90, "test")
+	if err := r.Set(45, "test"); err == nil || r.Degrees() != 90 {
+		t.Errorf("Set(45) = %v, rotation now %d; want an error and 90 kept", err, r.Degrees())
+	}
+}
+
+func TestControlRotation(t *testing.T) {
+	c, h, _ := newTestControl(t)
+	c.rotation = &screenRotation{}
+	if rec := serve(h, "GET", "/rotation", ""); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"rotation":0}` {
+		t.Errorf("GET /rotation: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(h, "PUT", "/rotation", `{"rotation": 270}`); rec.Code != http.StatusOK || c.rotation.Degrees() != 270 {
+		t.Errorf("PUT 270: %d %s, rotation %d", rec.Code, rec.Body, c.rotation.Degrees())
+	}
+	for _, body := range []string{`{"rotation": 45}`, `{}`, `270`} {
+		if rec := serve(h, "PUT", "/rotation", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: got %d, want 400", body, rec.Code)
+		}
+	}
+	if c.rotation.Degrees() != 270 {
+		t.Errorf("rejected PUTs changed the rotation to %d", c.rotation.Degrees())
+	}
+}
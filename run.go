@@ -0,0 +1,942 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Options are the run-time switches of Run that are not part of the config file: debug
+// output, one-shot modes and the values main resolved from flags.
+type Options struct {
+	// ConfigPath is the config file the settings came from ("" for none); reloads, profile
+	// switches and --auto-mount write back to it
+	ConfigPath string
+
+	// Rate is the output rate in Hz; 0 with RateFromDevice follows the sensor
+	Rate           float64
+	RateNative     bool // --rate native
+	RateFromDevice bool // no rate configured anywhere
+	PhaseLock      bool
+	Interpolate    bool // smooth upsampled output, see sampleInterpolator
+	SetScales      bool
+	SetRate        bool
+	Force          bool // run even if another instance holds the device
+
+	LogEvery         int
+	DebugRaw         bool
+	DebugDSU         bool
+	DebugCalib       bool
+	DebugOrientation bool
+	DebugLinearAccel bool
+	DumpPackets      bool
+	TUI              bool
+	OrientationUDP   string
+
+	MaxDropRate float64
+	DropAction  string
+
+	UDPDSCP      int
+	UDPTTL       int
+	WriteTimeout time.Duration
+	StrictCRC    bool
+	DBus         bool
+	SynthAccel   bool
+
+	AutoMount      bool
+	CalibrateFull  bool
+	CheckAlignment bool // compare the gyro with the accel frame and exit
+	TestPattern    bool // send testPattern instead of reading the sensor
+
+	// Reader, when set, is polled instead of the primary device once that is set up, so tests
+	// can script the sensor; the rest of the pipeline runs as for the device
+	Reader SampleReader
+}
+
+// exitError is an error from Run with the process exit code main should use.
+type exitError struct {
+	code int
+	err  error
+	hint string // lines printed after the error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func exitErrorf(code int, format string, args ...any) error {
+	return &exitError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// Run opens the device described by config, configures it and streams DSU until ctx is
+// cancelled (nil) or something fails. main only parses flags, environment and the config
+// file and calls it.
+func Run(ctx context.Context, config Config, opts Options) error {
+	cfg := &config
+	rate, logEvery, cfgPath := opts.Rate, opts.LogEvery, opts.ConfigPath
+
+	// Elegir device: IIO unless --source=evdev; auto falls back to evdev without IIO
+	var dev, gyroDev, accelDev *IIODevice
+	var evdev *EvdevDevice
+	var src SampleReader
+	var iioBuf *IIOBufferDevice // src with --source iio-buffer; replaced by bus error resets
+	var hasWorkingGyro, hasWorkingAccel bool
+	gyroUnit, accelUnit := rawUnitFactors(cfg)
+	rates := sensorRatesFor(cfg, rate) // sampling rates to write; the output rate may differ
+	iioBase := ""
+	var multi *multiSource // source_devices, replacing the automatic split merge
+	var clip *clipDetector // IIO sources only
+	if len(cfg.SourceDevices) > 0 && cfg.Source != "evdev" && !opts.TestPattern {
+		var err error
+		if multi, err = openMultiSource(cfg.SourceDevices, *cfg.EnableGyro, *cfg.EnableAccel); err != nil {
+			return exitErrorf(exitDeviceNotFound, "source_devices: %v", err)
+		}
+		iioBase = multi.parts[0].dev.Base
+	} else if cfg.Source != "evdev" && !opts.TestPattern {
+		base, err := selectIIOBase(os.Stdout, cfg)
+		var missing *iioMissingError
+		if errors.As(err, &missing) {
+			if cfg.Source != "auto" {
+				return &exitError{code: exitDeviceNotFound, err: err}
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+			fmt.Println("No IIO device; looking for an evdev motion device")
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "IIO device not found (name=%q). Tip: try --list-iio or --iio-path=%s/iio:deviceX\n", cfg.Name, sysfsBase)
+			listIIODevices(os.Stdout)
+			if cfg.Source != "auto" {
+				return exitErrorf(exitDeviceNotFound, "IIO device not found")
+			}
+			fmt.Println("No IIO device; looking for an evdev motion device")
+		}
+		iioBase = base
+	}
+	if opts.TestPattern {
+		fmt.Fprintf(os.Stderr, "WARNING: TEST PATTERN (--test-pattern): the sensor is ignored; sending a %d degree yaw swing every %v\n",
+			testPatternAmplitude, testPatternPeriod)
+		src = newTestPattern(time.Now())
+		hasWorkingGyro, hasWorkingAccel = true, true
+	} else if iioBase == "" {
+		var err error
+		if evdev, err = openEvdevSource(cfg); err != nil {
+			return exitErrorf(exitDeviceNotFound, "evdev: %v", err)
+		}
+		defer evdev.Close()
+		lock, err := lockDevice(evdev.Path, opts.Force)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		fmt.Printf("evdev source: %s (%s)\n", evdev.Path, evdev.Name)
+		fmt.Printf("HaveGyro=%v GyroScale=(%.6g,%.6g,%.6g)  HaveAccel=%v AccelScale=(%.6g,%.6g,%.6g)\n",
+			evdev.HaveGyro, evdev.GyroScale.X, evdev.GyroScale.Y, evdev.GyroScale.Z,
+			evdev.HaveAccel, evdev.AccelScale.X, evdev.AccelScale.Y, evdev.AccelScale.Z)
+		src = evdev
+		hasWorkingGyro, hasWorkingAccel = evdev.HaveGyro, evdev.HaveAccel
+	} else {
+		var err error
+		if multi != nil {
+			dev = multi.parts[0].dev
+		} else if dev, err = openIIODevice(iioBase); err != nil {
+			return exitErrorf(exitDeviceNotFound, "openIIODevice: %v", err)
+		}
+		// before anything is written to sysfs
+		lock, err := lockDevice(iioBase, opts.Force)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		fmt.Printf("IIO base: %s (%s)\n", iioBase, dev.Label)
+		if p, err := filepath.EvalSymlinks(iioBase); err == nil {
+			fmt.Printf("DSU slot 0 -> %s\n", p)
+		}
+		fmt.Printf("HaveGyro=%v GyroScale=(%.6f,%.6f,%.6f)  HaveAccel=%v AccelScale=(%.6f,%.6f,%.6f)\n",
+			dev.HaveGyro, dev.GyroScale.X, dev.GyroScale.Y, dev.GyroScale.Z,
+			dev.HaveAccel, dev.AccelScale.X, dev.AccelScale.Y, dev.AccelScale.Z)
+		if dev.GyroOffset != (Vec3{}) || dev.AccelOffset != (Vec3{}) {
+			fmt.Printf("Raw offsets: gyro=(%g,%g,%g) accel=(%g,%g,%g)\n",
+				dev.GyroOffset.X, dev.GyroOffset.Y, dev.GyroOffset.Z,
+				dev.AccelOffset.X, dev.AccelOffset.Y, dev.AccelOffset.Z)
+		}
+
+		// If the selected IIO device is split (accel-only or gyro-only), try to open the complementary device.
+		applySensorEnables(dev, *cfg.EnableGyro, *cfg.EnableAccel)
+		var others []*IIODevice // opened besides dev
+		if multi != nil {
+			others = multi.devices()[1:]
+		} else {
+			gyroDev, accelDev = openComplementary(os.Stdout, dev, *cfg.EnableGyro, *cfg.EnableAccel)
+			others = []*IIODevice{gyroDev, accelDev}
+		}
+		for _, d := range others {
+			if d == nil {
+				continue
+			}
+			lock, err := lockDevice(d.Base, opts.Force)
+			if err != nil {
+				return err
+			}
+			defer lock.Release()
+		}
+
+		// Configure scales and rates for all devices (primary + secondary)
+		configureDevice(dev, rates, opts.SetScales, opts.SetRate, cfg.ScalePolicy)
+		if gyroDev != nil {
+			configureDevice(gyroDev, rates, opts.SetScales, opts.SetRate, cfg.ScalePolicy)
+			fmt.Printf("Secondary gyro device: %s (%s) GyroScale=(%.6f,%.6f,%.6f)\n",
+				gyroDev.Base, gyroDev.Label, gyroDev.GyroScale.X, gyroDev.GyroScale.Y, gyroDev.GyroScale.Z)
+		}
+		if accelDev != nil {
+			configureDevice(accelDev, rates, opts.SetScales, opts.SetRate, cfg.ScalePolicy)
+			fmt.Printf("Secondary accel device: %s (%s) AccelScale=(%.6f,%.6f,%.6f)\n",
+				accelDev.Base, accelDev.Label, accelDev.AccelScale.X, accelDev.AccelScale.Y, accelDev.AccelScale.Z)
+		}
+		if multi != nil {
+			for i, p := range multi.parts {
+				if i > 0 {
+					configureDevice(p.dev, rates, opts.SetScales, opts.SetRate, cfg.ScalePolicy)
+				}
+				fmt.Printf("Source device: %s (%s) roles=%s\n", p.dev.Base, p.dev.Label, strings.Join(cfg.SourceDevices[i].Roles, ","))
+			}
+		}
+		// after configuring: gyro_rate or accel_rate may have changed it
+		if opts.RateFromDevice {
+			if hz := deviceOutputRate(dev, gyroDev, accelDev); hz > 0 {
+				rate = hz
+				fmt.Printf("Output rate: %g Hz, the sensor's sampling rate (set --rate to change)\n", hz)
+			}
+		}
+		for _, d := range append([]*IIODevice{dev}, others...) {
+			if d == nil {
+				continue
+			}
+			for _, msg := range implausibleScales(d, gyroUnit, accelUnit) {
+				fmt.Fprintf(os.Stderr, "WARNING: %s\n", msg)
+			}
+		}
+		src = dev
+		if multi != nil {
+			src = multi
+		}
+		clip = newClipDetector()
+		all := [3]bool{true, true, true}
+		if multi != nil {
+			for _, p := range multi.parts {
+				clip.watch(p.dev, p.axes.Gyro, p.axes.Accel)
+			}
+		} else {
+			clip.watch(dev, all, all)
+			if gyroDev != nil {
+				clip.watch(gyroDev, all, [3]bool{})
+			}
+			if accelDev != nil {
+				clip.watch(accelDev, [3]bool{}, all)
+			}
+		}
+		if cfg.Source == "iio-buffer" {
+			if gyroDev != nil || accelDev != nil || multi != nil {
+				return exitErrorf(exitConfig, "source iio-buffer needs accel and gyro on one device; %s has only one", dev.Base)
+			}
+			iioBuf, err = openIIOBuffer(dev, cfg.BufferDrain, cfg.BufferDev)
+			if err != nil {
+				return exitErrorf(exitFailure, "iio buffer: %v", err)
+			}
+			defer func() { iioBuf.Close() }()
+			fmt.Printf("Buffered source: %s (%s), %d-byte scans with %s hardware timestamps, sending the %s of each tick\n", dev.Base, iioBuf.f.Name(), iioBuf.scanSize, iioBuf.ts.clock, cfg.BufferDrain)
+			src = iioBuf
+		}
+
+		// Validate we have working sensors after configuration
+		hasWorkingGyro = (dev.HaveGyro && dev.GyroScale.X != 0) ||
+			(gyroDev != nil && gyroDev.GyroScale.X != 0)
+		hasWorkingAccel = (dev.HaveAccel && dev.AccelScale.X != 0) ||
+			(accelDev != nil && accelDev.AccelScale.X != 0)
+		if multi != nil {
+			hasWorkingGyro, hasWorkingAccel = multi.covers()
+		}
+	}
+	if opts.Reader != nil {
+		src = opts.Reader
+	}
+
+	if rate == 0 {
+		rate = defaultRate
+		if opts.RateFromDevice {
+			fmt.Printf("Output rate: %g Hz (the sensor's sampling rate is unknown)\n", rate)
+		}
+	}
+	cfg.Rate = rate
+
+	// Output tick: free-running at --rate, or locked to the sensor's native rate
+	tickPeriod := time.Duration(float64(time.Second) / rate)
+	if opts.RateNative || opts.PhaseLock {
+		native := sensorNativeRate(dev, gyroDev, accelDev)
+		if native <= 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: sensor sampling rate is unknown; running free at %g Hz\n", rate)
+		} else {
+			target := rate
+			if opts.RateNative {
+				target = native
+			}
+			hz, div := phaseLockedRate(native, target)
+			tickPeriod = time.Duration(float64(time.Second) / hz)
+			rate = hz
+			fmt.Printf("Output locked to the sensor: %.4g Hz (native %g Hz / %d)\n", hz, native, div)
+		}
+	}
+
+	// the complementary devices of a split sensor, as readers; nil interfaces when not split
+	var gyroReader, accelReader SampleReader
+	if gyroDev != nil {
+		gyroReader = gyroDev
+	}
+	if accelDev != nil {
+		accelReader = accelDev
+	}
+
+	if cfg.WarmupSamples > 0 || cfg.WarmupMs > 0 {
+		readers := []SampleReader{src}
+		if gyroReader != nil {
+			readers = append(readers, gyroReader)
+		}
+		if accelReader != nil {
+			readers = append(readers, accelReader)
+		}
+		n, d := warmUp(readers, cfg.WarmupSamples, cfg.WarmupMs, rate)
+		fmt.Printf("Warm-up: discarded %d samples over %v\n", n, d.Round(time.Millisecond))
+	}
+
+	if !hasWorkingGyro && *cfg.EnableGyro {
+		fmt.Fprintf(os.Stderr, "WARNING: No working gyroscope found (scale=0). Motion controls will not work!\n")
+		fmt.Fprintf(os.Stderr, "         Try running with elevated permissions or check if the device driver is loaded.\n")
+	}
+	if !hasWorkingAccel && *cfg.EnableAccel {
+		fmt.Fprintf(os.Stderr, "WARNING: No working accelerometer found (scale=0). Motion controls will not work!\n")
+		fmt.Fprintf(os.Stderr, "         Try running with elevated permissions or check if the device driver is loaded.\n")
+	}
+
+	// Check if any matrix is configured (config file is required)
+	accelMount, gyroMount, accelSrc, gyroSrc := resolveMatrices(cfg)
+	if accelSrc == "" && gyroSrc == "" && !opts.AutoMount && !opts.TestPattern {
+		where := cfgPath
+		if where == "" {
+			where = "~/.config/" + configFileName
+		}
+		return &exitError{code: exitNoMatrix, err: errors.New("No mount matrix configured."), hint: fmt.Sprintf(
+			"Please create a config file at %s\n"+
+				"Example configs for supported devices:\n"+
+				"  - Legion Go S: https://github.com/Sebalvarez97/iio-dsu-bridge/blob/main/examples/legion-go-s.yaml\n"+
+				"  - ROG Ally:    https://github.com/Sebalvarez97/iio-dsu-bridge/blob/main/examples/rog-ally.yaml\n", where)}
+	}
+
+	printSummary(os.Stdout, dev, gyroDev, accelDev, evdev, accelMount, gyroMount, accelSrc, gyroSrc, rate)
+
+	if cfg.GyroSensitivity != nil && *cfg.GyroSensitivity <= 0 {
+		return exitErrorf(exitConfig, "gyro_sensitivity must be > 0 (got %g)", *cfg.GyroSensitivity)
+	}
+	calPath := calibrationPath(cfg, cfgPath)
+	cal, err := loadCalibration(calPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "calibration: %v", err)
+	}
+	if cal.AccelCorrection != nil || cal.GyroCorrection != nil {
+		fmt.Printf("Calibration: %s\n", calPath)
+	}
+	settings := &settingsStore{}
+	ls, _ := newLiveSettings(cfg, cal)
+	settings.Store(ls)
+
+	// readIMU reads one sensor-frame sample: primary device, merged with the complementary
+	// split device, swapped if configured
+	tsg := newTSGuard(tickPeriod)
+	var skew skewStats // complementary minus primary timestamp, split devices only
+	readIMU := func() (IMUSample, error) {
+		s, err := readMerged(src, gyroReader, accelReader, cfg.SplitTimestamp, &skew)
+		if err != nil {
+			return s, err
+		}
+		if clip != nil {
+			clip.Check(s, time.Now())
+		}
+		s.TSus = tsg.Fix(s.TSus)
+		// Swap before anything else looks at the sample; each vector keeps the scale of the
+		// channel it was read from
+		if cfg.SwapAccelGyro {
+			s.Gyro, s.Accel = s.Accel, s.Gyro
+			s.RawGyro, s.RawAccel = s.RawAccel, s.RawGyro
+		}
+		// drivers that report deg/s or g (gyro_raw_units, accel_raw_units)
+		if !opts.TestPattern {
+			s.Gyro, s.Accel = s.Gyro.Scale(gyroUnit), s.Accel.Scale(accelUnit)
+		}
+		return s, nil
+	}
+
+	if opts.AutoMount {
+		rest, err := newRestDetector(cfg)
+		var m MountMatrix
+		if err == nil {
+			m, err = runAutoMount(readIMU, rest, rate)
+		}
+		if err != nil {
+			return exitErrorf(exitFailure, "auto mount: %v", err)
+		}
+		fmt.Printf("Auto mount matrix: %s\n", formatMatrix(m))
+		fmt.Fprintf(os.Stderr, "WARNING: gravity fixes tilt but not yaw: if turning the device left/right moves the wrong axis,\n")
+		fmt.Fprintf(os.Stderr, "         swap or negate the x and y rows of mount_matrix.\n")
+		mm := toMatrixYAML(m)
+		cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z = mm.X, mm.Y, mm.Z
+		if cfg.AccelMatrix.X != nil || cfg.GyroMatrix.X != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: accel_matrix/gyro_matrix still take precedence over the derived mount_matrix\n")
+		}
+		if cfgPath == "" {
+			cfgPath = userConfigPath()
+		}
+		if cfgPath == "" {
+			fmt.Fprintf(os.Stderr, "WARNING: no config file to save the matrix to (use --config)\n")
+		} else if err := updateConfigFile(cfgPath, map[string]any{"mount_matrix": mm}); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: could not save mount_matrix to %s: %v\n", cfgPath, err)
+		} else {
+			fmt.Printf("mount_matrix saved to %s\n", cfgPath)
+		}
+		ls, _ = newLiveSettings(cfg, cal)
+		settings.Store(ls)
+	}
+
+	if opts.CalibrateFull {
+		rest, err := newRestDetector(cfg)
+		if err == nil {
+			minQ := float64(defaultCalibrationMinQuality)
+			if q := cfg.CalibrationMinQuality; q != nil {
+				if *q < 0 || *q > 100 {
+					return exitErrorf(exitConfig, "calibration_min_quality must be between 0 and 100 (got %g)", *q)
+				}
+				minQ = *q
+			}
+			err = runCalibrateFull(readIMU, ls, rest, rate, calPath, minQ)
+		}
+		if err != nil {
+			return exitErrorf(exitFailure, "calibration: %v", err)
+		}
+		return nil
+	}
+
+	if opts.CheckAlignment {
+		if !hasWorkingGyro || !hasWorkingAccel {
+			return exitErrorf(exitFailure, "alignment check: needs both a gyro and an accelerometer")
+		}
+		if err := runCheckAlignment(readIMU, ls, rate); err != nil {
+			return exitErrorf(exitFailure, "alignment check: %v", err)
+		}
+		return nil
+	}
+
+	if cfg.Profile != "" {
+		fmt.Printf("Profile: %s\n", cfg.Profile)
+	}
+	profiles := &profileSwitcher{active: cfg.Profile, settings: settings, cfgPath: cfgPath, calPath: cfg.CalibrationFile}
+
+	// SIGHUP re-reads the config file and swaps in its matrices/sensitivity/deadzone
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := profiles.Reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "SIGHUP reload: %v\n", err)
+			} else {
+				fmt.Printf("Reloaded settings from %s\n", cfgPath)
+			}
+		}
+	}()
+
+	// SIGUSR2 pauses/resumes motion output
+	pause := &pauseSwitch{}
+	rotation := &screenRotation{}
+	if !validRotation(cfg.ScreenRotation) {
+		return exitErrorf(exitConfig, "screen_rotation must be 0, 90, 180 or 270 (got %d)", cfg.ScreenRotation)
+	}
+	rotation.deg.Store(int32(cfg.ScreenRotation))
+	if cfg.ScreenRotation != 0 {
+		fmt.Printf("Screen rotation: %d degrees\n", cfg.ScreenRotation)
+	}
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			pause.Toggle("SIGUSR2")
+		}
+	}()
+
+	var recenter *headingRecenter // only the fused orientation has a heading to recenter
+	if opts.DebugOrientation || opts.OrientationUDP != "" {
+		recenter = newHeadingRecenter(*cfg.RecenterRampMs)
+	}
+	// SIGQUIT prints the last samples sent, instead of Go's goroutine dump and exit; once Run
+	// returns it is Go's again
+	history := newSampleHistory(*cfg.HistorySize)
+	if history != nil {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGQUIT)
+		defer signal.Stop(quit)
+		go func() {
+			for range quit {
+				history.Dump(os.Stderr)
+			}
+		}()
+	}
+
+	// the control API and D-Bus ask for a gyro recalibration like a long press of the button does
+	recalRequest := make(chan struct{}, 1)
+	if opts.DBus {
+		device, label := iioBase, ""
+		if evdev != nil {
+			device, label = evdev.Path, evdev.Name
+		} else if opts.TestPattern {
+			device = "test-pattern"
+		} else if dev != nil {
+			label = dev.Label
+		}
+		svc := &dbusService{settings: settings, cfgPath: cfgPath, profiles: profiles, device: device, label: label, rate: int(math.Round(rate)), recenter: recenter, recalibrate: recalRequest}
+		if err := startDBusService(svc); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: D-Bus service not available: %v\n", err)
+		} else {
+			fmt.Printf("D-Bus service %s on the session bus\n", dbusName)
+		}
+	}
+
+	var gravSynth *gravitySynth
+	if opts.SynthAccel {
+		if hasWorkingAccel && *cfg.EnableAccel {
+			fmt.Println("--synth-accel ignored: a working accelerometer is present")
+		} else {
+			gravSynth = newGravitySynth()
+			fmt.Fprintf(os.Stderr, "WARNING: accel values are SYNTHETIC (--synth-accel): gravity is integrated from the gyro, assuming the device starts flat and still\n")
+		}
+	}
+
+	rest, err := newRestDetector(cfg)
+	if err != nil {
+		return exitErrorf(exitConfig, "%v", err)
+	}
+
+	var biasEst *gyroBiasEstimator
+	if cfg.GyroBiasRate < 0 {
+		return exitErrorf(exitConfig, "gyro_bias_rate must not be negative (got %g)", cfg.GyroBiasRate)
+	}
+	if cfg.GyroBiasRate > 0 {
+		biasEst = newGyroBiasEstimator(cfg.GyroBiasRate)
+		fmt.Printf("Online gyro bias correction at %g/s while resting\n", cfg.GyroBiasRate)
+	}
+	var recalButtonPress <-chan struct{}
+	if cfg.RecalibrateButton != "" {
+		code, err := parseButtonCode(cfg.RecalibrateButton)
+		if err == nil && cfg.RecalibrateButtonDevice == "" {
+			err = errors.New("recalibrate_button_device is not set")
+		}
+		if err != nil {
+			return exitErrorf(exitConfig, "recalibrate_button: %v", err)
+		}
+		hold := defaultRecalibrateHold
+		if cfg.RecalibrateHoldMs > 0 {
+			hold = time.Duration(cfg.RecalibrateHoldMs) * time.Millisecond
+		}
+		bw, err := openButtonWatcher(cfg.RecalibrateButtonDevice, code, hold)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: recalibrate button: %v; continuing without it\n", err)
+		} else {
+			defer bw.Close()
+			recalButtonPress = bw.LongPress
+			fmt.Printf("Hold %s on %s for %v to recalibrate the gyro\n", cfg.RecalibrateButton, cfg.RecalibrateButtonDevice, hold)
+		}
+	}
+	if biasEst == nil && (recalButtonPress != nil || cfg.ControlAddr != "" || opts.DBus) {
+		// a fixed bias (rate 0) that only a recalibration sets, for anything that can ask for one
+		biasEst = newGyroBiasEstimator(0)
+	}
+	recal := newGyroRecalibration(rate)
+	fmt.Printf("Pipeline: %s\n", settings.Load().pipeline(biasEst != nil))
+
+	if *cfg.GravityCutoffHz < 0 || cfg.AccelCutoffHz < 0 {
+		return exitErrorf(exitConfig, "gravity_cutoff_hz and accel_cutoff_hz must not be negative")
+	}
+	// same reading, two filters: a smooth gravity estimate for fusion, a light one for DSU.
+	// The cutoffs are live settings (PATCH /settings); the loop retunes the filters each tick
+	gravityLP := newVecLowPass(*cfg.GravityCutoffHz)
+	accelLP := newVecLowPass(cfg.AccelCutoffHz)
+	if cfg.AccelCutoffHz > 0 {
+		fmt.Printf("DSU accel low-pass at %g Hz\n", cfg.AccelCutoffHz)
+	}
+
+	var linAccel *linearAccelFilter
+	if opts.DebugLinearAccel {
+		linAccel = newLinearAccelFilter(linearAccelCutoffHz)
+	}
+
+	var orientation *orientationFilter
+	if opts.DebugOrientation || opts.OrientationUDP != "" {
+		orientation = newOrientationFilter()
+	}
+	var oriStream *orientationStream
+	if opts.OrientationUDP != "" {
+		var err error
+		if oriStream, err = newOrientationStream(opts.OrientationUDP); err != nil {
+			return exitErrorf(exitConfig, "--orientation-udp: %v", err)
+		}
+		defer oriStream.Close()
+		fmt.Printf("Streaming orientation to %s (JSON over UDP)\n", opts.OrientationUDP)
+	}
+
+	if gyroUnit != 1 || accelUnit != 1 {
+		fmt.Printf("Raw units overridden: gyro in %s, accel in %s\n", cmp.Or(cfg.GyroRawUnits, "rad_s"), cmp.Or(cfg.AccelRawUnits, "m_s2"))
+	}
+	if cfg.SwapAccelGyro {
+		fmt.Fprintf(os.Stderr, "WARNING: swap_accel_gyro is enabled: accel channels are treated as gyro and vice versa\n")
+	}
+
+	// DSU outputs: one on bind unless outputs lists several (Yuzu/Cemuhook expect port 26760)
+	if cfg.Bind == "" {
+		cfg.Bind = "127.0.0.1"
+	}
+	outCfgs := cfg.Outputs
+	if len(outCfgs) == 0 {
+		outCfgs = []outputConfig{{Bind: cfg.Bind}}
+	}
+	var outputs []Output
+	var servers []*DSUServer
+	for _, oc := range outCfgs {
+		if oc.Bind == "" {
+			oc.Bind = cfg.Bind
+		}
+		srv, err := listenDSU(oc.Bind)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		out := newDSUOutput(srv, oc)
+		if out.convention != nil {
+			fmt.Printf("  with its own convention: X=%v Y=%v Z=%v\n", oc.Convention.X, oc.Convention.Y, oc.Convention.Z)
+		}
+		if out.linear != nil {
+			fmt.Println("  sending linear accel (gravity removed)")
+		}
+		accelUnits := cmp.Or(oc.AccelUnits, cfg.OutputAccelUnits, "g")
+		gyroUnits := cmp.Or(oc.GyroUnits, cfg.OutputGyroUnits, "deg_s")
+		if err := srv.SetUnits(accelUnits, gyroUnits); err != nil {
+			return exitErrorf(exitConfig, "%v", err)
+		}
+		if accelUnits != "g" || gyroUnits != "deg_s" {
+			fmt.Printf("  sending accel in %s and gyro in %s (not standard DSU units)\n", accelUnits, gyroUnits)
+		}
+		outputs = append(outputs, out)
+		servers = append(servers, srv)
+	}
+	model := dsuModelFor(hasWorkingGyro && *cfg.EnableGyro, (hasWorkingAccel && *cfg.EnableAccel) || gravSynth != nil)
+	var connType uint8
+	switch {
+	case opts.TestPattern:
+		connType = dsuConnUSB
+	case evdev != nil:
+		connType = detectConnType(evdev.SysPath)
+	default:
+		connType = detectConnType(dev.Base)
+	}
+	mac, _ := parseMAC(cfg.ControllerMAC) // checked by main
+	switch {
+	case cfg.ControllerMAC != "":
+	case opts.TestPattern:
+		mac = deriveMAC("test-pattern")
+	case evdev != nil:
+		mac = deriveMAC(deviceIdentity(evdev.SysPath, evdev.Name))
+	default:
+		mac = deriveMAC(deviceIdentity(dev.Base, ""))
+	}
+	for _, srv := range servers {
+		srv.SetIdentity(model, connType)
+		srv.SetMAC(mac)
+		srv.SetPacketDump(opts.DumpPackets)
+	}
+	fmt.Printf("DSU identity: model=%d connection=%d mac=%s\n", model, connType, net.HardwareAddr(mac[:]))
+	if opts.UDPDSCP != 0 || opts.UDPTTL != 0 {
+		for _, srv := range servers {
+			if err := srv.SetQoS(opts.UDPDSCP, opts.UDPTTL); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: could not set UDP QoS (dscp=%d ttl=%d): %v\n", opts.UDPDSCP, opts.UDPTTL, err)
+			} else {
+				fmt.Printf("UDP QoS: dscp=%d ttl=%d\n", opts.UDPDSCP, opts.UDPTTL)
+			}
+		}
+	}
+
+	if opts.WriteTimeout != dsuWriteTimeout {
+		for _, srv := range servers {
+			srv.SetWriteTimeout(opts.WriteTimeout)
+		}
+	}
+	for _, srv := range servers {
+		srv.SetStrictCRC(opts.StrictCRC)
+	}
+
+	if cfg.ControlAddr != "" {
+		addr, err := startControlServer(cfg.ControlAddr, &controlServer{settings: settings, cfgPath: cfgPath, pause: pause, profiles: profiles, rotation: rotation, history: history, recenter: recenter, recalibrate: recalRequest, servers: servers})
+		if err != nil {
+			return exitErrorf(exitBindFailed, "control API: %v", err)
+		}
+		fmt.Printf("Control API listening on http://%s\n", addr)
+	}
+
+	var mon *monitor
+	if opts.TUI {
+		mon = &monitor{}
+		logEvery = 0 // the monitor owns stdout
+		go mon.run(servers)
+	}
+
+	// Main loop at fixed rate
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+
+	var interp *sampleInterpolator
+	if opts.Interpolate && !opts.TestPattern {
+		interp = &sampleInterpolator{}
+		msg := "Interpolating between sensor samples (adds about one sensor period of latency)"
+		if native := sensorNativeRate(dev, gyroDev, accelDev); native > 0 && rate <= native {
+			msg += fmt.Sprintf("; it only helps when the output rate (%g Hz) exceeds the sensor's (%g Hz)", rate, native)
+		}
+		fmt.Println(msg)
+	}
+	patternTag := ""
+	if opts.TestPattern {
+		patternTag = "  [TEST PATTERN]"
+	}
+	count := 0
+	var zeroGyro zeroGyroWatch
+	gravityChecked := false
+	drops := newDropCounter(tickPeriod)
+	lastSendDrops := sendDrops(servers) // per-client send drops when the drop window opened
+	readErrLog := newDedupLogger(os.Stderr, repeatSummaryEvery)
+	var busErrs busErrorWatch
+	presence := newPresenceDebouncer()
+	readFailed := false
+	// resetDevice replaces the primary IIO device (and its buffer) after repeated bus errors
+	resetDevice := func() error {
+		if multi != nil {
+			if err := multi.reset(rates, opts.SetScales, opts.SetRate, cfg.ScalePolicy, *cfg.EnableGyro, *cfg.EnableAccel); err != nil {
+				return err
+			}
+			dev = multi.parts[0].dev
+			return nil
+		}
+		d, err := resetIIODevice(iioBase, rates, opts.SetScales, opts.SetRate, cfg.ScalePolicy, *cfg.EnableGyro, *cfg.EnableAccel)
+		if err != nil {
+			return err
+		}
+		if iioBuf != nil {
+			iioBuf.Close()
+			b, err := openIIOBuffer(d, cfg.BufferDrain, cfg.BufferDev)
+			if err != nil {
+				return fmt.Errorf("iio buffer: %w", err)
+			}
+			iioBuf, src = b, b
+		} else {
+			src = d
+		}
+		dev = d
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("Shutting down")
+			return nil
+		case <-ticker.C:
+		}
+		now := time.Now()
+		drops.Tick(now)
+		if pct, ok := drops.Window(now); ok {
+			cur := sendDrops(servers)
+			if r := sendDropReport(lastSendDrops, cur); r != "" {
+				fmt.Fprintf(os.Stderr, "WARNING: DSU packets dropped over the last %v because the send failed or timed out: %s\n", dropWindow, r)
+			}
+			lastSendDrops = cur
+			if opts.MaxDropRate > 0 && pct > opts.MaxDropRate {
+				fmt.Fprintf(os.Stderr, "WARNING: %.1f%% of output ticks dropped over the last %v (%d in total); the loop can't keep up with %g Hz, try a lower --rate\n",
+					pct, dropWindow, drops.Total, rate)
+				if opts.DropAction == "exit" {
+					return exitErrorf(exitFailure, "too many dropped ticks (--drop-action exit)")
+				}
+			}
+		}
+		// a device that vanished (suspend, unbind) is reopened once it has been back for a while
+		if iioBase != "" && (readFailed || !presence.Settled() || !presence.Present()) {
+			if presence.Update(fileExists(iioBase), now) {
+				if presence.Present() {
+					fmt.Printf("Device %s is back; reopening it\n", iioBase)
+					if err := resetDevice(); err != nil {
+						fmt.Fprintf(os.Stderr, "WARNING: reopening %s failed: %v\n", iioBase, err)
+					}
+					busErrs.errs = 0
+				} else {
+					fmt.Printf("Device %s is gone; waiting for it to come back\n", iioBase)
+				}
+			}
+			if !presence.Present() {
+				continue
+			}
+		}
+		s, err := readIMU()
+		readFailed = err != nil
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				readErrLog.Printf("readSample: %v", err)
+			}
+			// the chip usually needs its configuration again after a bus glitch
+			if iioBase != "" {
+				if n := busErrs.Fail(err); n > 0 {
+					fmt.Fprintf(os.Stderr, "WARNING: %d bus errors in a row reading %s; resetting the device (reset #%d)\n", n, iioBase, busErrs.resets)
+					if err := resetDevice(); err != nil {
+						fmt.Fprintf(os.Stderr, "WARNING: device reset failed: %v\n", err)
+					}
+				}
+			}
+			continue
+		}
+		readErrLog.Clear()
+		if n := busErrs.OK(); n > 0 {
+			fmt.Printf("Device reads recovered after %d reset(s)\n", n)
+		}
+		if interp != nil {
+			s = interp.Update(s, now)
+		}
+
+		// Debug: show raw values before mount matrix transformation
+		if opts.DebugRaw && logEvery > 0 && count%logEvery == 0 {
+			fmt.Printf("RAW  G(rad/s)=(% .5f,% .5f,% .5f)  A(m/s^2)=(% .3f,% .3f,% .3f)  counts G=%v A=%v\n",
+				s.Gyro.X, s.Gyro.Y, s.Gyro.Z, s.Accel.X, s.Accel.Y, s.Accel.Z, s.RawGyro, s.RawAccel)
+		}
+
+		// Apply calibration, then separate mount matrices for gyro and accel
+		ls := settings.Load()
+		if !opts.TestPattern { // already in the DSU frame
+			s = ls.applyMatrices(s)
+			s = rotation.Apply(s)
+		}
+		if gravSynth != nil {
+			s.Accel = gravSynth.Update(s.Gyro, s.TSus)
+		}
+		gravityLP.SetCutoff(ls.GravityCutoffHz)
+		s.Gravity = gravityLP.Update(s.Accel, s.TSus)
+		still := rest.Update(s.Gyro, s.Accel, s.TSus)
+		if still && !gravityChecked && hasWorkingAccel && gravSynth == nil {
+			// once, at the first rest: catch the common inverted-Z matrix mistake
+			gravityChecked = true
+			desc, inverted := describeRestingGravity(s.Gravity)
+			fmt.Printf("Resting %s\n", desc)
+			if inverted {
+				fmt.Fprintf(os.Stderr, "WARNING: gravity looks inverted. If the device is lying screen up, negate the z row of accel_matrix\n")
+				fmt.Fprintf(os.Stderr, "         (or mount_matrix), e.g. z: [0, 0, 1] -> z: [0, 0, -1].\n")
+			}
+		}
+		select {
+		case <-recalButtonPress:
+			recal.Start(now)
+		case <-recalRequest:
+			recal.Start(now)
+		default:
+		}
+		if bias, done := recal.Update(s.Gyro, still, now); done {
+			biasEst.bias = bias
+		}
+		// Warn if gyro stays zero for extended period (likely misconfigured). Checked before the
+		// bias is subtracted, which would make a dead gyro read non-zero
+		if n := zeroGyro.Update(*cfg.EnableGyro && s.Gyro == (Vec3{})); n > 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: Gyro has been zero for %d samples. Check device scales or permissions.\n", n)
+		}
+		if biasEst != nil {
+			s.Gyro = s.Gyro.Sub(biasEst.Update(s.Gyro, still, s.TSus))
+		}
+		var q Quat
+		if orientation != nil {
+			q = recenter.Apply(orientation.Update(s.Gyro, s.Gravity, s.TSus), s.TSus)
+		}
+		var lin Vec3
+		if linAccel != nil {
+			lin = linAccel.Update(s.Accel, s.TSus)
+		}
+
+		s.Gyro = ls.applyGyroTuning(s.Gyro)
+		accelLP.SetCutoff(ls.AccelCutoffHz)
+		s.Accel = accelLP.Update(s.Accel, s.TSus)
+
+		if logEvery > 0 {
+			count++
+			if count%logEvery == 0 {
+				fmt.Printf("IMU  ts=%d  G(rad/s)=(% .5f,% .5f,% .5f)  A(m/s^2)=(% .3f,% .3f,% .3f)%s\n",
+					s.TSus, s.Gyro.X, s.Gyro.Y, s.Gyro.Z, s.Accel.X, s.Accel.Y, s.Accel.Z, patternTag)
+				if opts.DebugRaw && skew.n > 0 {
+					fmt.Printf("SKEW split devices: %v (timestamp: %s)\n", &skew, cfg.SplitTimestamp)
+				}
+			}
+		}
+
+		// Debug: show DSU packet values (in g and deg/s)
+		if opts.DebugDSU && logEvery > 0 && count%logEvery == 0 {
+			const rad2deg = 180.0 / math.Pi
+			ax := s.Accel.X / 9.80665
+			ay := s.Accel.Y / 9.80665
+			az := s.Accel.Z / 9.80665
+			gx := s.Gyro.X * rad2deg
+			gy := s.Gyro.Y * rad2deg
+			gz := s.Gyro.Z * rad2deg
+			fmt.Printf("DSU  G(deg/s)=(% .2f,% .2f,% .2f)  A(g)=(% .3f,% .3f,% .3f)\n",
+				gx, gy, gz, ax, ay, az)
+		}
+
+		if opts.DebugCalib && logEvery > 0 && count%logEvery == 0 {
+			v := rest.Verdict()
+			state := "moving"
+			if v.Still {
+				state = "still"
+			} else if v.StillFor > 0 {
+				state = "settling"
+			}
+			fmt.Printf("CAL  %-8s for %.2fs  accelErr=%.3f m/s^2  gyroVar=%.4f (deg/s)^2\n",
+				state, v.StillFor, v.AccelErr, v.GyroVar)
+			if biasEst != nil {
+				b := biasEst.bias.Scale(180 / math.Pi)
+				fmt.Printf("CAL  gyro bias (deg/s)=(% .3f,% .3f,% .3f)\n", b.X, b.Y, b.Z)
+			}
+		}
+
+		if linAccel != nil && logEvery > 0 && count%logEvery == 0 {
+			fmt.Printf("LIN  A(m/s^2)=(% .3f,% .3f,% .3f)  |A|=%.3f\n", lin.X, lin.Y, lin.Z, lin.Norm())
+		}
+
+		if oriStream != nil {
+			oriStream.Send(q, s.TSus, time.Now())
+		}
+		if opts.DebugOrientation && logEvery > 0 && count%logEvery == 0 {
+			roll, pitch, yaw := q.EulerDeg()
+			fmt.Printf("ORI  q=(% .4f,% .4f,% .4f,% .4f)  roll=% .1f pitch=% .1f yaw=% .1f\n",
+				q.W, q.X, q.Y, q.Z, roll, pitch, yaw)
+		}
+
+		s = pause.Apply(s)
+		for _, out := range outputs {
+			out.Send(s)
+		}
+		if history != nil {
+			history.Add(s, now)
+		}
+		if mon != nil {
+			mon.publish(s, rest.Verdict(), ls, drops.Total, pause.Paused())
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runConfig parses a config file body and fills in the defaults main sets for keys it
+// leaves out.
+func runConfig(t *testing.T, body string) Config {
+	t.Helper()
+	var cfg Config
+	if err := cfg.mergeYAML([]byte(body), "test.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.EnableGyro == nil {
+		on := true
+		cfg.EnableGyro = &on
+	}
+	if cfg.EnableAccel == nil {
+		on := true
+		cfg.EnableAccel = &on
+	}
+	if cfg.GravityCutoffHz == nil {
+		v := float64(defaultGravityCutoffHz)
+		cfg.GravityCutoffHz = &v
+	}
+	if cfg.HistorySize == nil {
+		v := defaultHistorySize
+		cfg.HistorySize = &v
+	}
+	if cfg.RecenterRampMs == nil {
+		v := defaultRecenterRampMs
+		cfg.RecenterRampMs = &v
+	}
+	for _, d := range []struct {
+		v   *string
+		def string
+	}{{&cfg.Source, "auto"}, {&cfg.ScalePolicy, "middle"}, {&cfg.BufferDrain, "latest"}, {&cfg.SplitTimestamp, "primary"}} {
+		if *d.v == "" {
+			*d.v = d.def
+		}
+	}
+	return cfg
+}
+
+// runOptions are the Options main passes without flags, at a fast output rate.
+func runOptions() Options {
+	return Options{Rate: 200, WriteTimeout: dsuWriteTimeout}
+}
+
+// freeUDPAddr returns a loopback address with a port nothing listens on.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+// startRun runs the bridge in the background on a free port until the test ends, and
+// returns a DSU client subscribed to it. Run must not fail.
+func startRun(t *testing.T, cfg Config, opts Options) *dsuTestClient {
+	t.Helper()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	cfg.Bind = freeUDPAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, cfg, opts) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Run did not return after cancel")
+		}
+	})
+	conn, err := net.Dial("udp", cfg.Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &dsuTestClient{t: t, conn: conn, done: done}
+}
+
+// clientPacket builds a client request of msgType with payload, as Yuzu sends it.
+func clientPacket(msgType uint32, payload []byte) []byte {
+	b := make([]byte, 20+len(payload))
+	copy(b, dsuMagicClient)
+	binary.LittleEndian.PutUint16(b[4:], dsuProtoVersion)
+	binary.LittleEndian.PutUint16(b[6:], uint16(4+len(payload)))
+	binary.LittleEndian.PutUint32(b[12:], 0xC11E47)
+	binary.LittleEndian.PutUint32(b[16:], msgType)
+	copy(b[20:], payload)
+	binary.LittleEndian.PutUint32(b[8:], crc32.ChecksumIEEE(b))
+	return b
+}
+
+// subscribeRequest is a data request for slot 0.
+func subscribeRequest() []byte {
+	return clientPacket(dsuMsgData, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+}
+
+// dsuMotion is the motion of a ControllerData packet, in the packet's units (g, deg/s).
+type dsuMotion struct {
+	PktNo       uint32
+	TS          uint64
+	Accel, Gyro Vec3
+}
+
+func decodeMotion(payload []byte) dsuMotion {
+	f := func(off int) float64 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(payload[off:])))
+	}
+	return dsuMotion{
+		PktNo: binary.LittleEndian.Uint32(payload[12:]),
+		TS:    binary.LittleEndian.Uint64(payload[48:]),
+		Accel: Vec3{f(56), f(60), f(64)},
+		Gyro:  Vec3{f(68), f(72), f(76)},
+	}
+}
+
+// dsuTestClient is a DSU client of a bridge started by startRun.
+type dsuTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	done chan error
+}
+
+// next subscribes (again, until the server answers) and returns the next motion packet.
+func (c *dsuTestClient) next() dsuMotion {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	buf := make([]byte, 2048)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-c.done:
+			c.t.Fatalf("Run returned early: %v", err)
+		default:
+		}
+		c.conn.Write(subscribeRequest())
+		c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				break
+			}
+			h, payload, err := parseDSUPacket(buf[:n], dsuMagicServer)
+			if err == nil && h.MsgType == dsuMsgData {
+				return decodeMotion(payload)
+			}
+		}
+	}
+	c.t.Fatal("no motion packet from the bridge")
+	return dsuMotion{}
+}
+
+// near reports whether a and b agree within tol on every axis.
+func near(a, b Vec3, tol float64) bool {
+	return math.Abs(a.X-b.X) <= tol && math.Abs(a.Y-b.Y) <= tol && math.Abs(a.Z-b.Z) <= tol
+}
+
+func TestRunSwapAccelGyroBeforeMatrices(t *testing.T) {
+	base := useSysfs(t)
+	// gyro reads 1 rad/s about x, accel 9.8 m/s^2 along z
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+		"name":             "bmi323-imu",
+		"in_anglvel_scale": "0.01",
+		"in_accel_scale":   "0.01",
+	}, "anglvel", [3]int{100, 0, 0}), "accel", [3]int{0, 0, 980}))
+
+	// the gyro matrix turns z into x; applied after the swap it sees the accel channels
+	cfg := runConfig(t, `
+swap_accel_gyro: true
+gyro_matrix:
+  x: [0, 0, 1]
+  y: [0, 1, 0]
+  z: [1, 0, 0]
+accel_matrix:
+  x: [1, 0, 0]
+  y: [0, 1, 0]
+  z: [0, 0, 1]
+`)
+	m := startRun(t, cfg, runOptions()).next()
+
+	wantGyro := Vec3{X: 9.8 * 180 / math.Pi}
+	wantAccel := Vec3{X: 1 / standardGravity}
+	if !near(m.Gyro, wantGyro, 1e-3) || !near(m.Accel, wantAccel, 1e-5) {
+		t.Errorf("got gyro %+v deg/s, accel %+v g; want gyro %+v, accel %+v", m.Gyro, m.Accel, wantGyro, wantAccel)
+	}
+}
+
+func TestRunSensorEnables(t *testing.T) {
+	tests := []struct {
+		name             string
+		gyro, accel      bool
+		wantGyro, wantAc Vec3
+	}{
+		{"both", true, true, Vec3{X: 0.5 * 180 / math.Pi}, Vec3{Z: 1}},
+		{"gyro only", true, false, Vec3{X: 0.5 * 180 / math.Pi}, Vec3{}},
+		{"accel only", false, true, Vec3{}, Vec3{Z: 1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			base := useSysfs(t)
+			attrs := map[string]string{"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001"}
+			axes(attrs, "anglvel", [3]int{500, 0, 0})
+			axes(attrs, "accel", [3]int{0, 0, 0})
+			attrs["in_accel_z_raw"] = "9807" // 9.807 m/s^2 = 1 g
+			// a disabled sensor must not be read at all: its channels don't parse
+			if !tc.gyro {
+				attrs["in_anglvel_x_raw"] = "garbage"
+			}
+			if !tc.accel {
+				attrs["in_accel_x_raw"] = "garbage"
+			}
+			writeAttrs(t, filepath.Join(base, "iio:device0"), attrs)
+
+			cfg := runConfig(t, checkIdentity)
+			*cfg.EnableGyro, *cfg.EnableAccel = tc.gyro, tc.accel
+			m := startRun(t, cfg, runOptions()).next()
+			if !near(m.Gyro, tc.wantGyro, 1e-3) || !near(m.Accel, tc.wantAc, 1e-4) {
+				t.Errorf("got gyro %+v accel %+v, want %+v and %+v", m.Gyro, m.Accel, tc.wantGyro, tc.wantAc)
+			}
+		})
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	for _, tc := range []struct {
+		name     string
+		noDevice bool
+		config   string
+		bind     string // a free port when empty
+		want     int
+	}{
+		{"no device", true, "source: iio\n" + checkIdentity, "", exitDeviceNotFound},
+		{"no mount matrix", false, "name: bmi323-imu\n", "", exitNoMatrix},
+		{"bad config value", false, "gyro_sensitivity: -1\n" + checkIdentity, "", exitConfig},
+		{"bad screen rotation", false, "screen_rotation: 45\n" + checkIdentity, "", exitConfig},
+		{"port in use", false, checkIdentity, busy.LocalAddr().String(), exitBindFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+			base := useSysfs(t)
+			if !tc.noDevice {
+				writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+					"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+				}, "anglvel", [3]int{}), "accel", [3]int{2: 9807}))
+			}
+			cfg := runConfig(t, tc.config)
+			if cfg.Bind = tc.bind; cfg.Bind == "" {
+				cfg.Bind = freeUDPAddr(t)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := Run(ctx, cfg, runOptions())
+			var ee *exitError
+			if !errors.As(err, &ee) || ee.code != tc.want {
+				t.Errorf("Run = %v, want exit code %d", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunMissingIIOSubsystem(t *testing.T) {
+	for _, tc := range []struct {
+		source       string
+		wantMissing  bool // the IIO error itself, rather than the evdev fallback's
+		wantEvdevErr bool
+	}{
+		{"iio", true, false},
+		{"iio-buffer", true, false},
+		// auto falls back to evdev, which finds nothing in an empty input directory
+		{"auto", false, true},
+	} {
+		t.Run(tc.source, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+			useSysfs(t)
+			sysfsBase = filepath.Join(sysfsBase, "nonexistent")
+			old := evdevDir
+			evdevDir = t.TempDir()
+			t.Cleanup(func() { evdevDir = old })
+
+			cfg := runConfig(t, "source: "+tc.source+"\n"+checkIdentity)
+			cfg.Bind = freeUDPAddr(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var err error
+			out := captureStderr(t, func() { err = Run(ctx, cfg, runOptions()) })
+			var ee *exitError
+			if !errors.As(err, &ee) || ee.code != exitDeviceNotFound {
+				t.Fatalf("Run = %v, want exit code %d", err, exitDeviceNotFound)
+			}
+			var missing *iioMissingError
+			if errors.As(err, &missing) != tc.wantMissing || (tc.wantMissing && missing.Path != sysfsBase) {
+				t.Errorf("Run = %v, IIO subsystem error %v", err, tc.wantMissing)
+			}
+			if got := strings.HasPrefix(err.Error(), "evdev: ") && strings.Contains(err.Error(), evdevDir); got != tc.wantEvdevErr {
+				t.Errorf("Run = %v, evdev error %v", err, tc.wantEvdevErr)
+			}
+			// either way the message names the path and the likely cause
+			if msg := err.Error() + out; !strings.Contains(msg, "IIO subsystem not found ("+sysfsBase) || !strings.Contains(msg, "CONFIG_IIO") {
+				t.Errorf("no IIO subsystem message:\n%s", msg)
+			}
+		})
+	}
+}
+
+func TestRunReturnsOnCancel(t *testing.T) {
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+	}, "anglvel", [3]int{}), "accel", [3]int{2: 9807}))
+	cfg := runConfig(t, checkIdentity)
+	cfg.Bind = freeUDPAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, cfg, runOptions()) }()
+	conn, err := net.Dial("udp", cfg.Bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	(&dsuTestClient{t: t, conn: conn, done: done}).next() // streaming
+
+	if locks, _ := filepath.Glob(filepath.Join(runtime, "*.lock")); len(locks) != 1 {
+		t.Errorf("while running: lock files %v, want one", locks)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run after cancel = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	// deferred cleanup ran: the lock is gone and the port is free again
+	if locks, _ := filepath.Glob(filepath.Join(runtime, "*.lock")); len(locks) != 0 {
+		t.Errorf("after cancel: lock files %v left", locks)
+	}
+	addr, _ := net.ResolveUDPAddr("udp", cfg.Bind)
+	if c, err := net.ListenUDP("udp", addr); err != nil {
+		t.Errorf("port still bound after cancel: %v", err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestRunRawUnits(t *testing.T) {
+	// each sensor reads the same physical motion: 45 deg/s about x and 1 g along z
+	gyroRaw := map[string][2]string{"": {"785398", "0.000001"}, "rad_s": {"785398", "0.000001"}, "deg_s": {"450", "0.1"}}
+	accelRaw := map[string][2]string{"": {"9807", "0.001"}, "m_s2": {"9807", "0.001"}, "g": {"1000", "0.001"}}
+	for _, gu := range []string{"", "rad_s", "deg_s"} {
+		for _, au := range []string{"", "m_s2", "g"} {
+			t.Run(cmp.Or(gu, "default")+"/"+cmp.Or(au, "default"), func(t *testing.T) {
+				base := useSysfs(t)
+				writeAttrs(t, filepath.Join(base, "iio:device0"), map[string]string{
+					"name": "bmi323-imu", "in_anglvel_scale": gyroRaw[gu][1], "in_accel_scale": accelRaw[au][1],
+					"in_anglvel_x_raw": gyroRaw[gu][0], "in_anglvel_y_raw": "0", "in_anglvel_z_raw": "0",
+					"in_accel_x_raw": "0", "in_accel_y_raw": "0", "in_accel_z_raw": accelRaw[au][0],
+				})
+				cfg := runConfig(t, checkIdentity)
+				cfg.GyroRawUnits, cfg.AccelRawUnits = gu, au
+				m := startRun(t, cfg, runOptions()).next()
+				if !near(m.Gyro, Vec3{X: 45}, 1e-3) || !near(m.Accel, Vec3{Z: 1}, 1e-4) {
+					t.Errorf("got gyro %+v deg/s, accel %+v g; want 45 deg/s about x and 1 g along z", m.Gyro, m.Accel)
+				}
+			})
+		}
+	}
+}
+
+func TestRunControllerMAC(t *testing.T) {
+	// the MAC in the info packet sent on subscribe and in every data packet
+	macs := func(t *testing.T, cfg Config) (info, data [6]byte) {
+		t.Helper()
+		c := startRun(t, cfg, runOptions())
+		c.next()
+		buf := make([]byte, 2048)
+		for info == ([6]byte{}) || data == ([6]byte{}) {
+			c.conn.Write(subscribeRequest())
+			c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, payload, err := parseDSUPacket(buf[:n], dsuMagicServer)
+			switch {
+			case err != nil:
+			case h.MsgType == dsuMsgInfo:
+				copy(info[:], payload[4:10])
+			case h.MsgType == dsuMsgData:
+				copy(data[:], payload[4:10])
+			}
+		}
+		return info, data
+	}
+	setup := func(t *testing.T, body string) Config {
+		base := useSysfs(t)
+		writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+			"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+		}, "anglvel", [3]int{}), "accel", [3]int{2: 9807}))
+		return runConfig(t, body+checkIdentity)
+	}
+
+	t.Run("derived", func(t *testing.T) {
+		cfg := setup(t, "")
+		want := deriveMAC(deviceIdentity(filepath.Join(sysfsBase, "iio:device0"), ""))
+		if info, data := macs(t, cfg); info != want || data != want {
+			t.Errorf("info MAC %x, data MAC %x; want %x derived from the device", info, data, want)
+		}
+	})
+	t.Run("controller_mac", func(t *testing.T) {
+		cfg := setup(t, "controller_mac: 02:20:6a:7e:51:99\n")
+		want := [6]byte{0x02, 0x20, 0x6a, 0x7e, 0x51, 0x99}
+		if info, data := macs(t, cfg); info != want || data != want {
+			t.Errorf("info MAC %x, data MAC %x; want the configured %x", info, data, want)
+		}
+	})
+}
+
+// scriptedReader is a SampleReader for Options.Reader: read n (counting from 0) returns
+// script(n).
+type scriptedReader struct {
+	mu     sync.Mutex
+	n      int
+	script func(n int) (IMUSample, error)
+}
+
+func (r *scriptedReader) readSample() (IMUSample, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.n
+	r.n++
+	return r.script(n)
+}
+
+func TestRunScriptedReader(t *testing.T) {
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+	}, "anglvel", [3]int{}), "accel", [3]int{}))
+
+	// every read is a new sample: n/100 rad/s about the sensor's x, 1 g along its z; the
+	// pipeline swaps x and y, doubles the gyro and halves the accel's z
+	cfg := runConfig(t, `
+mount_matrix:
+  x: [0, 1, 0]
+  y: [1, 0, 0]
+  z: [0, 0, 1]
+gyro_sensitivity: 2
+accel_axis_sensitivity: [1, 1, 0.5]
+`)
+	opts := runOptions()
+	opts.Reader = &scriptedReader{script: func(n int) (IMUSample, error) {
+		return IMUSample{
+			TSus: uint64(1_000_000 + n*5000), RawGyro: [3]int64{int64(n)},
+			Gyro: Vec3{X: float64(n) / 100}, Accel: Vec3{Z: standardGravity},
+		}, nil
+	}}
+	c := startRun(t, cfg, opts)
+
+	// consecutive packets carry consecutive reads, each through the whole pipeline
+	var prev uint64
+	for i := range 5 {
+		m := c.next()
+		n := math.Round(m.Gyro.Y / 2 / (180 / math.Pi) * 100)
+		if want := (Vec3{Y: 2 * n / 100 * 180 / math.Pi}); n < 0 || !near(m.Gyro, want, 1e-3) {
+			t.Errorf("packet %d: gyro %+v deg/s, want %+v", i, m.Gyro, want)
+		}
+		if !near(m.Accel, Vec3{Z: 0.5}, 1e-5) {
+			t.Errorf("packet %d: accel %+v g, want 0.5 along z", i, m.Accel)
+		}
+		if want := uint64(1_000_000 + n*5000); m.TS != want {
+			t.Errorf("packet %d: timestamp %d, want the read's %d", i, m.TS, want)
+		}
+		if i > 0 && m.TS <= prev {
+			t.Errorf("packet %d: timestamp %d not after %d", i, m.TS, prev)
+		}
+		prev = m.TS
+	}
+}
+
+func TestRunBusErrorsResetDevice(t *testing.T) {
+	base := useSysfs(t)
+	// the device itself reads 0.5 rad/s about x
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+	}, "anglvel", [3]int{500, 0, 0}), "accel", [3]int{2: 9807}))
+
+	// the scripted bus fails every read; only the reset, which reopens the device from
+	// sysfs, brings samples back
+	opts := runOptions()
+	eio := &fs.PathError{Op: "read", Path: filepath.Join(base, "iio:device0", "in_anglvel_x_raw"), Err: syscall.EIO}
+	opts.Reader = &scriptedReader{script: func(int) (IMUSample, error) { return IMUSample{}, eio }}
+	m := startRun(t, runConfig(t, checkIdentity), opts).next()
+	if want := (Vec3{X: 0.5 * 180 / math.Pi}); !near(m.Gyro, want, 1e-3) {
+		t.Errorf("after the reset: gyro %+v, want the device's %+v", m.Gyro, want)
+	}
+}
+
+func TestRunSourceDevices(t *testing.T) {
+	body := "source_devices:\n"
+	for _, d := range threeSourceDevices(t) {
+		body += "  - path: " + d.Path + "\n    roles: [" + strings.Join(d.Roles, ", ") + "]\n"
+	}
+	cfg := runConfig(t, body+checkIdentity)
+	m := startRun(t, cfg, runOptions()).next()
+	const g = 9.80665
+	deg := 180 / math.Pi
+	if !near(m.Gyro, Vec3{1 * deg, -2 * deg, 3 * deg}, 1e-3) || !near(m.Accel, Vec3{1 / g, -2 / g, -9.81 / g}, 1e-4) {
+		t.Errorf("got gyro %+v deg/s, accel %+v g; want the gyro from one device and the accel from two", m.Gyro, m.Accel)
+	}
+}
+
+func TestRunDeviceGoneAndBack(t *testing.T) {
+	base := useSysfs(t)
+	dir := filepath.Join(base, "iio:device0")
+	writeAttrs(t, dir, axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+	}, "anglvel", [3]int{}), "accel", [3]int{2: 9807}))
+	c := startRun(t, runConfig(t, checkIdentity), runOptions())
+	c.next()
+
+	// suspend removes the device; once it has been missing for a second nothing is sent
+	away := filepath.Join(t.TempDir(), "iio:device0")
+	if err := os.Rename(dir, away); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(deviceAbsentDebounce + 300*time.Millisecond)
+	buf := make([]byte, 2048)
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		if _, err := c.conn.Read(buf); err != nil {
+			break // drained what was sent before
+		}
+	}
+	c.conn.Write(subscribeRequest())
+	c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if h, _, err := parseDSUPacket(buf[:n], dsuMagicServer); err == nil && h.MsgType == dsuMsgData {
+			t.Fatal("motion sent while the device is gone")
+		}
+	}
+
+	// resume brings it back with the gyro turning; motion follows once it has settled
+	writeAttrs(t, away, map[string]string{"in_anglvel_x_raw": "1000"})
+	if err := os.Rename(away, dir); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !near(c.next().Gyro, Vec3{X: 180 / math.Pi}, 1e-3) {
+		if time.Now().After(deadline) {
+			t.Fatal("no motion from the device after it came back")
+		}
+	}
+}
+
+func TestRunOutputUnits(t *testing.T) {
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+	}, "anglvel", [3]int{1000, 0, 0}), "accel", [3]int{2: 9807}))
+	cfg := runConfig(t, "output_accel_units: m_s2\noutput_gyro_units: rad_s\n"+checkIdentity)
+	m := startRun(t, cfg, runOptions()).next()
+	if !near(m.Gyro, Vec3{X: 1}, 1e-4) || !near(m.Accel, Vec3{Z: 9.807}, 1e-3) {
+		t.Errorf("got gyro %+v, accel %+v; want 1 rad/s about x and 9.807 m/s^2 along z", m.Gyro, m.Accel)
+	}
+}
+
+func TestRunDBusRecalibrate(t *testing.T) {
+	// D-Bus alone, no control API, recalibrate button or online bias estimate
+	bus := fakeSessionBus(t)
+	base := useSysfs(t)
+	writeAttrs(t, filepath.Join(base, "iio:device0"), axes(axes(map[string]string{
+		"name": "bmi323-imu", "in_anglvel_scale": "0.001", "in_accel_scale": "0.001",
+	}, "anglvel", [3]int{10, 0, 0}), "accel", [3]int{2: 9807}))
+	opts := runOptions()
+	opts.DBus = true
+	c := startRun(t, runConfig(t, checkIdentity), opts)
+	drift := Vec3{X: 0.01 * 180 / math.Pi}
+	if m := c.next(); !near(m.Gyro, drift, 1e-3) {
+		t.Fatalf("gyro %+v before recalibrating, want %+v", m.Gyro, drift)
+	}
+	var conn *dbusConn
+	select {
+	case conn = <-bus:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bridge did not connect to the session bus")
+	}
+	if m := callService(t, conn, "Recalibrate"); m.Type != dbusMethodReturn {
+		t.Fatalf("Recalibrate: %s %v", m.str(dbusFieldErrorName), m.Body)
+	}
+	// the resting drift is measured and taken off
+	deadline := time.Now().Add(5 * time.Second)
+	for !near(c.next().Gyro, Vec3{}, 1e-3) {
+		if time.Now().After(deadline) {
+			t.Fatal("gyro drift not removed after a D-Bus Recalibrate")
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scalePicker chooses one value out of a channel's scales_available list.
+// channel is the IIO channel type ("anglvel" or "accel").
+type scalePicker func(dev *IIODevice, channel string, avail []float64) float64
+
+// scalePolicies are the selectable values of scale_policy / --scale-policy.
+var scalePolicies = map[string]scalePicker{
+	"middle":     pickMiddleScale,
+	"auto-noise": pickScaleAutoNoise,
+}
+
+const (
+	// rawFullScale is the largest magnitude a signed 16-bit channel can report.
+	rawFullScale = 32767
+	// gyroPlayRange is the angular rate (rad/s) normal play must fit in without clipping (1000 dps).
+	gyroPlayRange = 1000 * math.Pi / 180
+	// noiseSamples is how many resting samples auto-noise reads per candidate scale.
+	noiseSamples = 32
+)
+
+// knownScales lists the scales of chips whose driver may not expose in_*_scales_available,
+// keyed by a substring of the IIO device name and then by channel, in the units the driver
+// uses (rad/s and m/s^2 per LSB). To add a chip, copy the values from its kernel driver's
+// scale table (or from scales_available on a kernel that has it).
+var knownScales = []struct {
+	Chip   string
+	Scales map[string][]float64
+}{
+	{"bmi323", map[string][]float64{
+		"anglvel": {0.000066, 0.000133, 0.000266, 0.000532, 0.001065},
+		"accel":   {0.000598, 0.001197, 0.002394, 0.004788},
+	}},
+	{"bmi260", map[string][]float64{
+		"anglvel": {0.000066, 0.000133, 0.000266, 0.000532, 0.001065},
+		"accel":   {0.000598, 0.001197, 0.002394, 0.004788},
+	}},
+	{"bmi270", map[string][]float64{
+		"anglvel": {0.000066, 0.000133, 0.000266, 0.000532, 0.001065},
+		"accel":   {0.000598, 0.001197, 0.002394, 0.004788},
+	}},
+}
+
+// errNoPositiveScale is returned by availableScales for a list with no usable (> 0) entry.
+var errNoPositiveScale = errors.New("no positive scale available")
+
+// availableScales reads in_<channel>_scales_available, falling back to knownScales for the
+// device's chip. chip is set when the built-in table was used. Entries <= 0 are dropped, as
+// writing one would disable the sensor.
+func availableScales(dev *IIODevice, channel string) (avail []float64, chip string, err error) {
+	path := filepath.Join(dev.Base, "in_"+channel+"_scales_available")
+	if avail, err = readFloatList(path); err == nil {
+		avail = slices.DeleteFunc(avail, func(v float64) bool { return v <= 0 })
+		if len(avail) == 0 {
+			return nil, "", fmt.Errorf("%s: %w", path, errNoPositiveScale)
+		}
+		return avail, "", nil
+	}
+	b, _ := os.ReadFile(filepath.Join(dev.Base, "name"))
+	name := strings.ToLower(strings.TrimSpace(string(b)))
+	for _, k := range knownScales {
+		if v := k.Scales[channel]; name != "" && strings.Contains(name, k.Chip) && len(v) > 0 {
+			return v, k.Chip, nil
+		}
+	}
+	return nil, "", err
+}
+
+// setChannelScale gets the channel's available scales, lets pick choose a value and writes it
+// to in_<channel>_scale. It returns the scale written.
+func setChannelScale(dev *IIODevice, channel string, pick scalePicker) (float64, bool) {
+	avail, chip, err := availableScales(dev, channel)
+	if err != nil {
+		if errors.Is(err, errNoPositiveScale) {
+			fmt.Fprintf(os.Stderr, "WARNING: %v; in_%s_scale left as is\n", err, channel)
+		}
+		return 0, false
+	}
+	if chip != "" {
+		fmt.Printf("%s has no in_%s_scales_available; using the built-in %s scales\n", dev.Base, channel, chip)
+	}
+	v := pick(dev, channel, avail)
+	path := filepath.Join(dev.Base, "in_"+channel+"_scale")
+	if err := writeFloat(path, v); err != nil {
+		if !warnWriteDenied(path, err) {
+			fmt.Fprintf(os.Stderr, "WARNING: could not set %s: %v\n", path, err)
+		}
+		return 0, false
+	}
+	fmt.Printf("Set %s in_%s_scale=%g\n", dev.Base, channel, v)
+	return v, true
+}
+
+func pickMiddleScale(_ *IIODevice, _ string, avail []float64) float64 {
+	return avail[len(avail)/2]
+}
+
+// pickScaleAutoNoise walks the gyro scales from finest to coarsest and keeps the first one whose
+// full-scale range covers gyroPlayRange and whose resting readings don't saturate. The resting
+// noise floor measured at each candidate is logged. Accel, and any case where the gyro can't be
+// sampled, falls back to the middle pick.
+func pickScaleAutoNoise(dev *IIODevice, channel string, avail []float64) float64 {
+	if channel != "anglvel" || !dev.HaveGyro {
+		return pickMiddleScale(dev, channel, avail)
+	}
+	scalePath := filepath.Join(dev.Base, "in_anglvel_scale")
+	sc, ok := pickQuietScale(avail, func(sc float64) (float64, int64, error) {
+		if err := writeFloat(scalePath, sc); err != nil {
+			warnWriteDenied(scalePath, err)
+			return 0, 0, err
+		}
+		return sampleGyroNoise(dev, noiseSamples)
+	})
+	if !ok {
+		fmt.Println("auto-noise: could not sample the gyro, using the middle scale")
+		return pickMiddleScale(dev, channel, avail)
+	}
+	return sc
+}
+
+// gyroNoiseSampler switches the gyro to scale sc and returns its resting noise and largest
+// reading in raw counts (see sampleGyroNoise).
+type gyroNoiseSampler func(sc float64) (noise float64, peak int64, err error)
+
+// pickQuietScale is the selection of pickScaleAutoNoise: the finest scale of avail that covers
+// gyroPlayRange and whose resting peak from sample stays below 90% of the raw range. ok is
+// false when sampling fails or every candidate saturates.
+func pickQuietScale(avail []float64, sample gyroNoiseSampler) (sc float64, ok bool) {
+	cands := append([]float64(nil), avail...)
+	sort.Float64s(cands)
+	for _, sc := range cands {
+		if sc <= 0 || sc*rawFullScale < gyroPlayRange {
+			continue
+		}
+		noise, peak, err := sample(sc)
+		if err != nil {
+			return 0, false
+		}
+		fmt.Printf("auto-noise: scale=%g range=±%.0f dps noise=%.3f dps peak=%d\n",
+			sc, sc*rawFullScale*180/math.Pi, noise*sc*180/math.Pi, peak)
+		if peak >= rawFullScale*9/10 {
+			continue
+		}
+		return sc, true
+	}
+	return 0, false
+}
+
+// sampleGyroNoise reads n resting gyro samples and returns the mean per-axis standard deviation
+// and the largest absolute reading, both in raw counts.
+func sampleGyroNoise(dev *IIODevice, n int) (float64, int64, error) {
+	// let the new range settle before measuring
+	time.Sleep(50 * time.Millisecond)
+
+	var sum, sumSq [3]float64
+	var peak int64
+	for i := 0; i < n; i++ {
+		for a := 0; a < 3; a++ {
+			v, err := readInt(dev.AngVelPaths[a])
+			if err != nil {
+				return 0, 0, err
+			}
+			if v < 0 && -v > peak {
+				peak = -v
+			} else if v > peak {
+				peak = v
+			}
+			sum[a] += float64(v)
+			sumSq[a] += float64(v) * float64(v)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	var std float64
+	for a := 0; a < 3; a++ {
+		mean := sum[a] / float64(n)
+		std += math.Sqrt(math.Max(sumSq[a]/float64(n)-mean*mean, 0))
+	}
+	return std / 3, peak, nil
+}
+
+const (
+	// The full scale a scale implies (scale × largest count) must fall in these ranges. Real
+	// IMUs span about 125-4000 deg/s and 2-16 g; values far outside mean the scale was
+	// misread (a raw count taken for a scale, a unit mix-up).
+	minGyroFullScaleDPS = 10
+	maxGyroFullScaleDPS = 20000
+	minAccelFullScaleG  = 0.5
+	maxAccelFullScaleG  = 200
+)
+
+// channelFullCount returns the largest count axis can report: from its scan element's
+// realbits when the device describes it, else a signed 16-bit channel's.
+func channelFullCount(base, axis string) float64 {
+	if b, err := os.ReadFile(filepath.Join(base, "scan_elements", axis+"_type")); err == nil {
+		if e, err := parseScanType(string(b)); err == nil {
+			if e.Signed {
+				return math.Exp2(float64(e.RealBits-1)) - 1
+			}
+			return math.Exp2(float64(e.RealBits)) - 1
+		}
+	}
+	return rawFullScale
+}
+
+// gyroRawUnits and accelRawUnits are the values of gyro_raw_units and accel_raw_units: the
+// unit raw*scale is in, mapped to the factor that takes it to rad/s or m/s². The IIO ABI says
+// rad/s and m/s², but some drivers report deg/s or g.
+var (
+	gyroRawUnits  = map[string]float64{"rad_s": 1, "deg_s": math.Pi / 180}
+	accelRawUnits = map[string]float64{"m_s2": 1, "g": standardGravity}
+)
+
+// rawUnitFactors returns the factors for the configured raw units; unset means the IIO units.
+// main has already rejected unknown names.
+func rawUnitFactors(cfg *Config) (gyro, accel float64) {
+	gyro, accel = 1, 1
+	if f, ok := gyroRawUnits[cfg.GyroRawUnits]; ok {
+		gyro = f
+	}
+	if f, ok := accelRawUnits[cfg.AccelRawUnits]; ok {
+		accel = f
+	}
+	return gyro, accel
+}
+
+// implausibleScales checks the scales of dev against the physical full-scale ranges above and
+// returns a message for each sensor whose scale can't be right. Zero scales are left to the
+// "no working gyroscope" checks. gyroUnit and accelUnit are the rawUnitFactors.
+func implausibleScales(dev *IIODevice, gyroUnit, accelUnit float64) []string {
+	var out []string
+	for _, s := range []struct {
+		name, unit string
+		have       bool
+		chans      [3]string
+		scale      Vec3
+		toUnit     float64
+		lo, hi     float64
+	}{
+		{"gyro", "deg/s", dev.HaveGyro, dev.AngVelChans, dev.GyroScale, gyroUnit * 180 / math.Pi, minGyroFullScaleDPS, maxGyroFullScaleDPS},
+		{"accel", "g", dev.HaveAccel, dev.AccelChans, dev.AccelScale, accelUnit / standardGravity, minAccelFullScaleG, maxAccelFullScaleG},
+	} {
+		if !s.have {
+			continue
+		}
+		for i, sc := range []float64{s.scale.X, s.scale.Y, s.scale.Z} {
+			full := math.Abs(sc) * channelFullCount(dev.Base, s.chans[i]) * s.toUnit
+			if sc != 0 && (full < s.lo || full > s.hi) {
+				out = append(out, fmt.Sprintf("%s: %s scale %g implies a full scale of ±%.3g %s (expected %g-%g); the scale is probably misread",
+					dev.Base, s.chans[i], sc, full, s.unit, s.lo, s.hi))
+				break
+			}
+		}
+	}
+	return out
+}
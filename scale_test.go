@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestPickQuietScale(t *testing.T) {
+	// 0.0003 covers only ±560 dps and is never tried
+	avail := []float64{0.0024, 0.0003, 0.0012, 0.0006}
+	tests := []struct {
+		name   string
+		peaks  map[float64]int64 // resting peak per scale; missing = quiet
+		fail   bool
+		want   float64
+		wantOK bool
+		tried  []float64
+	}{
+		{"quiet everywhere takes the finest in range", nil, false, 0.0006, true, []float64{0.0006}},
+		{"saturated finest moves up", map[float64]int64{0.0006: 32000}, false, 0.0012, true, []float64{0.0006, 0.0012}},
+		{"just below the limit is kept", map[float64]int64{0.0006: rawFullScale*9/10 - 1}, false, 0.0006, true, []float64{0.0006}},
+		{"saturated everywhere", map[float64]int64{0.0006: 32767, 0.0012: 32767, 0.0024: 30000}, false, 0, false, []float64{0.0006, 0.0012, 0.0024}},
+		{"sampling fails", nil, true, 0, false, []float64{0.0006}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tried []float64
+			got, ok := pickQuietScale(avail, func(sc float64) (float64, int64, error) {
+				tried = append(tried, sc)
+				if tc.fail {
+					return 0, 0, errors.New("read error")
+				}
+				return 2, tc.peaks[sc], nil
+			})
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("pickQuietScale = %g, %v, want %g, %v", got, ok, tc.want, tc.wantOK)
+			}
+			if !slices.Equal(tried, tc.tried) {
+				t.Errorf("sampled scales %v, want %v", tried, tc.tried)
+			}
+		})
+	}
+}
+
+func TestPickScaleAutoNoiseAccelTakesMiddle(t *testing.T) {
+	dev := &IIODevice{HaveGyro: true, HaveAccel: true}
+	if got := pickScaleAutoNoise(dev, "accel", []float64{0.1, 0.2, 0.4}); got != 0.2 {
+		t.Errorf("accel scale = %g, want the middle 0.2", got)
+	}
+}
+
+// captureStderr returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = old }()
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestWarnWriteDenied(t *testing.T) {
+	writeDeniedOnce = sync.Once{}
+	t.Cleanup(func() { writeDeniedOnce = sync.Once{} })
+	denied := &fs.PathError{Op: "open", Path: "/sys/x/in_anglvel_scale", Err: syscall.EACCES}
+
+	var first, second bool
+	out := captureStderr(t, func() {
+		first = warnWriteDenied("/sys/x/in_anglvel_scale", denied)
+		second = warnWriteDenied("/sys/x/in_accel_scale", denied)
+	})
+	if !first || !second {
+		t.Errorf("EACCES not reported as a permission error: %v, %v", first, second)
+	}
+	// the hint is printed once, for the first path
+	if strings.Count(out, "ERROR: no permission") != 1 || !strings.Contains(out, "in_anglvel_scale") || !strings.Contains(out, "udev") {
+		t.Errorf("stderr:\n%s", out)
+	}
+	if warnWriteDenied("/sys/x/in_anglvel_scale", &fs.PathError{Op: "write", Err: syscall.EINVAL}) {
+		t.Error("EINVAL reported as a permission error")
+	}
+}
+
+func TestSetChannelScaleWriteFails(t *testing.T) {
+	writeDeniedOnce = sync.Once{}
+	t.Cleanup(func() { writeDeniedOnce = sync.Once{} })
+	dev := &IIODevice{Base: t.TempDir(), HaveGyro: true}
+	writeAttrs(t, dev.Base, map[string]string{"in_anglvel_scales_available": "0.000133 0.000266\n"})
+	// a directory where the attribute should be: the write fails, not for lack of permission
+	if err := os.Mkdir(filepath.Join(dev.Base, "in_anglvel_scale"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var ok bool
+	out := captureStderr(t, func() { _, ok = setChannelScale(dev, "anglvel", pickMiddleScale) })
+	if ok {
+		t.Error("setChannelScale reported success")
+	}
+	if !strings.Contains(out, "WARNING: could not set") || strings.Contains(out, "no permission") {
+		t.Errorf("stderr:\n%s", out)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write read-only files")
+	}
+	dev.Base = t.TempDir()
+	writeAttrs(t, dev.Base, map[string]string{"in_anglvel_scales_available": "0.000133 0.000266\n", "in_anglvel_scale": "0.000133\n"})
+	if err := os.Chmod(filepath.Join(dev.Base, "in_anglvel_scale"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	out = captureStderr(t, func() { _, ok = setChannelScale(dev, "anglvel", pickMiddleScale) })
+	if ok || !strings.Contains(out, "ERROR: no permission to write") {
+		t.Errorf("read-only scale: ok %v, stderr:\n%s", ok, out)
+	}
+}
+
+func TestAvailableScalesFallback(t *testing.T) {
+	gyroTable := knownScales[0].Scales["anglvel"]
+	for _, tc := range []struct {
+		name    string
+		attrs   map[string]string
+		channel string
+		want    []float64
+		chip    string
+	}{
+		{"sysfs list wins", map[string]string{"name": "bmi323-imu", "in_anglvel_scales_available": "0.001 0.002\n"}, "anglvel", []float64{0.001, 0.002}, ""},
+		{"known chip", map[string]string{"name": "bmi323-imu\n"}, "anglvel", gyroTable, "bmi323"},
+		{"known chip, any case", map[string]string{"name": "BMI260\n"}, "accel", knownScales[1].Scales["accel"], "bmi260"},
+		{"unknown chip", map[string]string{"name": "lsm6dsox\n"}, "anglvel", nil, ""},
+		{"no name", map[string]string{}, "anglvel", nil, ""},
+		{"channel not in the table", map[string]string{"name": "bmi323-imu\n"}, "magn", nil, ""},
+	} {
+		dev := &IIODevice{Base: t.TempDir()}
+		writeAttrs(t, dev.Base, tc.attrs)
+		got, chip, err := availableScales(dev, tc.channel)
+		if (err != nil) != (tc.want == nil) || !slices.Equal(got, tc.want) || chip != tc.chip {
+			t.Errorf("%s: %v, %q, %v; want %v from %q", tc.name, got, chip, err, tc.want, tc.chip)
+		}
+	}
+
+	// setChannelScale picks from the built-in table and writes the choice
+	dev := &IIODevice{Base: t.TempDir(), HaveGyro: true}
+	writeAttrs(t, dev.Base, map[string]string{"name": "bmi323-imu\n", "in_anglvel_scale": "0\n"})
+	v, ok := setChannelScale(dev, "anglvel", pickMiddleScale)
+	if want := gyroTable[len(gyroTable)/2]; !ok || v != want {
+		t.Fatalf("setChannelScale = %g, %v; want %g", v, ok, want)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dev.Base, "in_anglvel_scale")); string(b) != "0.000266" {
+		t.Errorf("in_anglvel_scale = %q", b)
+	}
+}
+
+func TestSetChannelScaleSkipsZero(t *testing.T) {
+	for _, tc := range []struct {
+		avail string
+		want  float64 // 0: nothing written
+	}{
+		// the middle of the raw list is 0
+		{"0.000133 0 0.000532\n", 0.000532},
+		{"0 0.000266\n", 0.000266},
+		{"-0.001 0 0.000133 0.000266 0.000532\n", 0.000266},
+		{"0 0\n", 0},
+		{"-0.5\n", 0},
+	} {
+		dev := &IIODevice{Base: t.TempDir(), HaveGyro: true}
+		writeAttrs(t, dev.Base, map[string]string{"in_anglvel_scales_available": tc.avail, "in_anglvel_scale": "0.001\n"})
+		var v float64
+		var ok bool
+		stderr := captureStderr(t, func() { v, ok = setChannelScale(dev, "anglvel", pickMiddleScale) })
+		b, _ := os.ReadFile(filepath.Join(dev.Base, "in_anglvel_scale"))
+		if tc.want == 0 {
+			if ok || string(b) != "0.001\n" || !strings.Contains(stderr, "no positive scale available; in_anglvel_scale left as is") {
+				t.Errorf("%q: %g, %v, scale %q, stderr %q; want the scale left alone and a warning", tc.avail, v, ok, b, stderr)
+			}
+			continue
+		}
+		if !ok || v != tc.want || string(b) != fmt.Sprintf("%.9g", tc.want) {
+			t.Errorf("%q: %g, %v, scale %q; want %g", tc.avail, v, ok, b, tc.want)
+		}
+	}
+	// a zero-only list does not fall back to the built-in table either
+	dev := &IIODevice{Base: t.TempDir()}
+	writeAttrs(t, dev.Base, map[string]string{"name": "bmi323-imu", "in_anglvel_scales_available": "0\n"})
+	if _, _, err := availableScales(dev, "anglvel"); !errors.Is(err, errNoPositiveScale) {
+		t.Errorf("zero-only list of a known chip: %v, want errNoPositiveScale", err)
+	}
+}
+
+func TestImplausibleScales(t *testing.T) {
+	gyroChans := [3]string{"in_anglvel_x", "in_anglvel_y", "in_anglvel_z"}
+	accelChans := [3]string{"in_accel_x", "in_accel_y", "in_accel_z"}
+	for _, tc := range []struct {
+		name        string
+		gyro, accel Vec3
+		scanType    string // in_anglvel_x_type, none when empty
+		want        []string
+	}{
+		{"2000 dps and 8 g", Vec3{0.001065, 0.001065, 0.001065}, Vec3{0.0024, 0.0024, 0.0024}, "", nil},
+		{"raw count read as scale", Vec3{0.001065, 0.001065, 0.001065}, Vec3{981, 981, 981}, "", []string{"in_accel_x scale 981"}},
+		{"gyro far too fine", Vec3{1e-9, 1e-9, 1e-9}, Vec3{0.0024, 0.0024, 0.0024}, "", []string{"in_anglvel_x scale 1e-09"}},
+		{"only one axis off", Vec3{0.001065, 5, 0.001065}, Vec3{0.0024, 0.0024, 0.0024}, "", []string{"in_anglvel_y scale 5"}},
+		{"both off", Vec3{1e-9, 1e-9, 1e-9}, Vec3{1e-9, 1e-9, 1e-9}, "", []string{"in_anglvel_x", "in_accel_x"}},
+		{"zero left to the gyro checks", Vec3{}, Vec3{0.0024, 0.0024, 0.0024}, "", nil},
+		// a 32-bit channel reaches 65536 times further than the 16-bit default
+		{"realbits from scan type", Vec3{0.001065, 0.001065, 0.001065}, Vec3{0.0024, 0.0024, 0.0024}, "le:s32/32>>0", []string{"in_anglvel_x scale 0.001065"}},
+	} {
+		base := t.TempDir()
+		if tc.scanType != "" {
+			writeAttrs(t, filepath.Join(base, "scan_elements"), map[string]string{"in_anglvel_x_type": tc.scanType})
+		}
+		dev := &IIODevice{Base: base, HaveGyro: true, HaveAccel: true, AngVelChans: gyroChans, AccelChans: accelChans, GyroScale: tc.gyro, AccelScale: tc.accel}
+		got := implausibleScales(dev, 1, 1)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %q, want %d messages", tc.name, got, len(tc.want))
+			continue
+		}
+		for i, w := range tc.want {
+			if !strings.Contains(got[i], w) {
+				t.Errorf("%s: message %q does not name %q", tc.name, got[i], w)
+			}
+		}
+	}
+
+	// a sensor the device doesn't have isn't checked
+	if got := implausibleScales(&IIODevice{Base: t.TempDir(), HaveGyro: true, AngVelChans: gyroChans, GyroScale: Vec3{0.001, 0.001, 0.001}, AccelScale: Vec3{981, 981, 981}}, 1, 1); got != nil {
+		t.Errorf("accel-less device: %q", got)
+	}
+
+	// a driver reporting deg/s and g: implausible as rad/s and m/s^2, right with raw units
+	degG := &IIODevice{Base: t.TempDir(), HaveGyro: true, HaveAccel: true, AngVelChans: gyroChans, AccelChans: accelChans,
+		GyroScale: Vec3{0.061, 0.061, 0.061}, AccelScale: Vec3{0.0000305, 0.0000305, 0.0000305}}
+	if got := implausibleScales(degG, 1, 1); len(got) != 2 {
+		t.Errorf("deg/s and g scales read as IIO units: %q, want both flagged", got)
+	}
+	if got := implausibleScales(degG, gyroRawUnits["deg_s"], accelRawUnits["g"]); got != nil {
+		t.Errorf("deg/s and g scales with raw units: %q", got)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// liveSettings are the processing settings the main loop reads on every tick. A set is never
+// modified once stored: changes (SIGHUP reload, control API) build a new one and swap it in,
+// so the loop always sees a consistent set.
+type liveSettings struct {
+	AccelMatrix     MountMatrix
+	GyroMatrix      MountMatrix
+	AccelCorrection MountMatrix // calibration, applied before AccelMatrix (see CorrectionAfterMount)
+	GyroCorrection  MountMatrix // calibration, applied before GyroMatrix
+	GyroSensitivity float64     // multiplier applied after the mount matrix (see SensitivityBeforeMount)
+	GyroAxisScale   Vec3        // per-axis multipliers after the mount matrix (gyro_axis_sensitivity)
+	AccelAxisScale  Vec3        // accel_axis_sensitivity
+	GyroDeadzone    float64     // deg/s; angular rates below it are sent as zero
+	AccelCutoffHz   float64     // low-pass corner of the accel sent to clients, 0 = unfiltered
+	GravityCutoffHz float64     // low-pass corner of the gravity estimate, 0 = unfiltered
+
+	CorrectionAfterMount   bool
+	SensitivityBeforeMount bool
+}
+
+type settingsStore struct {
+	p atomic.Pointer[liveSettings]
+}
+
+func (s *settingsStore) Load() *liveSettings    { return s.p.Load() }
+func (s *settingsStore) Store(ls *liveSettings) { s.p.Store(ls) }
+
+// newLiveSettings builds the live settings from a config and calibration (nil for none). ok
+// is false when no matrix is configured at all.
+func newLiveSettings(cfg *Config, cal *Calibration) (*liveSettings, bool) {
+	accelMount, gyroMount, accelSrc, gyroSrc := resolveMatrices(cfg)
+	accelCorr, gyroCorr := cal.corrections()
+	ls := &liveSettings{
+		AccelMatrix:     accelMount,
+		GyroMatrix:      gyroMount,
+		AccelCorrection: accelCorr,
+		GyroCorrection:  gyroCorr,
+		GyroSensitivity: 1,
+		GyroAxisScale:   axisScale(cfg.GyroAxisSensitivity),
+		AccelAxisScale:  axisScale(cfg.AccelAxisSensitivity),
+		GyroDeadzone:    cfg.GyroDeadzone,
+		AccelCutoffHz:   cfg.AccelCutoffHz,
+		GravityCutoffHz: defaultGravityCutoffHz,
+
+		CorrectionAfterMount:   cfg.CorrectionAfterMount,
+		SensitivityBeforeMount: cfg.SensitivityBeforeMount,
+	}
+	if cfg.GyroSensitivity != nil {
+		ls.GyroSensitivity = *cfg.GyroSensitivity
+	}
+	if cfg.GravityCutoffHz != nil {
+		ls.GravityCutoffHz = *cfg.GravityCutoffHz
+	}
+	return ls, accelSrc != "" || gyroSrc != ""
+}
+
+// axisScale turns a validated per-axis sensitivity into multipliers; unset is 1 on each axis.
+func axisScale(v []float64) Vec3 {
+	if len(v) != 3 {
+		return Vec3{1, 1, 1}
+	}
+	return Vec3{v[0], v[1], v[2]}
+}
+
+// applyMatrices corrects a sensor-frame sample with the calibration and then reorients it
+// with the mount matrices: out = mount * (correction * raw), or correction * (mount * raw)
+// with CorrectionAfterMount. With SensitivityBeforeMount the gyro is scaled first. The accel
+// per-axis sensitivity is applied last.
+func (ls *liveSettings) applyMatrices(s IMUSample) IMUSample {
+	if ls.SensitivityBeforeMount {
+		s.Gyro = s.Gyro.Scale(ls.GyroSensitivity)
+	}
+	if ls.CorrectionAfterMount {
+		s.Gyro = ls.GyroCorrection.Apply(ls.GyroMatrix.Apply(s.Gyro))
+		s.Accel = ls.AccelCorrection.Apply(ls.AccelMatrix.Apply(s.Accel))
+	} else {
+		s.Gyro = ls.GyroMatrix.Apply(ls.GyroCorrection.Apply(s.Gyro))
+		s.Accel = ls.AccelMatrix.Apply(ls.AccelCorrection.Apply(s.Accel))
+	}
+	s.Accel = s.Accel.Mul(ls.AccelAxisScale)
+	return s
+}
+
+// applyGyroTuning scales the (mount-adjusted) gyro by the sensitivity, unless that was done
+// before the mount matrix, and by the per-axis sensitivity, and zeroes it inside the deadzone.
+func (ls *liveSettings) applyGyroTuning(g Vec3) Vec3 {
+	if !ls.SensitivityBeforeMount {
+		g = g.Scale(ls.GyroSensitivity)
+	}
+	g = g.Mul(ls.GyroAxisScale)
+	if ls.GyroDeadzone > 0 && g.Norm()*180/math.Pi < ls.GyroDeadzone {
+		return Vec3{}
+	}
+	return g
+}
+
+// pipeline describes the order the main loop processes a sample in; bias is whether online
+// gyro bias correction runs.
+func (ls *liveSettings) pipeline(bias bool) string {
+	steps := []string{"read"}
+	if ls.SensitivityBeforeMount {
+		steps = append(steps, "sensitivity")
+	}
+	if ls.CorrectionAfterMount {
+		steps = append(steps, "mount", "correction")
+	} else {
+		steps = append(steps, "correction", "mount")
+	}
+	if bias {
+		steps = append(steps, "bias")
+	}
+	if !ls.SensitivityBeforeMount {
+		steps = append(steps, "sensitivity")
+	}
+	return strings.Join(append(steps, "deadzone", "send"), " -> ")
+}
+
+// reloadSettings re-reads the config file at path and its calibration file, and swaps in
+// their settings (SIGHUP). calPath overrides the calibration file named by the config.
+func reloadSettings(store *settingsStore, path, calPath, profile string) error {
+	if path == "" {
+		return fmt.Errorf("no config file in use")
+	}
+	cfg, _, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := applyProfile(cfg, profile); err != nil {
+		return fmt.Errorf("%w; keeping the current settings", err)
+	}
+	if err := validateMatrices(cfg); err != nil {
+		return fmt.Errorf("%w; keeping the current settings", err)
+	}
+	if calPath == "" {
+		calPath = calibrationPath(cfg, path)
+	}
+	cal, err := loadCalibration(calPath)
+	if err != nil {
+		return fmt.Errorf("%w; keeping the current settings", err)
+	}
+	ls, ok := newLiveSettings(cfg, cal)
+	if !ok {
+		return fmt.Errorf("%s has no mount matrix; keeping the current settings", path)
+	}
+	// the filter cutoffs may come from flags, so a reload keeps them (PATCH /settings changes them)
+	if cur := store.Load(); cur != nil {
+		ls.AccelCutoffHz, ls.GravityCutoffHz = cur.AccelCutoffHz, cur.GravityCutoffHz
+	}
+	store.Store(ls)
+	return nil
+}
+
+// matrixYAML is the on-disk form of a matrix block.
+type matrixYAML struct {
+	X []float64 `yaml:"x,flow" json:"x"`
+	Y []float64 `yaml:"y,flow" json:"y"`
+	Z []float64 `yaml:"z,flow" json:"z"`
+}
+
+func toMatrixYAML(m MountMatrix) matrixYAML {
+	return matrixYAML{
+		X: []float64{m.X.X, m.X.Y, m.X.Z},
+		Y: []float64{m.Y.X, m.Y.Y, m.Y.Z},
+		Z: []float64{m.Z.X, m.Z.Y, m.Z.Z},
+	}
+}
+
+// updateConfigFile sets top-level keys of the YAML config at path, keeping the rest of the
+// file (including comments) as is, with its permissions and, as root, its owner. The file is
+// created if missing.
+func updateConfigFile(path string, values map[string]any) error {
+	var doc yaml.Node
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return err
+		}
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: top level is not a mapping", path)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var vn yaml.Node
+		if err := vn.Encode(values[key]); err != nil {
+			return err
+		}
+		replaced := false
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == key {
+				root.Content[i+1] = &vn
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, &vn)
+		}
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	mode, owner := os.FileMode(0644), (*syscall.Stat_t)(nil)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+		owner, _ = fi.Sys().(*syscall.Stat_t)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, mode); err != nil {
+		return err
+	}
+	// WriteFile applies the umask, and keeps the mode of a tmp file left over from before
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if owner != nil && os.Geteuid() == 0 {
+		if err := os.Chown(tmp, int(owner.Uid), int(owner.Gid)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// swapXY turns x into y and y into x, a typical mount matrix.
+var swapXY = MountMatrix{X: Vec3{Y: 1}, Y: Vec3{X: 1}, Z: Vec3{Z: 1}}
+
+// scaleX is a correction that only makes sense in the sensor frame: the sensor's own x axis
+// reads 10% high.
+var scaleX = MountMatrix{X: Vec3{X: 1 / 1.1}, Y: Vec3{Y: 1}, Z: Vec3{Z: 1}}
+
+func TestApplyMatricesOrder(t *testing.T) {
+	ls := &liveSettings{
+		AccelMatrix: swapXY, GyroMatrix: swapXY,
+		AccelCorrection: scaleX, GyroCorrection: scaleX,
+		GyroSensitivity: 1, GyroAxisScale: Vec3{1, 1, 1}, AccelAxisScale: Vec3{1, 1, 1},
+	}
+	in := IMUSample{Gyro: Vec3{X: 1.1}, Accel: Vec3{X: 1.1}}
+
+	// correction then mount: the sensor x error is fixed, then x becomes DSU y
+	out := ls.applyMatrices(in)
+	if want := (Vec3{Y: 1}); !near(out.Gyro, want, 1e-12) || !near(out.Accel, want, 1e-12) {
+		t.Errorf("correction then mount: gyro %+v accel %+v, want %+v", out.Gyro, out.Accel, want)
+	}
+
+	// the other order corrects DSU x, which no longer holds the sensor's x reading
+	ls.CorrectionAfterMount = true
+	out = ls.applyMatrices(in)
+	if want := (Vec3{Y: 1.1}); !near(out.Gyro, want, 1e-12) || !near(out.Accel, want, 1e-12) {
+		t.Errorf("mount then correction: gyro %+v accel %+v, want %+v", out.Gyro, out.Accel, want)
+	}
+}
+
+func TestApplyMatricesCrossAxis(t *testing.T) {
+	// the sensor's y axis picks up 5% of a rotation about x; the correction is the inverse
+	// of that coupling
+	coupling := MountMatrix{X: Vec3{X: 1}, Y: Vec3{X: 0.05, Y: 1}, Z: Vec3{Z: 1}}
+	ls := &liveSettings{
+		AccelMatrix: identityMatrix, GyroMatrix: identityMatrix,
+		AccelCorrection: identityMatrix, GyroCorrection: MountMatrix{X: Vec3{X: 1}, Y: Vec3{X: -0.05, Y: 1}, Z: Vec3{Z: 1}},
+		GyroSensitivity: 1, GyroAxisScale: Vec3{1, 1, 1}, AccelAxisScale: Vec3{1, 1, 1},
+	}
+	measured := coupling.Apply(Vec3{X: 2})
+	if got := ls.applyMatrices(IMUSample{Gyro: measured}).Gyro; !near(got, Vec3{X: 2}, 1e-12) {
+		t.Errorf("corrected gyro %+v, want the pure x rotation", got)
+	}
+}
+
+func TestApplyMatricesSensitivityAndAxisScale(t *testing.T) {
+	ls := &liveSettings{
+		AccelMatrix: swapXY, GyroMatrix: swapXY,
+		AccelCorrection: identityMatrix, GyroCorrection: identityMatrix,
+		GyroSensitivity: 2, GyroAxisScale: Vec3{1, 3, 1}, AccelAxisScale: Vec3{1, 0.5, 1},
+	}
+	in := IMUSample{Gyro: Vec3{X: 1}, Accel: Vec3{X: 4}}
+
+	// per-axis scales apply to DSU axes, after the mount matrix
+	s := ls.applyMatrices(in)
+	if want := (Vec3{Y: 2}); s.Accel != want {
+		t.Errorf("accel %+v, want %+v", s.Accel, want)
+	}
+	if s.Gyro != (Vec3{Y: 1}) {
+		t.Errorf("gyro scaled before tuning: %+v", s.Gyro)
+	}
+	if g := ls.applyGyroTuning(s.Gyro); g != (Vec3{Y: 6}) {
+		t.Errorf("tuned gyro %+v, want sensitivity 2 times axis scale 3", g)
+	}
+
+	// with sensitivity_before_mount the multiplier is applied once, up front
+	ls.SensitivityBeforeMount = true
+	s = ls.applyMatrices(in)
+	if g := ls.applyGyroTuning(s.Gyro); g != (Vec3{Y: 6}) {
+		t.Errorf("sensitivity before mount: tuned gyro %+v, want %+v", g, Vec3{Y: 6})
+	}
+	if got := ls.pipeline(true); got != "read -> sensitivity -> correction -> mount -> bias -> deadzone -> send" {
+		t.Errorf("pipeline = %s", got)
+	}
+}
+
+func TestAxisSensitivityConfig(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr string // empty for valid
+	}{
+		{"gyro_axis_sensitivity: [1, 1.05, 0.97]\naccel_axis_sensitivity: [1.02, 1, 1]\n", ""},
+		{"gyro_axis_sensitivity: [1, 1.05]\n", "gyro_axis_sensitivity has 2 values, want 3"},
+		{"accel_axis_sensitivity: [1, 1, 1, 1]\n", "accel_axis_sensitivity has 4 values, want 3"},
+		{"gyro_axis_sensitivity: [1, -1, 1]\n", "values must be > 0"},
+		{"accel_axis_sensitivity: [0, 1, 1]\n", "values must be > 0"},
+	} {
+		cfg := runConfig(t, tc.body+checkIdentity)
+		err := validateMatrices(&cfg)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%q: %v, want %q", tc.body, err, tc.wantErr)
+		}
+	}
+
+	// each DSU axis gets its own multiplier, on top of the scalar sensitivity
+	cfg := runConfig(t, "gyro_sensitivity: 2\ngyro_axis_sensitivity: [1, 1.5, 0.5]\naccel_axis_sensitivity: [2, 1, 0.25]\n"+checkIdentity)
+	ls, _ := newLiveSettings(&cfg, nil)
+	s := ls.applyMatrices(IMUSample{Gyro: Vec3{1, 1, 1}, Accel: Vec3{1, 2, 4}})
+	if want := (Vec3{2, 2, 1}); s.Accel != want {
+		t.Errorf("accel %+v, want %+v", s.Accel, want)
+	}
+	if g, want := ls.applyGyroTuning(s.Gyro), (Vec3{2, 3, 1}); g != want {
+		t.Errorf("tuned gyro %+v, want %+v", g, want)
+	}
+
+	// unset is 1 on every axis
+	cfg = runConfig(t, checkIdentity)
+	if ls, _ := newLiveSettings(&cfg, nil); ls.GyroAxisScale != (Vec3{1, 1, 1}) || ls.AccelAxisScale != (Vec3{1, 1, 1}) {
+		t.Errorf("unset: gyro %+v accel %+v", ls.GyroAxisScale, ls.AccelAxisScale)
+	}
+}
+
+func TestLoadCalibrationCorrections(t *testing.T) {
+	dir := t.TempDir()
+	writeAttrs(t, dir, map[string]string{
+		"good.yaml":    "gyro_correction:\n  x: [0.9, 0, 0]\n  y: [0, 1, 0]\n  z: [0, 0, 1.02]\n",
+		"partial.yaml": "accel_correction:\n  x: [1, 0, 0]\n  y: [0, 1]\n  z: [0, 0, 1]\n",
+	})
+	cal, err := loadCalibration(filepath.Join(dir, "good.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accel, gyro := cal.corrections()
+	if accel != identityMatrix || gyro != (MountMatrix{X: Vec3{X: 0.9}, Y: Vec3{Y: 1}, Z: Vec3{Z: 1.02}}) {
+		t.Errorf("corrections: accel %+v, gyro %+v", accel, gyro)
+	}
+	if _, err := loadCalibration(filepath.Join(dir, "partial.yaml")); err == nil || !strings.Contains(err.Error(), "accel_correction: row y has 2 values") {
+		t.Errorf("partial correction: %v", err)
+	}
+	// no calibration file is no correction
+	if cal, err := loadCalibration(filepath.Join(dir, "missing.yaml")); err != nil || cal.AccelCorrection != nil || cal.GyroCorrection != nil {
+		t.Errorf("missing file: %+v, %v", cal, err)
+	}
+}
+
+func TestPipelineOrderNonOrthonormalCorrection(t *testing.T) {
+	// a shear: the sensor's x reading leaks 10% of y. It does not commute with a 90° mount
+	// rotation about z (x -> y, y -> -x), so the two orders disagree.
+	shear := MountMatrix{X: Vec3{X: 1, Y: 0.1}, Y: Vec3{Y: 1}, Z: Vec3{Z: 1}}
+	rot := MountMatrix{X: Vec3{Y: -1}, Y: Vec3{X: 1}, Z: Vec3{Z: 1}}
+	cfg := &Config{}
+	cfg.MountMatrix.X, cfg.MountMatrix.Y, cfg.MountMatrix.Z = []float64{0, -1, 0}, []float64{1, 0, 0}, []float64{0, 0, 1}
+	shearYAML := toMatrixYAML(shear)
+	cal := &Calibration{GyroCorrection: &shearYAML, AccelCorrection: &shearYAML}
+	in := IMUSample{Gyro: Vec3{X: 1, Y: 2}, Accel: Vec3{X: 1, Y: 2}}
+
+	ls, _ := newLiveSettings(cfg, cal)
+	if ls.GyroMatrix != rot || ls.GyroCorrection != shear {
+		t.Fatalf("settings: mount %+v, correction %+v", ls.GyroMatrix, ls.GyroCorrection)
+	}
+	// correction then mount: shear (1, 2) -> (1.2, 2), rotate -> (-2, 1.2)
+	before := ls.applyMatrices(in)
+	if want := (Vec3{X: -2, Y: 1.2}); !near(before.Gyro, want, 1e-12) || !near(before.Accel, want, 1e-12) {
+		t.Errorf("correction before mount: gyro %+v accel %+v, want %+v", before.Gyro, before.Accel, want)
+	}
+
+	// mount then correction: rotate (1, 2) -> (-2, 1), shear -> (-1.9, 1)
+	cfg.CorrectionAfterMount = true
+	ls, _ = newLiveSettings(cfg, cal)
+	after := ls.applyMatrices(in)
+	if want := (Vec3{X: -1.9, Y: 1}); !near(after.Gyro, want, 1e-12) || !near(after.Accel, want, 1e-12) {
+		t.Errorf("correction after mount: gyro %+v accel %+v, want %+v", after.Gyro, after.Accel, want)
+	}
+}
+
+func TestPipelineString(t *testing.T) {
+	for _, tc := range []struct {
+		afterMount, sensFirst, bias bool
+		want                        string
+	}{
+		{false, false, false, "read -> correction -> mount -> sensitivity -> deadzone -> send"},
+		{false, false, true, "read -> correction -> mount -> bias -> sensitivity -> deadzone -> send"},
+		{true, false, true, "read -> mount -> correction -> bias -> sensitivity -> deadzone -> send"},
+		{true, true, false, "read -> sensitivity -> mount -> correction -> deadzone -> send"},
+	} {
+		ls := &liveSettings{CorrectionAfterMount: tc.afterMount, SensitivityBeforeMount: tc.sensFirst}
+		if got := ls.pipeline(tc.bias); got != tc.want {
+			t.Errorf("pipeline(after_mount %v, sensitivity_first %v, bias %v) = %s, want %s", tc.afterMount, tc.sensFirst, tc.bias, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateConfigFileKeepsMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0640, 0644} {
+		path := filepath.Join(t.TempDir(), configFileName)
+		if err := os.WriteFile(path, []byte("name: bmi323\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path, mode) // past the umask
+		if os.Geteuid() == 0 {
+			// as root, the owner is kept too
+			if err := os.Chown(path, 1234, 1234); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := updateConfigFile(path, map[string]any{"gyro_deadzone": 0.5}); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("%04o config is %04o after an update", mode, fi.Mode().Perm())
+		}
+		if st := fi.Sys().(*syscall.Stat_t); os.Geteuid() == 0 && (st.Uid != 1234 || st.Gid != 1234) {
+			t.Errorf("owner %d:%d after an update, want 1234:1234", st.Uid, st.Gid)
+		}
+	}
+
+	// a new file is 0644
+	path := filepath.Join(t.TempDir(), configFileName)
+	if err := updateConfigFile(path, map[string]any{"gyro_deadzone": 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("new config: %v, %v; want mode 0644", fi, err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// splitTimestamps are the values of split_timestamp, which stamp a sample merged from a split
+// accel/gyro pair gets: the primary device's (default), the average of the devices' stamps, or
+// the newest of them.
+var splitTimestamps = []string{"primary", "average", "newer"}
+
+// combineSplitTS returns the timestamp of a merged sample for policy, from the primary
+// device's stamp followed by the complementary devices' ones.
+func combineSplitTS(policy string, stamps []uint64) uint64 {
+	switch policy {
+	case "average":
+		var sum float64
+		for _, ts := range stamps {
+			sum += float64(ts)
+		}
+		return uint64(math.Round(sum / float64(len(stamps))))
+	case "newer":
+		return slices.Max(stamps)
+	}
+	return stamps[0]
+}
+
+// skewStats tracks how far the complementary device's timestamps are from the primary's
+// (complementary minus primary, µs), printed with the IMU lines at -v.
+type skewStats struct {
+	n      int
+	sum    int64
+	last   int64
+	maxAbs int64
+}
+
+func (k *skewStats) Add(us int64) {
+	k.n++
+	k.sum += us
+	k.last = us
+	k.maxAbs = max(k.maxAbs, us, -us)
+}
+
+func (k *skewStats) String() string {
+	if k.n == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("last=%+dus mean=%+.0fus max=%dus over %d samples", k.last, float64(k.sum)/float64(k.n), k.maxAbs, k.n)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCombineSplitTS(t *testing.T) {
+	const base = 1_700_000_000_000_000 // realtime microseconds
+	for _, tc := range []struct {
+		policy string
+		stamps []uint64
+		want   uint64
+	}{
+		{"primary", []uint64{base, base + 800}, base},
+		{"primary", []uint64{base}, base},
+		{"average", []uint64{base, base + 800}, base + 400},
+		{"average", []uint64{base + 800, base}, base + 400},
+		{"average", []uint64{base, base + 1}, base + 1}, // half a microsecond rounds up
+		{"average", []uint64{base, base + 300, base + 900}, base + 400},
+		{"average", []uint64{base}, base},
+		{"newer", []uint64{base, base + 800}, base + 800},
+		{"newer", []uint64{base + 800, base}, base + 800},
+		{"newer", []uint64{base, base + 300, base - 50}, base + 300},
+		{"", []uint64{base, base + 800}, base}, // unset is primary
+	} {
+		if got := combineSplitTS(tc.policy, tc.stamps); got != tc.want {
+			t.Errorf("%q %v: %d, want %d", tc.policy, tc.stamps, got, tc.want)
+		}
+	}
+}
+
+func TestSkewStats(t *testing.T) {
+	var k skewStats
+	if k.String() != "no samples" {
+		t.Errorf("empty: %s", &k)
+	}
+	for _, us := range []int64{300, -900, 600} {
+		k.Add(us)
+	}
+	if k.n != 3 || k.last != 600 || k.maxAbs != 900 || k.sum != 0 {
+		t.Errorf("%+v", k)
+	}
+	if got, want := k.String(), "last=+600us mean=+0us max=900us over 3 samples"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+// stampReader returns one sample with a timestamp and a marker value, or err.
+type stampReader struct {
+	ts  uint64
+	v   float64
+	err error
+}
+
+func (r stampReader) readSample() (IMUSample, error) {
+	return IMUSample{TSus: r.ts, Gyro: Vec3{X: r.v}, Accel: Vec3{Z: r.v}}, r.err
+}
+
+func TestReadMergedTimestamps(t *testing.T) {
+	primary := stampReader{ts: 10_000, v: 1}
+	gyro := stampReader{ts: 10_600, v: 2}
+	accel := stampReader{ts: 9_700, v: 3}
+	for _, tc := range []struct {
+		policy      string
+		gyro, accel SampleReader
+		want        uint64
+		wantSkew    skewStats
+	}{
+		{"primary", gyro, nil, 10_000, skewStats{n: 1, sum: 600, last: 600, maxAbs: 600}},
+		{"average", gyro, nil, 10_300, skewStats{n: 1, sum: 600, last: 600, maxAbs: 600}},
+		{"newer", gyro, nil, 10_600, skewStats{n: 1, sum: 600, last: 600, maxAbs: 600}},
+		{"average", nil, accel, 9_850, skewStats{n: 1, sum: -300, last: -300, maxAbs: 300}},
+		{"newer", nil, accel, 10_000, skewStats{n: 1, sum: -300, last: -300, maxAbs: 300}},
+		{"average", gyro, accel, 10_100, skewStats{n: 2, sum: 300, last: -300, maxAbs: 600}},
+		// a failed complementary read keeps the primary's values and leaves its stamp out
+		{"average", stampReader{ts: 50_000, err: errors.New("EIO")}, nil, 10_000, skewStats{}},
+		{"newer", stampReader{ts: 50_000, err: errors.New("EIO")}, accel, 10_000, skewStats{n: 1, sum: -300, last: -300, maxAbs: 300}},
+		// not split: nothing to combine
+		{"newer", nil, nil, 10_000, skewStats{}},
+	} {
+		var skew skewStats
+		s, err := readMerged(primary, tc.gyro, tc.accel, tc.policy, &skew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.TSus != tc.want || skew != tc.wantSkew {
+			t.Errorf("%s, gyro %v, accel %v: ts %d skew %+v; want %d and %+v", tc.policy, tc.gyro, tc.accel, s.TSus, skew, tc.want, tc.wantSkew)
+		}
+		wantGyro, wantAccel := 1.0, 1.0
+		if r, ok := tc.gyro.(stampReader); ok && r.err == nil {
+			wantGyro = r.v
+		}
+		if tc.accel != nil {
+			wantAccel = accel.v
+		}
+		if s.Gyro.X != wantGyro || s.Accel.Z != wantAccel {
+			t.Errorf("%s: gyro %g accel %g, want %g and %g", tc.policy, s.Gyro.X, s.Accel.Z, wantGyro, wantAccel)
+		}
+	}
+
+	// a failed primary read fails the merge
+	if _, err := readMerged(stampReader{err: errors.New("EIO")}, gyro, accel, "average", &skewStats{}); err == nil {
+		t.Error("failed primary read merged")
+	}
+}
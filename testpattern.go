@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// testPatternAmplitude is how far the test pattern turns each way, in degrees.
+	testPatternAmplitude = 30
+	// testPatternPeriod is one full left-right-left swing of the test pattern.
+	testPatternPeriod = 4 * time.Second
+)
+
+// testPattern stands in for the sensor with --test-pattern: a device lying flat that slowly
+// yaws testPatternAmplitude degrees left and right, already in the DSU frame. If the
+// emulator's camera pans with it, the bridge and client work and a problem is on the sensor
+// side (device, scales, mount matrix).
+type testPattern struct {
+	start time.Time
+}
+
+func newTestPattern(start time.Time) *testPattern {
+	return &testPattern{start: start}
+}
+
+func (p *testPattern) readSample() (IMUSample, error) {
+	return p.At(time.Since(p.start)), nil
+}
+
+// At returns the sample t into the pattern. The yaw angle is A·sin(ωt), so the yaw rate
+// (DSU gyro Y) is A·ω·cos(ωt) and gravity turns with the angle.
+func (p *testPattern) At(t time.Duration) IMUSample {
+	w := 2 * math.Pi / testPatternPeriod.Seconds()
+	a := testPatternAmplitude * math.Pi / 180
+	wt := w * t.Seconds()
+	yaw := Vec3{Y: 1}
+	return IMUSample{
+		TSus:  uint64(p.start.Add(t).UnixMicro()),
+		Gyro:  Vec3{Y: a * w * math.Cos(wt)},
+		Accel: rotateVec(restGravity, yaw, -a*math.Sin(wt)),
+	}
+}
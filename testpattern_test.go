@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTestPatternWaveform(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	p := newTestPattern(start)
+	amp := testPatternAmplitude * math.Pi / 180
+	peakRate := amp * 2 * math.Pi / testPatternPeriod.Seconds()
+
+	for _, tc := range []struct {
+		at       time.Duration
+		rate     float64 // yaw rate, rad/s
+		accelX   float64 // m/s^2
+		describe string
+	}{
+		{0, peakRate, 0, "centered, turning fastest"},
+		{testPatternPeriod / 4, 0, standardGravity * math.Sin(amp), "turned all the way one side"},
+		{testPatternPeriod / 2, -peakRate, 0, "centered, turning back"},
+		{3 * testPatternPeriod / 4, 0, -standardGravity * math.Sin(amp), "turned all the way the other side"},
+		{testPatternPeriod, peakRate, 0, "one period later, as at the start"},
+	} {
+		s := p.At(tc.at)
+		if !near(s.Gyro, Vec3{Y: tc.rate}, 1e-9) || math.Abs(s.Accel.X-tc.accelX) > 1e-9 || math.Abs(s.Accel.Y) > 1e-9 {
+			t.Errorf("%v (%s): gyro %+v accel %+v, want yaw rate %g and accel x %g", tc.at, tc.describe, s.Gyro, s.Accel, tc.rate, tc.accelX)
+		}
+		if want := uint64(start.Add(tc.at).UnixMicro()); s.TSus != want {
+			t.Errorf("%v: timestamp %d, want %d", tc.at, s.TSus, want)
+		}
+	}
+
+	// the yaw rate integrates to the swing, and gravity turns with it at every step
+	const step = time.Millisecond
+	angle := 0.0
+	for at := time.Duration(0); at < testPatternPeriod; at += step {
+		s := p.At(at)
+		if g := s.Accel.Norm(); math.Abs(g-standardGravity) > 1e-9 {
+			t.Fatalf("%v: gravity %g m/s^2", at, g)
+		}
+		if tilt := math.Atan2(s.Accel.X, -s.Accel.Z); math.Abs(tilt-angle) > 1e-3 {
+			t.Fatalf("%v: gravity turned %g rad, the integrated yaw rate %g", at, tilt, angle)
+		}
+		// trapezoid rule
+		angle += (s.Gyro.Y + p.At(at+step).Gyro.Y) / 2 * step.Seconds()
+		if angle > amp+1e-6 || angle < -amp-1e-6 {
+			t.Fatalf("%v: swung to %g rad, past %g", at, angle, amp)
+		}
+	}
+	if math.Abs(angle) > 1e-6 {
+		t.Errorf("after a period the swing ends at %g rad, want back at 0", angle)
+	}
+}
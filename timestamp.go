@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// tsStallWarnEvery rate-limits the stalled timestamp warning.
+const tsStallWarnEvery = 10 * time.Second
+
+// tsGuard repairs sample timestamps that repeat. Some drivers stamp consecutive samples with
+// the same hardware time under load; clients integrating the gyro over dt then see a zero
+// interval followed by a double one. Repeated stamps are replaced by the previous one plus
+// the expected interval until the clock moves again. A clock that resumes behind the
+// interpolated stamps is left to the DSU server's monotonic guard.
+type tsGuard struct {
+	dtUS   uint64 // expected sample interval (µs)
+	last   uint64 // last timestamp read from the source
+	out    uint64 // last timestamp handed out
+	stalls int    // repeated samples since the last warning
+	warned time.Time
+}
+
+func newTSGuard(dt time.Duration) *tsGuard {
+	return &tsGuard{dtUS: uint64(max(dt/time.Microsecond, 1))}
+}
+
+// Fix returns the timestamp to use for a sample stamped ts.
+func (g *tsGuard) Fix(ts uint64) uint64 {
+	if g.last != 0 && ts == g.last {
+		g.stalls++
+		if now := time.Now(); now.Sub(g.warned) >= tsStallWarnEvery {
+			fmt.Fprintf(os.Stderr, "WARNING: sample timestamp stalled (%d repeated since last warning); interpolating %d us steps\n",
+				g.stalls, g.dtUS)
+			g.warned, g.stalls = now, 0
+		}
+		g.out += g.dtUS
+		return g.out
+	}
+	g.last, g.out = ts, ts
+	return ts
+}
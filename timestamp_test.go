@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTSGuardStalled(t *testing.T) {
+	g := newTSGuard(4 * time.Millisecond)
+	// 250 Hz hardware stamps that stall for three samples, then move on
+	in := []uint64{1_000_000, 1_004_000, 1_004_000, 1_004_000, 1_004_000, 1_020_000, 1_024_000}
+	want := []uint64{1_000_000, 1_004_000, 1_008_000, 1_012_000, 1_016_000, 1_020_000, 1_024_000}
+	var got []uint64
+	out := captureStderr(t, func() {
+		for _, ts := range in {
+			got = append(got, g.Fix(ts))
+		}
+	})
+	if !slices.Equal(got, want) {
+		t.Errorf("Fix(%v) = %v, want %v", in, got, want)
+	}
+	// one warning for the run, not one per repeated sample
+	if n := strings.Count(out, "timestamp stalled"); n != 1 || !strings.Contains(out, "interpolating 4000 us steps") {
+		t.Errorf("stderr:\n%s", out)
+	}
+}
+
+func TestTSGuardPassesThrough(t *testing.T) {
+	g := newTSGuard(10 * time.Millisecond)
+	// irregular but moving stamps are passed on as read, and so is a clock that resumes
+	// behind the interpolated ones (the DSU server's monotonic guard handles that)
+	in := []uint64{500, 9_000, 9_000, 9_000, 25_000, 25_500, 12_000}
+	want := []uint64{500, 9_000, 19_000, 29_000, 25_000, 25_500, 12_000}
+	var got []uint64
+	captureStderr(t, func() {
+		for _, ts := range in {
+			got = append(got, g.Fix(ts))
+		}
+	})
+	if !slices.Equal(got, want) {
+		t.Errorf("Fix(%v) = %v, want %v", in, got, want)
+	}
+	// a sub-microsecond interval still steps forward
+	if g := newTSGuard(time.Nanosecond); g.dtUS != 1 {
+		t.Errorf("dtUS = %d, want 1", g.dtUS)
+	}
+}
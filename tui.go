@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// monitorRefresh is how often --tui redraws. The main loop only publishes a snapshot; all
+// formatting and terminal I/O happen on the monitor goroutine.
+const monitorRefresh = 100 * time.Millisecond
+
+// Full scale of the --tui bar meters.
+const (
+	monitorGyroRange  = 360.0 // deg/s
+	monitorAccelRange = 2.0   // g
+	monitorBarWidth   = 30
+)
+
+// monitorSnapshot is the latest state the main loop hands to the monitor.
+type monitorSnapshot struct {
+	Sample   IMUSample // as sent over DSU
+	Rest     restVerdict
+	Samples  uint64 // samples processed so far
+	Dropped  uint64 // output ticks missed so far
+	Paused   bool
+	Settings *liveSettings
+}
+
+// monitorStats is what the monitor adds to a snapshot when drawing it.
+type monitorStats struct {
+	RateHz  float64 // measured sample rate
+	Clients int
+	Packets uint32
+}
+
+type monitor struct {
+	latest  atomic.Pointer[monitorSnapshot]
+	samples uint64
+}
+
+// publish stores the sample just sent; called from the main loop.
+func (m *monitor) publish(s IMUSample, v restVerdict, ls *liveSettings, dropped uint64, paused bool) {
+	m.samples++
+	m.latest.Store(&monitorSnapshot{Sample: s, Rest: v, Samples: m.samples, Dropped: dropped, Paused: paused, Settings: ls})
+}
+
+// run redraws the screen until q is pressed or the process is interrupted, then restores the
+// terminal and exits.
+func (m *monitor) run(servers []*DSUServer) {
+	restore := termCbreak(os.Stdin.Fd())
+	quit := make(chan struct{}, 1)
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(b); err != nil || (n == 1 && (b[0] == 'q' || b[0] == 'Q')) {
+				quit <- struct{}{}
+				return
+			}
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	fmt.Print("\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+	exit := func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		restore()
+		os.Exit(0)
+	}
+
+	tick := time.NewTicker(monitorRefresh)
+	defer tick.Stop()
+	var lastSamples uint64
+	lastAt := time.Now()
+	for {
+		select {
+		case <-quit:
+			exit()
+		case <-sig:
+			exit()
+		case now := <-tick.C:
+			snap := m.latest.Load()
+			if snap == nil {
+				continue
+			}
+			var st monitorStats
+			for _, srv := range servers {
+				clients, packets := srv.Stats()
+				st.Clients += clients
+				st.Packets += packets
+			}
+			if dt := now.Sub(lastAt).Seconds(); dt > 0 {
+				st.RateHz = float64(snap.Samples-lastSamples) / dt
+			}
+			lastSamples, lastAt = snap.Samples, now
+			fmt.Print("\x1b[H\x1b[2J" + renderMonitor(snap, st))
+		}
+	}
+}
+
+// renderMonitor formats one --tui frame.
+func renderMonitor(snap *monitorSnapshot, st monitorStats) string {
+	var b strings.Builder
+	const rad2deg = 180.0 / math.Pi
+	g := snap.Sample.Gyro.Scale(rad2deg)
+	a := snap.Sample.Accel.Scale(1 / standardGravity)
+
+	state := "moving"
+	if snap.Paused {
+		state = "PAUSED"
+	} else if snap.Rest.Still {
+		state = "resting"
+	} else if snap.Rest.StillFor > 0 {
+		state = "settling"
+	}
+	fmt.Fprintf(&b, "iio-dsu-bridge monitor  (q to quit)\n\n")
+	fmt.Fprintf(&b, "State:   %-8s  rate %.0f Hz  dropped %d  clients %d  packets %d\n\n",
+		state, st.RateHz, snap.Dropped, st.Clients, st.Packets)
+
+	fmt.Fprintf(&b, "Gyro (deg/s, ±%.0f)\n", monitorGyroRange)
+	for _, ax := range []struct {
+		n string
+		v float64
+	}{{"x", g.X}, {"y", g.Y}, {"z", g.Z}} {
+		fmt.Fprintf(&b, "  %s %s % 8.2f\n", ax.n, meterBar(ax.v/monitorGyroRange, monitorBarWidth), ax.v)
+	}
+	fmt.Fprintf(&b, "Accel (g, ±%.0f)\n", monitorAccelRange)
+	for _, ax := range []struct {
+		n string
+		v float64
+	}{{"x", a.X}, {"y", a.Y}, {"z", a.Z}} {
+		fmt.Fprintf(&b, "  %s %s % 8.3f\n", ax.n, meterBar(ax.v/monitorAccelRange, monitorBarWidth), ax.v)
+	}
+
+	if ls := snap.Settings; ls != nil {
+		fmt.Fprintf(&b, "\nGyro matrix       Accel matrix\n")
+		rows := func(m MountMatrix) [3]Vec3 { return [3]Vec3{m.X, m.Y, m.Z} }
+		gr, ar := rows(ls.GyroMatrix), rows(ls.AccelMatrix)
+		for i := range 3 {
+			fmt.Fprintf(&b, "  [% .2f % .2f % .2f]  [% .2f % .2f % .2f]\n",
+				gr[i].X, gr[i].Y, gr[i].Z, ar[i].X, ar[i].Y, ar[i].Z)
+		}
+		fmt.Fprintf(&b, "Sensitivity %.2f  deadzone %.2f deg/s\n", ls.GyroSensitivity, ls.GyroDeadzone)
+	}
+	return b.String()
+}
+
+// meterBar draws v in [-1, 1] as a bar growing left or right from the centre of a field of
+// width cells; values out of range are clipped.
+func meterBar(v float64, width int) string {
+	half := width / 2
+	n := int(math.Round(math.Abs(math.Max(-1, math.Min(1, v))) * float64(half)))
+	cells := []rune(strings.Repeat(" ", half) + "|" + strings.Repeat(" ", half))
+	for i := 1; i <= n; i++ {
+		if v < 0 {
+			cells[half-i] = '#'
+		} else {
+			cells[half+i] = '#'
+		}
+	}
+	return "[" + string(cells) + "]"
+}
+
+// termCbreak turns off line buffering and echo on the terminal fd so single key presses reach
+// the monitor, keeping Ctrl-C as a signal. It returns a func restoring the previous mode; on a
+// non-terminal both are no-ops.
+func termCbreak(fd uintptr) func() {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return func() {}
+	}
+	t := old
+	t.Lflag &^= syscall.ICANON | syscall.ECHO
+	t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+	if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+		return func() {}
+	}
+	return func() { ioctl(fd, syscall.TCSETS, unsafe.Pointer(&old)) }
+}
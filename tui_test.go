@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMeterBar(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		want string
+	}{
+		{0, "[    |    ]"},
+		{0.5, "[    |##  ]"},
+		{-0.5, "[  ##|    ]"},
+		{1, "[    |####]"},
+		// out of range is clipped, not wider than the field
+		{3, "[    |####]"},
+		{-7, "[####|    ]"},
+	} {
+		if got := meterBar(tc.v, 8); got != tc.want {
+			t.Errorf("meterBar(%v, 8) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestRenderMonitor(t *testing.T) {
+	snap := &monitorSnapshot{
+		Sample: IMUSample{
+			Gyro:  Vec3{X: 90 * math.Pi / 180, Z: -360 * math.Pi / 180},
+			Accel: Vec3{Z: -standardGravity},
+		},
+		Rest:    restVerdict{Still: true},
+		Dropped: 3,
+		Settings: &liveSettings{
+			AccelMatrix: identityMatrix, GyroMatrix: swapXY,
+			GyroSensitivity: 1.5, GyroDeadzone: 0.25,
+		},
+	}
+	out := renderMonitor(snap, monitorStats{RateHz: 199.6, Clients: 2, Packets: 1234})
+	for _, want := range []string{
+		"State:   resting   rate 200 Hz  dropped 3  clients 2  packets 1234\n",
+		"  x [               |####           ]    90.00\n",
+		"  y [               |               ]     0.00\n",
+		"  z [###############|               ]  -360.00\n",
+		"  z [       ########|               ]   -1.000\n",
+		"  [ 0.00  1.00  0.00]  [ 1.00  0.00  0.00]\n",
+		"Sensitivity 1.50  deadzone 0.25 deg/s\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("frame is missing %q:\n%s", want, out)
+		}
+	}
+
+	// pause wins over rest, a partial still stretch is settling
+	snap.Paused = true
+	if out := renderMonitor(snap, monitorStats{}); !strings.Contains(out, "State:   PAUSED") {
+		t.Errorf("paused frame:\n%s", out)
+	}
+	snap.Paused, snap.Rest = false, restVerdict{StillFor: 0.2}
+	if out := renderMonitor(snap, monitorStats{}); !strings.Contains(out, "State:   settling") {
+		t.Errorf("settling frame:\n%s", out)
+	}
+	// without settings there is no matrix block
+	snap.Settings = nil
+	if out := renderMonitor(snap, monitorStats{}); strings.Contains(out, "matrix") {
+		t.Errorf("frame without settings shows matrices:\n%s", out)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Output levels set by -q, -v and -vv.
+const (
+	verbosityQuiet   = -1 // no stdout: only warnings and errors (stderr)
+	verbosityNormal  = 0
+	verbosityVerbose = 1 // IMU lines with raw and DSU values
+	verbosityDebug   = 2 // also the resting detector, and IMU lines more often
+)
+
+// debugLogEvery is the IMU line interval at -vv, unless --log-every is given.
+const debugLogEvery = 5
+
+// verbosityFromFlags maps -q, -v and -vv to a verbosity level.
+func verbosityFromFlags(quiet, verbose, debug bool) (int, error) {
+	switch {
+	case quiet && (verbose || debug):
+		return 0, errors.New("-q can't be combined with -v or -vv")
+	case quiet:
+		return verbosityQuiet, nil
+	case debug:
+		return verbosityDebug, nil
+	case verbose:
+		return verbosityVerbose, nil
+	}
+	return verbosityNormal, nil
+}
+
+// outputSettings are the switches a verbosity level turns on or off. Flags given explicitly
+// are layered on top: debug flags only add, --log-every always wins.
+type outputSettings struct {
+	LogEvery   int
+	DebugRaw   bool
+	DebugDSU   bool
+	DebugCalib bool
+}
+
+// apply adjusts o for level. logEverySet is whether --log-every was given.
+func (o outputSettings) apply(level int, logEverySet bool) outputSettings {
+	switch level {
+	case verbosityQuiet:
+		if !logEverySet {
+			o.LogEvery = 0
+		}
+	case verbosityDebug:
+		o.DebugCalib = true
+		if !logEverySet {
+			o.LogEvery = debugLogEvery
+		}
+		fallthrough
+	case verbosityVerbose:
+		o.DebugRaw, o.DebugDSU = true, true
+	}
+	return o
+}
+
+// silenceStdout sends everything printed to stdout (banners, matrix dumps, IMU lines) to
+// /dev/null for -q. Warnings and errors go to stderr and are kept.
+func silenceStdout() {
+	if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = null
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestVerbosityFromFlags(t *testing.T) {
+	for _, tc := range []struct {
+		quiet, verbose, debug bool
+		want                  int
+		wantErr               bool
+	}{
+		{false, false, false, verbosityNormal, false},
+		{true, false, false, verbosityQuiet, false},
+		{false, true, false, verbosityVerbose, false},
+		{false, false, true, verbosityDebug, false},
+		{false, true, true, verbosityDebug, false}, // -v -vv is -vv
+		{true, true, false, 0, true},
+		{true, false, true, 0, true},
+	} {
+		got, err := verbosityFromFlags(tc.quiet, tc.verbose, tc.debug)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("verbosityFromFlags(q=%v, v=%v, vv=%v) = %d, %v; want %d, error %v", tc.quiet, tc.verbose, tc.debug, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestOutputSettingsApply(t *testing.T) {
+	def := outputSettings{LogEvery: 25}
+	for _, tc := range []struct {
+		name        string
+		in          outputSettings
+		level       int
+		logEverySet bool
+		want        outputSettings
+	}{
+		{"normal", def, verbosityNormal, false, def},
+		{"quiet", def, verbosityQuiet, false, outputSettings{}},
+		{"quiet, --log-every wins", outputSettings{LogEvery: 100}, verbosityQuiet, true, outputSettings{LogEvery: 100}},
+		{"quiet keeps an explicit debug flag", outputSettings{LogEvery: 25, DebugCalib: true}, verbosityQuiet, false, outputSettings{DebugCalib: true}},
+		{"verbose", def, verbosityVerbose, false, outputSettings{LogEvery: 25, DebugRaw: true, DebugDSU: true}},
+		{"verbose adds to --debug-calib", outputSettings{LogEvery: 25, DebugCalib: true}, verbosityVerbose, false, outputSettings{LogEvery: 25, DebugRaw: true, DebugDSU: true, DebugCalib: true}},
+		{"debug", def, verbosityDebug, false, outputSettings{LogEvery: debugLogEvery, DebugRaw: true, DebugDSU: true, DebugCalib: true}},
+		{"debug, --log-every wins", outputSettings{LogEvery: 50}, verbosityDebug, true, outputSettings{LogEvery: 50, DebugRaw: true, DebugDSU: true, DebugCalib: true}},
+		{"debug, --log-every 0 wins", outputSettings{}, verbosityDebug, true, outputSettings{DebugRaw: true, DebugDSU: true, DebugCalib: true}},
+	} {
+		if got := tc.in.apply(tc.level, tc.logEverySet); got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}